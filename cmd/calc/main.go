@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/StepanShel/YandexProject/internal/cli"
+	"github.com/StepanShel/YandexProject/pkg/client"
+	"golang.org/x/term"
+)
+
+func main() {
+	addr := flag.String("addr", "http://localhost:8081", "orchestrator address")
+	username := flag.String("user", os.Getenv("CALC_USER"), "login (default $CALC_USER)")
+	poll := flag.Duration("poll", 200*time.Millisecond, "interval between status checks")
+	file := flag.String("file", "", "evaluate expressions from file (- for stdin) instead of starting the REPL")
+	parallel := flag.Int("parallel", 4, "batch mode: expressions evaluated at once")
+	format := flag.String("format", "csv", "batch mode: output format, csv or json")
+	output := flag.String("o", "-", "batch mode: output file (- for stdout)")
+	timeout := flag.Duration("timeout", 10*time.Minute, "batch mode: time limit for the whole batch")
+	flag.Parse()
+
+	if *format != "csv" && *format != "json" {
+		log.Printf("Unknown format %q", *format)
+		os.Exit(cli.ExitUsage)
+	}
+
+	// The password is not a flag so that it stays out of shell history
+	// and process listings.
+	password := os.Getenv("CALC_PASSWORD")
+
+	// Prompts would read the expressions of a batch given on stdin, so
+	// the credentials have to come from elsewhere.
+	if *file == "-" && (*username == "" || password == "") {
+		log.Print("With -file - set the login with -user or $CALC_USER and the password with $CALC_PASSWORD")
+		os.Exit(cli.ExitUsage)
+	}
+
+	// The prompts, the REPL and batches from stdin share one reader, so
+	// that none of them loses input buffered by another.
+	stdin := bufio.NewReader(os.Stdin)
+	if *username == "" {
+		*username = prompt(stdin, "login: ")
+	}
+	if password == "" {
+		password = promptPassword(stdin, "password: ")
+	}
+
+	c := client.New(*addr)
+	c.PollInterval = *poll
+	if err := c.Login(context.Background(), *username, password); err != nil {
+		log.Printf("Failed to log in: %v", err)
+		os.Exit(cli.ExitUsage)
+	}
+
+	if *file != "" {
+		os.Exit(runBatch(c, stdin, *file, *output, *format, *parallel, *timeout))
+	}
+
+	repl := cli.NewREPL(c, stdin, os.Stdout)
+	if home, err := os.UserHomeDir(); err == nil {
+		if err := repl.LoadHistory(filepath.Join(home, ".calc_history")); err != nil {
+			log.Printf("Failed to load history: %v", err)
+		}
+	}
+
+	if err := repl.Run(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func runBatch(c *client.Client, stdin io.Reader, file, output, format string, parallel int, timeout time.Duration) int {
+	in := stdin
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			log.Print(err)
+			return cli.ExitUsage
+		}
+		defer f.Close()
+		in = f
+	}
+
+	items, err := cli.ReadBatch(in)
+	if err != nil {
+		log.Printf("Failed to read %s: %v", file, err)
+		return cli.ExitUsage
+	}
+
+	var out io.Writer = os.Stdout
+	if output != "-" {
+		f, err := os.Create(output)
+		if err != nil {
+			log.Print(err)
+			return cli.ExitUsage
+		}
+		defer f.Close()
+		out = f
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	results := cli.RunBatch(ctx, c, items, parallel)
+
+	write := cli.WriteCSV
+	if format == "json" {
+		write = cli.WriteJSON
+	}
+	if err := write(out, results); err != nil {
+		log.Printf("Failed to write results: %v", err)
+		return cli.ExitUsage
+	}
+
+	if failed := cli.CountFailed(results); failed > 0 {
+		log.Printf("%d of %d expressions failed", failed, len(results))
+	}
+	return cli.ExitCode(results)
+}
+
+func prompt(in *bufio.Reader, label string) string {
+	fmt.Print(label)
+	line, _ := in.ReadString('\n')
+	return strings.TrimSpace(line)
+}
+
+// promptPassword reads a password without echoing it when stdin is a
+// terminal.
+func promptPassword(in *bufio.Reader, label string) string {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return prompt(in, label)
+	}
+
+	fmt.Print(label)
+	password, _ := term.ReadPassword(fd)
+	fmt.Println()
+	return strings.TrimSpace(string(password))
+}
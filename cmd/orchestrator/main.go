@@ -1,18 +1,32 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/StepanShel/YandexProject/internal/auth"
+	"github.com/StepanShel/YandexProject/internal/problem"
+	"github.com/StepanShel/YandexProject/internal/ratelimit"
+	"github.com/StepanShel/YandexProject/internal/repo"
 	GRPC "github.com/StepanShel/YandexProject/pkg/orchestrator/gRPC"
 	"github.com/StepanShel/YandexProject/pkg/orchestrator/handler"
 	"github.com/StepanShel/YandexProject/proto/calc"
 	"google.golang.org/grpc"
 )
 
+// webhookShutdownTimeout bounds how long shutdown waits for webhook
+// deliveries; retries back off for up to a minute.
+const webhookShutdownTimeout = 2 * time.Minute
+
 func main() {
 	grpcServer := grpc.NewServer()
 	calcService := GRPC.NewServer()
@@ -29,21 +43,82 @@ func main() {
 	}()
 
 	server := handler.NewServer(calcService)
-	jwtService := auth.NewJWTService("secret")
+	keys, err := auth.NewKeySet(auth.KeyConfig{
+		Secret:          server.Config.JWTSecret,
+		PreviousSecrets: server.Config.JWTPreviousSecrets,
+		Dir:             server.Config.JWTKeysDir,
+	})
+	if err != nil {
+		log.Fatalf("failed to load JWT keys: %v", err)
+	}
+	if keys.Ephemeral() {
+		log.Println("no JWT_SECRET or JWT_KEYS_DIR set: signing tokens with a generated key, they will not survive a restart")
+	}
+	go func() {
+		for range time.Tick(time.Duration(server.Config.JWTKeysReloadSeconds) * time.Second) {
+			if err := keys.Reload(); err != nil {
+				log.Printf("failed to reload JWT keys: %v", err)
+			}
+		}
+	}()
+
+	jwtService := auth.NewJWTService(keys, server.Repo)
+	jwtService.AccessTTL = time.Duration(server.Config.AccessTokenTTLMinutes) * time.Minute
+	jwtService.RefreshTTL = time.Duration(server.Config.RefreshTokenTTLHours) * time.Hour
 	authHandler := auth.NewAuthHandler(server.Repo, jwtService)
+	lockout := time.Duration(server.Config.LoginLockoutSeconds) * time.Second
+	maxLockout := time.Duration(server.Config.LoginLockoutMaxSeconds) * time.Second
+	maxUserLockout := time.Duration(server.Config.LoginUserLockoutMaxSeconds) * time.Second
+	authHandler.Guard = &auth.LoginGuard{
+		Users:      ratelimit.NewLockout(server.Config.LoginMaxAttempts, lockout, maxLockout),
+		IPs:        ratelimit.NewLockout(server.Config.LoginMaxAttemptsPerIP, lockout, maxLockout),
+		Accounts:   ratelimit.NewLockout(server.Config.LoginMaxAttemptsPerUser, lockout, maxUserLockout),
+		TrustProxy: server.Config.TrustProxy,
+	}
+	for _, admin := range server.Config.Admins {
+		err := server.Repo.SetUserRole(admin, repo.RoleAdmin)
+		if errors.Is(err, sql.ErrNoRows) {
+			log.Fatalf("ADMIN_USERS: user %s does not exist, register it before granting the admin role", admin)
+		}
+		if err != nil {
+			log.Fatalf("failed to grant admin role to %s: %v", admin, err)
+		}
+	}
+
+	mux := http.NewServeMux()
+	server.Routes(mux, authHandler, jwtService)
 
-	http.HandleFunc("/api/v1/register", authHandler.Register)
-	http.HandleFunc("/api/v1/login", authHandler.Login)
+	if server.Config.WebhookSecret == "" {
+		log.Println("no WEBHOOK_SECRET set: expressions with a callback_url are rejected")
+	}
 
-	http.HandleFunc("/api/v1/calculate", jwtService.AuthMiddleware(server.HandleCalculate))
-	http.HandleFunc("/api/v1/expressions", jwtService.AuthMiddleware(server.HandleExpressions))
-	http.HandleFunc("/api/v1/expressions/{id}", jwtService.AuthMiddleware(server.HandleExpressionsById))
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	httpServer := &http.Server{
+		Addr:    fmt.Sprintf(":%s", server.Config.Port),
+		Handler: problem.WithRequestID(mux),
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := httpServer.Shutdown(shutdownCtx); err != nil {
+			log.Printf("failed to stop HTTP server: %v", err)
+		}
+	}()
 
 	fmt.Printf("Orchestrator is running on http://localhost:%s\n", server.Config.Port)
-	addr := fmt.Sprintf(":%s", server.Config.Port)
-	if err := http.ListenAndServe(addr, nil); err != nil {
+	if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		log.Fatalf("Error starting server: %v", err)
 	}
 
+	// Let webhook deliveries in progress, retries included, finish.
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), webhookShutdownTimeout)
+	defer cancel()
+	if err := server.Webhooks.Shutdown(shutdownCtx); err != nil {
+		log.Printf("webhook deliveries still pending: %v", err)
+	}
+
 	fmt.Println("Server stopped")
 }
@@ -1,6 +1,7 @@
 package agent
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -38,13 +39,12 @@ func (a *Agent) Worker(id int) {
 
 		log.Printf("Worker %d received task: %f %s %f", id, task.Arg1, task.Operation, task.Arg2)
 
-		result, err := Calculate(task.Operation, int(task.OperationTime), float64(task.Arg1), float64(task.Arg2))
-		if err != nil {
-			log.Printf("Worker %d: calculation error: %v", id, err)
-			continue
+		result, calcErr := Calculate(task.Operation, int(task.OperationTime), task.Arg1, task.Arg2)
+		if calcErr != nil {
+			log.Printf("Worker %d: calculation error: %v", id, calcErr)
 		}
 
-		if err := a.client.SendResult(task.Id, result, nil); err != nil {
+		if err := a.client.SendResult(task.Id, result, calcErr); err != nil {
 			log.Printf("Worker %d: failed to send result: %v", id, err)
 			continue
 		}
@@ -66,6 +66,9 @@ func Calculate(operation string, duration int, a, b float64) (float64, error) {
 		return a * b, nil
 	case "/":
 		time.Sleep(time.Millisecond * time.Duration(duration))
+		if b == 0 {
+			return 0, errors.New("division by zero")
+		}
 		return a / b, nil
 	default:
 		return 0, fmt.Errorf("invalid operator: %s", operation)
@@ -0,0 +1,36 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCalculate(t *testing.T) {
+	tests := []struct {
+		operation string
+		a, b      float64
+		want      float64
+	}{
+		{"+", 1.5, 2, 3.5},
+		{"-", 1, 2.5, -1.5},
+		{"*", 1e-3, 2, 0.002},
+		{"/", 1, 4, 0.25},
+		{"/", 0, 5, 0},
+	}
+	for _, tt := range tests {
+		got, err := Calculate(tt.operation, 0, tt.a, tt.b)
+		require.NoError(t, err, "%v %s %v", tt.a, tt.operation, tt.b)
+		assert.Equal(t, tt.want, got, "%v %s %v", tt.a, tt.operation, tt.b)
+	}
+
+	// Division by zero fails the task instead of producing Inf or NaN.
+	_, err := Calculate("/", 0, 1, 0)
+	assert.EqualError(t, err, "division by zero")
+	_, err = Calculate("/", 0, 0, 0)
+	assert.EqualError(t, err, "division by zero")
+
+	_, err = Calculate("^", 0, 2, 3)
+	assert.EqualError(t, err, "invalid operator: ^")
+}
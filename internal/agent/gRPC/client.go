@@ -43,7 +43,7 @@ func (c *Client) SendResult(taskID string, result float64, err error) error {
 
 	res := &calc.Result{
 		TaskId: taskID,
-		Result: float32(result),
+		Result: result,
 	}
 	if err != nil {
 		res.Error = err.Error()
@@ -0,0 +1,139 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/StepanShel/YandexProject/internal/jsonbody"
+	"github.com/StepanShel/YandexProject/internal/problem"
+	"github.com/StepanShel/YandexProject/internal/ratelimit"
+)
+
+const (
+	// MinPasswordLength is the minimum number of characters in a password.
+	MinPasswordLength = 8
+	// maxPasswordBytes is the most bcrypt can hash.
+	maxPasswordBytes = 72
+)
+
+// Usernames appear in URLs of the admin API and in logs, so they are kept
+// to a safe alphabet.
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{2,31}$`)
+
+var errWrongPassword = problem.New("wrong_password", "current password is incorrect")
+
+type PasswordChangeRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// ValidateUsername checks that username is 3 to 32 letters, digits, dots,
+// underscores or hyphens, starting with a letter or digit.
+func ValidateUsername(username string) error {
+	if !usernamePattern.MatchString(username) {
+		return problem.New("invalid_username", "username must be 3 to 32 letters, digits, '.', '_' or '-', starting with a letter or digit")
+	}
+	return nil
+}
+
+// ValidatePassword checks password against the password policy: at least
+// MinPasswordLength characters and at most 72 bytes, with a letter and a
+// digit, and different from the username.
+func ValidatePassword(username, password string) error {
+	if utf8.RuneCountInString(password) < MinPasswordLength {
+		return problem.Errorf("weak_password", "password must be at least %d characters long", MinPasswordLength)
+	}
+	if len(password) > maxPasswordBytes {
+		return problem.Errorf("weak_password", "password must be at most %d bytes long", maxPasswordBytes)
+	}
+
+	var letter, digit bool
+	for _, r := range password {
+		letter = letter || unicode.IsLetter(r)
+		digit = digit || unicode.IsDigit(r)
+	}
+	if !letter || !digit {
+		return problem.New("weak_password", "password must contain a letter and a digit")
+	}
+
+	if strings.EqualFold(password, username) {
+		return problem.New("weak_password", "password must differ from the username")
+	}
+	return nil
+}
+
+// ConfirmPassword checks the password of the user for an action that
+// requires it. A stolen access token must not allow guessing the password,
+// so failures count towards the login lockout like failed logins do. Unless
+// the password is correct, the error is written to w and false returned.
+func (h *AuthHandler) ConfirmPassword(w http.ResponseWriter, r *http.Request, username, password string) bool {
+	if wait := h.Guard.locked(r, username); wait > 0 {
+		w.Header().Set("Retry-After", ratelimit.RetryAfter(wait))
+		problem.Write(w, http.StatusTooManyRequests, errLoginLocked)
+		return false
+	}
+	valid, err := h.userRepo.Authenticate(username, password)
+	if err != nil || !valid {
+		h.Guard.fail(r, username)
+		problem.Write(w, http.StatusForbidden, errWrongPassword)
+		return false
+	}
+	h.Guard.succeed(r, username)
+	return true
+}
+
+// endpoint api/v1/account/password
+//
+// Changes the password. All tokens of the user stop working; the response
+// carries new ones for the caller.
+func (h *AuthHandler) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	claims, ok := ClaimsFrom(r.Context())
+	if !ok {
+		problem.Write(w, http.StatusUnauthorized, problem.New("unauthorized", "unauthorized"))
+		return
+	}
+
+	var request PasswordChangeRequest
+	if code, err := jsonbody.Decode(w, r, &request, maxCredentialsBytes); err != nil {
+		problem.Write(w, code, err)
+		return
+	}
+
+	if !h.ConfirmPassword(w, r, claims.Subject, request.CurrentPassword) {
+		return
+	}
+	if err := ValidatePassword(claims.Subject, request.NewPassword); err != nil {
+		problem.Write(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	if request.NewPassword == request.CurrentPassword {
+		problem.Write(w, http.StatusUnprocessableEntity, problem.New("weak_password", "new password must differ from the current one"))
+		return
+	}
+
+	if err := h.userRepo.SetPassword(claims.Subject, request.NewPassword); err != nil {
+		fmt.Println(err)
+		problem.Write(w, http.StatusInternalServerError, errors.New("failed to change password"))
+		return
+	}
+
+	user, err := h.userRepo.GetUserByName(claims.Subject)
+	if err != nil {
+		fmt.Println(err)
+		problem.Write(w, http.StatusInternalServerError, errors.New("failed to generate token"))
+		return
+	}
+	tokens, err := h.jwtService.IssueTokens(user)
+	if err != nil {
+		fmt.Println(err)
+		problem.Write(w, http.StatusInternalServerError, errors.New("failed to generate token"))
+		return
+	}
+
+	writeTokens(w, tokens)
+}
@@ -0,0 +1,39 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateUsername(t *testing.T) {
+	for _, name := range []string{"bob", "alice.smith", "ci-bot_2", strings.Repeat("a", 32)} {
+		assert.NoError(t, ValidateUsername(name), name)
+	}
+	for _, name := range []string{"", "ab", "-bob", "bob smith", "bob/../admin", "боб", strings.Repeat("a", 33)} {
+		assert.Error(t, ValidateUsername(name), name)
+	}
+}
+
+func TestValidatePassword(t *testing.T) {
+	tests := []struct {
+		password string
+		valid    bool
+	}{
+		{"correct-horse-1", true},
+		{"пароль123", true},
+		{"short1", false},
+		{"onlyletters", false},
+		{"1234567890", false},
+		{"Alice2024", true},
+		{strings.Repeat("a1", 36), true},
+		{strings.Repeat("a1", 37), false},
+	}
+	for _, tt := range tests {
+		err := ValidatePassword("bob", tt.password)
+		assert.Equal(t, tt.valid, err == nil, "%q: %v", tt.password, err)
+	}
+
+	assert.Error(t, ValidatePassword("alice2024", "Alice2024"))
+}
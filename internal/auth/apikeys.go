@@ -0,0 +1,283 @@
+package auth
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/StepanShel/YandexProject/internal/jsonbody"
+	"github.com/StepanShel/YandexProject/internal/problem"
+	"github.com/StepanShel/YandexProject/internal/repo"
+	"github.com/google/uuid"
+)
+
+// API key scopes. Keys act with the role of their user, limited by the
+// scopes: read allows the GET endpoints, write also submitting, cancelling
+// and deleting expressions, and admin everything an admin may do.
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+	ScopeAdmin = "admin"
+)
+
+const (
+	// APIKeyPrefix starts every API key, so that keys are recognised when
+	// sent as bearer tokens and found by secret scanners.
+	APIKeyPrefix = "calc_"
+	// APIKeyHeader is the header API keys are sent in.
+	APIKeyHeader = "X-API-Key"
+
+	// maxAPIKeys is how many keys one user may have.
+	maxAPIKeys = 50
+	// maxAPIKeyName bounds the length of key names.
+	maxAPIKeyName = 100
+	// prefixLength is how much of the key is kept to tell keys apart.
+	prefixLength = len(APIKeyPrefix) + 6
+)
+
+var (
+	errAPIKeyInvalid  = problem.New("invalid_api_key", "invalid, expired or revoked API key")
+	errAPIKeyNotFound = problem.New("api_key_not_found", "API key not found")
+)
+
+type APIKeyRequest struct {
+	Name string `json:"name"`
+	// Scopes default to read and write.
+	Scopes []string `json:"scopes,omitempty"`
+	// ExpiresAt is when the key stops working; keys without it do not
+	// expire.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+type APIKey struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+}
+
+// CreatedAPIKey is returned once, when the key is created; the key cannot
+// be retrieved later.
+type CreatedAPIKey struct {
+	APIKey APIKey `json:"api_key"`
+	Key    string `json:"key"`
+}
+
+type APIKeysResponse struct {
+	APIKeys []APIKey `json:"api_keys"`
+}
+
+func newAPIKey(key *repo.APIKey) APIKey {
+	result := APIKey{
+		ID:        key.ID.String(),
+		Name:      key.Name,
+		Prefix:    key.Prefix,
+		Scopes:    key.Scopes,
+		CreatedAt: key.CreatedAt.UTC(),
+	}
+	if !key.LastUsedAt.IsZero() {
+		t := key.LastUsedAt.UTC()
+		result.LastUsedAt = &t
+	}
+	if !key.ExpiresAt.IsZero() {
+		t := key.ExpiresAt.UTC()
+		result.ExpiresAt = &t
+	}
+	return result
+}
+
+// validateScopes checks the requested scopes against the role of the user.
+func validateScopes(scopes []string, role string) error {
+	if len(scopes) == 0 {
+		return problem.New("invalid_scope", "at least one scope is required")
+	}
+	for _, scope := range scopes {
+		switch scope {
+		case ScopeRead, ScopeWrite:
+		case ScopeAdmin:
+			if role != repo.RoleAdmin {
+				return problem.New("invalid_scope", "the admin scope requires the admin role")
+			}
+		default:
+			return problem.Errorf("invalid_scope", "unknown scope: %s", scope)
+		}
+	}
+	return nil
+}
+
+// keyRole is the role requests made with a key of the user with the given
+// role act with.
+func keyRole(role string, scopes []string) string {
+	has := func(scope string) bool {
+		for _, s := range scopes {
+			if s == scope {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch {
+	case role == repo.RoleAdmin && has(ScopeAdmin):
+		return repo.RoleAdmin
+	case role != repo.RoleReadonly && (has(ScopeWrite) || has(ScopeAdmin)):
+		return repo.RoleUser
+	}
+	return repo.RoleReadonly
+}
+
+// authenticateAPIKey returns the claims requests made with the key act
+// with. They have no ID, so they cannot be revoked by logout.
+func (s *TokenService) authenticateAPIKey(secret string) (*Claims, int, error) {
+	key, err := s.tokens.UseAPIKey(hashToken(secret))
+	if errors.Is(err, repo.ErrAPIKeyInvalid) {
+		return nil, http.StatusUnauthorized, errAPIKeyInvalid
+	}
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	user, err := s.tokens.GetUserByName(key.Username)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if user.Disabled {
+		return nil, http.StatusForbidden, errAccountDisabled
+	}
+
+	claims := &Claims{Role: keyRole(user.Role, key.Scopes), Team: user.TeamID, APIKey: key.ID.String()}
+	claims.Subject = user.Username
+	return claims, 0, nil
+}
+
+// The api/v1/apikeys endpoints are routed with RequireToken, so that a
+// leaked key cannot be used to create more.
+
+// endpoint api/v1/apikeys
+func (h *AuthHandler) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	claims, ok := ClaimsFrom(r.Context())
+	if !ok {
+		problem.Write(w, http.StatusUnauthorized, problem.New("unauthorized", "unauthorized"))
+		return
+	}
+
+	var request APIKeyRequest
+	if code, err := jsonbody.Decode(w, r, &request, maxCredentialsBytes); err != nil {
+		problem.Write(w, code, err)
+		return
+	}
+
+	request.Name = strings.TrimSpace(request.Name)
+	if request.Name == "" || utf8.RuneCountInString(request.Name) > maxAPIKeyName {
+		problem.Write(w, http.StatusUnprocessableEntity, problem.Errorf("invalid_name", "name must be 1 to %d characters long", maxAPIKeyName))
+		return
+	}
+	if request.Scopes == nil {
+		request.Scopes = []string{ScopeRead, ScopeWrite}
+	}
+	if err := validateScopes(request.Scopes, claims.Role); err != nil {
+		problem.Write(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	if request.ExpiresAt != nil && !request.ExpiresAt.After(time.Now()) {
+		problem.Write(w, http.StatusUnprocessableEntity, problem.New("invalid_expiry", "expires_at must be in the future"))
+		return
+	}
+
+	keys, err := h.userRepo.ListAPIKeys(claims.Subject)
+	if err != nil {
+		fmt.Println(err)
+		problem.Write(w, http.StatusInternalServerError, errors.New("failed to create API key"))
+		return
+	}
+	if len(keys) >= maxAPIKeys {
+		problem.Write(w, http.StatusConflict, problem.Errorf("too_many_api_keys", "no more than %d API keys are allowed; revoke unused ones", maxAPIKeys))
+		return
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		fmt.Println(err)
+		problem.Write(w, http.StatusInternalServerError, errors.New("failed to create API key"))
+		return
+	}
+	secret := APIKeyPrefix + base64.RawURLEncoding.EncodeToString(buf)
+
+	key := &repo.APIKey{
+		Username: claims.Subject,
+		Name:     request.Name,
+		Prefix:   secret[:prefixLength],
+		KeyHash:  hashToken(secret),
+		Scopes:   request.Scopes,
+	}
+	if request.ExpiresAt != nil {
+		key.ExpiresAt = *request.ExpiresAt
+	}
+	if err := h.userRepo.CreateAPIKey(key); err != nil {
+		fmt.Println(err)
+		problem.Write(w, http.StatusInternalServerError, errors.New("failed to create API key"))
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusCreated, CreatedAPIKey{APIKey: newAPIKey(key), Key: secret})
+}
+
+// endpoint api/v1/apikeys
+func (h *AuthHandler) ListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	claims, ok := ClaimsFrom(r.Context())
+	if !ok {
+		problem.Write(w, http.StatusUnauthorized, problem.New("unauthorized", "unauthorized"))
+		return
+	}
+
+	keys, err := h.userRepo.ListAPIKeys(claims.Subject)
+	if err != nil {
+		fmt.Println(err)
+		problem.Write(w, http.StatusInternalServerError, errors.New("failed to get API keys"))
+		return
+	}
+
+	result := make([]APIKey, 0, len(keys))
+	for i := range keys {
+		result = append(result, newAPIKey(&keys[i]))
+	}
+	writeJSON(w, http.StatusOK, APIKeysResponse{APIKeys: result})
+}
+
+// endpoint api/v1/apikeys/:id
+func (h *AuthHandler) RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	claims, ok := ClaimsFrom(r.Context())
+	if !ok {
+		problem.Write(w, http.StatusUnauthorized, problem.New("unauthorized", "unauthorized"))
+		return
+	}
+
+	value := r.PathValue("id")
+	id, err := uuid.Parse(value)
+	if err != nil || id.String() != value {
+		problem.Write(w, http.StatusBadRequest, problem.New("invalid_api_key_id", "invalid API key id"))
+		return
+	}
+
+	if err := h.userRepo.RevokeAPIKey(claims.Subject, id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			problem.Write(w, http.StatusNotFound, errAPIKeyNotFound)
+			return
+		}
+		fmt.Println(err)
+		problem.Write(w, http.StatusInternalServerError, errors.New("failed to revoke API key"))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -2,69 +2,375 @@ package auth
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"strings"
 	"time"
 
+	"github.com/StepanShel/YandexProject/internal/problem"
+	"github.com/StepanShel/YandexProject/internal/repo"
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultAccessTTL  = time.Hour
+	defaultRefreshTTL = 30 * 24 * time.Hour
 )
 
 type TokenService struct {
-	secretKey []byte
+	keys   *KeySet
+	tokens *repo.Repo
+
+	// AccessTTL and RefreshTTL are the lifetimes of issued access and
+	// refresh tokens.
+	AccessTTL  time.Duration
+	RefreshTTL time.Duration
 }
 
-func NewJWTService(secret string) *TokenService {
-	return &TokenService{secretKey: []byte(secret)}
+// Claims are the claims of access tokens. The ID (jti) is what gets
+// revoked on logout; a Version older than the user's token version makes
+// the token invalid, and so does a UserID of a deleted user.
+type Claims struct {
+	UserID  string `json:"uid,omitempty"`
+	Role    string `json:"role,omitempty"`
+	Version int    `json:"ver,omitempty"`
+	// Team is the id of the team of the user. It is not carried in tokens:
+	// AuthMiddleware reads the current one, so that joining or leaving a
+	// team takes effect at once.
+	Team string `json:"-"`
+	// APIKey is the id of the API key the request was authenticated with
+	// instead of an access token.
+	APIKey string `json:"-"`
+	jwt.RegisteredClaims
+}
+
+// HasRole reports whether the token was issued to a user with one of the
+// roles. Tokens without a role were issued to plain users.
+func (c *Claims) HasRole(roles ...string) bool {
+	role := c.Role
+	if role == "" {
+		role = repo.RoleUser
+	}
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// NewJWTService returns a service signing access tokens with keys and
+// keeping refresh tokens and revoked access tokens in tokens.
+func NewJWTService(keys *KeySet, tokens *repo.Repo) *TokenService {
+	return &TokenService{
+		keys:       keys,
+		tokens:     tokens,
+		AccessTTL:  defaultAccessTTL,
+		RefreshTTL: defaultRefreshTTL,
+	}
 }
 
-func (s *TokenService) GenerateToken(username string) (string, error) {
-	claims := jwt.MapClaims{
-		"sub": username,
-		"exp": time.Now().Add(time.Hour).Unix(),
+func (s *TokenService) GenerateToken(user *repo.User) (string, error) {
+	now := time.Now()
+	claims := Claims{
+		UserID:  user.ID,
+		Role:    user.Role,
+		Version: user.TokenVersion,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.NewString(),
+			Subject:   user.Username,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(s.AccessTTL)),
+		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(s.secretKey)
+	key := s.keys.Signing()
+	token := jwt.NewWithClaims(key.method(), claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.signingKey())
 }
 
-func (s *TokenService) ValidateToken(tokenString string) (string, error) {
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		return s.secretKey, nil
+// IssueTokens returns a new access token and refresh token for the user.
+func (s *TokenService) IssueTokens(user *repo.User) (*TokenResponse, error) {
+	refresh, hash, err := newRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+	err = s.tokens.CreateRefreshToken(&repo.RefreshToken{
+		Username:  user.Username,
+		TokenHash: hash,
+		ExpiresAt: time.Now().Add(s.RefreshTTL),
 	})
+	if err != nil {
+		return nil, err
+	}
+	return s.tokenResponse(user, refresh)
+}
+
+// Refresh exchanges a refresh token for a new pair of tokens. The refresh
+// token cannot be used again; presenting it twice revokes all refresh
+// tokens of its user. Disabled users get repo.ErrUserDisabled.
+func (s *TokenService) Refresh(refreshToken string) (*TokenResponse, error) {
+	refresh, hash, err := newRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+	next := &repo.RefreshToken{TokenHash: hash, ExpiresAt: time.Now().Add(s.RefreshTTL)}
+	if err := s.tokens.RotateRefreshToken(hashToken(refreshToken), next); err != nil {
+		return nil, err
+	}
+	// The role may have changed since the refresh token was issued.
+	user, err := s.tokens.GetUserByName(next.Username)
+	if err != nil {
+		return nil, err
+	}
+	if user.Disabled {
+		return nil, repo.ErrUserDisabled
+	}
+	return s.tokenResponse(user, refresh)
+}
+
+// Logout revokes the access token and, if given, the user's refresh token.
+func (s *TokenService) Logout(claims *Claims, refreshToken string) error {
+	if claims.ID != "" && claims.ExpiresAt != nil {
+		if err := s.tokens.RevokeToken(claims.ID, claims.ExpiresAt.Time); err != nil {
+			return err
+		}
+	}
+	if refreshToken == "" {
+		return nil
+	}
+	err := s.tokens.RevokeRefreshToken(claims.Subject, hashToken(refreshToken))
+	if errors.Is(err, repo.ErrTokenInvalid) {
+		return nil
+	}
+	return err
+}
+
+func (s *TokenService) tokenResponse(user *repo.User, refresh string) (*TokenResponse, error) {
+	access, err := s.GenerateToken(user)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenResponse{
+		Token:        access,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(s.AccessTTL.Seconds()),
+		RefreshToken: refresh,
+	}, nil
+}
+
+// newRefreshToken returns a random refresh token and the hash it is stored
+// under.
+func newRefreshToken() (token, hash string, err error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", fmt.Errorf("generate refresh token: %w", err)
+	}
+	token = base64.RawURLEncoding.EncodeToString(buf)
+	return token, hashToken(token), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *TokenService) ValidateToken(tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, s.keys.keyFunc,
+		jwt.WithValidMethods(s.keys.algorithms()),
+		jwt.WithExpirationRequired(),
+	)
 
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		return claims["sub"].(string), nil
+	if !token.Valid || claims.Subject == "" {
+		return nil, jwt.ErrInvalidKey
 	}
 
-	return "", jwt.ErrInvalidKey
+	return claims, nil
+}
+
+// endpoint .well-known/jwks.json
+//
+// Publishes the public keys tokens are verified with, so that other
+// services can check them.
+func (s *TokenService) HandleJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(s.keys.JWKS())
 }
 
+type claimsKey struct{}
+
+// ClaimsFrom returns the claims of the access token the request was
+// authenticated with.
+func ClaimsFrom(ctx context.Context) (*Claims, bool) {
+	claims, ok := ctx.Value(claimsKey{}).(*Claims)
+	return claims, ok
+}
+
+// AuthMiddleware authenticates requests with an access token or an API key.
+// API keys are sent in the X-API-Key header or as bearer tokens.
 func (s *TokenService) AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" {
-			http.Error(w, "Authorization header is required", http.StatusUnauthorized)
-			return
+		// Browsers cannot set headers on WebSocket handshakes, so the
+		// token may be offered as a subprotocol there instead. It is not
+		// taken from the query string, which ends up in access logs.
+		if token, ok := WebSocketToken(r); authHeader == "" && ok {
+			authHeader = "Bearer " + token
 		}
 
-		parts := strings.Split(authHeader, " ")
-		if len(parts) != 2 || parts[0] != "Bearer" {
-			http.Error(w, "Invalid Authorization header format", http.StatusUnauthorized)
-			return
-		}
-		token := parts[1]
+		var (
+			claims *Claims
+			code   int
+			err    error
+		)
+		if key := r.Header.Get(APIKeyHeader); key != "" {
+			claims, code, err = s.authenticateAPIKey(key)
+		} else {
+			if authHeader == "" {
+				problem.Write(w, http.StatusUnauthorized, problem.New("missing_token", "Authorization header is required"))
+				return
+			}
+
+			parts := strings.Split(authHeader, " ")
+			if len(parts) != 2 || parts[0] != "Bearer" {
+				problem.Write(w, http.StatusUnauthorized, problem.New("invalid_authorization_header", "Invalid Authorization header format"))
+				return
+			}
 
-		username, err := s.ValidateToken(token)
+			if strings.HasPrefix(parts[1], APIKeyPrefix) {
+				claims, code, err = s.authenticateAPIKey(parts[1])
+			} else {
+				claims, code, err = s.authenticateToken(parts[1])
+			}
+		}
 		if err != nil {
-			http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+			if code == http.StatusInternalServerError {
+				fmt.Println(err)
+				err = problem.New("internal_error", "failed to check token")
+			}
+			problem.Write(w, code, err)
 			return
 		}
 
-		ctx := context.WithValue(r.Context(), "username", username)
+		ctx := context.WithValue(r.Context(), "username", claims.Subject)
+		ctx = context.WithValue(ctx, claimsKey{}, claims)
 		next(w, r.WithContext(ctx))
 	}
 }
+
+// authenticateToken validates the access token and checks that it was
+// not revoked and its user may still use it.
+func (s *TokenService) authenticateToken(token string) (*Claims, int, error) {
+	claims, err := s.ValidateToken(token)
+	if err != nil {
+		return nil, http.StatusUnauthorized, problem.New("invalid_token", "Invalid or expired token")
+	}
+
+	revoked, err := s.tokens.IsTokenRevoked(claims.ID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if revoked {
+		return nil, http.StatusUnauthorized, problem.New("token_revoked", "Token has been revoked")
+	}
+
+	user, err := s.tokens.GetUserByName(claims.Subject)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, http.StatusUnauthorized, problem.New("invalid_token", "Invalid or expired token")
+	}
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if user.Disabled {
+		return nil, http.StatusForbidden, errAccountDisabled
+	}
+	if claims.UserID != user.ID || claims.Version != user.TokenVersion {
+		return nil, http.StatusUnauthorized, problem.New("token_revoked", "Token has been revoked")
+	}
+	claims.Team = user.TeamID
+
+	return claims, 0, nil
+}
+
+// RequireRole lets through only requests authenticated with a token of one
+// of the roles. It must be used inside AuthMiddleware.
+func RequireRole(roles ...string) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			claims, ok := ClaimsFrom(r.Context())
+			if !ok {
+				problem.Write(w, http.StatusUnauthorized, problem.New("unauthorized", "unauthorized"))
+				return
+			}
+			if !claims.HasRole(roles...) {
+				problem.Write(w, http.StatusForbidden, problem.New("insufficient_role", "your role does not allow this operation"))
+				return
+			}
+			next(w, r)
+		}
+	}
+}
+
+// RequireToken lets through only requests authenticated with an access
+// token rather than an API key, for operations on the account itself. It
+// must be used inside AuthMiddleware.
+func RequireToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := ClaimsFrom(r.Context())
+		if !ok {
+			problem.Write(w, http.StatusUnauthorized, problem.New("unauthorized", "unauthorized"))
+			return
+		}
+		if claims.APIKey != "" {
+			problem.Write(w, http.StatusForbidden, problem.New("api_key_not_allowed", "this operation requires an access token, not an API key"))
+			return
+		}
+		next(w, r)
+	}
+}
+
+// WebSocketProtocol is the subprotocol browsers offer, followed by the
+// access token as a second one, to authenticate a WebSocket handshake:
+//
+//	new WebSocket(url, ["bearer", token])
+//
+// The server accepts only WebSocketProtocol, so the token is not echoed.
+const WebSocketProtocol = "bearer"
+
+// WebSocketToken returns the token offered in the subprotocols of a
+// WebSocket handshake, see WebSocketProtocol.
+func WebSocketToken(r *http.Request) (string, bool) {
+	if !isWebSocket(r) {
+		return "", false
+	}
+
+	var protocols []string
+	for _, value := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, protocol := range strings.Split(value, ",") {
+			protocols = append(protocols, strings.TrimSpace(protocol))
+		}
+	}
+	if len(protocols) != 2 || protocols[0] != WebSocketProtocol || protocols[1] == "" {
+		return "", false
+	}
+	return protocols[1], true
+}
+
+func isWebSocket(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
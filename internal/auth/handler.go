@@ -1,15 +1,53 @@
 package auth
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 
+	"github.com/StepanShel/YandexProject/internal/jsonbody"
+	"github.com/StepanShel/YandexProject/internal/problem"
+	"github.com/StepanShel/YandexProject/internal/ratelimit"
 	"github.com/StepanShel/YandexProject/internal/repo"
 )
 
+// maxCredentialsBytes bounds register and login bodies.
+const maxCredentialsBytes = 4 << 10
+
+var (
+	errUserExists         = problem.New("username_taken", "user already exists")
+	errInvalidCredentials = problem.New("invalid_credentials", "invalid credentials")
+	errInvalidRefresh     = problem.New("invalid_refresh_token", "invalid or expired refresh token")
+	errRefreshReused      = problem.New("refresh_token_reused", "refresh token was already used; all sessions have been ended")
+	errAccountDisabled    = problem.New("account_disabled", "account is disabled")
+)
+
+type TokenResponse struct {
+	Token     string `json:"token"`
+	TokenType string `json:"token_type"`
+	// ExpiresIn is the lifetime of Token in seconds.
+	ExpiresIn int `json:"expires_in"`
+	// RefreshToken is exchanged for new tokens at api/v1/token/refresh.
+	RefreshToken string `json:"refresh_token"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type LogoutRequest struct {
+	// RefreshToken, if given, is revoked together with the access token.
+	RefreshToken string `json:"refresh_token,omitempty"`
+}
+
 type AuthHandler struct {
 	userRepo   *repo.Repo
 	jwtService *TokenService
+
+	// Guard, if set, locks out logins after repeated failures.
+	Guard *LoginGuard
 }
 
 func NewAuthHandler(userRepo *repo.Repo, jwtService *TokenService) *AuthHandler {
@@ -22,14 +60,29 @@ func NewAuthHandler(userRepo *repo.Repo, jwtService *TokenService) *AuthHandler
 func (h *AuthHandler) Register(w http.ResponseWriter, r *http.Request) {
 	var user repo.User
 
-	defer r.Body.Close()
-	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
-		http.Error(w, "invalid request body", http.StatusBadRequest)
+	if code, err := jsonbody.Decode(w, r, &user, maxCredentialsBytes); err != nil {
+		problem.Write(w, code, err)
 		return
 	}
 
+	if err := ValidateUsername(user.Username); err != nil {
+		problem.Write(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	if err := ValidatePassword(user.Username, user.Password); err != nil {
+		problem.Write(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	user.Role = repo.RoleUser
+
 	if err := h.userRepo.InsertUser(user); err != nil {
-		http.Error(w, err.Error(), http.StatusConflict)
+		if errors.Is(err, repo.ErrUserExists) {
+			problem.Write(w, http.StatusConflict, errUserExists)
+			return
+		}
+		fmt.Println(err)
+		problem.Write(w, http.StatusInternalServerError, errors.New("failed to register user"))
 		return
 	}
 
@@ -39,25 +92,114 @@ func (h *AuthHandler) Register(w http.ResponseWriter, r *http.Request) {
 func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 	var user repo.User
 
-	defer r.Body.Close()
-	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
-		http.Error(w, "invalid request body", http.StatusBadRequest)
+	if code, err := jsonbody.Decode(w, r, &user, maxCredentialsBytes); err != nil {
+		problem.Write(w, code, err)
+		return
+	}
+
+	if wait := h.Guard.locked(r, user.Username); wait > 0 {
+		w.Header().Set("Retry-After", ratelimit.RetryAfter(wait))
+		problem.Write(w, http.StatusTooManyRequests, errLoginLocked)
 		return
 	}
 
 	valid, err := h.userRepo.Authenticate(user.Username, user.Password)
 	if err != nil || !valid {
-		http.Error(w, "invalid credentials", http.StatusUnauthorized)
+		h.Guard.fail(r, user.Username)
+		problem.Write(w, http.StatusUnauthorized, errInvalidCredentials)
 		return
 	}
+	h.Guard.succeed(r, user.Username)
 
-	token, err := h.jwtService.GenerateToken(user.Username)
+	account, err := h.userRepo.GetUserByName(user.Username)
 	if err != nil {
-		http.Error(w, "failed to generate token", http.StatusInternalServerError)
+		fmt.Println(err)
+		problem.Write(w, http.StatusInternalServerError, errors.New("failed to generate token"))
+		return
+	}
+	if account.Disabled {
+		problem.Write(w, http.StatusForbidden, errAccountDisabled)
 		return
 	}
 
-	json.NewEncoder(w).Encode(map[string]string{
-		"token": token,
-	})
+	tokens, err := h.jwtService.IssueTokens(account)
+	if err != nil {
+		fmt.Println(err)
+		problem.Write(w, http.StatusInternalServerError, errors.New("failed to generate token"))
+		return
+	}
+
+	writeTokens(w, tokens)
+}
+
+// endpoint api/v1/token/refresh
+func (h *AuthHandler) Refresh(w http.ResponseWriter, r *http.Request) {
+	var request RefreshRequest
+	if code, err := jsonbody.Decode(w, r, &request, maxCredentialsBytes); err != nil {
+		problem.Write(w, code, err)
+		return
+	}
+
+	tokens, err := h.jwtService.Refresh(request.RefreshToken)
+	switch {
+	case errors.Is(err, repo.ErrTokenInvalid):
+		problem.Write(w, http.StatusUnauthorized, errInvalidRefresh)
+		return
+	case errors.Is(err, repo.ErrTokenReused):
+		problem.Write(w, http.StatusUnauthorized, errRefreshReused)
+		return
+	case errors.Is(err, repo.ErrUserDisabled):
+		problem.Write(w, http.StatusForbidden, errAccountDisabled)
+		return
+	case err != nil:
+		fmt.Println(err)
+		problem.Write(w, http.StatusInternalServerError, errors.New("failed to refresh token"))
+		return
+	}
+
+	writeTokens(w, tokens)
+}
+
+// endpoint api/v1/logout
+//
+// Revokes the access token the request is made with. The body is optional.
+func (h *AuthHandler) Logout(w http.ResponseWriter, r *http.Request) {
+	claims, ok := ClaimsFrom(r.Context())
+	if !ok {
+		problem.Write(w, http.StatusUnauthorized, problem.New("unauthorized", "unauthorized"))
+		return
+	}
+
+	data, code, err := jsonbody.Read(w, r, maxCredentialsBytes)
+	if err != nil {
+		problem.Write(w, code, err)
+		return
+	}
+	var request LogoutRequest
+	if len(bytes.TrimSpace(data)) > 0 {
+		if err := jsonbody.Unmarshal(data, &request); err != nil {
+			problem.Write(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	if err := h.jwtService.Logout(claims, request.RefreshToken); err != nil {
+		fmt.Println(err)
+		problem.Write(w, http.StatusInternalServerError, errors.New("failed to log out"))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeTokens(w http.ResponseWriter, tokens *TokenResponse) {
+	// Tokens must not end up in shared caches.
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, tokens)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
 }
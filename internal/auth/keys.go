@@ -0,0 +1,377 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Signing algorithms of JWT keys.
+const (
+	AlgHS256 = "HS256"
+	AlgRS256 = "RS256"
+	AlgEdDSA = "EdDSA"
+)
+
+// minSecretLength is the shortest HS256 secret accepted, as RFC 7518
+// requires keys at least as long as the hash.
+const minSecretLength = 32
+
+// Key is a key signing or verifying tokens. Its ID is sent in the kid
+// header of the tokens it signs.
+type Key struct {
+	ID        string
+	Algorithm string
+
+	// private is nil for keys that can only verify.
+	private crypto.PrivateKey
+	public  crypto.PublicKey
+	secret  []byte
+}
+
+// CanSign reports whether the key can sign tokens.
+func (k *Key) CanSign() bool {
+	return k.secret != nil || k.private != nil
+}
+
+func (k *Key) method() jwt.SigningMethod {
+	return jwt.GetSigningMethod(k.Algorithm)
+}
+
+func (k *Key) signingKey() any {
+	if k.secret != nil {
+		return k.secret
+	}
+	return k.private
+}
+
+func (k *Key) verificationKey() any {
+	if k.secret != nil {
+		return k.secret
+	}
+	return k.public
+}
+
+// HMACKey returns an HS256 key for secret.
+func HMACKey(secret []byte) (*Key, error) {
+	if len(secret) < minSecretLength {
+		return nil, fmt.Errorf("HS256 secret must be at least %d bytes", minSecretLength)
+	}
+	// The ID must not reveal the secret, so it is derived from its hash.
+	sum := sha256.Sum256(append([]byte("kid:"), secret...))
+	return &Key{
+		ID:        "hs-" + base64.RawURLEncoding.EncodeToString(sum[:9]),
+		Algorithm: AlgHS256,
+		secret:    secret,
+	}, nil
+}
+
+// GenerateKey returns a new EdDSA key.
+func GenerateKey() (*Key, error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return newAsymmetricKey(private, public)
+}
+
+// ParseKey reads a PEM encoded RSA or Ed25519 key. Private keys sign and
+// verify, public keys only verify.
+func ParseKey(data []byte) (*Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		private, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return newAsymmetricKey(private, &private.PublicKey)
+	case "PRIVATE KEY":
+		private, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		switch private := private.(type) {
+		case *rsa.PrivateKey:
+			return newAsymmetricKey(private, &private.PublicKey)
+		case ed25519.PrivateKey:
+			return newAsymmetricKey(private, private.Public())
+		}
+		return nil, fmt.Errorf("unsupported private key type %T", private)
+	case "PUBLIC KEY":
+		public, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return newAsymmetricKey(nil, public)
+	}
+	return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+}
+
+func newAsymmetricKey(private crypto.PrivateKey, public crypto.PublicKey) (*Key, error) {
+	key := &Key{private: private, public: public}
+	switch public := public.(type) {
+	case *rsa.PublicKey:
+		if public.N.BitLen() < 2048 {
+			return nil, errors.New("RSA keys must be at least 2048 bits")
+		}
+		key.Algorithm = AlgRS256
+	case ed25519.PublicKey:
+		key.Algorithm = AlgEdDSA
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", public)
+	}
+	key.ID = key.thumbprint()
+	return key, nil
+}
+
+// JWK is a public key in JSON Web Key format.
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	// RSA keys.
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// Ed25519 keys.
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+}
+
+// JWKS is a JSON Web Key Set.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+func (k *Key) jwk() JWK {
+	jwk := JWK{KeyID: k.ID, Use: "sig", Algorithm: k.Algorithm}
+	switch public := k.public.(type) {
+	case *rsa.PublicKey:
+		jwk.KeyType = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+	case ed25519.PublicKey:
+		jwk.KeyType = "OKP"
+		jwk.Curve = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(public)
+	}
+	return jwk
+}
+
+// thumbprint is the RFC 7638 thumbprint of the public key.
+func (k *Key) thumbprint() string {
+	jwk := k.jwk()
+	var members map[string]string
+	if jwk.KeyType == "RSA" {
+		members = map[string]string{"e": jwk.E, "kty": jwk.KeyType, "n": jwk.N}
+	} else {
+		members = map[string]string{"crv": jwk.Curve, "kty": jwk.KeyType, "x": jwk.X}
+	}
+	// encoding/json writes map keys sorted and without whitespace, which is
+	// the canonical form the RFC asks for.
+	data, _ := json.Marshal(members)
+	sum := sha256.Sum256(data)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// KeyConfig tells where the keys come from.
+type KeyConfig struct {
+	// Secret is the HS256 secret. PreviousSecrets are still accepted.
+	Secret          string
+	PreviousSecrets []string
+	// Dir holds PEM encoded RSA and Ed25519 keys. The most recently modified
+	// private key signs; all keys verify, so a key stays valid until its file
+	// is removed.
+	Dir string
+}
+
+// KeySet holds the signing key and the keys accepted for verification. It
+// is safe for concurrent use and can be reloaded to rotate keys.
+type KeySet struct {
+	config KeyConfig
+
+	mu      sync.RWMutex
+	signing *Key
+	keys    map[string]*Key
+	// fallback signs when no key is configured. It is generated once, so
+	// reloading does not invalidate the tokens it signed.
+	fallback *Key
+}
+
+// NewKeySet loads the keys described by config. Without any configured
+// signing key an ephemeral EdDSA key is generated; its tokens do not
+// survive a restart.
+func NewKeySet(config KeyConfig) (*KeySet, error) {
+	ks := &KeySet{config: config}
+	if err := ks.Reload(); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+// Reload loads the keys again. On error the current keys are kept.
+func (ks *KeySet) Reload() error {
+	signing, keys, err := loadKeys(ks.config)
+	if err != nil {
+		return err
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if signing == nil {
+		if ks.fallback == nil {
+			if ks.fallback, err = GenerateKey(); err != nil {
+				return err
+			}
+		}
+		signing = ks.fallback
+		keys = append(keys, signing)
+	}
+
+	ks.signing = signing
+	ks.keys = make(map[string]*Key, len(keys))
+	for _, key := range keys {
+		ks.keys[key.ID] = key
+	}
+	return nil
+}
+
+// Ephemeral reports whether tokens are signed with a generated key.
+func (ks *KeySet) Ephemeral() bool {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return ks.signing == ks.fallback
+}
+
+func loadKeys(config KeyConfig) (*Key, []*Key, error) {
+	var signing *Key
+	var keys []*Key
+
+	for i, secret := range append([]string{config.Secret}, config.PreviousSecrets...) {
+		if secret == "" {
+			continue
+		}
+		key, err := HMACKey([]byte(secret))
+		if err != nil {
+			return nil, nil, err
+		}
+		if i == 0 {
+			signing = key
+		}
+		keys = append(keys, key)
+	}
+
+	if config.Dir == "" {
+		return signing, keys, nil
+	}
+
+	paths, err := filepath.Glob(filepath.Join(config.Dir, "*.pem"))
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Strings(paths)
+
+	var newest time.Time
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		key, err := ParseKey(data)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", path, err)
+		}
+		keys = append(keys, key)
+
+		if key.CanSign() && (signing == nil || signing.secret != nil || info.ModTime().After(newest)) {
+			signing, newest = key, info.ModTime()
+		}
+	}
+	return signing, keys, nil
+}
+
+// Signing returns the key new tokens are signed with.
+func (ks *KeySet) Signing() *Key {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return ks.signing
+}
+
+// Lookup returns the key with the given ID.
+func (ks *KeySet) Lookup(id string) (*Key, bool) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	key, ok := ks.keys[id]
+	return key, ok
+}
+
+// JWKS returns the public keys in the set. HS256 secrets are not included.
+func (ks *KeySet) JWKS() JWKS {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	jwks := JWKS{Keys: []JWK{}}
+	for _, key := range ks.keys {
+		if key.public != nil {
+			jwks.Keys = append(jwks.Keys, key.jwk())
+		}
+	}
+	sort.Slice(jwks.Keys, func(i, j int) bool { return jwks.Keys[i].KeyID < jwks.Keys[j].KeyID })
+	return jwks
+}
+
+// algorithms lists the algorithms of the keys in the set.
+func (ks *KeySet) algorithms() []string {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	seen := make(map[string]bool)
+	var algs []string
+	for _, key := range ks.keys {
+		if !seen[key.Algorithm] {
+			seen[key.Algorithm] = true
+			algs = append(algs, key.Algorithm)
+		}
+	}
+	return algs
+}
+
+// keyFunc finds the key named by the kid header of a token and checks that
+// the token is signed with the key's algorithm.
+func (ks *KeySet) keyFunc(token *jwt.Token) (any, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, ok := ks.Lookup(kid)
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	if token.Method.Alg() != key.Algorithm {
+		return nil, fmt.Errorf("key %q does not use %s", kid, token.Method.Alg())
+	}
+	return key.verificationKey(), nil
+}
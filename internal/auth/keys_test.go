@@ -0,0 +1,186 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/StepanShel/YandexProject/internal/repo"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeKey(t *testing.T, dir, name string, private any, modTime time.Time) {
+	t.Helper()
+
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	require.NoError(t, err)
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600))
+	require.NoError(t, os.Chtimes(path, modTime, modTime))
+}
+
+func header(t *testing.T, token string) map[string]any {
+	t.Helper()
+
+	parsed, _, err := jwt.NewParser().ParseUnverified(token, &Claims{})
+	require.NoError(t, err)
+	return parsed.Header
+}
+
+func TestHMACKey(t *testing.T) {
+	_, err := HMACKey([]byte("secret"))
+	assert.Error(t, err)
+
+	key, err := HMACKey([]byte(strings.Repeat("s", 32)))
+	require.NoError(t, err)
+	assert.Equal(t, AlgHS256, key.Algorithm)
+	assert.NotContains(t, key.ID, "sss")
+}
+
+func TestKeyRotation(t *testing.T) {
+	dir := t.TempDir()
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	now := time.Now()
+	writeKey(t, dir, "old.pem", edKey, now.Add(-time.Hour))
+
+	keys, err := NewKeySet(KeyConfig{Dir: dir})
+	require.NoError(t, err)
+	assert.False(t, keys.Ephemeral())
+	service := NewJWTService(keys, nil)
+
+	oldToken, err := service.GenerateToken(&repo.User{Username: "alice"})
+	require.NoError(t, err)
+	assert.Equal(t, "EdDSA", header(t, oldToken)["alg"])
+
+	// A newer key takes over signing; tokens of the old one stay valid.
+	writeKey(t, dir, "new.pem", rsaKey, now)
+	require.NoError(t, keys.Reload())
+
+	newToken, err := service.GenerateToken(&repo.User{Username: "alice"})
+	require.NoError(t, err)
+	assert.Equal(t, "RS256", header(t, newToken)["alg"])
+	assert.NotEqual(t, header(t, oldToken)["kid"], header(t, newToken)["kid"])
+
+	for _, token := range []string{oldToken, newToken} {
+		claims, err := service.ValidateToken(token)
+		require.NoError(t, err)
+		assert.Equal(t, "alice", claims.Subject)
+	}
+	assert.Len(t, keys.JWKS().Keys, 2)
+
+	// Once its file is removed the old key no longer verifies.
+	require.NoError(t, os.Remove(filepath.Join(dir, "old.pem")))
+	require.NoError(t, keys.Reload())
+	_, err = service.ValidateToken(oldToken)
+	assert.Error(t, err)
+	_, err = service.ValidateToken(newToken)
+	assert.NoError(t, err)
+
+	// A broken file keeps the current keys.
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "broken.pem"), []byte("garbage"), 0o600))
+	assert.Error(t, keys.Reload())
+	_, err = service.ValidateToken(newToken)
+	assert.NoError(t, err)
+}
+
+func TestValidateTokenRejectsForgedTokens(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	dir := t.TempDir()
+	writeKey(t, dir, "key.pem", rsaKey, time.Now())
+
+	keys, err := NewKeySet(KeyConfig{Dir: dir})
+	require.NoError(t, err)
+	service := NewJWTService(keys, nil)
+	kid := keys.Signing().ID
+
+	claims := jwt.MapClaims{"sub": "mallory", "exp": time.Now().Add(time.Hour).Unix()}
+
+	// HS256 signed with the public key, the classic algorithm confusion.
+	publicDER, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	require.NoError(t, err)
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	forged.Header["kid"] = kid
+	token, err := forged.SignedString(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}))
+	require.NoError(t, err)
+	_, err = service.ValidateToken(token)
+	assert.Error(t, err)
+
+	// Unsigned tokens.
+	unsigned := jwt.NewWithClaims(jwt.SigningMethodNone, claims)
+	unsigned.Header["kid"] = kid
+	token, err = unsigned.SignedString(jwt.UnsafeAllowNoneSignatureType)
+	require.NoError(t, err)
+	_, err = service.ValidateToken(token)
+	assert.Error(t, err)
+
+	// Tokens without a kid.
+	token, err = jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(rsaKey)
+	require.NoError(t, err)
+	_, err = service.ValidateToken(token)
+	assert.Error(t, err)
+
+	// Tokens without an expiry.
+	noExp := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{"sub": "mallory"})
+	noExp.Header["kid"] = kid
+	token, err = noExp.SignedString(rsaKey)
+	require.NoError(t, err)
+	_, err = service.ValidateToken(token)
+	assert.Error(t, err)
+}
+
+func TestPreviousSecrets(t *testing.T) {
+	oldSecret, newSecret := strings.Repeat("o", 32), strings.Repeat("n", 32)
+
+	oldKeys, err := NewKeySet(KeyConfig{Secret: oldSecret})
+	require.NoError(t, err)
+	token, err := NewJWTService(oldKeys, nil).GenerateToken(&repo.User{Username: "alice"})
+	require.NoError(t, err)
+
+	keys, err := NewKeySet(KeyConfig{Secret: newSecret, PreviousSecrets: []string{oldSecret}})
+	require.NoError(t, err)
+	_, err = NewJWTService(keys, nil).ValidateToken(token)
+	assert.NoError(t, err)
+	assert.Empty(t, keys.JWKS().Keys)
+
+	keys, err = NewKeySet(KeyConfig{Secret: newSecret})
+	require.NoError(t, err)
+	_, err = NewJWTService(keys, nil).ValidateToken(token)
+	assert.Error(t, err)
+}
+
+func TestEphemeralKeySurvivesReload(t *testing.T) {
+	keys, err := NewKeySet(KeyConfig{})
+	require.NoError(t, err)
+	assert.True(t, keys.Ephemeral())
+
+	id := keys.Signing().ID
+	require.NoError(t, keys.Reload())
+	assert.Equal(t, id, keys.Signing().ID)
+}
+
+// TestThumbprint checks the key ID against the example of RFC 7638.
+func TestThumbprint(t *testing.T) {
+	n, err := base64.RawURLEncoding.DecodeString("0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw")
+	require.NoError(t, err)
+
+	key, err := newAsymmetricKey(nil, &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: 65537})
+	require.NoError(t, err)
+	assert.Equal(t, "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs", key.ID)
+	assert.Equal(t, "AQAB", key.jwk().E)
+}
@@ -0,0 +1,69 @@
+package auth
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/StepanShel/YandexProject/internal/problem"
+	"github.com/StepanShel/YandexProject/internal/ratelimit"
+)
+
+var errLoginLocked = problem.New("login_locked", "too many failed logins; try again later")
+
+// LoginGuard slows down password guessing: a username guessed from one
+// client address, an address with too many failed logins overall and a
+// username guessed from many addresses are locked out for a while. Locked
+// out logins are refused before the password is checked, so a correct
+// password does not help either.
+type LoginGuard struct {
+	// Users counts failures per username and client address.
+	Users *ratelimit.Lockout
+	// IPs counts failures per client address, whatever the username.
+	IPs *ratelimit.Lockout
+	// Accounts counts failures per username, whatever the address. As
+	// anyone can lock an account out this way, it is meant to have a
+	// higher threshold and a shorter maximum lockout than Users.
+	Accounts *ratelimit.Lockout
+	// TrustProxy takes client addresses from X-Forwarded-For.
+	TrustProxy bool
+}
+
+// userKey is the key of logins to username from the client of r.
+func (g *LoginGuard) userKey(r *http.Request, username string) string {
+	return ratelimit.ClientIP(r, g.TrustProxy) + " " + username
+}
+
+// locked reports how long logins to username from the client of r remain
+// locked out, or 0.
+func (g *LoginGuard) locked(r *http.Request, username string) time.Duration {
+	if g == nil {
+		return 0
+	}
+	return max(
+		g.Users.Locked(g.userKey(r, username)),
+		g.IPs.Locked(ratelimit.ClientIP(r, g.TrustProxy)),
+		g.Accounts.Locked(username),
+	)
+}
+
+// fail records a failed login. Unknown usernames count too, so that
+// lockouts do not tell which users exist.
+func (g *LoginGuard) fail(r *http.Request, username string) {
+	if g == nil {
+		return
+	}
+	g.Users.Fail(g.userKey(r, username))
+	g.IPs.Fail(ratelimit.ClientIP(r, g.TrustProxy))
+	g.Accounts.Fail(username)
+}
+
+// succeed forgets the failed logins to username from the client of r.
+// Those of the address and of the username are kept, or logging in to
+// one's own account would allow guessing others, and the owner logging in
+// would allow guessing theirs from other addresses.
+func (g *LoginGuard) succeed(r *http.Request, username string) {
+	if g == nil {
+		return
+	}
+	g.Users.Reset(g.userKey(r, username))
+}
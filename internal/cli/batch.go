@@ -0,0 +1,185 @@
+package cli
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/StepanShel/YandexProject/pkg/client"
+)
+
+// Exit codes of batch mode.
+const (
+	ExitOK     = 0
+	ExitFailed = 1
+	ExitUsage  = 2
+)
+
+// BatchItem is one expression read from a batch file.
+type BatchItem struct {
+	Line       int
+	Ref        string
+	Expression string
+}
+
+// BatchResult is the outcome of one BatchItem.
+type BatchResult struct {
+	Line       int      `json:"line"`
+	Ref        string   `json:"ref,omitempty"`
+	Expression string   `json:"expression"`
+	ID         string   `json:"id,omitempty"`
+	Status     string   `json:"status"`
+	Result     *float64 `json:"result,omitempty"`
+	Error      string   `json:"error,omitempty"`
+}
+
+func (r BatchResult) Failed() bool {
+	return r.Error != ""
+}
+
+// ReadBatch reads one expression per line. Lines starting with "{" are JSON
+// objects with an "expression" and an optional "ref" echoed in the output.
+// Blank lines and lines starting with "#" are skipped.
+func ReadBatch(in io.Reader) ([]BatchItem, error) {
+	var items []BatchItem
+
+	scanner := bufio.NewScanner(in)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		item := BatchItem{Line: line, Expression: text}
+		if strings.HasPrefix(text, "{") {
+			var entry struct {
+				Ref        string `json:"ref"`
+				Expression string `json:"expression"`
+			}
+			if err := json.Unmarshal([]byte(text), &entry); err != nil {
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+			item.Ref, item.Expression = entry.Ref, entry.Expression
+		}
+
+		items = append(items, item)
+	}
+
+	return items, scanner.Err()
+}
+
+// RunBatch submits the items with at most parallel requests in flight and
+// waits for all of them. Results are returned in input order.
+func RunBatch(ctx context.Context, c *client.Client, items []BatchItem, parallel int) []BatchResult {
+	results := make([]BatchResult, len(items))
+	sem := make(chan struct{}, max(parallel, 1))
+
+	var wg sync.WaitGroup
+	for i, item := range items {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = runItem(ctx, c, item)
+		}()
+	}
+	wg.Wait()
+
+	return results
+}
+
+func runItem(ctx context.Context, c *client.Client, item BatchItem) BatchResult {
+	result := BatchResult{Line: item.Line, Ref: item.Ref, Expression: item.Expression}
+
+	id, err := submit(ctx, c, item.Expression)
+	if err != nil {
+		result.Status, result.Error = "rejected", err.Error()
+		return result
+	}
+	result.ID = id
+
+	expr, err := c.Wait(ctx, id)
+	if err != nil {
+		result.Status, result.Error = "unknown", err.Error()
+		return result
+	}
+
+	result.Status = expr.Status
+	if expr.Failed() {
+		result.Error = "evaluation failed"
+		return result
+	}
+	result.Result = &expr.Result
+	return result
+}
+
+// submit retries expressions rejected because the user already has too many
+// in progress, which is expected when parallel exceeds the server's limit,
+// or because of the rate limit.
+func submit(ctx context.Context, c *client.Client, expression string) (string, error) {
+	for attempt := 1; ; attempt++ {
+		id, err := c.Calculate(ctx, expression)
+
+		var apiErr *client.Error
+		if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusTooManyRequests {
+			return id, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", err
+		case <-time.After(max(apiErr.RetryAfter, time.Duration(min(attempt, 10))*c.PollInterval)):
+		}
+	}
+}
+
+// CountFailed returns the number of results that failed.
+func CountFailed(results []BatchResult) int {
+	failed := 0
+	for _, result := range results {
+		if result.Failed() {
+			failed++
+		}
+	}
+	return failed
+}
+
+// ExitCode is ExitFailed if any of the results failed and ExitOK otherwise.
+func ExitCode(results []BatchResult) int {
+	if CountFailed(results) > 0 {
+		return ExitFailed
+	}
+	return ExitOK
+}
+
+func WriteCSV(out io.Writer, results []BatchResult) error {
+	w := csv.NewWriter(out)
+	w.Write([]string{"line", "ref", "expression", "id", "status", "result", "error"})
+
+	for _, r := range results {
+		value := ""
+		if r.Result != nil {
+			value = strconv.FormatFloat(*r.Result, 'g', -1, 64)
+		}
+		w.Write([]string{strconv.Itoa(r.Line), r.Ref, r.Expression, r.ID, r.Status, value, r.Error})
+	}
+
+	w.Flush()
+	return w.Error()
+}
+
+func WriteJSON(out io.Writer, results []BatchResult) error {
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(results)
+}
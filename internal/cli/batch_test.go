@@ -0,0 +1,101 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadBatch(t *testing.T) {
+	input := strings.Join([]string{
+		"2+2",
+		"",
+		"# comment",
+		`{"ref":"a","expression":"3*pi"}`,
+		"  1 / 0  ",
+	}, "\n")
+
+	items, err := ReadBatch(strings.NewReader(input))
+	require.NoError(t, err)
+	assert.Equal(t, []BatchItem{
+		{Line: 1, Expression: "2+2"},
+		{Line: 4, Ref: "a", Expression: "3*pi"},
+		{Line: 5, Expression: "1 / 0"},
+	}, items)
+
+	_, err = ReadBatch(strings.NewReader("2+2\n{\"expression\":"))
+	assert.ErrorContains(t, err, "line 2:")
+}
+
+func TestRunBatch(t *testing.T) {
+	f, c := newFakeOrchestrator(t, nil)
+	// Rejected submissions are retried.
+	f.busy = 2
+
+	items := []BatchItem{
+		{Line: 1, Expression: "2+2"},
+		{Line: 2, Ref: "b", Expression: "1/0"},
+		{Line: 3, Expression: "7*6"},
+	}
+	results := RunBatch(context.Background(), c, items, 2)
+	require.Len(t, results, 3)
+
+	// Results keep the input order whatever order they finish in.
+	assert.Equal(t, 1, results[0].Line)
+	assert.Equal(t, "DONE", results[0].Status)
+	assert.Equal(t, 4.0, *results[0].Result)
+
+	assert.Equal(t, "b", results[1].Ref)
+	assert.Equal(t, "ERROR", results[1].Status)
+	assert.Equal(t, "evaluation failed", results[1].Error)
+	assert.Nil(t, results[1].Result)
+
+	assert.Equal(t, 42.0, *results[2].Result)
+	assert.ElementsMatch(t, []string{"2+2", "1/0", "7*6"}, f.submissions())
+
+	assert.Equal(t, 1, CountFailed(results))
+	assert.Equal(t, ExitFailed, ExitCode(results))
+	assert.Equal(t, ExitOK, ExitCode([]BatchResult{results[0], results[2]}))
+	assert.Equal(t, ExitOK, ExitCode(nil))
+}
+
+func TestRunBatchCancelled(t *testing.T) {
+	f, c := newFakeOrchestrator(t, nil)
+	f.busy = 1
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	results := RunBatch(ctx, c, []BatchItem{{Line: 1, Expression: "2+2"}}, 1)
+
+	assert.Equal(t, "rejected", results[0].Status)
+	assert.NotEmpty(t, results[0].Error)
+	assert.Equal(t, ExitFailed, ExitCode(results))
+}
+
+func TestWriteResults(t *testing.T) {
+	value := 1.5
+	results := []BatchResult{
+		{Line: 1, Ref: "a", Expression: "3/2", ID: "1", Status: "DONE", Result: &value},
+		{Line: 2, Expression: "1/0", ID: "2", Status: "ERROR", Error: "evaluation failed"},
+	}
+
+	var out bytes.Buffer
+	require.NoError(t, WriteCSV(&out, results))
+	assert.Equal(t, "line,ref,expression,id,status,result,error\n"+
+		"1,a,3/2,1,DONE,1.5,\n"+
+		"2,,1/0,2,ERROR,,evaluation failed\n", out.String())
+
+	out.Reset()
+	require.NoError(t, WriteJSON(&out, results))
+	var decoded []map[string]any
+	require.NoError(t, json.Unmarshal(out.Bytes(), &decoded))
+	assert.Equal(t, []map[string]any{
+		{"line": 1.0, "ref": "a", "expression": "3/2", "id": "1", "status": "DONE", "result": 1.5},
+		{"line": 2.0, "expression": "1/0", "id": "2", "status": "ERROR", "error": "evaluation failed"},
+	}, decoded)
+}
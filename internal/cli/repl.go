@@ -0,0 +1,258 @@
+package cli
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/StepanShel/YandexProject/pkg/client"
+	"github.com/StepanShel/YandexProject/pkg/orchestrator/parser"
+)
+
+var assignment = regexp.MustCompile(`^\s*([A-Za-z_][A-Za-z0-9_]*)\s*=\s*(.+)$`)
+
+const replHelp = `Enter an expression to evaluate it, or one of:
+  name = expr    evaluate expr and store the result in name
+  :trace expr    evaluate expr showing the plan and status changes
+  :vars          list stored variables
+  :history       list previous input
+  :help          show this help
+  :quit          exit`
+
+// REPL reads expressions line by line and prints their results.
+type REPL struct {
+	client      *client.Client
+	in          *bufio.Scanner
+	out         io.Writer
+	vars        map[string]float64
+	history     []string
+	historyFile string
+}
+
+func NewREPL(c *client.Client, in io.Reader, out io.Writer) *REPL {
+	return &REPL{
+		client: c,
+		in:     bufio.NewScanner(in),
+		out:    out,
+		vars:   make(map[string]float64),
+	}
+}
+
+// LoadHistory reads previous input from path and appends new input to it.
+func (r *REPL) LoadHistory(path string) error {
+	r.historyFile = path
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			r.history = append(r.history, line)
+		}
+	}
+	return nil
+}
+
+func (r *REPL) Run() error {
+	fmt.Fprintln(r.out, "Type :help for help.")
+
+	for {
+		fmt.Fprint(r.out, "> ")
+		if !r.in.Scan() {
+			fmt.Fprintln(r.out)
+			return r.in.Err()
+		}
+
+		line := strings.TrimSpace(r.in.Text())
+		if line == "" {
+			continue
+		}
+		r.remember(line)
+
+		if line == ":quit" || line == ":q" {
+			return nil
+		}
+		if err := r.handle(line); err != nil {
+			fmt.Fprintln(r.out, "error:", err)
+		}
+	}
+}
+
+func (r *REPL) handle(line string) error {
+	switch {
+	case line == ":help":
+		fmt.Fprintln(r.out, replHelp)
+		return nil
+	case line == ":vars":
+		r.printVars()
+		return nil
+	case line == ":history":
+		for i, entry := range r.history {
+			fmt.Fprintf(r.out, "%4d  %s\n", i+1, entry)
+		}
+		return nil
+	case strings.HasPrefix(line, ":trace "):
+		_, err := r.evaluate(strings.TrimPrefix(line, ":trace "), true)
+		return err
+	case strings.HasPrefix(line, ":"):
+		return fmt.Errorf("unknown command %s, see :help", strings.Fields(line)[0])
+	}
+
+	if m := assignment.FindStringSubmatch(line); m != nil {
+		name := m[1]
+		if _, builtin := parser.Builtins[name]; builtin {
+			return fmt.Errorf("%s is a built-in constant", name)
+		}
+		result, err := r.evaluate(m[2], false)
+		if err != nil {
+			return err
+		}
+		r.vars[name] = result
+		return nil
+	}
+
+	_, err := r.evaluate(line, false)
+	return err
+}
+
+// evaluate submits expression with variables substituted and waits for the
+// result. With trace set it also prints the evaluation plan and every status
+// change seen while polling.
+func (r *REPL) evaluate(expression string, trace bool) (float64, error) {
+	expression, err := r.substitute(expression)
+	if err != nil {
+		return 0, err
+	}
+
+	if trace {
+		r.printPlan(expression)
+	}
+
+	ctx := context.Background()
+	start := time.Now()
+	id, err := r.client.Calculate(ctx, expression)
+	if err != nil {
+		return 0, err
+	}
+	if trace {
+		fmt.Fprintf(r.out, "  submitted as %s\n", id)
+	}
+
+	status := ""
+	for {
+		expr, err := r.client.Get(ctx, id)
+		if err != nil {
+			return 0, err
+		}
+
+		if trace && expr.Status != status {
+			fmt.Fprintf(r.out, "  %8s  %s\n", time.Since(start).Round(time.Millisecond), expr.Status)
+		}
+		status = expr.Status
+
+		if expr.Done() {
+			fmt.Fprintln(r.out, formatNumber(expr.Result))
+			return expr.Result, nil
+		}
+		if expr.Failed() {
+			return 0, fmt.Errorf("expression %s failed", id)
+		}
+
+		time.Sleep(r.client.PollInterval)
+	}
+}
+
+// substitute replaces stored variables in expression with their values.
+// Other identifiers are left for the orchestrator to resolve as constants.
+func (r *REPL) substitute(expression string) (string, error) {
+	tokens, err := parser.Tokenize(expression)
+	if err != nil {
+		return "", err
+	}
+
+	changed := false
+	for i, token := range tokens {
+		name := strings.TrimPrefix(token, "-")
+		value, ok := r.vars[name]
+		if !ok {
+			continue
+		}
+		if name != token {
+			value = -value
+		}
+		tokens[i] = formatNumber(value)
+		changed = true
+	}
+
+	if !changed {
+		return expression, nil
+	}
+	return strings.Join(tokens, ""), nil
+}
+
+func (r *REPL) printPlan(expression string) {
+	fmt.Fprintf(r.out, "  expression: %s\n", expression)
+
+	tokens, err := parser.Tokenize(expression)
+	var constants map[string]float64
+	if err == nil {
+		constants, err = r.client.Constants(context.Background())
+	}
+	if err == nil {
+		tokens, _, err = parser.ResolveConstants(tokens, constants)
+	}
+	var node *parser.Node
+	if err == nil {
+		node, err = parser.Ast(tokens)
+	}
+	if err != nil {
+		fmt.Fprintf(r.out, "  plan unavailable: %v\n", err)
+		return
+	}
+
+	for i, step := range parser.Plan(node) {
+		fmt.Fprintf(r.out, "  #%d = %s %s %s\n", i+1, step.Left, step.Operation, step.Right)
+	}
+}
+
+func (r *REPL) printVars() {
+	names := make([]string, 0, len(r.vars))
+	for name := range r.vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(r.out, "%s = %s\n", name, formatNumber(r.vars[name]))
+	}
+}
+
+func (r *REPL) remember(line string) {
+	r.history = append(r.history, line)
+	if r.historyFile == "" {
+		return
+	}
+
+	f, err := os.OpenFile(r.historyFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fmt.Fprintln(f, line)
+}
+
+func formatNumber(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
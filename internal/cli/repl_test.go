@@ -0,0 +1,190 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/StepanShel/YandexProject/internal/agent"
+	"github.com/StepanShel/YandexProject/pkg/client"
+	"github.com/StepanShel/YandexProject/pkg/orchestrator/config"
+	"github.com/StepanShel/YandexProject/pkg/orchestrator/parser"
+	"github.com/StepanShel/YandexProject/proto/calc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeOrchestrator evaluates submitted expressions right away with the
+// orchestrator's parser and records what was submitted. The first busy
+// submissions are rejected as if the user had too many in progress.
+type fakeOrchestrator struct {
+	constants map[string]float64
+
+	mu          sync.Mutex
+	busy        int
+	submitted   []string
+	expressions map[string]client.Expression
+}
+
+func newFakeOrchestrator(t *testing.T, constants map[string]float64) (*fakeOrchestrator, *client.Client) {
+	t.Helper()
+
+	f := &fakeOrchestrator{constants: constants, expressions: make(map[string]client.Expression)}
+	ts := httptest.NewServer(f.handler())
+	t.Cleanup(ts.Close)
+
+	c := client.New(ts.URL)
+	c.PollInterval = time.Millisecond
+	c.SetToken("token")
+	return f, c
+}
+
+func (f *fakeOrchestrator) handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("POST /api/v1/calculate", func(w http.ResponseWriter, r *http.Request) {
+		var body struct{ Expression string }
+		json.NewDecoder(r.Body).Decode(&body)
+
+		f.mu.Lock()
+		if f.busy > 0 {
+			f.busy--
+			f.mu.Unlock()
+			http.Error(w, "too many expressions", http.StatusTooManyRequests)
+			return
+		}
+		f.submitted = append(f.submitted, body.Expression)
+		id := strconv.Itoa(len(f.submitted))
+		f.expressions[id] = f.evaluate(id, body.Expression)
+		f.mu.Unlock()
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"id": id})
+	})
+
+	mux.HandleFunc("GET /api/v1/expressions/{id}", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		expr, ok := f.expressions[r.PathValue("id")]
+		f.mu.Unlock()
+		if !ok {
+			http.Error(w, "expression not found", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]client.Expression{"Expression": expr})
+	})
+
+	mux.HandleFunc("GET /api/v1/constants", func(w http.ResponseWriter, r *http.Request) {
+		list := []map[string]any{{"name": "pi", "value": 3.14, "builtin": true}}
+		for name, value := range f.constants {
+			list = append(list, map[string]any{"name": name, "value": value})
+		}
+		json.NewEncoder(w).Encode(list)
+	})
+
+	return mux
+}
+
+func (f *fakeOrchestrator) evaluate(id, expression string) client.Expression {
+	failed := client.Expression{ID: id, Status: "ERROR"}
+
+	tokens, err := parser.Tokenize(expression)
+	if err != nil {
+		return failed
+	}
+	if tokens, _, err = parser.ResolveConstants(tokens, f.constants); err != nil {
+		return failed
+	}
+	node, err := parser.Ast(tokens)
+	if err != nil {
+		return failed
+	}
+
+	tasksch := make(chan *calc.Task)
+	resultch := make(chan *calc.Result)
+	defer close(tasksch)
+	go func() {
+		for task := range tasksch {
+			value, err := agent.Calculate(task.Operation, 0, task.Arg1, task.Arg2)
+			result := &calc.Result{TaskId: task.Id, Result: value}
+			if err != nil {
+				result.Error = err.Error()
+			}
+			resultch <- result
+		}
+	}()
+
+	value, err := parser.ParsingAST(context.Background(), node, &config.Config{}, tasksch, resultch)
+	if err != nil {
+		return failed
+	}
+	return client.Expression{ID: id, Status: "DONE", Result: value}
+}
+
+func (f *fakeOrchestrator) submissions() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.submitted...)
+}
+
+func TestREPL(t *testing.T) {
+	f, c := newFakeOrchestrator(t, map[string]float64{"VAT": 0.2})
+
+	input := strings.Join([]string{
+		"x = 2+2*2",
+		"x * 10",
+		"y = -x / 4",
+		":vars",
+		":trace x * VAT",
+		"pi = 3",
+		"1 / 0",
+		":bogus",
+		":quit",
+		"never read",
+	}, "\n")
+	var out bytes.Buffer
+	require.NoError(t, NewREPL(c, strings.NewReader(input), &out).Run())
+
+	// Variables are substituted before submitting, constants are left to
+	// the orchestrator.
+	assert.Equal(t, []string{"2+2*2", "6*10", "-6/4", "6*VAT", "1 / 0"}, f.submissions())
+
+	output := out.String()
+	assert.Contains(t, output, "> 6\n")
+	assert.Contains(t, output, "> 60\n")
+	assert.Contains(t, output, "x = 6\ny = -1.5\n")
+	// The plan uses the organisation's constants.
+	assert.Contains(t, output, "  #1 = 6 * 0.2\n")
+	assert.NotContains(t, output, "plan unavailable")
+	assert.Contains(t, output, "error: pi is a built-in constant\n")
+	assert.Contains(t, output, "error: expression 5 failed\n")
+	assert.Contains(t, output, "error: unknown command :bogus, see :help\n")
+}
+
+func TestREPLSubstitute(t *testing.T) {
+	r := &REPL{vars: map[string]float64{"x": 1.5, "y": -2}}
+
+	tests := []struct {
+		input, expected string
+	}{
+		{"2 + 2", "2 + 2"},
+		{"x * 2", "1.5*2"},
+		{"-x + y", "-1.5+-2"},
+		{"(x - pi) / xy", "(1.5-pi)/xy"},
+	}
+
+	for _, tt := range tests {
+		got, err := r.substitute(tt.input)
+		require.NoError(t, err, tt.input)
+		assert.Equal(t, tt.expected, got, tt.input)
+	}
+
+	_, err := r.substitute("x $ 2")
+	assert.EqualError(t, err, "invalid character: $")
+}
@@ -0,0 +1,88 @@
+// Package jsonbody decodes JSON request bodies strictly: the body must hold
+// exactly one JSON value without unknown fields and fit in a size limit.
+package jsonbody
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/StepanShel/YandexProject/internal/problem"
+)
+
+// DefaultLimit bounds request bodies when no positive limit is given, e.g.
+// when a configured limit is negative.
+const DefaultLimit = 1 << 20
+
+// Read returns the body of r, or an error with the HTTP status describing
+// it if the body is larger than limit bytes, or than DefaultLimit if limit
+// is not positive.
+func Read(w http.ResponseWriter, r *http.Request, limit int64) ([]byte, int, error) {
+	defer r.Body.Close()
+
+	if limit <= 0 {
+		limit = DefaultLimit
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return nil, http.StatusRequestEntityTooLarge, problem.Errorf("body_too_large", "request body is larger than %d bytes", limit)
+	}
+	if err != nil {
+		return nil, http.StatusBadRequest, problem.New("invalid_body", "failed to read request body")
+	}
+	return data, http.StatusOK, nil
+}
+
+// Decode reads the body of r into v. code is the HTTP status describing
+// the error, if any.
+func Decode(w http.ResponseWriter, r *http.Request, v any, limit int64) (int, error) {
+	data, code, err := Read(w, r, limit)
+	if err != nil {
+		return code, err
+	}
+	if err := Unmarshal(data, v); err != nil {
+		return http.StatusBadRequest, err
+	}
+	return http.StatusOK, nil
+}
+
+// Unmarshal decodes data into v, rejecting unknown fields and anything
+// following the value.
+func Unmarshal(data []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return describe(err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return problem.New("invalid_json", "request body must hold a single JSON value")
+	}
+	return nil
+}
+
+// describe turns a decoding error into a problem naming what is wrong.
+func describe(err error) error {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.Is(err, io.EOF):
+		return problem.New("invalid_body", "request body is empty")
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return problem.New("invalid_json", "request body is truncated")
+	case errors.As(err, &syntaxErr):
+		return problem.Errorf("invalid_json", "malformed JSON at offset %d", syntaxErr.Offset)
+	case errors.As(err, &typeErr):
+		if typeErr.Field == "" {
+			return problem.Errorf("invalid_field", "request body must be %s", typeErr.Type)
+		}
+		return problem.Errorf("invalid_field", "field %s must be %s", typeErr.Field, typeErr.Type)
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		return problem.Errorf("unknown_field", "unknown field %s", strings.TrimPrefix(err.Error(), "json: unknown field "))
+	}
+	return problem.New("invalid_body", err.Error())
+}
@@ -0,0 +1,65 @@
+package jsonbody
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/StepanShel/YandexProject/internal/problem"
+	"github.com/stretchr/testify/assert"
+)
+
+type request struct {
+	Expression string `json:"expression"`
+	Count      int    `json:"count"`
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		body string
+		code int
+		err  string
+	}{
+		{`{"expression": "2+2", "count": 1}`, http.StatusOK, ""},
+		{``, http.StatusBadRequest, "invalid_body"},
+		{`{"expression": "2+2"`, http.StatusBadRequest, "invalid_json"},
+		{`{"expression": 2+2}`, http.StatusBadRequest, "invalid_json"},
+		{`{"expression": "2+2"} {}`, http.StatusBadRequest, "invalid_json"},
+		{`{"expression": "2+2", "expresion": "3"}`, http.StatusBadRequest, "unknown_field"},
+		{`{"count": "one"}`, http.StatusBadRequest, "invalid_field"},
+		{`[]`, http.StatusBadRequest, "invalid_field"},
+		{`{"expression": "` + strings.Repeat("1", 64) + `"}`, http.StatusRequestEntityTooLarge, "body_too_large"},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/", strings.NewReader(tt.body))
+
+		var v request
+		code, err := Decode(w, r, &v, 64)
+		assert.Equal(t, tt.code, code, tt.body)
+		if tt.err == "" {
+			assert.NoError(t, err, tt.body)
+		} else {
+			assert.Equal(t, tt.err, problem.Code(err, code), tt.body)
+		}
+	}
+}
+
+func TestDecodeDefaultLimit(t *testing.T) {
+	for _, limit := range []int64{0, -1} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/", strings.NewReader(`{"expression": "`+strings.Repeat("1", DefaultLimit)+`"}`))
+
+		var v request
+		code, err := Decode(w, r, &v, limit)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, code)
+		assert.Equal(t, "body_too_large", problem.Code(err, code))
+
+		r = httptest.NewRequest("POST", "/", strings.NewReader(`{"expression": "2+2"}`))
+		code, err = Decode(w, r, &v, limit)
+		assert.Equal(t, http.StatusOK, code)
+		assert.NoError(t, err)
+	}
+}
@@ -0,0 +1,150 @@
+// Package problem reports HTTP API errors as RFC 7807 problem details.
+package problem
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// ContentType is the media type of problem responses.
+	ContentType = "application/problem+json"
+	// RequestIDHeader carries the request ID in both directions.
+	RequestIDHeader = "X-Request-ID"
+	// typePrefix prefixes the code to form the problem type URI.
+	typePrefix = "urn:calc:problem:"
+)
+
+// Problem is the body of every error response.
+type Problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	// Code is a stable machine readable name of the error.
+	Code      string `json:"code"`
+	RequestID string `json:"request_id,omitempty"`
+	// Error repeats Detail for clients of the former {"error": ...} bodies.
+	Error string `json:"error"`
+	// Items describes the failures of individual items of a batch request.
+	Items any `json:"items,omitempty"`
+}
+
+// Error is an error with a stable code.
+type Error struct {
+	Code   string
+	Detail string
+	Items  any
+}
+
+func (e *Error) Error() string {
+	return e.Detail
+}
+
+// New returns an error with the given code and detail.
+func New(code, detail string) *Error {
+	return &Error{Code: code, Detail: detail}
+}
+
+// Errorf returns an error with the given code and a formatted detail.
+func Errorf(code, format string, args ...any) *Error {
+	return &Error{Code: code, Detail: fmt.Sprintf(format, args...)}
+}
+
+// Code returns the code of err, falling back to the generic code of status
+// for errors created without one.
+func Code(err error, status int) string {
+	var e *Error
+	if errors.As(err, &e) && e.Code != "" {
+		return e.Code
+	}
+	switch status {
+	case http.StatusBadRequest:
+		return "bad_request"
+	case http.StatusUnauthorized:
+		return "unauthorized"
+	case http.StatusForbidden:
+		return "forbidden"
+	case http.StatusNotFound:
+		return "not_found"
+	case http.StatusMethodNotAllowed:
+		return "method_not_allowed"
+	case http.StatusConflict:
+		return "conflict"
+	case http.StatusRequestEntityTooLarge:
+		return "payload_too_large"
+	case http.StatusUnprocessableEntity:
+		return "unprocessable_entity"
+	case http.StatusTooManyRequests:
+		return "too_many_requests"
+	case http.StatusServiceUnavailable:
+		return "service_unavailable"
+	}
+	if status >= 500 {
+		return "internal_error"
+	}
+	return "error"
+}
+
+// From builds the problem describing err.
+func From(status int, err error) Problem {
+	code := Code(err, status)
+	p := Problem{
+		Type:   typePrefix + code,
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: err.Error(),
+		Code:   code,
+		Error:  err.Error(),
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		p.Items = e.Items
+	}
+	return p
+}
+
+// logf logs server errors; tests replace it.
+var logf = log.Printf
+
+// Write writes err as a problem with the given status. The request ID is
+// taken from the response header set by WithRequestID. Server errors are
+// logged with the request ID, so that clients can refer to them.
+func Write(w http.ResponseWriter, status int, err error) error {
+	p := From(status, err)
+	p.RequestID = w.Header().Get(RequestIDHeader)
+	if status >= 500 {
+		logf("request %s: %d %s", p.RequestID, status, err)
+	}
+
+	w.Header().Set("Content-Type", ContentType)
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(p)
+}
+
+// NotFound answers requests to unknown paths.
+func NotFound(w http.ResponseWriter, r *http.Request) {
+	Write(w, http.StatusNotFound, Errorf("route_not_found", "no route for %s %s", r.Method, r.URL.Path))
+}
+
+// validRequestID limits the request IDs accepted from clients.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+// WithRequestID assigns every request an ID, echoed in the X-Request-ID
+// response header. A well-formed ID sent by the client is kept.
+func WithRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = uuid.NewString()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r)
+	})
+}
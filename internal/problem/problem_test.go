@@ -0,0 +1,84 @@
+package problem
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCode(t *testing.T) {
+	assert.Equal(t, "expression_not_found", Code(New("expression_not_found", "expression not found"), 404))
+	assert.Equal(t, "expression_not_found", Code(fmt.Errorf("wrapped: %w", New("expression_not_found", "x")), 404))
+	assert.Equal(t, "not_found", Code(errors.New("x"), 404))
+	assert.Equal(t, "internal_error", Code(errors.New("x"), 502))
+}
+
+func TestWrite(t *testing.T) {
+	handler := WithRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Write(w, http.StatusConflict, New("username_taken", "user already exists"))
+	}))
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/api/v1/register", nil)
+	req.Header.Set(RequestIDHeader, "client-id.1")
+	handler.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	assert.Equal(t, ContentType, rec.Header().Get("Content-Type"))
+	assert.Equal(t, "client-id.1", rec.Header().Get(RequestIDHeader))
+
+	var p Problem
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &p))
+	assert.Equal(t, Problem{
+		Type:      "urn:calc:problem:username_taken",
+		Title:     "Conflict",
+		Status:    http.StatusConflict,
+		Detail:    "user already exists",
+		Code:      "username_taken",
+		RequestID: "client-id.1",
+		Error:     "user already exists",
+	}, p)
+}
+
+func TestWriteLogsServerErrors(t *testing.T) {
+	var logged []string
+	logf = func(format string, args ...any) { logged = append(logged, fmt.Sprintf(format, args...)) }
+	t.Cleanup(func() { logf = log.Printf })
+
+	handler := WithRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			NotFound(w, r)
+			return
+		}
+		Write(w, http.StatusInternalServerError, errors.New("failed to save expression"))
+	}))
+
+	for _, path := range []string{"/missing", "/calculate"} {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set(RequestIDHeader, "client-id.1")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// Only the server error is logged.
+	assert.Equal(t, []string{"request client-id.1: 500 failed to save expression"}, logged)
+}
+
+func TestWithRequestIDReplacesInvalid(t *testing.T) {
+	handler := WithRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(RequestIDHeader, "bad id\n")
+	handler.ServeHTTP(rec, req)
+
+	id := rec.Header().Get(RequestIDHeader)
+	assert.NotEmpty(t, id)
+	assert.NotEqual(t, "bad id\n", id)
+}
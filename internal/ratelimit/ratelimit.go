@@ -0,0 +1,242 @@
+// Package ratelimit limits how often clients may do something: Limiter
+// keeps a token bucket per key, Lockout locks a key out for exponentially
+// growing periods after repeated failures.
+package ratelimit
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// sweepSize is the number of keys above which idle ones are dropped.
+	// Later sweeps wait until the number of keys has doubled, so that
+	// their cost is spread over the keys added in between.
+	sweepSize = 10000
+	// maxKeys caps the number of keys kept. When it is reached, an
+	// arbitrary key is forgotten to make room for a new one.
+	maxKeys = 1000000
+)
+
+// room tells when a map of keys has to be swept or trimmed.
+type room struct {
+	sweepAt int
+	maxKeys int
+}
+
+// needsSweep reports whether a map holding n keys should be swept before
+// a key is added.
+func (r *room) needsSweep(n int) bool {
+	return n >= max(r.sweepAt, sweepSize)
+}
+
+// swept records that a sweep left n keys.
+func (r *room) swept(n int) {
+	r.sweepAt = 2 * n
+}
+
+// full reports whether a map holding n keys has no room for another one.
+func (r *room) full(n int) bool {
+	return n >= r.maxKeys
+}
+
+// Quota allows PerMinute requests a minute on average and bursts of up to
+// Burst requests. PerMinute must be positive.
+type Quota struct {
+	PerMinute int
+	Burst     int
+}
+
+type bucket struct {
+	tokens float64
+	at     time.Time
+}
+
+// Limiter keeps a token bucket per key. It is safe for concurrent use.
+type Limiter struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	room    room
+	now     func() time.Time
+}
+
+func New() *Limiter {
+	return &Limiter{buckets: make(map[string]*bucket), room: room{maxKeys: maxKeys}, now: time.Now}
+}
+
+// Allow takes a token from the bucket of key. If there is none, it reports
+// how long until there is one.
+func (l *Limiter) Allow(key string, q Quota) (bool, time.Duration) {
+	rate := float64(q.PerMinute) / 60 // tokens per second
+	burst := float64(q.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	b, ok := l.buckets[key]
+	if !ok {
+		if l.room.needsSweep(len(l.buckets)) {
+			l.sweep(now, rate, burst)
+			l.room.swept(len(l.buckets))
+		}
+		if l.room.full(len(l.buckets)) {
+			for key := range l.buckets {
+				delete(l.buckets, key)
+				break
+			}
+		}
+		b = &bucket{tokens: burst, at: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.at).Seconds()*rate)
+	b.at = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	return false, wait
+}
+
+// sweep drops the buckets that have refilled; a missing bucket is full.
+func (l *Limiter) sweep(now time.Time, rate, burst float64) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.at).Seconds()*rate >= burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+type failures struct {
+	count int
+	last  time.Time
+}
+
+// Lockout counts failures per key. After Threshold failures the key is
+// locked for Base, and each further failure doubles the period up to Max.
+// Failures are forgotten after Max without new ones. It is safe for
+// concurrent use.
+type Lockout struct {
+	Threshold int
+	Base      time.Duration
+	Max       time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*failures
+	room    room
+	now     func() time.Time
+}
+
+func NewLockout(threshold int, base, max time.Duration) *Lockout {
+	return &Lockout{
+		Threshold: threshold,
+		Base:      base,
+		Max:       max,
+		entries:   make(map[string]*failures),
+		room:      room{maxKeys: maxKeys},
+		now:       time.Now,
+	}
+}
+
+// Locked reports how long key remains locked out, or 0.
+func (l *Lockout) Locked(key string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	f, ok := l.entries[key]
+	if !ok {
+		return 0
+	}
+	wait := f.last.Add(l.period(f.count)).Sub(l.now())
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+// Fail records a failure of key.
+func (l *Lockout) Fail(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	f, ok := l.entries[key]
+	if !ok {
+		if l.room.needsSweep(len(l.entries)) {
+			for k, f := range l.entries {
+				if now.Sub(f.last) > l.Max {
+					delete(l.entries, k)
+				}
+			}
+			l.room.swept(len(l.entries))
+		}
+		if l.room.full(len(l.entries)) {
+			for k := range l.entries {
+				delete(l.entries, k)
+				break
+			}
+		}
+	}
+	if !ok || now.Sub(f.last) > l.Max {
+		f = &failures{}
+		l.entries[key] = f
+	}
+	f.count++
+	f.last = now
+}
+
+// Reset forgets the failures of key.
+func (l *Lockout) Reset(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.entries, key)
+}
+
+// period is how long a key with count failures is locked for.
+func (l *Lockout) period(count int) time.Duration {
+	if count < l.Threshold {
+		return 0
+	}
+	period := l.Base
+	for i := l.Threshold; i < count && period < l.Max; i++ {
+		period *= 2
+	}
+	return min(period, l.Max)
+}
+
+// ClientIP returns the address of the client. Behind a reverse proxy,
+// trustProxy takes it from the last X-Forwarded-For entry, the one the
+// proxy added; earlier entries are set by the client and cannot be
+// trusted.
+func ClientIP(r *http.Request, trustProxy bool) string {
+	if trustProxy {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			parts := strings.Split(forwarded, ",")
+			if ip := strings.TrimSpace(parts[len(parts)-1]); net.ParseIP(ip) != nil {
+				return ip
+			}
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// RetryAfter formats wait as the value of a Retry-After header: whole
+// seconds, rounded up.
+func RetryAfter(wait time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(wait.Seconds())))
+}
@@ -0,0 +1,154 @@
+package ratelimit
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// clock is a fake time source advanced by the tests.
+type clock struct{ t time.Time }
+
+func (c *clock) now() time.Time          { return c.t }
+func (c *clock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func TestLimiter(t *testing.T) {
+	c := &clock{t: time.Now()}
+	l := New()
+	l.now = c.now
+	quota := Quota{PerMinute: 60, Burst: 3}
+
+	for range 3 {
+		ok, _ := l.Allow("alice", quota)
+		assert.True(t, ok)
+	}
+	ok, wait := l.Allow("alice", quota)
+	assert.False(t, ok)
+	assert.Equal(t, time.Second, wait)
+
+	// Other keys have their own buckets.
+	ok, _ = l.Allow("bob", quota)
+	assert.True(t, ok)
+
+	// Tokens refill at the quota rate, up to the burst.
+	c.advance(time.Second)
+	ok, _ = l.Allow("alice", quota)
+	assert.True(t, ok)
+	ok, _ = l.Allow("alice", quota)
+	assert.False(t, ok)
+
+	c.advance(time.Hour)
+	for range 3 {
+		ok, _ = l.Allow("alice", quota)
+		assert.True(t, ok)
+	}
+	ok, _ = l.Allow("alice", quota)
+	assert.False(t, ok)
+}
+
+func TestLockout(t *testing.T) {
+	c := &clock{t: time.Now()}
+	l := NewLockout(3, time.Minute, 10*time.Minute)
+	l.now = c.now
+
+	for range 2 {
+		l.Fail("alice")
+	}
+	assert.Zero(t, l.Locked("alice"))
+
+	// The lockout doubles with each failure after the threshold, up to Max.
+	for _, want := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute, 10 * time.Minute, 10 * time.Minute} {
+		l.Fail("alice")
+		assert.Equal(t, want, l.Locked("alice"))
+	}
+	assert.Zero(t, l.Locked("bob"))
+
+	c.advance(9 * time.Minute)
+	assert.Equal(t, time.Minute, l.Locked("alice"))
+	c.advance(time.Minute)
+	assert.Zero(t, l.Locked("alice"))
+
+	// Failures are forgotten after Max without new ones.
+	c.advance(time.Minute)
+	l.Fail("alice")
+	assert.Zero(t, l.Locked("alice"))
+
+	for range 3 {
+		l.Fail("bob")
+	}
+	l.Reset("bob")
+	assert.Zero(t, l.Locked("bob"))
+}
+
+func TestLimiterSweep(t *testing.T) {
+	c := &clock{t: time.Now()}
+	l := New()
+	l.now = c.now
+	quota := Quota{PerMinute: 60, Burst: 1}
+
+	// Idle buckets are dropped once there are too many keys...
+	for i := range sweepSize {
+		l.Allow(fmt.Sprint("ip:", i), quota)
+	}
+	c.advance(time.Second)
+	l.Allow("alice", quota)
+	l.Allow("alice", quota)
+	assert.Len(t, l.buckets, 1)
+
+	// ...and the next sweep waits until the map has doubled.
+	for i := range sweepSize {
+		l.Allow(fmt.Sprint("ip:", i), quota)
+	}
+	assert.Len(t, l.buckets, sweepSize+1)
+	assert.False(t, l.room.needsSweep(len(l.buckets)))
+
+	// The number of keys is capped.
+	l = New()
+	l.room.maxKeys = 3
+	for i := range 10 {
+		ok, _ := l.Allow(fmt.Sprint("ip:", i), quota)
+		assert.True(t, ok)
+	}
+	assert.Len(t, l.buckets, 3)
+}
+
+func TestLockoutSweep(t *testing.T) {
+	c := &clock{t: time.Now()}
+	l := NewLockout(3, time.Minute, 10*time.Minute)
+	l.now = c.now
+
+	for i := range sweepSize {
+		l.Fail(fmt.Sprint("user", i))
+	}
+	c.advance(11 * time.Minute)
+	l.Fail("alice")
+	assert.Len(t, l.entries, 1)
+
+	l = NewLockout(3, time.Minute, 10*time.Minute)
+	l.room.maxKeys = 3
+	for i := range 10 {
+		l.Fail(fmt.Sprint("user", i))
+	}
+	assert.Len(t, l.entries, 3)
+}
+
+func TestClientIP(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "192.0.2.1:4321"
+	r.Header.Set("X-Forwarded-For", "10.0.0.1, 198.51.100.7")
+
+	assert.Equal(t, "192.0.2.1", ClientIP(r, false))
+	assert.Equal(t, "198.51.100.7", ClientIP(r, true))
+
+	r.Header.Set("X-Forwarded-For", "not an address")
+	assert.Equal(t, "192.0.2.1", ClientIP(r, true))
+}
+
+func TestRetryAfter(t *testing.T) {
+	assert.Equal(t, "1", RetryAfter(time.Millisecond))
+	assert.Equal(t, "60", RetryAfter(time.Minute))
+	assert.Equal(t, "61", RetryAfter(time.Minute+time.Nanosecond))
+}
@@ -1,19 +1,198 @@
 package repo
 
 import (
+	"time"
+
 	"github.com/google/uuid"
 )
 
+// User roles. Readonly users may only read their own expressions; admins
+// may also manage users and settings and read the expressions of anyone.
+const (
+	RoleUser     = "user"
+	RoleAdmin    = "admin"
+	RoleReadonly = "readonly"
+)
+
+// ValidRole reports whether role is one of the known roles.
+func ValidRole(role string) bool {
+	return role == RoleUser || role == RoleAdmin || role == RoleReadonly
+}
+
 type User struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
+	// ID, Role, Disabled and TokenVersion are never read from requests.
+	ID       string `json:"-"`
+	Role     string `json:"-"`
+	Disabled bool   `json:"-"`
+	// TokenVersion is carried in access tokens; bumping it invalidates
+	// the tokens issued before.
+	TokenVersion int `json:"-"`
+	// TeamID is the team the user belongs to, if any.
+	TeamID string `json:"-"`
+}
+
+// Team is a group of users sharing expressions. Only its owner invites and
+// removes the members.
+type Team struct {
+	ID        uuid.UUID `json:"id"`
+	Name      string    `json:"name"`
+	Owner     string    `json:"owner"`
+	Members   []string  `json:"members"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TeamInvite is an invite for Username to join a team, pending until they
+// accept or decline it.
+type TeamInvite struct {
+	TeamID    uuid.UUID
+	Team      string
+	Owner     string
+	Username  string
+	CreatedAt time.Time
 }
 
+// Expression statuses. pending expressions wait for a free slot; done,
+// error and cancelled are final.
+const (
+	StatusPending    = "pending"
+	StatusProcessing = "processing"
+	StatusDone       = "done"
+	StatusError      = "error"
+	StatusCancelled  = "cancelled"
+)
+
 type Expression struct {
 	ID         uuid.UUID `json:"id"`
 	Username   string    `json:"username"`
 	Expression string    `json:"expression"`
-	Result     int       `json:"result"`
+	Result     float64   `json:"result"`
 	Status     string    `json:"status"`
 	CreatedAt  string    `json:"created_at"`
+	// Constants records the constants the expression was evaluated with.
+	Constants []ConstantUsage `json:"constants,omitempty"`
+	// CallbackURL is notified when the expression reaches a terminal status.
+	CallbackURL string `json:"callback_url,omitempty"`
+	// BatchID is the batch the expression was submitted with, if any.
+	BatchID uuid.UUID `json:"batch_id,omitempty"`
+	// IdempotencyKey is the client supplied key the expression was submitted
+	// with, if any.
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+	// StartedAt and FinishedAt are empty until evaluation starts and ends.
+	StartedAt  string `json:"started_at,omitempty"`
+	FinishedAt string `json:"finished_at,omitempty"`
+	// Error describes why the expression could not be evaluated.
+	Error string `json:"error,omitempty"`
+	// TeamID is the team the expression is shared with, if any.
+	TeamID string `json:"team_id,omitempty"`
+}
+
+// Finished reports whether the expression reached a final status.
+func (e *Expression) Finished() bool {
+	return e.Status == StatusDone || e.Status == StatusError || e.Status == StatusCancelled
+}
+
+// RefreshToken is a long-lived token exchanged for new access tokens. Only
+// the SHA-256 hash of the token is stored.
+type RefreshToken struct {
+	ID        uuid.UUID
+	Username  string
+	TokenHash string
+	ExpiresAt time.Time
+}
+
+// Batch is a group of expressions submitted together. Counts holds the
+// number of its expressions in each status.
+type Batch struct {
+	ID        uuid.UUID      `json:"id"`
+	Username  string         `json:"username"`
+	CreatedAt string         `json:"created_at"`
+	Total     int            `json:"total"`
+	Counts    map[string]int `json:"counts"`
+}
+
+// Constant is an organisation-wide named value usable in expressions.
+type Constant struct {
+	Name      string  `json:"name"`
+	Value     float64 `json:"value"`
+	Version   int     `json:"version"`
+	UpdatedBy string  `json:"updated_by"`
+	UpdatedAt string  `json:"updated_at"`
+}
+
+// ConstantUsage is a constant value as resolved for one expression.
+// Version is 0 for built-in constants.
+type ConstantUsage struct {
+	Name    string  `json:"name"`
+	Value   float64 `json:"value"`
+	Version int     `json:"version"`
+	// Variable marks a value supplied with the expression itself.
+	Variable bool `json:"variable,omitempty"`
+}
+
+// WebhookAttempt is one try to deliver an expression result to its
+// callback URL.
+type WebhookAttempt struct {
+	ExpressionID uuid.UUID `json:"expression_id"`
+	URL          string    `json:"url"`
+	Attempt      int       `json:"attempt"`
+	StatusCode   int       `json:"status_code"`
+	Error        string    `json:"error,omitempty"`
+	Delivered    bool      `json:"delivered"`
+	CreatedAt    string    `json:"created_at"`
+}
+
+// ExpressionFilter selects a page of a user's expressions.
+type ExpressionFilter struct {
+	Username string
+	// Statuses limits the result to these statuses when not empty.
+	Statuses []string
+	// From and To bound the creation time, To being exclusive. Zero values
+	// leave the range open.
+	From, To time.Time
+	// Search matches a substring of the expression text.
+	Search    string
+	Ascending bool
+	// Limit is the page size; zero or less lists everything at once.
+	Limit int
+	// After continues the listing after the position of a previous page.
+	After *Cursor
+	// BatchID limits the result to one batch when set.
+	BatchID uuid.UUID
+	// Scope selects whose expressions are listed, ScopeOwn by default.
+	// TeamID is the team of Username.
+	Scope  string
+	TeamID string
+}
+
+// Listing scopes: the expressions of the user, those shared with their
+// team, or those of others shared with the user or their team.
+const (
+	ScopeOwn    = "own"
+	ScopeTeam   = "team"
+	ScopeShared = "shared"
+)
+
+// Cursor is the position of an expression in a listing.
+type Cursor struct {
+	CreatedAt time.Time
+	ID        uuid.UUID
+}
+
+// APIKey is a long-lived key authenticating requests of its user instead of
+// an access token. Only the SHA-256 hash of the key is stored; Prefix is the
+// beginning of the key, shown to tell keys apart.
+type APIKey struct {
+	ID        uuid.UUID
+	Username  string
+	Name      string
+	Prefix    string
+	KeyHash   string
+	Scopes    []string
+	CreatedAt time.Time
+	// LastUsedAt is zero until the key is used, ExpiresAt for keys that
+	// do not expire.
+	LastUsedAt time.Time
+	ExpiresAt  time.Time
 }
@@ -2,10 +2,14 @@ package repo
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -14,7 +18,12 @@ type Repo struct {
 }
 
 func NewRepository() (*Repo, error) {
-	db, err := sql.Open("sqlite3", "math")
+	return Open("math")
+}
+
+// Open opens the SQLite database at path, creating the tables if needed.
+func Open(path string) (*Repo, error) {
+	db, err := sql.Open("sqlite3", path)
 	if err != nil {
 		return nil, err
 	}
@@ -38,29 +47,287 @@ func createTables(db *sql.DB) error {
 		return err
 	}
 
+	if err := addColumn(db, "users", "role", "TEXT NOT NULL DEFAULT '"+RoleUser+"'"); err != nil {
+		return err
+	}
+
+	if err := addColumn(db, "users", "disabled_at", "TIMESTAMP"); err != nil {
+		return err
+	}
+
+	if err := addColumn(db, "users", "token_version", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+
+	// The id tells a deleted user from a new one registered under the same
+	// name, so that tokens of the deleted user are not accepted.
+	if err := addColumn(db, "users", "id", "TEXT"); err != nil {
+		return err
+	}
+	if _, err := db.Exec("UPDATE users SET id = lower(hex(randomblob(16))) WHERE id IS NULL"); err != nil {
+		return err
+	}
+
+	// Users belong to at most one team.
+	if err := addColumn(db, "users", "team_id", "TEXT"); err != nil {
+		return err
+	}
+
 	_, err = db.Exec(`
         CREATE TABLE IF NOT EXISTS expressions (
             id TEXT PRIMARY KEY,
             username TEXT NOT NULL,
             expression TEXT NOT NULL,
-            result INTEGER,
+            result REAL,
             status TEXT NOT NULL,
             created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
             FOREIGN KEY(username) REFERENCES users(username)
         )
     `)
 
+	if err != nil {
+		return err
+	}
+
+	if err := addColumn(db, "expressions", "constants", "TEXT"); err != nil {
+		return err
+	}
+
+	if err := addColumn(db, "expressions", "callback_url", "TEXT"); err != nil {
+		return err
+	}
+
+	if err := addColumn(db, "expressions", "deleted_at", "TIMESTAMP"); err != nil {
+		return err
+	}
+
+	if err := addColumn(db, "expressions", "batch_id", "TEXT"); err != nil {
+		return err
+	}
+
+	if err := addColumn(db, "expressions", "idempotency_key", "TEXT"); err != nil {
+		return err
+	}
+
+	if err := addColumn(db, "expressions", "started_at", "TIMESTAMP"); err != nil {
+		return err
+	}
+
+	if err := addColumn(db, "expressions", "finished_at", "TIMESTAMP"); err != nil {
+		return err
+	}
+
+	if err := addColumn(db, "expressions", "error", "TEXT"); err != nil {
+		return err
+	}
+
+	// team_id is the team the expression is shared with, read-only.
+	if err := addColumn(db, "expressions", "team_id", "TEXT"); err != nil {
+		return err
+	}
+	if _, err := db.Exec("CREATE INDEX IF NOT EXISTS idx_expressions_team ON expressions (team_id)"); err != nil {
+		return err
+	}
+
+	// Older versions stored "DONE" for evaluated expressions.
+	if _, err := db.Exec("UPDATE expressions SET status = ? WHERE status = 'DONE'", StatusDone); err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS batches (
+            id TEXT PRIMARY KEY,
+            username TEXT NOT NULL,
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            FOREIGN KEY(username) REFERENCES users(username)
+        )
+    `)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+        CREATE INDEX IF NOT EXISTS idx_expressions_batch
+            ON expressions (batch_id);
+        CREATE INDEX IF NOT EXISTS idx_expressions_idempotency
+            ON expressions (username, idempotency_key, created_at)
+            WHERE idempotency_key IS NOT NULL;
+        CREATE INDEX IF NOT EXISTS idx_expressions_user_created
+            ON expressions (username, created_at, id);
+        CREATE INDEX IF NOT EXISTS idx_expressions_user_status
+            ON expressions (username, status, created_at, id)
+    `)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS constants (
+            name TEXT PRIMARY KEY,
+            value REAL NOT NULL,
+            version INTEGER NOT NULL DEFAULT 1,
+            updated_by TEXT NOT NULL,
+            updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+        )
+    `)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS webhook_deliveries (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            expression_id TEXT NOT NULL,
+            url TEXT NOT NULL,
+            attempt INTEGER NOT NULL,
+            status_code INTEGER NOT NULL DEFAULT 0,
+            error TEXT NOT NULL DEFAULT '',
+            delivered BOOLEAN NOT NULL,
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            FOREIGN KEY(expression_id) REFERENCES expressions(id)
+        )
+    `)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS refresh_tokens (
+            id TEXT PRIMARY KEY,
+            username TEXT NOT NULL,
+            token_hash TEXT UNIQUE NOT NULL,
+            expires_at TIMESTAMP NOT NULL,
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            revoked_at TIMESTAMP,
+            replaced_by TEXT,
+            FOREIGN KEY(username) REFERENCES users(username)
+        );
+        CREATE INDEX IF NOT EXISTS idx_refresh_tokens_user
+            ON refresh_tokens (username);
+        CREATE TABLE IF NOT EXISTS revoked_tokens (
+            jti TEXT PRIMARY KEY,
+            expires_at TIMESTAMP NOT NULL
+        )
+    `)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS api_keys (
+            id TEXT PRIMARY KEY,
+            username TEXT NOT NULL,
+            name TEXT NOT NULL,
+            prefix TEXT NOT NULL,
+            key_hash TEXT UNIQUE NOT NULL,
+            scopes TEXT NOT NULL,
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            last_used_at TIMESTAMP,
+            expires_at TIMESTAMP,
+            revoked_at TIMESTAMP,
+            FOREIGN KEY(username) REFERENCES users(username)
+        );
+        CREATE INDEX IF NOT EXISTS idx_api_keys_user
+            ON api_keys (username)
+    `)
+	if err != nil {
+		return err
+	}
+
+	// Teams, the invites to join them and the expressions shared with
+	// particular users; expressions shared with a team carry its id in
+	// expressions.team_id.
+	_, err = db.Exec(`
+        CREATE TABLE IF NOT EXISTS teams (
+            id TEXT PRIMARY KEY,
+            name TEXT UNIQUE NOT NULL,
+            owner TEXT NOT NULL,
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            FOREIGN KEY(owner) REFERENCES users(username)
+        );
+        CREATE TABLE IF NOT EXISTS expression_shares (
+            expression_id TEXT NOT NULL,
+            username TEXT NOT NULL,
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            PRIMARY KEY (expression_id, username),
+            FOREIGN KEY(expression_id) REFERENCES expressions(id)
+        );
+        CREATE INDEX IF NOT EXISTS idx_expression_shares_user
+            ON expression_shares (username);
+        CREATE TABLE IF NOT EXISTS team_invites (
+            team_id TEXT NOT NULL,
+            username TEXT NOT NULL,
+            created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+            PRIMARY KEY (team_id, username),
+            FOREIGN KEY(team_id) REFERENCES teams(id)
+        );
+        CREATE INDEX IF NOT EXISTS idx_team_invites_user
+            ON team_invites (username)
+    `)
+
+	return err
+}
+
+// addColumn adds a column to an existing table unless it is already there,
+// so that databases created by older versions keep working.
+func addColumn(db *sql.DB, table, column, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			ctype     string
+			notNull   int
+			dfltValue sql.NullString
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &ctype, &notNull, &dfltValue, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
 	return err
 }
 
 // Users methods
 // ------------------------------------------------------------------------//
 
+// ErrUserExists is returned by InsertUser when the username is taken.
+var ErrUserExists = errors.New("user already exists")
+
+// ErrUserDisabled is returned for accounts disabled by an admin.
+var ErrUserDisabled = errors.New("user is disabled")
+
+// InsertUser stores a new user with a hash of the password. An empty role
+// means RoleUser.
 func (r *Repo) InsertUser(user User) error {
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	if user.Role == "" {
+		user.Role = RoleUser
+	}
 	_, err = r.db.Exec(
-		"INSERT INTO users (username, password) VALUES ($1, $2)",
-		user.Username, string(hashedPassword))
+		"INSERT INTO users (id, username, password, role) VALUES ($1, $2, $3, $4)",
+		uuid.NewString(), user.Username, string(hashedPassword), user.Role)
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
+		return ErrUserExists
+	}
 	return err
 }
 
@@ -99,77 +366,1207 @@ func (r *Repo) Authenticate(username, password string) (bool, error) {
 	return err == nil, nil
 }
 
-// ------------------------------------------------------------------------//
-
-// Expressions methods
-// ------------------------------------------------------------------------//
+const userColumns = "id, username, role, disabled_at IS NOT NULL, token_version, COALESCE(team_id, '')"
 
-func (r *Repo) CreateExpression(expr *Expression) error {
-	expr.ID = uuid.New()
-	_, err := r.db.Exec(
-		"INSERT INTO expressions (id, username, expression, result, status) VALUES ($1, $2, $3, 0, $4)",
-		expr.ID.String(), expr.Username, expr.Expression, expr.Status)
-	return err
+func scanUser(row rowScanner) (*User, error) {
+	var user User
+	if err := row.Scan(&user.ID, &user.Username, &user.Role, &user.Disabled, &user.TokenVersion, &user.TeamID); err != nil {
+		return nil, err
+	}
+	return &user, nil
 }
 
-func (r *Repo) UpdateExpressionResult(id uuid.UUID, result int, status string) error {
-	_, err := r.db.Exec(
-		"UPDATE expressions SET result = $1, status = $2 WHERE id = $3",
-		result, status, id.String())
-	fmt.Println(err)
-	return err
+// GetUserByName returns the user without the password. It returns
+// sql.ErrNoRows if there is no such user.
+func (r *Repo) GetUserByName(username string) (*User, error) {
+	return scanUser(r.db.QueryRow(
+		"SELECT "+userColumns+" FROM users WHERE username = $1", username))
 }
 
-func (r *Repo) GetExpressions(username string) ([]Expression, error) {
-	rows, err := r.db.Query(
-		`SELECT id, username, expression, 
-         COALESCE(result, 0) as result,  
-         status, created_at 
-         FROM expressions WHERE username = ?`,
-		username)
+// ListUsers returns all users ordered by name, without their passwords.
+func (r *Repo) ListUsers() ([]User, error) {
+	rows, err := r.db.Query("SELECT " + userColumns + " FROM users ORDER BY username")
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var expressions []Expression
+	users := []User{}
 	for rows.Next() {
-		var expr Expression
-		var idStr string
-
-		err := rows.Scan(&idStr, &expr.Username, &expr.Expression, &expr.Result, &expr.Status, &expr.CreatedAt)
+		user, err := scanUser(rows)
 		if err != nil {
 			return nil, err
 		}
+		users = append(users, *user)
+	}
+	return users, rows.Err()
+}
 
-		expr.ID, err = uuid.Parse(idStr)
-		if err != nil {
-			return nil, err
+// SetUserRole changes the role of the user. Access tokens issued before
+// carry the old role and stop being accepted; refresh tokens keep working
+// and get tokens with the new role. It returns sql.ErrNoRows if there is
+// no such user.
+func (r *Repo) SetUserRole(username, role string) error {
+	res, err := r.db.Exec(
+		`UPDATE users SET role = $1,
+             token_version = token_version + (role != $1)
+         WHERE username = $2`,
+		role, username)
+	if err != nil {
+		return err
+	}
+	return requireRow(res)
+}
+
+// SetUserDisabled disables or re-enables the user. Disabling ends all
+// sessions of the user. It returns sql.ErrNoRows if there is no such user.
+func (r *Repo) SetUserDisabled(username string, disabled bool) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := "UPDATE users SET disabled_at = NULL WHERE username = $1"
+	if disabled {
+		query = `UPDATE users SET disabled_at = COALESCE(disabled_at, CURRENT_TIMESTAMP),
+                     token_version = token_version + 1
+                 WHERE username = $1`
+	}
+	res, err := tx.Exec(query, username)
+	if err != nil {
+		return err
+	}
+	if err := requireRow(res); err != nil {
+		return err
+	}
+
+	if disabled {
+		if err := revokeRefreshTokens(tx, username); err != nil {
+			return err
 		}
+	}
+
+	return tx.Commit()
+}
+
+// SetPassword replaces the password of the user, ends all sessions of the
+// user and revokes their API keys. It returns sql.ErrNoRows if there is no
+// such user.
+func (r *Repo) SetPassword(username, password string) error {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
 
-		expressions = append(expressions, expr)
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
 	}
+	defer tx.Rollback()
 
-	return expressions, nil
+	res, err := tx.Exec(
+		"UPDATE users SET password = $1, token_version = token_version + 1 WHERE username = $2",
+		string(hashedPassword), username)
+	if err != nil {
+		return err
+	}
+	if err := requireRow(res); err != nil {
+		return err
+	}
+
+	if err := revokeRefreshTokens(tx, username); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(
+		"UPDATE api_keys SET revoked_at = CURRENT_TIMESTAMP WHERE username = $1 AND revoked_at IS NULL",
+		username); err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
-func (r *Repo) GetExpressionByID(id uuid.UUID) (*Expression, error) {
+// DeleteUser removes the user with their expressions, batches, tokens, API
+// keys and the team they own. It returns sql.ErrNoRows if there is no such
+// user.
+func (r *Repo) DeleteUser(username string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, query := range []string{
+		"DELETE FROM expression_shares WHERE username = $1 OR expression_id IN (SELECT id FROM expressions WHERE username = $1)",
+		"DELETE FROM team_invites WHERE username = $1 OR team_id IN (SELECT id FROM teams WHERE owner = $1)",
+		"UPDATE expressions SET team_id = NULL WHERE team_id IN (SELECT id FROM teams WHERE owner = $1)",
+		"UPDATE users SET team_id = NULL WHERE team_id IN (SELECT id FROM teams WHERE owner = $1)",
+		"DELETE FROM teams WHERE owner = $1",
+		"DELETE FROM webhook_deliveries WHERE expression_id IN (SELECT id FROM expressions WHERE username = $1)",
+		"DELETE FROM expressions WHERE username = $1",
+		"DELETE FROM batches WHERE username = $1",
+		"DELETE FROM refresh_tokens WHERE username = $1",
+		"DELETE FROM api_keys WHERE username = $1",
+	} {
+		if _, err := tx.Exec(query, username); err != nil {
+			return err
+		}
+	}
+
+	res, err := tx.Exec("DELETE FROM users WHERE username = $1", username)
+	if err != nil {
+		return err
+	}
+	if err := requireRow(res); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// requireRow returns sql.ErrNoRows if res affected no rows.
+func requireRow(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ------------------------------------------------------------------------//
+
+// Expressions methods
+// ------------------------------------------------------------------------//
+
+// expressionColumns are read by scanExpression, in this order.
+const expressionColumns = `id, username, expression, COALESCE(result, 0), status, created_at,
+         COALESCE(constants, ''), COALESCE(callback_url, ''), COALESCE(batch_id, ''),
+         COALESCE(idempotency_key, ''), started_at, finished_at, COALESCE(error, ''), COALESCE(team_id, '')`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanExpression(row rowScanner) (*Expression, error) {
 	var expr Expression
-	var idStr, username string
+	var idStr, constants, batchID string
+	var startedAt, finishedAt sql.NullString
 
-	err := r.db.QueryRow(
-		"SELECT id, username, expression, result, status, created_at FROM expressions WHERE id = ?",
-		id.String()).Scan(&idStr, &username, &expr.Expression, &expr.Result, &expr.Status, &expr.CreatedAt)
+	err := row.Scan(&idStr, &expr.Username, &expr.Expression, &expr.Result, &expr.Status, &expr.CreatedAt,
+		&constants, &expr.CallbackURL, &batchID, &expr.IdempotencyKey, &startedAt, &finishedAt, &expr.Error, &expr.TeamID)
 	if err != nil {
 		return nil, err
 	}
+	expr.StartedAt, expr.FinishedAt = startedAt.String, finishedAt.String
 
 	expr.ID, err = uuid.Parse(idStr)
 	if err != nil {
 		return nil, err
 	}
 
+	if batchID != "" {
+		if expr.BatchID, err = uuid.Parse(batchID); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := decodeConstants(constants, &expr); err != nil {
+		return nil, err
+	}
+
 	return &expr, nil
 }
 
+func (r *Repo) CreateExpression(expr *Expression) error {
+	if expr.ID == uuid.Nil {
+		expr.ID = uuid.New()
+	}
+	idempotencyKey := sql.NullString{String: expr.IdempotencyKey, Valid: expr.IdempotencyKey != ""}
+	_, err := r.db.Exec(
+		"INSERT INTO expressions (id, username, expression, result, status, callback_url, idempotency_key) VALUES ($1, $2, $3, 0, $4, $5, $6)",
+		expr.ID.String(), expr.Username, expr.Expression, expr.Status, expr.CallbackURL, idempotencyKey)
+	return err
+}
+
+// StartExpression marks the expression as being evaluated.
+func (r *Repo) StartExpression(id uuid.UUID) error {
+	_, err := r.db.Exec(
+		"UPDATE expressions SET status = $1, started_at = CURRENT_TIMESTAMP WHERE id = $2",
+		StatusProcessing, id.String())
+	return err
+}
+
+// FinishExpression stores the final status of the expression with its result
+// or the reason it failed.
+func (r *Repo) FinishExpression(id uuid.UUID, result float64, status, errMsg string) error {
+	_, err := r.db.Exec(
+		"UPDATE expressions SET result = $1, status = $2, error = $3, finished_at = CURRENT_TIMESTAMP WHERE id = $4",
+		result, status, errMsg, id.String())
+	return err
+}
+
+func (r *Repo) GetExpressions(username string) ([]Expression, error) {
+	rows, err := r.db.Query(
+		"SELECT "+expressionColumns+" FROM expressions WHERE username = ? AND deleted_at IS NULL",
+		username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var expressions []Expression
+	for rows.Next() {
+		expr, err := scanExpression(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		expressions = append(expressions, *expr)
+	}
+
+	return expressions, nil
+}
+
+// ListExpressions returns one page of the expressions in the scope of the
+// filter matching it, ordered by creation time, and the cursor of the next
+// page, which is nil on the last page.
+func (r *Repo) ListExpressions(filter ExpressionFilter) ([]Expression, *Cursor, error) {
+	var where []string
+	var args []any
+	switch filter.Scope {
+	case ScopeTeam:
+		where = []string{"team_id = ?"}
+		args = []any{filter.TeamID}
+	case ScopeShared:
+		where = []string{"username != ?", "(team_id = ? OR id IN (SELECT expression_id FROM expression_shares WHERE username = ?))"}
+		args = []any{filter.Username, filter.TeamID, filter.Username}
+	default:
+		where = []string{"username = ?"}
+		args = []any{filter.Username}
+	}
+	where = append(where, "deleted_at IS NULL")
+
+	if len(filter.Statuses) > 0 {
+		where = append(where, "status IN (?"+strings.Repeat(", ?", len(filter.Statuses)-1)+")")
+		for _, status := range filter.Statuses {
+			args = append(args, status)
+		}
+	}
+	if !filter.From.IsZero() {
+		where = append(where, "created_at >= ?")
+		args = append(args, formatTimestamp(filter.From))
+	}
+	if !filter.To.IsZero() {
+		where = append(where, "created_at < ?")
+		args = append(args, formatTimestamp(filter.To))
+	}
+	if filter.BatchID != uuid.Nil {
+		where = append(where, "batch_id = ?")
+		args = append(args, filter.BatchID.String())
+	}
+	if filter.Search != "" {
+		where = append(where, `expression LIKE ? ESCAPE '\'`)
+		args = append(args, "%"+likeEscaper.Replace(filter.Search)+"%")
+	}
+
+	order, cmp := "DESC", "<"
+	if filter.Ascending {
+		order, cmp = "ASC", ">"
+	}
+	if filter.After != nil {
+		where = append(where, "(created_at, id) "+cmp+" (?, ?)")
+		args = append(args, formatTimestamp(filter.After.CreatedAt), filter.After.ID.String())
+	}
+
+	// One extra row tells whether there is a next page. SQLite takes a
+	// negative limit as none.
+	limit := -1
+	if filter.Limit > 0 {
+		limit = filter.Limit + 1
+	}
+	args = append(args, limit)
+	rows, err := r.db.Query(
+		"SELECT "+expressionColumns+" FROM expressions WHERE "+strings.Join(where, " AND ")+
+			" ORDER BY created_at "+order+", id "+order+" LIMIT ?",
+		args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var expressions []Expression
+	for rows.Next() {
+		expr, err := scanExpression(rows)
+		if err != nil {
+			return nil, nil, err
+		}
+		expressions = append(expressions, *expr)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	if filter.Limit <= 0 || len(expressions) <= filter.Limit {
+		return expressions, nil, nil
+	}
+
+	expressions = expressions[:filter.Limit]
+	last := expressions[len(expressions)-1]
+	createdAt, err := time.Parse(time.RFC3339Nano, last.CreatedAt)
+	if err != nil {
+		return nil, nil, err
+	}
+	return expressions, &Cursor{CreatedAt: createdAt, ID: last.ID}, nil
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// formatTimestamp formats t the way SQLite stores CURRENT_TIMESTAMP.
+func formatTimestamp(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05")
+}
+
+func (r *Repo) GetExpressionByID(id uuid.UUID) (*Expression, error) {
+	return scanExpression(r.db.QueryRow(
+		"SELECT "+expressionColumns+" FROM expressions WHERE id = ? AND deleted_at IS NULL",
+		id.String()))
+}
+
+// GetExpressionByIdempotencyKey returns the latest expression the user
+// submitted with key since the given time, or sql.ErrNoRows.
+func (r *Repo) GetExpressionByIdempotencyKey(username, key string, since time.Time) (*Expression, error) {
+	return scanExpression(r.db.QueryRow(
+		"SELECT "+expressionColumns+` FROM expressions
+         WHERE username = ? AND idempotency_key = ? AND created_at >= ? AND deleted_at IS NULL
+         ORDER BY created_at DESC LIMIT 1`,
+		username, key, formatTimestamp(since)))
+}
+
+// DeleteExpression hides the expression from all queries. The row is kept
+// so that the delivery history of webhooks stays consistent.
+func (r *Repo) DeleteExpression(id uuid.UUID) error {
+	res, err := r.db.Exec(
+		"UPDATE expressions SET deleted_at = CURRENT_TIMESTAMP WHERE id = $1 AND deleted_at IS NULL",
+		id.String())
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// CreateBatch stores the batch and all of its expressions in one
+// transaction, so that either all of them are saved or none is.
+func (r *Repo) CreateBatch(batch *Batch, exprs []*Expression) error {
+	if batch.ID == uuid.Nil {
+		batch.ID = uuid.New()
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(
+		"INSERT INTO batches (id, username) VALUES ($1, $2)",
+		batch.ID.String(), batch.Username); err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare(
+		`INSERT INTO expressions (id, username, expression, result, status, callback_url, constants, batch_id)
+         VALUES ($1, $2, $3, 0, $4, $5, $6, $7)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, expr := range exprs {
+		if expr.ID == uuid.Nil {
+			expr.ID = uuid.New()
+		}
+		expr.BatchID = batch.ID
+
+		var constants sql.NullString
+		if len(expr.Constants) > 0 {
+			data, err := json.Marshal(expr.Constants)
+			if err != nil {
+				return err
+			}
+			constants = sql.NullString{String: string(data), Valid: true}
+		}
+
+		if _, err := stmt.Exec(expr.ID.String(), expr.Username, expr.Expression, expr.Status,
+			expr.CallbackURL, constants, batch.ID.String()); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetBatch returns the batch with the number of its expressions in each
+// status. Deleted expressions are not counted.
+func (r *Repo) GetBatch(id uuid.UUID) (*Batch, error) {
+	batch := Batch{ID: id, Counts: make(map[string]int)}
+	err := r.db.QueryRow(
+		"SELECT username, created_at FROM batches WHERE id = $1",
+		id.String()).Scan(&batch.Username, &batch.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := r.db.Query(
+		"SELECT status, COUNT(*) FROM expressions WHERE batch_id = $1 AND deleted_at IS NULL GROUP BY status",
+		id.String())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var status string
+		var count int
+		if err := rows.Scan(&status, &count); err != nil {
+			return nil, err
+		}
+		batch.Counts[status] = count
+		batch.Total += count
+	}
+
+	return &batch, rows.Err()
+}
+
+// SetExpressionConstants records the constants an expression was resolved with.
+func (r *Repo) SetExpressionConstants(id uuid.UUID, constants []ConstantUsage) error {
+	data, err := json.Marshal(constants)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.db.Exec(
+		"UPDATE expressions SET constants = $1 WHERE id = $2",
+		string(data), id.String())
+	return err
+}
+
+func decodeConstants(data string, expr *Expression) error {
+	if data == "" {
+		return nil
+	}
+	return json.Unmarshal([]byte(data), &expr.Constants)
+}
+
+//------------------------------------------------------------------------//
+
+// Constants methods
+// ------------------------------------------------------------------------//
+
+func (r *Repo) GetConstants() ([]Constant, error) {
+	rows, err := r.db.Query(
+		"SELECT name, value, version, updated_by, updated_at FROM constants ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var constants []Constant
+	for rows.Next() {
+		var c Constant
+		if err := rows.Scan(&c.Name, &c.Value, &c.Version, &c.UpdatedBy, &c.UpdatedAt); err != nil {
+			return nil, err
+		}
+		constants = append(constants, c)
+	}
+
+	return constants, rows.Err()
+}
+
+// SetConstant creates a constant or updates its value, bumping the version.
+func (r *Repo) SetConstant(name string, value float64, updatedBy string) (*Constant, error) {
+	_, err := r.db.Exec(
+		`INSERT INTO constants (name, value, version, updated_by) VALUES ($1, $2, 1, $3)
+         ON CONFLICT(name) DO UPDATE SET
+             value = excluded.value,
+             version = constants.version + 1,
+             updated_by = excluded.updated_by,
+             updated_at = CURRENT_TIMESTAMP`,
+		name, value, updatedBy)
+	if err != nil {
+		return nil, err
+	}
+
+	var c Constant
+	err = r.db.QueryRow(
+		"SELECT name, value, version, updated_by, updated_at FROM constants WHERE name = ?",
+		name).Scan(&c.Name, &c.Value, &c.Version, &c.UpdatedBy, &c.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+func (r *Repo) DeleteConstant(name string) error {
+	res, err := r.db.Exec("DELETE FROM constants WHERE name = ?", name)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+//------------------------------------------------------------------------//
+
+// Webhook methods
+// ------------------------------------------------------------------------//
+
+func (r *Repo) InsertWebhookAttempt(attempt WebhookAttempt) error {
+	_, err := r.db.Exec(
+		`INSERT INTO webhook_deliveries (expression_id, url, attempt, status_code, error, delivered)
+         VALUES ($1, $2, $3, $4, $5, $6)`,
+		attempt.ExpressionID.String(), attempt.URL, attempt.Attempt, attempt.StatusCode, attempt.Error, attempt.Delivered)
+	return err
+}
+
+func (r *Repo) GetWebhookAttempts(expressionID uuid.UUID) ([]WebhookAttempt, error) {
+	rows, err := r.db.Query(
+		`SELECT expression_id, url, attempt, status_code, error, delivered, created_at
+         FROM webhook_deliveries WHERE expression_id = ? ORDER BY id`,
+		expressionID.String())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var attempts []WebhookAttempt
+	for rows.Next() {
+		var a WebhookAttempt
+		var idStr string
+		if err := rows.Scan(&idStr, &a.URL, &a.Attempt, &a.StatusCode, &a.Error, &a.Delivered, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		if a.ExpressionID, err = uuid.Parse(idStr); err != nil {
+			return nil, err
+		}
+		attempts = append(attempts, a)
+	}
+
+	return attempts, rows.Err()
+}
+
+//------------------------------------------------------------------------//
+
+// Token methods
+// ------------------------------------------------------------------------//
+
+var (
+	// ErrTokenInvalid is returned for unknown, expired or revoked refresh
+	// tokens.
+	ErrTokenInvalid = errors.New("invalid refresh token")
+	// ErrTokenReused is returned when a refresh token is presented again
+	// after it was exchanged. One of the user's tokens has leaked then, so
+	// all of them are revoked.
+	ErrTokenReused = errors.New("refresh token reused")
+)
+
+func (r *Repo) CreateRefreshToken(token *RefreshToken) error {
+	if token.ID == uuid.Nil {
+		token.ID = uuid.New()
+	}
+	_, err := r.db.Exec(
+		"INSERT INTO refresh_tokens (id, username, token_hash, expires_at) VALUES ($1, $2, $3, $4)",
+		token.ID.String(), token.Username, token.TokenHash, formatTimestamp(token.ExpiresAt))
+	return err
+}
+
+// RotateRefreshToken exchanges the refresh token with the given hash for
+// next, which is stored for the same user. The old token cannot be used
+// again: presenting it once more, even in a concurrent exchange, revokes
+// every token of the user and returns ErrTokenReused.
+func (r *Repo) RotateRefreshToken(hash string, next *RefreshToken) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var (
+		id, username string
+		live         bool
+		revoked      bool
+		replacedBy   sql.NullString
+	)
+	err = tx.QueryRow(
+		`SELECT id, username, expires_at > $1, revoked_at IS NOT NULL, replaced_by
+         FROM refresh_tokens WHERE token_hash = $2`,
+		formatTimestamp(time.Now()), hash).Scan(&id, &username, &live, &revoked, &replacedBy)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrTokenInvalid
+	}
+	if err != nil {
+		return err
+	}
+
+	if revoked {
+		if !replacedBy.Valid {
+			return ErrTokenInvalid
+		}
+		if err := revokeRefreshTokens(tx, username); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		return ErrTokenReused
+	}
+	if !live {
+		return ErrTokenInvalid
+	}
+
+	if next.ID == uuid.Nil {
+		next.ID = uuid.New()
+	}
+	next.Username = username
+	if _, err := tx.Exec(
+		"INSERT INTO refresh_tokens (id, username, token_hash, expires_at) VALUES ($1, $2, $3, $4)",
+		next.ID.String(), next.Username, next.TokenHash, formatTimestamp(next.ExpiresAt)); err != nil {
+		return err
+	}
+	res, err := tx.Exec(
+		"UPDATE refresh_tokens SET revoked_at = CURRENT_TIMESTAMP, replaced_by = $1 WHERE id = $2 AND revoked_at IS NULL",
+		next.ID.String(), id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n != 1 {
+		// The token was rotated or revoked since it was read: drop the new
+		// token and treat the request as reuse.
+		if err := tx.Rollback(); err != nil {
+			return err
+		}
+		if err := revokeRefreshTokens(r.db, username); err != nil {
+			return err
+		}
+		return ErrTokenReused
+	}
+
+	return tx.Commit()
+}
+
+// execer is implemented by both *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// querier is implemented by both *sql.DB and *sql.Tx.
+type querier interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+// revokeRefreshTokens revokes every refresh token of the user.
+func revokeRefreshTokens(db execer, username string) error {
+	_, err := db.Exec(
+		"UPDATE refresh_tokens SET revoked_at = CURRENT_TIMESTAMP WHERE username = $1 AND revoked_at IS NULL",
+		username)
+	return err
+}
+
+// RevokeRefreshToken revokes the user's refresh token with the given hash.
+// It returns ErrTokenInvalid if there is no such unrevoked token.
+func (r *Repo) RevokeRefreshToken(username, hash string) error {
+	res, err := r.db.Exec(
+		`UPDATE refresh_tokens SET revoked_at = CURRENT_TIMESTAMP
+         WHERE username = $1 AND token_hash = $2 AND revoked_at IS NULL`,
+		username, hash)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrTokenInvalid
+	}
+	return nil
+}
+
+// RevokeToken adds the access token with the given ID to the revocation
+// list until it expires. Entries of tokens that expired are dropped.
+func (r *Repo) RevokeToken(jti string, expiresAt time.Time) error {
+	if _, err := r.db.Exec(
+		"DELETE FROM revoked_tokens WHERE expires_at <= $1",
+		formatTimestamp(time.Now())); err != nil {
+		return err
+	}
+
+	_, err := r.db.Exec(
+		"INSERT OR IGNORE INTO revoked_tokens (jti, expires_at) VALUES ($1, $2)",
+		jti, formatTimestamp(expiresAt))
+	return err
+}
+
+func (r *Repo) IsTokenRevoked(jti string) (bool, error) {
+	var revoked bool
+	err := r.db.QueryRow(
+		"SELECT EXISTS (SELECT 1 FROM revoked_tokens WHERE jti = $1)", jti).Scan(&revoked)
+	return revoked, err
+}
+
+//------------------------------------------------------------------------//
+
+// API key methods
+// ------------------------------------------------------------------------//
+
+// ErrAPIKeyInvalid is returned for unknown, expired or revoked API keys.
+var ErrAPIKeyInvalid = errors.New("invalid API key")
+
+// apiKeyTouchInterval limits how often the last use of a key is recorded.
+const apiKeyTouchInterval = time.Minute
+
+const apiKeyColumns = "id, username, name, prefix, scopes, created_at, last_used_at, expires_at"
+
+func scanAPIKey(row rowScanner) (*APIKey, error) {
+	var key APIKey
+	var idStr, scopes string
+	var lastUsedAt, expiresAt sql.NullTime
+
+	err := row.Scan(&idStr, &key.Username, &key.Name, &key.Prefix, &scopes, &key.CreatedAt, &lastUsedAt, &expiresAt)
+	if err != nil {
+		return nil, err
+	}
+	key.LastUsedAt, key.ExpiresAt = lastUsedAt.Time, expiresAt.Time
+
+	if key.ID, err = uuid.Parse(idStr); err != nil {
+		return nil, err
+	}
+	if scopes != "" {
+		key.Scopes = strings.Split(scopes, ",")
+	}
+	return &key, nil
+}
+
+func (r *Repo) CreateAPIKey(key *APIKey) error {
+	if key.ID == uuid.Nil {
+		key.ID = uuid.New()
+	}
+	key.CreatedAt = time.Now().UTC().Truncate(time.Second)
+	expiresAt := sql.NullString{String: formatTimestamp(key.ExpiresAt), Valid: !key.ExpiresAt.IsZero()}
+	_, err := r.db.Exec(
+		`INSERT INTO api_keys (id, username, name, prefix, key_hash, scopes, created_at, expires_at)
+         VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		key.ID.String(), key.Username, key.Name, key.Prefix, key.KeyHash, strings.Join(key.Scopes, ","),
+		formatTimestamp(key.CreatedAt), expiresAt)
+	return err
+}
+
+// ListAPIKeys returns the keys of the user that were not revoked, newest
+// first. Expired keys are included.
+func (r *Repo) ListAPIKeys(username string) ([]APIKey, error) {
+	rows, err := r.db.Query(
+		"SELECT "+apiKeyColumns+" FROM api_keys WHERE username = $1 AND revoked_at IS NULL ORDER BY created_at DESC, id",
+		username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, *key)
+	}
+	return keys, rows.Err()
+}
+
+// RevokeAPIKey revokes the user's key. It returns sql.ErrNoRows if the user
+// has no such unrevoked key.
+func (r *Repo) RevokeAPIKey(username string, id uuid.UUID) error {
+	res, err := r.db.Exec(
+		"UPDATE api_keys SET revoked_at = CURRENT_TIMESTAMP WHERE id = $1 AND username = $2 AND revoked_at IS NULL",
+		id.String(), username)
+	if err != nil {
+		return err
+	}
+	return requireRow(res)
+}
+
+// UseAPIKey returns the live key with the given hash and records its use.
+// It returns ErrAPIKeyInvalid if there is no such key or it expired or was
+// revoked.
+func (r *Repo) UseAPIKey(hash string) (*APIKey, error) {
+	now := time.Now()
+	key, err := scanAPIKey(r.db.QueryRow(
+		`SELECT `+apiKeyColumns+` FROM api_keys
+         WHERE key_hash = $1 AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > $2)`,
+		hash, formatTimestamp(now)))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrAPIKeyInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Keys used by busy jobs would otherwise cost a write per request.
+	if key.LastUsedAt.IsZero() || now.Sub(key.LastUsedAt) >= apiKeyTouchInterval {
+		if _, err := r.db.Exec(
+			"UPDATE api_keys SET last_used_at = $1 WHERE id = $2",
+			formatTimestamp(now), key.ID.String()); err != nil {
+			return nil, err
+		}
+		key.LastUsedAt = now
+	}
+	return key, nil
+}
+
+//------------------------------------------------------------------------//
+
+// Team methods
+// ------------------------------------------------------------------------//
+
+var (
+	// ErrTeamExists is returned by CreateTeam when the name is taken.
+	ErrTeamExists = errors.New("team already exists")
+	// ErrInTeam is returned when the user already belongs to a team.
+	ErrInTeam = errors.New("user already belongs to a team")
+)
+
+// CreateTeam stores a new team with its owner as the only member.
+func (r *Repo) CreateTeam(team *Team) error {
+	team.ID = uuid.New()
+	team.CreatedAt = time.Now().UTC().Truncate(time.Second)
+	team.Members = []string{team.Owner}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		"INSERT INTO teams (id, name, owner, created_at) VALUES ($1, $2, $3, $4)",
+		team.ID.String(), team.Name, team.Owner, formatTimestamp(team.CreatedAt))
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
+		return ErrTeamExists
+	}
+	if err != nil {
+		return err
+	}
+	if err := joinTeam(tx, team.ID, team.Owner); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// joinTeam adds the user to the team. It returns ErrInTeam if the user
+// already belongs to one and sql.ErrNoRows if there is no such user.
+func joinTeam(tx *sql.Tx, id uuid.UUID, username string) error {
+	res, err := tx.Exec(
+		"UPDATE users SET team_id = $1 WHERE username = $2 AND team_id IS NULL",
+		id.String(), username)
+	if err != nil {
+		return err
+	}
+	if err := requireRow(res); !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	var exists bool
+	if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE username = $1)", username).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return ErrInTeam
+	}
+	return sql.ErrNoRows
+}
+
+// GetTeam returns the team with its members ordered by name, or
+// sql.ErrNoRows.
+func (r *Repo) GetTeam(id uuid.UUID) (*Team, error) {
+	var team Team
+	var idStr string
+	err := r.db.QueryRow(
+		"SELECT id, name, owner, created_at FROM teams WHERE id = $1", id.String(),
+	).Scan(&idStr, &team.Name, &team.Owner, &team.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if team.ID, err = uuid.Parse(idStr); err != nil {
+		return nil, err
+	}
+
+	rows, err := r.db.Query("SELECT username FROM users WHERE team_id = $1 ORDER BY username", id.String())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	team.Members = []string{}
+	for rows.Next() {
+		var member string
+		if err := rows.Scan(&member); err != nil {
+			return nil, err
+		}
+		team.Members = append(team.Members, member)
+	}
+	return &team, rows.Err()
+}
+
+// InviteTeamMember invites the user to join the team; the user joins with
+// AcceptTeamInvite. Inviting the user again keeps the first invite. It
+// returns ErrInTeam if the user already belongs to a team and sql.ErrNoRows
+// if there is no such user.
+func (r *Repo) InviteTeamMember(id uuid.UUID, username string) (*TeamInvite, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var teamID string
+	if err := tx.QueryRow("SELECT COALESCE(team_id, '') FROM users WHERE username = $1", username).Scan(&teamID); err != nil {
+		return nil, err
+	}
+	if teamID != "" {
+		return nil, ErrInTeam
+	}
+
+	_, err = tx.Exec(
+		"INSERT OR IGNORE INTO team_invites (team_id, username, created_at) VALUES ($1, $2, $3)",
+		id.String(), username, formatTimestamp(time.Now()))
+	if err != nil {
+		return nil, err
+	}
+	invites, err := queryTeamInvites(tx, "i.team_id = $1 AND i.username = $2", id.String(), username)
+	if err != nil {
+		return nil, err
+	}
+	if len(invites) == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	return &invites[0], tx.Commit()
+}
+
+// ListTeamInvites returns the invites of the user, oldest first.
+func (r *Repo) ListTeamInvites(username string) ([]TeamInvite, error) {
+	return queryTeamInvites(r.db, "i.username = $1", username)
+}
+
+func queryTeamInvites(db querier, where string, args ...any) ([]TeamInvite, error) {
+	rows, err := db.Query(`
+        SELECT i.team_id, t.name, t.owner, i.username, i.created_at
+        FROM team_invites i JOIN teams t ON t.id = i.team_id
+        WHERE `+where+`
+        ORDER BY i.created_at, t.name`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invites := []TeamInvite{}
+	for rows.Next() {
+		var invite TeamInvite
+		var idStr string
+		if err := rows.Scan(&idStr, &invite.Team, &invite.Owner, &invite.Username, &invite.CreatedAt); err != nil {
+			return nil, err
+		}
+		if invite.TeamID, err = uuid.Parse(idStr); err != nil {
+			return nil, err
+		}
+		invites = append(invites, invite)
+	}
+	return invites, rows.Err()
+}
+
+// AcceptTeamInvite adds the user to the team that invited them and drops
+// their other invites. It returns sql.ErrNoRows if there is no such invite
+// and ErrInTeam if the user has joined a team since.
+func (r *Repo) AcceptTeamInvite(id uuid.UUID, username string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("DELETE FROM team_invites WHERE team_id = $1 AND username = $2", id.String(), username)
+	if err != nil {
+		return err
+	}
+	if err := requireRow(res); err != nil {
+		return err
+	}
+	if err := joinTeam(tx, id, username); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM team_invites WHERE username = $1", username); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DeclineTeamInvite drops the invite of the user to the team. It returns
+// sql.ErrNoRows if there is no such invite.
+func (r *Repo) DeclineTeamInvite(id uuid.UUID, username string) error {
+	res, err := r.db.Exec("DELETE FROM team_invites WHERE team_id = $1 AND username = $2", id.String(), username)
+	if err != nil {
+		return err
+	}
+	return requireRow(res)
+}
+
+// RemoveTeamMember removes the user from the team and stops sharing their
+// expressions with it. It returns sql.ErrNoRows if the user is not a member.
+func (r *Repo) RemoveTeamMember(id uuid.UUID, username string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(
+		"UPDATE users SET team_id = NULL WHERE username = $1 AND team_id = $2",
+		username, id.String())
+	if err != nil {
+		return err
+	}
+	if err := requireRow(res); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE expressions SET team_id = NULL WHERE username = $1 AND team_id = $2", username, id.String()); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DeleteTeam removes the team, leaving its members without one. It returns
+// sql.ErrNoRows if there is no such team.
+func (r *Repo) DeleteTeam(id uuid.UUID) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, query := range []string{
+		"DELETE FROM team_invites WHERE team_id = $1",
+		"UPDATE expressions SET team_id = NULL WHERE team_id = $1",
+		"UPDATE users SET team_id = NULL WHERE team_id = $1",
+	} {
+		if _, err := tx.Exec(query, id.String()); err != nil {
+			return err
+		}
+	}
+
+	res, err := tx.Exec("DELETE FROM teams WHERE id = $1", id.String())
+	if err != nil {
+		return err
+	}
+	if err := requireRow(res); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ShareExpression shares the expression read-only with the team, unless
+// teamID is empty, and with the users, replacing how it was shared before.
+// It returns sql.ErrNoRows if there is no such expression.
+func (r *Repo) ShareExpression(id uuid.UUID, teamID string, usernames []string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(
+		"UPDATE expressions SET team_id = NULLIF($1, '') WHERE id = $2 AND deleted_at IS NULL",
+		teamID, id.String())
+	if err != nil {
+		return err
+	}
+	if err := requireRow(res); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM expression_shares WHERE expression_id = $1", id.String()); err != nil {
+		return err
+	}
+	for _, username := range usernames {
+		_, err := tx.Exec(
+			"INSERT OR IGNORE INTO expression_shares (expression_id, username) VALUES ($1, $2)",
+			id.String(), username)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetExpressionShares returns the users the expression is shared with,
+// ordered by name.
+func (r *Repo) GetExpressionShares(id uuid.UUID) ([]string, error) {
+	rows, err := r.db.Query(
+		"SELECT username FROM expression_shares WHERE expression_id = $1 ORDER BY username", id.String())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usernames := []string{}
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err != nil {
+			return nil, err
+		}
+		usernames = append(usernames, username)
+	}
+	return usernames, rows.Err()
+}
+
+// IsSharedWith reports whether the expression is shared with the user
+// personally; sharing with a team is told by Expression.TeamID.
+func (r *Repo) IsSharedWith(id uuid.UUID, username string) (bool, error) {
+	var shared bool
+	err := r.db.QueryRow(
+		"SELECT EXISTS (SELECT 1 FROM expression_shares WHERE expression_id = $1 AND username = $2)",
+		id.String(), username).Scan(&shared)
+	return shared, err
+}
+
 //------------------------------------------------------------------------//
@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
@@ -49,7 +50,7 @@ func TestUserOperations(t *testing.T) {
 
 		// Попытка вставить того же пользователя снова
 		err = repo.InsertUser(user)
-		assert.Error(t, err)
+		assert.ErrorIs(t, err, ErrUserExists)
 	})
 
 	// Тест GetUser
@@ -128,7 +129,7 @@ func TestExpressionOperations(t *testing.T) {
 		assert.NotEqual(t, uuid.Nil, expr.ID)
 	})
 
-	// Тест GetExpressionByID и UpdateExpressionResult
+	// Тест GetExpressionByID и FinishExpression
 	t.Run("GetAndUpdateExpression", func(t *testing.T) {
 		expr := &Expression{
 			Username:   user.Username,
@@ -144,17 +145,17 @@ func TestExpressionOperations(t *testing.T) {
 		assert.NoError(t, err)
 		assert.Equal(t, expr.ID, foundExpr.ID)
 		assert.Equal(t, expr.Expression, foundExpr.Expression)
-		assert.Equal(t, 0, foundExpr.Result)
+		assert.Equal(t, 0.0, foundExpr.Result)
 		assert.Equal(t, "pending", foundExpr.Status)
 
 		// Обновляем результат
-		err = repo.UpdateExpressionResult(expr.ID, 9, "completed")
+		err = repo.FinishExpression(expr.ID, 9, "completed", "")
 		assert.NoError(t, err)
 
 		// Проверяем обновление
 		updatedExpr, err := repo.GetExpressionByID(expr.ID)
 		assert.NoError(t, err)
-		assert.Equal(t, 9, updatedExpr.Result)
+		assert.Equal(t, 9.0, updatedExpr.Result)
 		assert.Equal(t, "completed", updatedExpr.Status)
 	})
 
@@ -174,7 +175,7 @@ func TestExpressionOperations(t *testing.T) {
 
 		err := repo.CreateExpression(expr1)
 		require.NoError(t, err)
-		err = repo.UpdateExpressionResult(expr1.ID, 10, "completed")
+		err = repo.FinishExpression(expr1.ID, 10, "completed", "")
 		require.NoError(t, err)
 
 		err = repo.CreateExpression(expr2)
@@ -190,12 +191,12 @@ func TestExpressionOperations(t *testing.T) {
 		for _, e := range expressions {
 			if e.ID == expr1.ID {
 				found1 = true
-				assert.Equal(t, 10, e.Result)
+				assert.Equal(t, 10.0, e.Result)
 				assert.Equal(t, "completed", e.Status)
 			}
 			if e.ID == expr2.ID {
 				found2 = true
-				assert.Equal(t, 0, e.Result)
+				assert.Equal(t, 0.0, e.Result)
 				assert.Equal(t, "pending", e.Status)
 			}
 		}
@@ -210,3 +211,653 @@ func TestExpressionOperations(t *testing.T) {
 		assert.Equal(t, sql.ErrNoRows, err)
 	})
 }
+
+func TestConstantOperations(t *testing.T) {
+	repo := setupTestDB(t)
+	defer cleanupTestDB(t)
+
+	// Тест SetConstant
+	t.Run("SetConstant", func(t *testing.T) {
+		c, err := repo.SetConstant("VAT", 0.2, "admin")
+		require.NoError(t, err)
+		assert.Equal(t, "VAT", c.Name)
+		assert.Equal(t, 0.2, c.Value)
+		assert.Equal(t, 1, c.Version)
+
+		// Повторная запись увеличивает версию
+		c, err = repo.SetConstant("VAT", 0.18, "admin2")
+		require.NoError(t, err)
+		assert.Equal(t, 0.18, c.Value)
+		assert.Equal(t, 2, c.Version)
+		assert.Equal(t, "admin2", c.UpdatedBy)
+	})
+
+	// Тест GetConstants
+	t.Run("GetConstants", func(t *testing.T) {
+		_, err := repo.SetConstant("FEE", 5, "admin")
+		require.NoError(t, err)
+
+		constants, err := repo.GetConstants()
+		require.NoError(t, err)
+		require.Len(t, constants, 2)
+		assert.Equal(t, "FEE", constants[0].Name)
+		assert.Equal(t, "VAT", constants[1].Name)
+	})
+
+	// Тест DeleteConstant
+	t.Run("DeleteConstant", func(t *testing.T) {
+		err := repo.DeleteConstant("FEE")
+		assert.NoError(t, err)
+
+		err = repo.DeleteConstant("FEE")
+		assert.Equal(t, sql.ErrNoRows, err)
+	})
+
+	// Тест SetExpressionConstants
+	t.Run("SetExpressionConstants", func(t *testing.T) {
+		err := repo.InsertUser(User{Username: "constuser", Password: "constpass"})
+		require.NoError(t, err)
+
+		expr := &Expression{
+			Username:   "constuser",
+			Expression: "100 * VAT",
+			Status:     "pending",
+		}
+		require.NoError(t, repo.CreateExpression(expr))
+
+		usage := []ConstantUsage{
+			{Name: "VAT", Value: 0.18, Version: 2},
+			{Name: "pi", Value: 3.141592653589793, Version: 0},
+		}
+		require.NoError(t, repo.SetExpressionConstants(expr.ID, usage))
+
+		found, err := repo.GetExpressionByID(expr.ID)
+		require.NoError(t, err)
+		assert.Equal(t, usage, found.Constants)
+		assert.Equal(t, "constuser", found.Username)
+	})
+}
+
+func TestWebhookAttempts(t *testing.T) {
+	repo := setupTestDB(t)
+	defer cleanupTestDB(t)
+
+	require.NoError(t, repo.InsertUser(User{Username: "hookuser", Password: "hookpass"}))
+
+	expr := &Expression{
+		Username:    "hookuser",
+		Expression:  "2 + 2",
+		Status:      "processing",
+		CallbackURL: "https://example.com/hook",
+	}
+	require.NoError(t, repo.CreateExpression(expr))
+
+	found, err := repo.GetExpressionByID(expr.ID)
+	require.NoError(t, err)
+	assert.Equal(t, expr.CallbackURL, found.CallbackURL)
+
+	require.NoError(t, repo.InsertWebhookAttempt(WebhookAttempt{
+		ExpressionID: expr.ID, URL: expr.CallbackURL, Attempt: 1, StatusCode: 503, Error: "unavailable",
+	}))
+	require.NoError(t, repo.InsertWebhookAttempt(WebhookAttempt{
+		ExpressionID: expr.ID, URL: expr.CallbackURL, Attempt: 2, StatusCode: 200, Delivered: true,
+	}))
+
+	attempts, err := repo.GetWebhookAttempts(expr.ID)
+	require.NoError(t, err)
+	require.Len(t, attempts, 2)
+	assert.Equal(t, 1, attempts[0].Attempt)
+	assert.False(t, attempts[0].Delivered)
+	assert.Equal(t, "unavailable", attempts[0].Error)
+	assert.Equal(t, 2, attempts[1].Attempt)
+	assert.True(t, attempts[1].Delivered)
+
+	attempts, err = repo.GetWebhookAttempts(uuid.New())
+	assert.NoError(t, err)
+	assert.Empty(t, attempts)
+}
+
+func TestDeleteExpression(t *testing.T) {
+	repo := setupTestDB(t)
+	defer cleanupTestDB(t)
+
+	require.NoError(t, repo.InsertUser(User{Username: "deluser", Password: "delpass"}))
+
+	kept := &Expression{Username: "deluser", Expression: "1 + 1", Status: "DONE"}
+	deleted := &Expression{Username: "deluser", Expression: "2 + 2", Status: "DONE"}
+	require.NoError(t, repo.CreateExpression(kept))
+	require.NoError(t, repo.CreateExpression(deleted))
+
+	require.NoError(t, repo.DeleteExpression(deleted.ID))
+
+	// Удалённое выражение больше не находится
+	_, err := repo.GetExpressionByID(deleted.ID)
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	expressions, err := repo.GetExpressions("deluser")
+	require.NoError(t, err)
+	require.Len(t, expressions, 1)
+	assert.Equal(t, kept.ID, expressions[0].ID)
+
+	// Повторное удаление
+	assert.Equal(t, sql.ErrNoRows, repo.DeleteExpression(deleted.ID))
+	assert.Equal(t, sql.ErrNoRows, repo.DeleteExpression(uuid.New()))
+}
+
+func TestListExpressions(t *testing.T) {
+	repo := setupTestDB(t)
+	defer cleanupTestDB(t)
+
+	require.NoError(t, repo.InsertUser(User{Username: "listuser", Password: "listpass"}))
+	require.NoError(t, repo.InsertUser(User{Username: "otheruser", Password: "otherpass"}))
+
+	// Пять выражений, созданных с интервалом в час
+	base := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	var ids []uuid.UUID
+	for i, text := range []string{"1 + 1", "2 * 50%", "3 + 3", "4 * 4", "5 + 5"} {
+		expr := &Expression{Username: "listuser", Expression: text, Status: "DONE"}
+		if i%2 == 1 {
+			expr.Status = "error"
+		}
+		require.NoError(t, repo.CreateExpression(expr))
+		_, err := repo.db.Exec("UPDATE expressions SET created_at = ? WHERE id = ?",
+			formatTimestamp(base.Add(time.Duration(i)*time.Hour)), expr.ID.String())
+		require.NoError(t, err)
+		ids = append(ids, expr.ID)
+	}
+	require.NoError(t, repo.CreateExpression(&Expression{Username: "otheruser", Expression: "1 + 1", Status: "DONE"}))
+
+	list := func(filter ExpressionFilter) ([]uuid.UUID, *Cursor) {
+		t.Helper()
+		filter.Username = "listuser"
+		if filter.Limit == 0 {
+			filter.Limit = 10
+		}
+		expressions, next, err := repo.ListExpressions(filter)
+		require.NoError(t, err)
+
+		var found []uuid.UUID
+		for _, e := range expressions {
+			found = append(found, e.ID)
+		}
+		return found, next
+	}
+
+	t.Run("Order", func(t *testing.T) {
+		found, next := list(ExpressionFilter{})
+		assert.Equal(t, []uuid.UUID{ids[4], ids[3], ids[2], ids[1], ids[0]}, found)
+		assert.Nil(t, next)
+
+		found, _ = list(ExpressionFilter{Ascending: true})
+		assert.Equal(t, ids, found)
+	})
+
+	t.Run("Pages", func(t *testing.T) {
+		var all []uuid.UUID
+		var after *Cursor
+		for pages := 0; ; pages++ {
+			require.Less(t, pages, 5)
+
+			found, next := list(ExpressionFilter{Limit: 2, After: after, Ascending: true})
+			all = append(all, found...)
+			if next == nil {
+				break
+			}
+			after = next
+		}
+		assert.Equal(t, ids, all)
+	})
+
+	t.Run("Filters", func(t *testing.T) {
+		found, _ := list(ExpressionFilter{Statuses: []string{"error"}})
+		assert.Equal(t, []uuid.UUID{ids[3], ids[1]}, found)
+
+		found, _ = list(ExpressionFilter{From: base.Add(time.Hour), To: base.Add(3 * time.Hour), Ascending: true})
+		assert.Equal(t, []uuid.UUID{ids[1], ids[2]}, found)
+
+		found, _ = list(ExpressionFilter{Search: "+", Ascending: true})
+		assert.Equal(t, []uuid.UUID{ids[0], ids[2], ids[4]}, found)
+
+		// Спецсимволы LIKE ищутся буквально
+		found, _ = list(ExpressionFilter{Search: "%"})
+		assert.Equal(t, []uuid.UUID{ids[1]}, found)
+	})
+}
+
+func TestBatchOperations(t *testing.T) {
+	repo := setupTestDB(t)
+	defer cleanupTestDB(t)
+
+	require.NoError(t, repo.InsertUser(User{Username: "batchuser", Password: "batchpass"}))
+
+	batch := &Batch{Username: "batchuser"}
+	exprs := []*Expression{
+		{Username: "batchuser", Expression: "1 + 1", Status: "processing"},
+		{Username: "batchuser", Expression: "a * 2", Status: "processing",
+			Constants: []ConstantUsage{{Name: "a", Value: 3, Variable: true}}},
+	}
+	require.NoError(t, repo.CreateBatch(batch, exprs))
+	assert.NotEqual(t, uuid.Nil, batch.ID)
+
+	// Выражения пакета сохраняются вместе с переменными
+	stored, err := repo.GetExpressionByID(exprs[1].ID)
+	require.NoError(t, err)
+	assert.Equal(t, batch.ID, stored.BatchID)
+	assert.Equal(t, exprs[1].Constants, stored.Constants)
+
+	require.NoError(t, repo.FinishExpression(exprs[0].ID, 2, "DONE", ""))
+
+	got, err := repo.GetBatch(batch.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "batchuser", got.Username)
+	assert.Equal(t, 2, got.Total)
+	assert.Equal(t, map[string]int{"DONE": 1, "processing": 1}, got.Counts)
+
+	listed, _, err := repo.ListExpressions(ExpressionFilter{Username: "batchuser", BatchID: batch.ID, Limit: 10})
+	require.NoError(t, err)
+	assert.Len(t, listed, 2)
+
+	// Ошибка при вставке откатывает весь пакет
+	failed := &Batch{Username: "batchuser"}
+	duplicate := uuid.New()
+	err = repo.CreateBatch(failed, []*Expression{
+		{ID: duplicate, Username: "batchuser", Expression: "3 + 3", Status: "processing"},
+		{ID: duplicate, Username: "batchuser", Expression: "4 + 4", Status: "processing"},
+	})
+	assert.Error(t, err)
+
+	_, err = repo.GetBatch(failed.ID)
+	assert.Equal(t, sql.ErrNoRows, err)
+	_, err = repo.GetExpressionByID(duplicate)
+	assert.Equal(t, sql.ErrNoRows, err)
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	repo := setupTestDB(t)
+	defer cleanupTestDB(t)
+
+	require.NoError(t, repo.InsertUser(User{Username: "keyuser", Password: "keypass"}))
+	require.NoError(t, repo.InsertUser(User{Username: "otheruser", Password: "otherpass"}))
+
+	expr := &Expression{Username: "keyuser", Expression: "1 + 1", Status: "processing", IdempotencyKey: "key-1"}
+	require.NoError(t, repo.CreateExpression(expr))
+	require.NoError(t, repo.CreateExpression(&Expression{Username: "keyuser", Expression: "2 + 2", Status: "processing"}))
+
+	since := time.Now().Add(-time.Hour)
+
+	found, err := repo.GetExpressionByIdempotencyKey("keyuser", "key-1", since)
+	require.NoError(t, err)
+	assert.Equal(t, expr.ID, found.ID)
+	assert.Equal(t, "key-1", found.IdempotencyKey)
+
+	// Ключ принадлежит конкретному пользователю
+	_, err = repo.GetExpressionByIdempotencyKey("otheruser", "key-1", since)
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	// Ключи старше окна не учитываются
+	_, err = repo.GetExpressionByIdempotencyKey("keyuser", "key-1", time.Now().Add(time.Hour))
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	// Как и удалённые выражения
+	require.NoError(t, repo.DeleteExpression(expr.ID))
+	_, err = repo.GetExpressionByIdempotencyKey("keyuser", "key-1", since)
+	assert.Equal(t, sql.ErrNoRows, err)
+}
+
+func TestExpressionLifecycle(t *testing.T) {
+	repo := setupTestDB(t)
+	defer cleanupTestDB(t)
+
+	require.NoError(t, repo.InsertUser(User{Username: "lifeuser", Password: "lifepass"}))
+
+	expr := &Expression{Username: "lifeuser", Expression: "1 / 0", Status: StatusPending}
+	require.NoError(t, repo.CreateExpression(expr))
+
+	stored, err := repo.GetExpressionByID(expr.ID)
+	require.NoError(t, err)
+	assert.NotEmpty(t, stored.CreatedAt)
+	assert.Empty(t, stored.StartedAt)
+	assert.Empty(t, stored.FinishedAt)
+	assert.False(t, stored.Finished())
+
+	// Начало вычисления
+	require.NoError(t, repo.StartExpression(expr.ID))
+	stored, err = repo.GetExpressionByID(expr.ID)
+	require.NoError(t, err)
+	assert.Equal(t, StatusProcessing, stored.Status)
+	assert.NotEmpty(t, stored.StartedAt)
+	assert.Empty(t, stored.FinishedAt)
+
+	// Завершение с ошибкой
+	require.NoError(t, repo.FinishExpression(expr.ID, 0, StatusError, "division by zero"))
+	stored, err = repo.GetExpressionByID(expr.ID)
+	require.NoError(t, err)
+	assert.Equal(t, StatusError, stored.Status)
+	assert.Equal(t, "division by zero", stored.Error)
+	assert.NotEmpty(t, stored.FinishedAt)
+	assert.True(t, stored.Finished())
+
+	// Дробный результат сохраняется без округления
+	fractional := &Expression{Username: "lifeuser", Expression: "1e-3*2", Status: StatusPending}
+	require.NoError(t, repo.CreateExpression(fractional))
+	require.NoError(t, repo.FinishExpression(fractional.ID, 0.002, StatusDone, ""))
+	stored, err = repo.GetExpressionByID(fractional.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 0.002, stored.Result)
+}
+
+func TestRefreshTokens(t *testing.T) {
+	repo := setupTestDB(t)
+	defer cleanupTestDB(t)
+
+	require.NoError(t, repo.InsertUser(User{Username: "tokenuser", Password: "tokenpass"}))
+
+	expires := time.Now().Add(time.Hour)
+	require.NoError(t, repo.CreateRefreshToken(&RefreshToken{Username: "tokenuser", TokenHash: "h1", ExpiresAt: expires}))
+
+	// Обмен выдаёт новый токен тому же пользователю
+	next := &RefreshToken{TokenHash: "h2", ExpiresAt: expires}
+	require.NoError(t, repo.RotateRefreshToken("h1", next))
+	assert.Equal(t, "tokenuser", next.Username)
+
+	// Неизвестный токен
+	assert.ErrorIs(t, repo.RotateRefreshToken("unknown", &RefreshToken{TokenHash: "h3", ExpiresAt: expires}), ErrTokenInvalid)
+
+	// Повторное использование отзывает все токены пользователя
+	assert.ErrorIs(t, repo.RotateRefreshToken("h1", &RefreshToken{TokenHash: "h3", ExpiresAt: expires}), ErrTokenReused)
+	assert.ErrorIs(t, repo.RotateRefreshToken("h2", &RefreshToken{TokenHash: "h3", ExpiresAt: expires}), ErrTokenInvalid)
+
+	// Просроченный токен
+	require.NoError(t, repo.CreateRefreshToken(&RefreshToken{Username: "tokenuser", TokenHash: "old", ExpiresAt: time.Now().Add(-time.Minute)}))
+	assert.ErrorIs(t, repo.RotateRefreshToken("old", &RefreshToken{TokenHash: "h4", ExpiresAt: expires}), ErrTokenInvalid)
+
+	// Отзыв при выходе
+	require.NoError(t, repo.CreateRefreshToken(&RefreshToken{Username: "tokenuser", TokenHash: "h5", ExpiresAt: expires}))
+	assert.ErrorIs(t, repo.RevokeRefreshToken("otheruser", "h5"), ErrTokenInvalid)
+	require.NoError(t, repo.RevokeRefreshToken("tokenuser", "h5"))
+	assert.ErrorIs(t, repo.RevokeRefreshToken("tokenuser", "h5"), ErrTokenInvalid)
+	assert.ErrorIs(t, repo.RotateRefreshToken("h5", &RefreshToken{TokenHash: "h6", ExpiresAt: expires}), ErrTokenInvalid)
+}
+
+func TestRotateRefreshTokenRace(t *testing.T) {
+	repo := setupTestDB(t)
+	defer cleanupTestDB(t)
+
+	require.NoError(t, repo.InsertUser(User{Username: "tokenuser", Password: "tokenpass"}))
+	expires := time.Now().Add(time.Hour)
+	require.NoError(t, repo.CreateRefreshToken(&RefreshToken{Username: "tokenuser", TokenHash: "h1", ExpiresAt: expires}))
+	require.NoError(t, repo.CreateRefreshToken(&RefreshToken{Username: "tokenuser", TokenHash: "other", ExpiresAt: expires}))
+
+	// Параллельный обмен отзывает h1 между чтением и обновлением
+	_, err := repo.db.Exec(`CREATE TRIGGER concurrent_rotation AFTER INSERT ON refresh_tokens
+		WHEN NEW.token_hash = 'h2' BEGIN
+			UPDATE refresh_tokens SET revoked_at = CURRENT_TIMESTAMP WHERE token_hash = 'h1';
+		END`)
+	require.NoError(t, err)
+
+	// Проигравший обмен считается повторным использованием
+	assert.ErrorIs(t, repo.RotateRefreshToken("h1", &RefreshToken{TokenHash: "h2", ExpiresAt: expires}), ErrTokenReused)
+
+	// Новый токен не сохранён, остальные токены пользователя отозваны
+	var stored int
+	require.NoError(t, repo.db.QueryRow("SELECT COUNT(*) FROM refresh_tokens WHERE token_hash = 'h2'").Scan(&stored))
+	assert.Zero(t, stored)
+	assert.ErrorIs(t, repo.RotateRefreshToken("other", &RefreshToken{TokenHash: "h3", ExpiresAt: expires}), ErrTokenInvalid)
+}
+
+func TestRevokedTokens(t *testing.T) {
+	repo := setupTestDB(t)
+	defer cleanupTestDB(t)
+
+	revoked, err := repo.IsTokenRevoked("jti-1")
+	require.NoError(t, err)
+	assert.False(t, revoked)
+
+	require.NoError(t, repo.RevokeToken("jti-1", time.Now().Add(time.Hour)))
+	require.NoError(t, repo.RevokeToken("jti-1", time.Now().Add(time.Hour)))
+	revoked, err = repo.IsTokenRevoked("jti-1")
+	require.NoError(t, err)
+	assert.True(t, revoked)
+
+	// Истёкшие записи удаляются при следующем отзыве
+	require.NoError(t, repo.RevokeToken("jti-2", time.Now().Add(-time.Minute)))
+	require.NoError(t, repo.RevokeToken("jti-3", time.Now().Add(time.Hour)))
+	revoked, err = repo.IsTokenRevoked("jti-2")
+	require.NoError(t, err)
+	assert.False(t, revoked)
+}
+
+func TestUserRoles(t *testing.T) {
+	repo := setupTestDB(t)
+	defer cleanupTestDB(t)
+
+	require.NoError(t, repo.InsertUser(User{Username: "bob", Password: "pass"}))
+	require.NoError(t, repo.InsertUser(User{Username: "admin", Password: "pass", Role: RoleAdmin}))
+
+	// Роль по умолчанию — user
+	bob, err := repo.GetUserByName("bob")
+	require.NoError(t, err)
+	assert.Equal(t, RoleUser, bob.Role)
+	assert.False(t, bob.Disabled)
+	assert.Empty(t, bob.Password)
+
+	users, err := repo.ListUsers()
+	require.NoError(t, err)
+	require.Len(t, users, 2)
+	assert.Equal(t, "admin", users[0].Username)
+	assert.Equal(t, RoleAdmin, users[0].Role)
+
+	// Смена роли меняет версию токенов, повторная установка той же роли — нет
+	require.NoError(t, repo.SetUserRole("bob", RoleReadonly))
+	require.NoError(t, repo.SetUserRole("bob", RoleReadonly))
+	updated, err := repo.GetUserByName("bob")
+	require.NoError(t, err)
+	assert.Equal(t, RoleReadonly, updated.Role)
+	assert.Equal(t, bob.TokenVersion+1, updated.TokenVersion)
+
+	// Блокировка отзывает refresh-токены
+	require.NoError(t, repo.CreateRefreshToken(&RefreshToken{Username: "bob", TokenHash: "h1", ExpiresAt: time.Now().Add(time.Hour)}))
+	require.NoError(t, repo.SetUserDisabled("bob", true))
+	disabled, err := repo.GetUserByName("bob")
+	require.NoError(t, err)
+	assert.True(t, disabled.Disabled)
+	assert.Greater(t, disabled.TokenVersion, updated.TokenVersion)
+	assert.ErrorIs(t, repo.RotateRefreshToken("h1", &RefreshToken{TokenHash: "h2", ExpiresAt: time.Now().Add(time.Hour)}), ErrTokenInvalid)
+
+	require.NoError(t, repo.SetUserDisabled("bob", false))
+	enabled, err := repo.GetUserByName("bob")
+	require.NoError(t, err)
+	assert.False(t, enabled.Disabled)
+
+	// Несуществующий пользователь
+	assert.ErrorIs(t, repo.SetUserRole("nobody", RoleAdmin), sql.ErrNoRows)
+	assert.ErrorIs(t, repo.SetUserDisabled("nobody", true), sql.ErrNoRows)
+	_, err = repo.GetUserByName("nobody")
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+}
+
+func TestAPIKeys(t *testing.T) {
+	repo := setupTestDB(t)
+	defer cleanupTestDB(t)
+
+	key := &APIKey{Username: "alice", Name: "cron", Prefix: "calc_abcdef", KeyHash: "hash1", Scopes: []string{"read", "write"}}
+	require.NoError(t, repo.CreateAPIKey(key))
+	expired := &APIKey{Username: "alice", Name: "old", Prefix: "calc_zzzzzz", KeyHash: "hash2", Scopes: []string{"read"},
+		ExpiresAt: time.Now().Add(-time.Hour)}
+	require.NoError(t, repo.CreateAPIKey(expired))
+
+	// Использование ключа запоминается
+	used, err := repo.UseAPIKey("hash1")
+	require.NoError(t, err)
+	assert.Equal(t, key.ID, used.ID)
+	assert.Equal(t, []string{"read", "write"}, used.Scopes)
+	assert.False(t, used.LastUsedAt.IsZero())
+
+	// Просроченный и неизвестный ключи не принимаются
+	_, err = repo.UseAPIKey("hash2")
+	assert.ErrorIs(t, err, ErrAPIKeyInvalid)
+	_, err = repo.UseAPIKey("unknown")
+	assert.ErrorIs(t, err, ErrAPIKeyInvalid)
+
+	keys, err := repo.ListAPIKeys("alice")
+	require.NoError(t, err)
+	assert.Len(t, keys, 2)
+
+	// Отозвать ключ может только его владелец
+	assert.ErrorIs(t, repo.RevokeAPIKey("bob", key.ID), sql.ErrNoRows)
+	require.NoError(t, repo.RevokeAPIKey("alice", key.ID))
+	assert.ErrorIs(t, repo.RevokeAPIKey("alice", key.ID), sql.ErrNoRows)
+	_, err = repo.UseAPIKey("hash1")
+	assert.ErrorIs(t, err, ErrAPIKeyInvalid)
+
+	keys, err = repo.ListAPIKeys("alice")
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	assert.Equal(t, "old", keys[0].Name)
+}
+
+func TestSetPasswordAndDeleteUser(t *testing.T) {
+	repo := setupTestDB(t)
+	defer cleanupTestDB(t)
+
+	require.NoError(t, repo.InsertUser(User{Username: "alice", Password: "old-pass1"}))
+	before, err := repo.GetUserByName("alice")
+	require.NoError(t, err)
+	assert.NotEmpty(t, before.ID)
+
+	// Смена пароля завершает все сессии и отзывает API-ключи
+	require.NoError(t, repo.CreateRefreshToken(&RefreshToken{Username: "alice", TokenHash: "h1", ExpiresAt: time.Now().Add(time.Hour)}))
+	require.NoError(t, repo.CreateAPIKey(&APIKey{Username: "alice", Name: "old", Prefix: "calc_o", KeyHash: "k0", Scopes: []string{"read"}}))
+	require.NoError(t, repo.SetPassword("alice", "new-pass1"))
+	keys, err := repo.ListAPIKeys("alice")
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+	ok, err := repo.Authenticate("alice", "new-pass1")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	after, err := repo.GetUserByName("alice")
+	require.NoError(t, err)
+	assert.Equal(t, before.TokenVersion+1, after.TokenVersion)
+	assert.ErrorIs(t, repo.RotateRefreshToken("h1", &RefreshToken{TokenHash: "h2", ExpiresAt: time.Now().Add(time.Hour)}), ErrTokenInvalid)
+	assert.ErrorIs(t, repo.SetPassword("nobody", "new-pass1"), sql.ErrNoRows)
+
+	// Удаление пользователя удаляет и его выражения
+	expr := &Expression{Username: "alice", Expression: "2+2", Status: StatusPending}
+	require.NoError(t, repo.CreateExpression(expr))
+	require.NoError(t, repo.CreateAPIKey(&APIKey{Username: "alice", Name: "job", Prefix: "calc_x", KeyHash: "k1", Scopes: []string{"read"}}))
+	require.NoError(t, repo.DeleteUser("alice"))
+
+	_, err = repo.GetUserByName("alice")
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+	_, err = repo.GetExpressionByID(expr.ID)
+	assert.Error(t, err)
+	_, err = repo.UseAPIKey("k1")
+	assert.ErrorIs(t, err, ErrAPIKeyInvalid)
+	assert.ErrorIs(t, repo.DeleteUser("alice"), sql.ErrNoRows)
+
+	// Новый пользователь с тем же именем получает другой id
+	require.NoError(t, repo.InsertUser(User{Username: "alice", Password: "new-pass1"}))
+	again, err := repo.GetUserByName("alice")
+	require.NoError(t, err)
+	assert.NotEqual(t, before.ID, again.ID)
+}
+
+func TestTeams(t *testing.T) {
+	repo := setupTestDB(t)
+	defer cleanupTestDB(t)
+
+	for _, name := range []string{"alice", "bob", "carol"} {
+		require.NoError(t, repo.InsertUser(User{Username: name, Password: "secret42"}))
+	}
+
+	team := &Team{Name: "ops", Owner: "alice"}
+	require.NoError(t, repo.CreateTeam(team))
+	assert.NotEqual(t, uuid.Nil, team.ID)
+	assert.ErrorIs(t, repo.CreateTeam(&Team{Name: "ops", Owner: "bob"}), ErrTeamExists)
+	// Пользователь состоит не больше чем в одной команде
+	assert.ErrorIs(t, repo.CreateTeam(&Team{Name: "dev", Owner: "alice"}), ErrInTeam)
+
+	// Пользователь вступает в команду, только приняв приглашение
+	invite, err := repo.InviteTeamMember(team.ID, "bob")
+	require.NoError(t, err)
+	assert.Equal(t, TeamInvite{TeamID: team.ID, Team: "ops", Owner: "alice", Username: "bob", CreatedAt: invite.CreatedAt}, *invite)
+	again, err := repo.InviteTeamMember(team.ID, "bob")
+	require.NoError(t, err)
+	assert.Equal(t, invite, again)
+	_, err = repo.InviteTeamMember(team.ID, "alice")
+	assert.ErrorIs(t, err, ErrInTeam)
+	_, err = repo.InviteTeamMember(team.ID, "nobody")
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+	invites, err := repo.ListTeamInvites("bob")
+	require.NoError(t, err)
+	assert.Equal(t, []TeamInvite{*invite}, invites)
+	assert.ErrorIs(t, repo.AcceptTeamInvite(team.ID, "carol"), sql.ErrNoRows)
+
+	// Принятое приглашение отменяет остальные
+	other := &Team{Name: "dev", Owner: "carol"}
+	require.NoError(t, repo.CreateTeam(other))
+	_, err = repo.InviteTeamMember(other.ID, "bob")
+	require.NoError(t, err)
+	require.NoError(t, repo.AcceptTeamInvite(team.ID, "bob"))
+	invites, err = repo.ListTeamInvites("bob")
+	require.NoError(t, err)
+	assert.Empty(t, invites)
+	assert.ErrorIs(t, repo.AcceptTeamInvite(other.ID, "bob"), sql.ErrNoRows)
+	require.NoError(t, repo.DeleteTeam(other.ID))
+
+	got, err := repo.GetTeam(team.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"alice", "bob"}, got.Members)
+	bob, err := repo.GetUserByName("bob")
+	require.NoError(t, err)
+	assert.Equal(t, team.ID.String(), bob.TeamID)
+
+	// Выражение доступно команде и отдельным пользователям только на чтение
+	expr := &Expression{Username: "alice", Expression: "2+2", Status: StatusPending}
+	require.NoError(t, repo.CreateExpression(expr))
+	require.NoError(t, repo.ShareExpression(expr.ID, team.ID.String(), []string{"carol"}))
+	shares, err := repo.GetExpressionShares(expr.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"carol"}, shares)
+	shared, err := repo.IsSharedWith(expr.ID, "carol")
+	require.NoError(t, err)
+	assert.True(t, shared)
+	assert.ErrorIs(t, repo.ShareExpression(uuid.New(), "", nil), sql.ErrNoRows)
+
+	list := func(filter ExpressionFilter) []Expression {
+		filter.Limit = 10
+		exprs, _, err := repo.ListExpressions(filter)
+		require.NoError(t, err)
+		return exprs
+	}
+	assert.Len(t, list(ExpressionFilter{Username: "bob", Scope: ScopeTeam, TeamID: team.ID.String()}), 1)
+	assert.Len(t, list(ExpressionFilter{Username: "bob", Scope: ScopeShared, TeamID: team.ID.String()}), 1)
+	assert.Len(t, list(ExpressionFilter{Username: "carol", Scope: ScopeShared}), 1)
+	assert.Empty(t, list(ExpressionFilter{Username: "bob"}))
+	// Свои выражения не попадают в чужие
+	assert.Empty(t, list(ExpressionFilter{Username: "alice", Scope: ScopeShared, TeamID: team.ID.String()}))
+
+	// Выбывший участник больше не делится своими выражениями с командой
+	own := &Expression{Username: "bob", Expression: "3+3", Status: StatusPending}
+	require.NoError(t, repo.CreateExpression(own))
+	require.NoError(t, repo.ShareExpression(own.ID, team.ID.String(), nil))
+	require.NoError(t, repo.RemoveTeamMember(team.ID, "bob"))
+	assert.ErrorIs(t, repo.RemoveTeamMember(team.ID, "bob"), sql.ErrNoRows)
+	moved, err := repo.GetExpressionByID(own.ID)
+	require.NoError(t, err)
+	assert.Empty(t, moved.TeamID)
+
+	// Удаление владельца удаляет команду, приглашения в неё и его доступы
+	_, err = repo.InviteTeamMember(team.ID, "bob")
+	require.NoError(t, err)
+	require.NoError(t, repo.DeleteUser("alice"))
+	_, err = repo.GetTeam(team.ID)
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+	invites, err = repo.ListTeamInvites("bob")
+	require.NoError(t, err)
+	assert.Empty(t, invites)
+	shared, err = repo.IsSharedWith(expr.ID, "carol")
+	require.NoError(t, err)
+	assert.False(t, shared)
+	assert.ErrorIs(t, repo.DeleteTeam(team.ID), sql.ErrNoRows)
+}
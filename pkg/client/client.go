@@ -0,0 +1,390 @@
+// Package client is a Go client for the orchestrator REST API (/api/v1).
+//
+// A Client logs in once and keeps the JWT and its refresh token. When the
+// token is about to expire or the server rejects it, the client renews it
+// with the refresh token, or logs in again with the remembered credentials
+// if that fails, and retries the request. Alternatively the client can
+// authenticate with an API key, which needs no renewal.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Client talks to the orchestrator on behalf of one user. It is safe for
+// concurrent use once logged in.
+type Client struct {
+	BaseURL      string
+	HTTPClient   *http.Client
+	PollInterval time.Duration
+
+	mu       sync.Mutex
+	renewing sync.Mutex
+	token    string
+	expires  time.Time
+	refresh  string
+	apiKey   string
+	username string
+	password string
+}
+
+type tokenResponse struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// refreshMargin is how long before expiry a token is replaced.
+const refreshMargin = time.Minute
+
+// Expression mirrors the orchestrator's expression representation.
+type Expression struct {
+	ID     string  `json:"id"`
+	Status string  `json:"status"`
+	Result float64 `json:"result"`
+}
+
+// Done reports whether the expression was evaluated successfully.
+func (e *Expression) Done() bool {
+	return strings.EqualFold(e.Status, "done")
+}
+
+// Failed reports whether the expression could not be evaluated.
+func (e *Expression) Failed() bool {
+	return strings.EqualFold(e.Status, "error")
+}
+
+// Error is returned for responses with a non-2xx status code.
+type Error struct {
+	StatusCode int
+	Message    string
+	// Code is the stable error code of the problem response, if any.
+	Code string
+	// RequestID identifies the failed request in the server logs.
+	RequestID string
+	// RetryAfter is how long to wait before retrying a rate limited
+	// request, from the Retry-After header.
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:      strings.TrimRight(baseURL, "/"),
+		HTTPClient:   &http.Client{Timeout: 30 * time.Second},
+		PollInterval: 200 * time.Millisecond,
+	}
+}
+
+// Register creates a new user account.
+func (c *Client) Register(ctx context.Context, username, password string) error {
+	body := map[string]string{"username": username, "password": password}
+	return c.send(ctx, http.MethodPost, "/api/v1/register", body, nil)
+}
+
+// Login obtains a token and remembers the credentials for re-login.
+func (c *Client) Login(ctx context.Context, username, password string) error {
+	var resp tokenResponse
+	body := map[string]string{"username": username, "password": password}
+	if err := c.send(ctx, http.MethodPost, "/api/v1/login", body, &resp); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.username, c.password = username, password
+	c.setToken(resp.Token)
+	c.refresh = resp.RefreshToken
+	return nil
+}
+
+// Logout revokes the token and the refresh token and forgets the
+// credentials.
+func (c *Client) Logout(ctx context.Context) error {
+	c.mu.Lock()
+	body := map[string]string{"refresh_token": c.refresh}
+	c.mu.Unlock()
+
+	if err := c.send(ctx, http.MethodPost, "/api/v1/logout", body, nil); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.token, c.expires, c.refresh = "", time.Time{}, ""
+	c.username, c.password = "", ""
+	return nil
+}
+
+// SetToken uses an already issued token. Without credentials or a refresh
+// token the client cannot renew it once it expires.
+func (c *Client) SetToken(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.setToken(token)
+}
+
+// SetRefreshToken uses an already issued refresh token to renew the token.
+func (c *Client) SetRefreshToken(refreshToken string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.refresh = refreshToken
+}
+
+// SetAPIKey authenticates requests with an API key instead of a token.
+func (c *Client) SetAPIKey(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.apiKey = key
+}
+
+func (c *Client) setToken(token string) {
+	c.token = token
+	c.expires = tokenExpiry(token)
+}
+
+// Calculate submits expression and returns its ID.
+func (c *Client) Calculate(ctx context.Context, expression string) (string, error) {
+	var resp struct {
+		ID string `json:"id"`
+	}
+	body := map[string]string{"expression": expression}
+	if err := c.do(ctx, http.MethodPost, "/api/v1/calculate", body, &resp); err != nil {
+		return "", err
+	}
+	return resp.ID, nil
+}
+
+func (c *Client) Get(ctx context.Context, id string) (*Expression, error) {
+	var resp struct {
+		Expression Expression `json:"Expression"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/api/v1/expressions/"+id, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp.Expression, nil
+}
+
+// List returns all expressions of the logged in user, newest first,
+// following the pages of the listing.
+func (c *Client) List(ctx context.Context) ([]Expression, error) {
+	var all []Expression
+	path := "/api/v1/expressions?limit=500"
+	for {
+		var resp struct {
+			Expressions []Expression `json:"expressions"`
+			NextCursor  string       `json:"next_cursor"`
+		}
+		if err := c.do(ctx, http.MethodGet, path, nil, &resp); err != nil {
+			return nil, err
+		}
+		all = append(all, resp.Expressions...)
+		if resp.NextCursor == "" {
+			return all, nil
+		}
+		path = "/api/v1/expressions?limit=500&cursor=" + url.QueryEscape(resp.NextCursor)
+	}
+}
+
+// Constants returns the values of the organisation's constants by name.
+// Built-in constants are not included.
+func (c *Client) Constants(ctx context.Context) (map[string]float64, error) {
+	var resp []struct {
+		Name    string  `json:"name"`
+		Value   float64 `json:"value"`
+		Builtin bool    `json:"builtin"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/api/v1/constants", nil, &resp); err != nil {
+		return nil, err
+	}
+
+	constants := make(map[string]float64, len(resp))
+	for _, constant := range resp {
+		if !constant.Builtin {
+			constants[constant.Name] = constant.Value
+		}
+	}
+	return constants, nil
+}
+
+// Wait polls the expression until it is done or failed, or ctx expires.
+func (c *Client) Wait(ctx context.Context, id string) (*Expression, error) {
+	ticker := time.NewTicker(c.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		expr, err := c.Get(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if expr.Done() || expr.Failed() {
+			return expr, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// do sends an authenticated request, renewing the token first if it is
+// about to expire and once more if the server rejects it.
+func (c *Client) do(ctx context.Context, method, path string, body, out any) error {
+	c.mu.Lock()
+	canRelogin := c.username != "" || c.refresh != ""
+	expiring := !c.expires.IsZero() && time.Until(c.expires) < refreshMargin
+	stale := c.token
+	c.mu.Unlock()
+
+	if canRelogin && expiring {
+		if err := c.relogin(ctx, stale); err != nil {
+			return err
+		}
+	}
+
+	err := c.send(ctx, method, path, body, out)
+
+	var apiErr *Error
+	if canRelogin && errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusUnauthorized {
+		if err := c.relogin(ctx, stale); err != nil {
+			return err
+		}
+		return c.send(ctx, method, path, body, out)
+	}
+	return err
+}
+
+// relogin replaces the stale token, renewing it with the refresh token and
+// falling back to the credentials if the refresh token is rejected. Refresh
+// tokens are single-use, so concurrent callers renew the token only once.
+func (c *Client) relogin(ctx context.Context, stale string) error {
+	c.renewing.Lock()
+	defer c.renewing.Unlock()
+
+	c.mu.Lock()
+	username, password, refresh := c.username, c.password, c.refresh
+	renewed := c.token != stale
+	c.mu.Unlock()
+	if renewed {
+		return nil
+	}
+
+	if refresh != "" {
+		var resp tokenResponse
+		err := c.send(ctx, http.MethodPost, "/api/v1/token/refresh", map[string]string{"refresh_token": refresh}, &resp)
+		if err == nil {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.setToken(resp.Token)
+			c.refresh = resp.RefreshToken
+			return nil
+		}
+		if username == "" {
+			return err
+		}
+	}
+
+	return c.Login(ctx, username, password)
+}
+
+func (c *Client) send(ctx context.Context, method, path string, body, out any) error {
+	var payload bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&payload).Encode(body); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, &payload)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	c.mu.Lock()
+	token, apiKey := c.token, c.apiKey
+	c.mu.Unlock()
+	if apiKey != "" {
+		req.Header.Set("X-API-Key", apiKey)
+	} else if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return decodeError(resp)
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// tokenExpiry reads the exp claim of a JWT without verifying it; the zero
+// time is returned when it cannot be determined.
+func tokenExpiry(token string) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}
+	}
+
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp == 0 {
+		return time.Time{}
+	}
+	return time.Unix(claims.Exp, 0)
+}
+
+func decodeError(resp *http.Response) error {
+	var raw bytes.Buffer
+	raw.ReadFrom(resp.Body)
+
+	var body struct {
+		Detail    string `json:"detail"`
+		Error     string `json:"error"`
+		Code      string `json:"code"`
+		RequestID string `json:"request_id"`
+	}
+	message := strings.TrimSpace(raw.String())
+	if json.Unmarshal(raw.Bytes(), &body) == nil {
+		if body.Detail != "" {
+			message = body.Detail
+		} else if body.Error != "" {
+			message = body.Error
+		}
+	}
+
+	apiErr := &Error{StatusCode: resp.StatusCode, Message: message, Code: body.Code, RequestID: body.RequestID}
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		apiErr.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	return apiErr
+}
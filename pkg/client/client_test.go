@@ -0,0 +1,321 @@
+package client
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeServer imitates the orchestrator: each login or refresh issues a new
+// token and refresh token and only the latest ones are accepted.
+type fakeServer struct {
+	mu        sync.Mutex
+	logins    int
+	refreshes int
+	token     string
+	refresh   string
+	polls     int
+}
+
+func (f *fakeServer) handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("POST /api/v1/register", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	mux.HandleFunc("POST /api/v1/login", func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		if body["password"] != "secret" {
+			http.Error(w, "invalid credentials", http.StatusUnauthorized)
+			return
+		}
+
+		f.mu.Lock()
+		f.logins++
+		resp := f.issue()
+		f.mu.Unlock()
+
+		json.NewEncoder(w).Encode(resp)
+	})
+
+	mux.HandleFunc("POST /api/v1/token/refresh", func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if body["refresh_token"] != f.refresh {
+			http.Error(w, "invalid refresh token", http.StatusUnauthorized)
+			return
+		}
+		f.refreshes++
+		json.NewEncoder(w).Encode(f.issue())
+	})
+
+	mux.HandleFunc("POST /api/v1/logout", f.authorized(func(w http.ResponseWriter, r *http.Request) {
+		f.revoke()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	mux.HandleFunc("POST /api/v1/calculate", f.authorized(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"id": "42"})
+	}))
+
+	mux.HandleFunc("GET /api/v1/expressions", f.authorized(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"expressions": []Expression{{ID: "42", Status: "DONE", Result: 6}}})
+	}))
+
+	mux.HandleFunc("GET /api/v1/expressions/{id}", f.authorized(func(w http.ResponseWriter, r *http.Request) {
+		if r.PathValue("id") != "42" {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "expression not found"})
+			return
+		}
+
+		f.mu.Lock()
+		f.polls++
+		status := "processing"
+		if f.polls >= 3 {
+			status = "DONE"
+		}
+		f.mu.Unlock()
+
+		json.NewEncoder(w).Encode(map[string]Expression{"Expression": {ID: "42", Status: status, Result: 6}})
+	}))
+
+	return mux
+}
+
+func (f *fakeServer) authorized(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		token := f.token
+		f.mu.Unlock()
+
+		if r.Header.Get("X-API-Key") == fakeAPIKey {
+			next(w, r)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer "+token {
+			http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+const fakeAPIKey = "calc_key"
+
+// issue replaces the tokens; f.mu must be held.
+func (f *fakeServer) issue() map[string]string {
+	n := f.logins + f.refreshes
+	f.token = fakeToken(n, time.Now().Add(time.Hour))
+	f.refresh = fmt.Sprintf("refresh-%d", n)
+	return map[string]string{"token": f.token, "refresh_token": f.refresh}
+}
+
+func (f *fakeServer) revoke() {
+	f.mu.Lock()
+	f.token = "revoked"
+	f.mu.Unlock()
+}
+
+func (f *fakeServer) revokeRefresh() {
+	f.mu.Lock()
+	f.refresh = "revoked"
+	f.mu.Unlock()
+}
+
+func fakeToken(n int, exp time.Time) string {
+	payload, _ := json.Marshal(map[string]any{"sub": "user", "exp": exp.Unix(), "n": n})
+	return "e30." + base64.RawURLEncoding.EncodeToString(payload) + ".sig"
+}
+
+func newTestClient(t *testing.T) (*Client, *fakeServer) {
+	t.Helper()
+
+	fake := &fakeServer{}
+	server := httptest.NewServer(fake.handler())
+	t.Cleanup(server.Close)
+
+	c := New(server.URL)
+	c.PollInterval = time.Millisecond
+	return c, fake
+}
+
+func TestClient(t *testing.T) {
+	ctx := context.Background()
+	c, fake := newTestClient(t)
+
+	require.NoError(t, c.Register(ctx, "user", "secret"))
+	require.NoError(t, c.Login(ctx, "user", "secret"))
+
+	id, err := c.Calculate(ctx, "2+2*2")
+	require.NoError(t, err)
+	assert.Equal(t, "42", id)
+
+	expr, err := c.Wait(ctx, id)
+	require.NoError(t, err)
+	assert.True(t, expr.Done())
+	assert.Equal(t, 6.0, expr.Result)
+	assert.Equal(t, 3, fake.polls)
+
+	exprs, err := c.List(ctx)
+	require.NoError(t, err)
+	assert.Len(t, exprs, 1)
+
+	_, err = c.Get(ctx, "missing")
+	var apiErr *Error
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusNotFound, apiErr.StatusCode)
+	assert.Equal(t, "expression not found", apiErr.Message)
+}
+
+func TestClientRelogin(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("RejectedToken", func(t *testing.T) {
+		c, fake := newTestClient(t)
+		require.NoError(t, c.Login(ctx, "user", "secret"))
+
+		fake.revoke()
+		_, err := c.Calculate(ctx, "1+1")
+		require.NoError(t, err)
+		assert.Equal(t, 1, fake.logins)
+		assert.Equal(t, 1, fake.refreshes)
+	})
+
+	t.Run("RejectedRefreshToken", func(t *testing.T) {
+		c, fake := newTestClient(t)
+		require.NoError(t, c.Login(ctx, "user", "secret"))
+
+		fake.revoke()
+		fake.revokeRefresh()
+		_, err := c.Calculate(ctx, "1+1")
+		require.NoError(t, err)
+		assert.Equal(t, 2, fake.logins)
+		assert.Equal(t, 0, fake.refreshes)
+	})
+
+	t.Run("ConcurrentRenewal", func(t *testing.T) {
+		c, fake := newTestClient(t)
+		require.NoError(t, c.Login(ctx, "user", "secret"))
+
+		fake.revoke()
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := c.Calculate(ctx, "1+1")
+				assert.NoError(t, err)
+			}()
+		}
+		wg.Wait()
+		assert.Equal(t, 1, fake.logins)
+		assert.Equal(t, 1, fake.refreshes)
+	})
+
+	t.Run("RefreshTokenOnly", func(t *testing.T) {
+		c, fake := newTestClient(t)
+		require.NoError(t, c.Login(ctx, "user", "secret"))
+		refresh := fake.refresh
+
+		other := New(c.BaseURL)
+		other.SetToken("stale")
+		other.SetRefreshToken(refresh)
+		_, err := other.List(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 1, fake.refreshes)
+	})
+
+	t.Run("ExpiringToken", func(t *testing.T) {
+		c, fake := newTestClient(t)
+		require.NoError(t, c.Login(ctx, "user", "secret"))
+
+		c.SetToken(fakeToken(0, time.Now().Add(10*time.Second)))
+		_, err := c.List(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 1, fake.logins)
+		assert.Equal(t, 1, fake.refreshes)
+	})
+
+	t.Run("NoCredentials", func(t *testing.T) {
+		c, fake := newTestClient(t)
+		c.SetToken("stale")
+
+		_, err := c.List(ctx)
+		var apiErr *Error
+		require.ErrorAs(t, err, &apiErr)
+		assert.Equal(t, http.StatusUnauthorized, apiErr.StatusCode)
+		assert.Equal(t, 0, fake.logins)
+	})
+}
+
+func TestLogout(t *testing.T) {
+	ctx := context.Background()
+	c, fake := newTestClient(t)
+	require.NoError(t, c.Login(ctx, "user", "secret"))
+
+	require.NoError(t, c.Logout(ctx))
+	assert.Equal(t, "revoked", fake.token)
+
+	// Without a token or credentials the client cannot log in again.
+	_, err := c.List(ctx)
+	var apiErr *Error
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusUnauthorized, apiErr.StatusCode)
+	assert.Equal(t, 1, fake.logins)
+}
+
+func TestAPIKey(t *testing.T) {
+	ctx := context.Background()
+	c, fake := newTestClient(t)
+	c.SetAPIKey(fakeAPIKey)
+
+	exprs, err := c.List(ctx)
+	require.NoError(t, err)
+	assert.Len(t, exprs, 1)
+	assert.Zero(t, fake.logins)
+
+	c.SetAPIKey("calc_revoked")
+	_, err = c.List(ctx)
+	var apiErr *Error
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusUnauthorized, apiErr.StatusCode)
+}
+
+func TestTokenExpiry(t *testing.T) {
+	exp := time.Unix(1700000000, 0)
+	assert.Equal(t, exp, tokenExpiry(fakeToken(1, exp)))
+	assert.True(t, tokenExpiry("not-a-jwt").IsZero())
+	assert.True(t, tokenExpiry(fmt.Sprintf("a.%s.c", "!!")).IsZero())
+}
+
+func TestRetryAfter(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.Header().Set("Retry-After", "42")
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"detail":"too many requests; try again later","code":"rate_limited"}`))
+	}))
+	defer ts.Close()
+
+	err := New(ts.URL).Login(context.Background(), "alice", "secret")
+	var apiErr *Error
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, "rate_limited", apiErr.Code)
+	assert.Equal(t, 42*time.Second, apiErr.RetryAfter)
+}
@@ -0,0 +1,117 @@
+// Package cache keeps the results of evaluated expressions and subtrees so
+// that repeated work is answered without dispatching tasks to the agents.
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+type Stats struct {
+	Hits    int64 `json:"hits"`
+	Misses  int64 `json:"misses"`
+	Entries int   `json:"entries"`
+}
+
+type entry struct {
+	key     string
+	value   float64
+	expires time.Time
+}
+
+// Cache is a least recently used cache of results whose entries expire
+// after a TTL. The zero value is not usable; use New.
+type Cache struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	order      *list.List // front is the most recently used
+	entries    map[string]*list.Element
+	hits       int64
+	misses     int64
+	now        func() time.Time
+}
+
+// New returns a cache holding at most maxEntries results for ttl each.
+// A cache with maxEntries <= 0 stores nothing.
+func New(ttl time.Duration, maxEntries int) *Cache {
+	return &Cache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		order:      list.New(),
+		entries:    make(map[string]*list.Element),
+		now:        time.Now,
+	}
+}
+
+func (c *Cache) Get(key string) (float64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if ok && c.now().After(elem.Value.(*entry).expires) {
+		c.remove(elem)
+		ok = false
+	}
+	if !ok {
+		c.misses++
+		return 0, false
+	}
+
+	c.hits++
+	c.order.MoveToFront(elem)
+	return elem.Value.(*entry).value, true
+}
+
+func (c *Cache) Put(key string, value float64) {
+	if c.maxEntries <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expires := c.now().Add(c.ttl)
+	if elem, ok := c.entries[key]; ok {
+		e := elem.Value.(*entry)
+		e.value, e.expires = value, expires
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&entry{key: key, value: value, expires: expires})
+	for c.order.Len() > c.maxEntries {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return Stats{Hits: c.hits, Misses: c.misses, Entries: c.order.Len()}
+}
+
+func (c *Cache) remove(elem *list.Element) {
+	c.order.Remove(elem)
+	delete(c.entries, elem.Value.(*entry).key)
+}
+
+// Prefixed returns a view of the cache whose keys are scoped by prefix.
+func (c *Cache) Prefixed(prefix string) *View {
+	return &View{cache: c, prefix: prefix}
+}
+
+// View is a part of a Cache whose keys share a prefix.
+type View struct {
+	cache  *Cache
+	prefix string
+}
+
+func (v *View) Get(key string) (float64, bool) {
+	return v.cache.Get(v.prefix + key)
+}
+
+func (v *View) Put(key string, value float64) {
+	v.cache.Put(v.prefix+key, value)
+}
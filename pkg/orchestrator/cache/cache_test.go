@@ -0,0 +1,64 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCache(t *testing.T) {
+	c := New(time.Minute, 2)
+
+	_, ok := c.Get("a")
+	assert.False(t, ok)
+
+	c.Put("a", 1)
+	c.Put("b", 2)
+	value, ok := c.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, 1.0, value)
+
+	// "b" is the least recently used entry and makes room for "c".
+	c.Put("c", 3)
+	_, ok = c.Get("b")
+	assert.False(t, ok)
+	_, ok = c.Get("c")
+	assert.True(t, ok)
+
+	assert.Equal(t, Stats{Hits: 2, Misses: 2, Entries: 2}, c.Stats())
+}
+
+func TestCacheTTL(t *testing.T) {
+	now := time.Now()
+	c := New(time.Minute, 10)
+	c.now = func() time.Time { return now }
+
+	c.Put("a", 1)
+	now = now.Add(2 * time.Minute)
+
+	_, ok := c.Get("a")
+	assert.False(t, ok)
+	assert.Equal(t, 0, c.Stats().Entries)
+}
+
+func TestCacheDisabled(t *testing.T) {
+	c := New(time.Minute, 0)
+	c.Put("a", 1)
+
+	_, ok := c.Get("a")
+	assert.False(t, ok)
+}
+
+func TestPrefixed(t *testing.T) {
+	c := New(time.Minute, 10)
+	one, two := c.Prefixed("1/"), c.Prefixed("2/")
+
+	one.Put("a", 1)
+	_, ok := two.Get("a")
+	assert.False(t, ok)
+
+	value, ok := one.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, 1.0, value)
+}
@@ -3,6 +3,7 @@ package config
 import (
 	"os"
 	"strconv"
+	"strings"
 )
 
 type Config struct {
@@ -11,6 +12,88 @@ type Config struct {
 	Subtime       int
 	MultiplicTime int
 	Divtime       int
+	// Admins get the admin role at startup. They must be registered
+	// already.
+	Admins []string
+
+	// Limits protecting the cluster from oversized expressions.
+	MaxExpressionLength      int
+	MaxDepth                 int
+	MaxTasks                 int
+	MaxConcurrentExpressions int
+	MaxBatchSize             int
+	// Batch expressions run on a budget of their own, so a large batch
+	// does not keep the user from calculating.
+	MaxConcurrentBatchExpressions int
+	// An agent has the operation time plus TaskTimeoutSlackMs to return
+	// the result of a task before the expression fails. A non-positive
+	// value disables the timeout.
+	TaskTimeoutSlackMs int
+	// Request bodies larger than these are rejected; batches get their own,
+	// larger limit.
+	MaxBodyBytes      int
+	MaxBatchBodyBytes int
+
+	// IdempotencyWindowHours is how long an Idempotency-Key is remembered.
+	IdempotencyWindowHours int
+
+	// Results of expressions and their subtrees are cached for
+	// CacheTTLSeconds. A negative CacheMaxEntries disables the cache.
+	CacheTTLSeconds int
+	CacheMaxEntries int
+
+	// JWT keys: an HS256 secret and older secrets still accepted, and a
+	// directory of PEM encoded RS256/EdDSA keys re-read every
+	// JWTKeysReloadSeconds, so that keys can be rotated without a restart.
+	JWTSecret            string
+	JWTPreviousSecrets   []string
+	JWTKeysDir           string
+	JWTKeysReloadSeconds int
+
+	// Lifetimes of access tokens and of the refresh tokens that renew them.
+	AccessTokenTTLMinutes int
+	RefreshTokenTTLHours  int
+
+	// WebhookSecret signs the results posted to callback URLs.
+	WebhookSecret      string
+	WebhookMaxAttempts int
+
+	// Each user, or each client address for requests without credentials,
+	// may make RateLimitPerMinute requests a minute with bursts of up to
+	// RateLimitBurst. RateLimitUsers overrides the per-minute quota of
+	// particular users. A negative RateLimitPerMinute disables the limit.
+	RateLimitPerMinute int
+	RateLimitBurst     int
+	RateLimitUsers     map[string]int
+	// Before their credentials are checked, requests are limited to
+	// RateLimitIPPerMinute a minute, with bursts of up to RateLimitIPBurst,
+	// per client address. A negative RateLimitIPPerMinute disables the
+	// limit.
+	RateLimitIPPerMinute int
+	RateLimitIPBurst     int
+
+	// After LoginMaxAttempts failed logins to a username from a client
+	// address, or LoginMaxAttemptsPerIP from an address to any username,
+	// logins from the address are locked for LoginLockoutSeconds, doubling
+	// with each further failure up to LoginLockoutMaxSeconds. After
+	// LoginMaxAttemptsPerUser failed logins to a username from any
+	// addresses, logins to it are locked the same way, but only up to
+	// LoginUserLockoutMaxSeconds, as anyone can cause this lockout.
+	LoginMaxAttempts           int
+	LoginMaxAttemptsPerIP      int
+	LoginMaxAttemptsPerUser    int
+	LoginLockoutSeconds        int
+	LoginLockoutMaxSeconds     int
+	LoginUserLockoutMaxSeconds int
+
+	// WSAllowedOrigins lists the origins, besides the server's own, of
+	// pages allowed to open WebSocket connections, e.g.
+	// "https://app.example.com".
+	WSAllowedOrigins []string
+
+	// TrustProxy takes client addresses from X-Forwarded-For; set it only
+	// behind a reverse proxy that sets the header.
+	TrustProxy bool
 }
 
 func getEnv(key string, defaultValue int) int {
@@ -21,6 +104,29 @@ func getEnv(key string, defaultValue int) int {
 	return value
 }
 
+func getEnvList(key string) []string {
+	var values []string
+	for _, value := range strings.Split(os.Getenv(key), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// getEnvQuotas parses a list like "alice:1200,bob:60". Like in getEnv,
+// zero means unset.
+func getEnvQuotas(key string) map[string]int {
+	quotas := make(map[string]int)
+	for _, value := range getEnvList(key) {
+		name, quota, ok := strings.Cut(value, ":")
+		if n, err := strconv.Atoi(strings.TrimSpace(quota)); ok && err == nil && n != 0 {
+			quotas[strings.TrimSpace(name)] = n
+		}
+	}
+	return quotas
+}
+
 func ConfigFromEnv() *Config {
 	return &Config{
 		Port:          strconv.Itoa(getEnv("PORT", 8081)),
@@ -28,5 +134,49 @@ func ConfigFromEnv() *Config {
 		Subtime:       getEnv("TIME_SUBTRACTION_MS", 10),
 		MultiplicTime: getEnv("TIME_MULTIPLICATIONS_MS", 10),
 		Divtime:       getEnv("TIME_DIVISIONS_MS", 10),
+		Admins:        getEnvList("ADMIN_USERS"),
+
+		MaxExpressionLength:           getEnv("MAX_EXPRESSION_LENGTH", 10000),
+		MaxDepth:                      getEnv("MAX_EXPRESSION_DEPTH", 100),
+		MaxTasks:                      getEnv("MAX_TASKS_PER_EXPRESSION", 1000),
+		MaxConcurrentExpressions:      getEnv("MAX_CONCURRENT_EXPRESSIONS", 10),
+		MaxBatchSize:                  getEnv("MAX_BATCH_SIZE", 10000),
+		MaxConcurrentBatchExpressions: getEnv("MAX_CONCURRENT_BATCH_EXPRESSIONS", 10),
+		TaskTimeoutSlackMs:            getEnv("TASK_TIMEOUT_SLACK_MS", 60000),
+		MaxBodyBytes:                  getEnv("MAX_BODY_BYTES", 1<<20),
+		MaxBatchBodyBytes:             getEnv("MAX_BATCH_BODY_BYTES", 32<<20),
+
+		IdempotencyWindowHours: getEnv("IDEMPOTENCY_WINDOW_HOURS", 24),
+
+		CacheTTLSeconds: getEnv("CACHE_TTL_SECONDS", 3600),
+		CacheMaxEntries: getEnv("CACHE_MAX_ENTRIES", 100000),
+
+		JWTSecret:            os.Getenv("JWT_SECRET"),
+		JWTPreviousSecrets:   getEnvList("JWT_PREVIOUS_SECRETS"),
+		JWTKeysDir:           os.Getenv("JWT_KEYS_DIR"),
+		JWTKeysReloadSeconds: getEnv("JWT_KEYS_RELOAD_SECONDS", 60),
+
+		AccessTokenTTLMinutes: getEnv("ACCESS_TOKEN_TTL_MINUTES", 60),
+		RefreshTokenTTLHours:  getEnv("REFRESH_TOKEN_TTL_HOURS", 720),
+
+		WebhookSecret:      os.Getenv("WEBHOOK_SECRET"),
+		WebhookMaxAttempts: getEnv("WEBHOOK_MAX_ATTEMPTS", 5),
+
+		RateLimitPerMinute:   getEnv("RATE_LIMIT_PER_MINUTE", 600),
+		RateLimitBurst:       getEnv("RATE_LIMIT_BURST", 200),
+		RateLimitUsers:       getEnvQuotas("RATE_LIMIT_USERS"),
+		RateLimitIPPerMinute: getEnv("RATE_LIMIT_IP_PER_MINUTE", 6000),
+		RateLimitIPBurst:     getEnv("RATE_LIMIT_IP_BURST", 2000),
+
+		LoginMaxAttempts:           getEnv("LOGIN_MAX_ATTEMPTS", 5),
+		LoginMaxAttemptsPerIP:      getEnv("LOGIN_MAX_ATTEMPTS_PER_IP", 20),
+		LoginMaxAttemptsPerUser:    getEnv("LOGIN_MAX_ATTEMPTS_PER_USER", 50),
+		LoginLockoutSeconds:        getEnv("LOGIN_LOCKOUT_SECONDS", 30),
+		LoginLockoutMaxSeconds:     getEnv("LOGIN_LOCKOUT_MAX_SECONDS", 3600),
+		LoginUserLockoutMaxSeconds: getEnv("LOGIN_USER_LOCKOUT_MAX_SECONDS", 300),
+
+		WSAllowedOrigins: getEnvList("WS_ALLOWED_ORIGINS"),
+
+		TrustProxy: os.Getenv("TRUST_PROXY") == "true",
 	}
 }
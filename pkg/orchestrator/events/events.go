@@ -0,0 +1,156 @@
+// Package events fans out expression progress to subscribers such as the
+// Server-Sent Events endpoints.
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// Event types.
+const (
+	// TypeStatus reports a change of the expression status. The terminal
+	// statuses carry the result or the error.
+	TypeStatus = "status"
+	// TypeTask reports a task being dispatched to the agents or finished.
+	TypeTask = "task"
+)
+
+// Task states.
+const (
+	TaskDispatched = "dispatched"
+	TaskDone       = "done"
+)
+
+type Event struct {
+	Type         string    `json:"type"`
+	ExpressionID string    `json:"expression_id"`
+	Username     string    `json:"-"`
+	Status       string    `json:"status,omitempty"`
+	Result       *float64  `json:"result,omitempty"`
+	Error        string    `json:"error,omitempty"`
+	Task         *Task     `json:"task,omitempty"`
+	Time         time.Time `json:"time"`
+}
+
+type Task struct {
+	ID        string   `json:"id"`
+	State     string   `json:"state"`
+	Operation string   `json:"operation,omitempty"`
+	Arg1      float64  `json:"arg1"`
+	Arg2      float64  `json:"arg2"`
+	Result    *float64 `json:"result,omitempty"`
+	Error     string   `json:"error,omitempty"`
+	// Completed and Total describe the progress of the whole expression.
+	Completed int `json:"completed"`
+	Total     int `json:"total"`
+}
+
+// subscriberBuffer is how many events a slow subscriber may lag behind
+// before events for it are dropped. Terminal events are kept in place of
+// older non-terminal ones, see Publish.
+const subscriberBuffer = 64
+
+type Subscription struct {
+	C            chan Event
+	username     string
+	expressionID string
+}
+
+type Hub struct {
+	mu   sync.Mutex
+	subs map[*Subscription]struct{}
+}
+
+func NewHub() *Hub {
+	return &Hub{subs: make(map[*Subscription]struct{})}
+}
+
+// Subscribe returns a subscription to the events of the user's expressions.
+// A non-empty expressionID limits it to that expression.
+func (h *Hub) Subscribe(username, expressionID string) *Subscription {
+	sub := &Subscription{
+		C:            make(chan Event, subscriberBuffer),
+		username:     username,
+		expressionID: expressionID,
+	}
+
+	h.mu.Lock()
+	h.subs[sub] = struct{}{}
+	h.mu.Unlock()
+
+	return sub
+}
+
+func (h *Hub) Unsubscribe(sub *Subscription) {
+	h.mu.Lock()
+	delete(h.subs, sub)
+	h.mu.Unlock()
+}
+
+// Publish delivers e to all matching subscribers without blocking. When a
+// subscriber's buffer is full, non-terminal events are dropped, while a
+// terminal event replaces the oldest buffered non-terminal one, so that
+// streams waiting for the end of an expression always get it. Only a
+// subscription to all expressions whose buffer holds nothing but terminal
+// events can lose one.
+func (h *Hub) Publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for sub := range h.subs {
+		if sub.username != e.Username {
+			continue
+		}
+		if sub.expressionID != "" && sub.expressionID != e.ExpressionID {
+			continue
+		}
+
+		select {
+		case sub.C <- e:
+		default:
+			if e.Terminal() {
+				sub.evict(e)
+			}
+		}
+	}
+}
+
+// evict replaces the oldest non-terminal event buffered for sub with e.
+// Publish is the only sender and holds the hub's lock, so putting the
+// remaining events back cannot block even if the subscriber is reading
+// them at the same time.
+func (sub *Subscription) evict(e Event) {
+	var kept []Event
+	evicted := false
+drain:
+	for {
+		select {
+		case buffered := <-sub.C:
+			if !evicted && !buffered.Terminal() {
+				evicted = true
+				continue
+			}
+			kept = append(kept, buffered)
+		default:
+			break drain
+		}
+	}
+
+	for _, buffered := range kept {
+		sub.C <- buffered
+	}
+	select {
+	case sub.C <- e:
+	default:
+	}
+}
+
+// Terminal reports whether e is the last event of its expression.
+func (e Event) Terminal() bool {
+	return e.Type == TypeStatus && e.Status != "" && e.Status != "processing"
+}
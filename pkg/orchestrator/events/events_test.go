@@ -0,0 +1,74 @@
+package events
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHub(t *testing.T) {
+	hub := NewHub()
+
+	firehose := hub.Subscribe("alice", "")
+	single := hub.Subscribe("alice", "expr-1")
+	other := hub.Subscribe("bob", "")
+
+	hub.Publish(Event{Type: TypeStatus, ExpressionID: "expr-1", Username: "alice", Status: "processing"})
+	hub.Publish(Event{Type: TypeStatus, ExpressionID: "expr-2", Username: "alice", Status: "DONE"})
+
+	assert.Len(t, firehose.C, 2)
+	assert.Len(t, single.C, 1)
+	assert.Len(t, other.C, 0)
+
+	e := <-single.C
+	assert.Equal(t, "expr-1", e.ExpressionID)
+	assert.False(t, e.Time.IsZero())
+	assert.False(t, e.Terminal())
+
+	hub.Unsubscribe(single)
+	hub.Publish(Event{Type: TypeStatus, ExpressionID: "expr-1", Username: "alice", Status: "DONE"})
+	assert.Len(t, single.C, 0)
+	assert.Len(t, firehose.C, 3)
+}
+
+func TestHubSlowSubscriber(t *testing.T) {
+	hub := NewHub()
+	sub := hub.Subscribe("alice", "")
+
+	for i := 0; i < subscriberBuffer*2; i++ {
+		hub.Publish(Event{Type: TypeTask, ExpressionID: "expr-1", Username: "alice"})
+	}
+
+	assert.Len(t, sub.C, subscriberBuffer)
+
+	// The terminal event takes the place of the oldest task event.
+	hub.Publish(Event{Type: TypeStatus, ExpressionID: "expr-1", Username: "alice", Status: "DONE"})
+	assert.Len(t, sub.C, subscriberBuffer)
+	var last Event
+	for range subscriberBuffer {
+		last = <-sub.C
+	}
+	assert.True(t, last.Terminal())
+}
+
+func TestHubSlowSubscriberAllTerminal(t *testing.T) {
+	hub := NewHub()
+	sub := hub.Subscribe("alice", "")
+
+	for i := 0; i < subscriberBuffer+1; i++ {
+		hub.Publish(Event{Type: TypeStatus, ExpressionID: fmt.Sprint("expr-", i), Username: "alice", Status: "DONE"})
+	}
+
+	// With nothing to evict the newest event is dropped.
+	require.Len(t, sub.C, subscriberBuffer)
+	assert.Equal(t, "expr-0", (<-sub.C).ExpressionID)
+}
+
+func TestTerminal(t *testing.T) {
+	assert.True(t, Event{Type: TypeStatus, Status: "DONE"}.Terminal())
+	assert.True(t, Event{Type: TypeStatus, Status: "error"}.Terminal())
+	assert.False(t, Event{Type: TypeStatus, Status: "processing"}.Terminal())
+	assert.False(t, Event{Type: TypeTask, Status: "processing"}.Terminal())
+}
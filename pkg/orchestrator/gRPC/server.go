@@ -2,36 +2,94 @@ package grpc
 
 import (
 	"context"
+	"sync"
 
 	"github.com/StepanShel/YandexProject/proto/calc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type Server struct {
 	calc.CalculatorServer
-	Tasks   chan *calc.Task
-	AgentCh chan *calc.Result
+	Tasks chan *calc.Task
+
+	mu      sync.Mutex
+	pending map[string]pendingTask
+}
+
+// pendingTask is a task that was submitted and has no result yet.
+type pendingTask struct {
+	expressionID string
+	results      chan<- *calc.Result
 }
 
 func NewServer() *Server {
 	return &Server{
-		Tasks: make(chan *calc.Task, 100),
+		Tasks:   make(chan *calc.Task, 100),
+		pending: make(map[string]pendingTask),
+	}
+}
+
+// Submit queues task of the given expression for the agents. The agent's
+// result for it is delivered to results, which must be able to accept it
+// without blocking forever.
+func (s *Server) Submit(expressionID string, task *calc.Task, results chan<- *calc.Result) {
+	s.mu.Lock()
+	s.pending[task.Id] = pendingTask{expressionID: expressionID, results: results}
+	s.mu.Unlock()
+
+	s.Tasks <- task
+}
+
+// Drop forgets all tasks of the expression. Tasks still queued are skipped
+// instead of being handed to an agent, and results for tasks already being
+// computed are rejected.
+func (s *Server) Drop(expressionID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, task := range s.pending {
+		if task.expressionID == expressionID {
+			delete(s.pending, id)
+		}
 	}
 }
 
 func (s *Server) GetTask(ctx context.Context, _ *calc.Empty) (*calc.Task, error) {
-	select {
-	case task := <-s.Tasks:
-		return task, nil
-	case <-ctx.Done():
-		return nil, ctx.Err()
+	for {
+		select {
+		case task := <-s.Tasks:
+			if s.isPending(task.Id) {
+				return task, nil
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
 	}
 }
 
+func (s *Server) isPending(taskID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.pending[taskID]
+	return ok
+}
+
 func (s *Server) SendResult(ctx context.Context, result *calc.Result) (*calc.Empty, error) {
+	s.mu.Lock()
+	task, ok := s.pending[result.TaskId]
+	delete(s.pending, result.TaskId)
+	s.mu.Unlock()
+
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "unknown task %s", result.TaskId)
+	}
+
 	select {
 	case <-ctx.Done():
 		return nil, ctx.Err()
-	case s.AgentCh <- result:
+	case task.results <- result:
 		return &calc.Empty{}, nil
 	}
 }
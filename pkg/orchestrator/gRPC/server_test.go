@@ -0,0 +1,58 @@
+package grpc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/StepanShel/YandexProject/proto/calc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestSubmitRoutesResults(t *testing.T) {
+	s := NewServer()
+	results1 := make(chan *calc.Result, 1)
+	results2 := make(chan *calc.Result, 1)
+
+	s.Submit("expr-1", &calc.Task{Id: "t1"}, results1)
+	s.Submit("expr-2", &calc.Task{Id: "t2"}, results2)
+
+	_, err := s.SendResult(context.Background(), &calc.Result{TaskId: "t2", Result: 2})
+	require.NoError(t, err)
+	_, err = s.SendResult(context.Background(), &calc.Result{TaskId: "t1", Result: 1})
+	require.NoError(t, err)
+
+	assert.Equal(t, "t1", (<-results1).TaskId)
+	assert.Equal(t, "t2", (<-results2).TaskId)
+
+	// Повторный результат той же задачи отклоняется
+	_, err = s.SendResult(context.Background(), &calc.Result{TaskId: "t1"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestDrop(t *testing.T) {
+	s := NewServer()
+	results := make(chan *calc.Result, 1)
+
+	s.Submit("cancelled", &calc.Task{Id: "t1"}, results)
+	s.Submit("cancelled", &calc.Task{Id: "t2"}, results)
+	s.Submit("running", &calc.Task{Id: "t3"}, results)
+
+	s.Drop("cancelled")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	task, err := s.GetTask(ctx, &calc.Empty{})
+	require.NoError(t, err)
+	assert.Equal(t, "t3", task.Id)
+
+	_, err = s.GetTask(ctx, &calc.Empty{})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	_, err = s.SendResult(context.Background(), &calc.Result{TaskId: "t1"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
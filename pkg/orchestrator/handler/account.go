@@ -0,0 +1,69 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/StepanShel/YandexProject/internal/jsonbody"
+	"github.com/StepanShel/YandexProject/internal/repo"
+)
+
+// endpoint DELETE api/v1/account
+//
+// Deletes the account with all its expressions once the password is
+// confirmed. Running expressions are cancelled first.
+func (server *Server) HandleDeleteAccount(w http.ResponseWriter, r *http.Request) {
+	username, ok := r.Context().Value("username").(string)
+	if !ok {
+		respJson(w, errUnauthorized, http.StatusUnauthorized)
+		return
+	}
+
+	var request AccountDeletionRequest
+	if code, err := jsonbody.Decode(w, r, &request, int64(server.Config.MaxBodyBytes)); err != nil {
+		respJson(w, err, code)
+		return
+	}
+
+	if !server.confirmPassword(w, r, username, request.Password) {
+		return
+	}
+
+	if err := server.cancelAll(username); err != nil {
+		fmt.Println(err)
+		respJson(w, errors.New("failed to delete account"), http.StatusInternalServerError)
+		return
+	}
+	if err := server.Repo.DeleteUser(username); err != nil {
+		fmt.Println(err)
+		respJson(w, errors.New("failed to delete account"), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// cancelAll cancels all unfinished expressions of the user.
+func (server *Server) cancelAll(username string) error {
+	filter := repo.ExpressionFilter{
+		Username: username,
+		Statuses: []string{repo.StatusPending, repo.StatusProcessing},
+		Limit:    maxPageSize,
+	}
+	for {
+		expressions, next, err := server.Repo.ListExpressions(filter)
+		if err != nil {
+			return err
+		}
+		for _, expr := range expressions {
+			if err := server.cancelExpression(expr.ID, username); err != nil && !errors.Is(err, errNotRunning) {
+				return err
+			}
+		}
+		if next == nil {
+			return nil
+		}
+		filter.After = next
+	}
+}
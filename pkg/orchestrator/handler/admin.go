@@ -0,0 +1,190 @@
+package handler
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/StepanShel/YandexProject/internal/jsonbody"
+	"github.com/StepanShel/YandexProject/internal/problem"
+	"github.com/StepanShel/YandexProject/internal/repo"
+	"github.com/StepanShel/YandexProject/pkg/orchestrator/config"
+)
+
+// The api/v1/admin endpoints are routed for admins only, see Routes.
+
+var errUserNotFound = problem.New("user_not_found", "user not found")
+
+func newUserInfo(user *repo.User) UserInfo {
+	return UserInfo{Username: user.Username, Role: user.Role, Disabled: user.Disabled}
+}
+
+// endpoint api/v1/admin/users
+func (server *Server) HandleAdminUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := server.Repo.ListUsers()
+	if err != nil {
+		fmt.Println(err)
+		respJson(w, errors.New("failed to get users"), http.StatusInternalServerError)
+		return
+	}
+
+	result := make([]UserInfo, 0, len(users))
+	for i := range users {
+		result = append(result, newUserInfo(&users[i]))
+	}
+
+	respJson(w, ResponseUsers{Users: result}, 200)
+}
+
+// endpoint api/v1/admin/users/:username
+//
+// Changes the role of a user or disables the account. Admins cannot change
+// their own account, so that there is always an admin left.
+func (server *Server) HandleAdminUpdateUser(w http.ResponseWriter, r *http.Request) {
+	username, ok := r.Context().Value("username").(string)
+	if !ok {
+		respJson(w, errUnauthorized, http.StatusUnauthorized)
+		return
+	}
+
+	var request UserUpdate
+	if code, err := jsonbody.Decode(w, r, &request, int64(server.Config.MaxBodyBytes)); err != nil {
+		respJson(w, err, code)
+		return
+	}
+	if request.Role != nil && !repo.ValidRole(*request.Role) {
+		respJson(w, problem.Errorf("invalid_role", "role must be %s, %s or %s", repo.RoleUser, repo.RoleAdmin, repo.RoleReadonly), 422)
+		return
+	}
+
+	target := r.PathValue("username")
+	if target == username {
+		respJson(w, problem.New("cannot_modify_self", "admins cannot change their own account"), http.StatusConflict)
+		return
+	}
+
+	err := func() error {
+		if request.Role != nil {
+			if err := server.Repo.SetUserRole(target, *request.Role); err != nil {
+				return err
+			}
+		}
+		if request.Disabled != nil {
+			return server.Repo.SetUserDisabled(target, *request.Disabled)
+		}
+		return nil
+	}()
+	if err == nil {
+		var user *repo.User
+		if user, err = server.Repo.GetUserByName(target); err == nil {
+			respJson(w, newUserInfo(user), 200)
+			return
+		}
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		respJson(w, errUserNotFound, 404)
+		return
+	}
+	fmt.Println(err)
+	respJson(w, errors.New("failed to update user"), http.StatusInternalServerError)
+}
+
+// endpoint api/v1/admin/expressions?owner=
+//
+// Lists the expressions of any user, with the query parameters of
+// api/v2/expressions.
+func (server *Server) HandleAdminExpressions(w http.ResponseWriter, r *http.Request) {
+	owner := r.URL.Query().Get("owner")
+	if owner == "" {
+		respJson(w, problem.New("invalid_parameter", "owner is required"), http.StatusBadRequest)
+		return
+	}
+
+	filter, err := parseListQuery(r.URL.Query(), owner, defaultPageSize)
+	if err != nil {
+		respJson(w, err, http.StatusBadRequest)
+		return
+	}
+	// The expressions of the owner, whatever the scope.
+	filter.Scope = repo.ScopeOwn
+	for _, status := range filter.Statuses {
+		if !statuses[status] {
+			respJson(w, problem.Errorf("invalid_parameter", "unknown status: %s", status), http.StatusBadRequest)
+			return
+		}
+	}
+
+	expressions, next, err := server.Repo.ListExpressions(filter)
+	if err != nil {
+		fmt.Println(err)
+		respJson(w, errors.New("failed to get expressions"), http.StatusInternalServerError)
+		return
+	}
+
+	result := make([]ExpressionV2, 0, len(expressions))
+	for i := range expressions {
+		result = append(result, newExpressionV2(&expressions[i]))
+	}
+
+	respJson(w, ResponseExpressionsV2{Expressions: result, NextCursor: encodeCursor(next)}, 200)
+}
+
+// endpoint api/v1/admin/expressions/:id
+func (server *Server) HandleAdminExpressionById(w http.ResponseWriter, r *http.Request) {
+	id, err := parseID(r.PathValue("id"))
+	if err != nil {
+		respJson(w, errInvalidID, http.StatusBadRequest)
+		return
+	}
+
+	expr, err := server.Repo.GetExpressionByID(id)
+	if err != nil {
+		respJson(w, errNotFound, 404)
+		return
+	}
+
+	respJson(w, newExpressionV2(expr), 200)
+}
+
+// endpoint api/v1/admin/settings/timings
+//
+// GET returns the operation timings, PUT replaces them. New timings apply to
+// the expressions submitted afterwards and last until the restart.
+func (server *Server) HandleAdminTimings(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		var request OperationTimings
+		if code, err := jsonbody.Decode(w, r, &request, int64(server.Config.MaxBodyBytes)); err != nil {
+			respJson(w, err, code)
+			return
+		}
+		if request.Addition <= 0 || request.Subtraction <= 0 || request.Multiplication <= 0 || request.Division <= 0 {
+			respJson(w, problem.New("invalid_timing", "all operation timings must be positive"), 422)
+			return
+		}
+
+		server.settingsMu.Lock()
+		server.Config.AddTime = request.Addition
+		server.Config.Subtime = request.Subtraction
+		server.Config.MultiplicTime = request.Multiplication
+		server.Config.Divtime = request.Division
+		server.settingsMu.Unlock()
+	}
+
+	cfg := server.timings()
+	respJson(w, OperationTimings{
+		Addition:       cfg.AddTime,
+		Subtraction:    cfg.Subtime,
+		Multiplication: cfg.MultiplicTime,
+		Division:       cfg.Divtime,
+	}, 200)
+}
+
+// timings returns a copy of the configuration with the current operation
+// timings, safe to read while admins change them.
+func (server *Server) timings() *config.Config {
+	server.settingsMu.RLock()
+	defer server.settingsMu.RUnlock()
+	cfg := *server.Config
+	return &cfg
+}
@@ -0,0 +1,262 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/StepanShel/YandexProject/internal/jsonbody"
+	"github.com/StepanShel/YandexProject/internal/problem"
+	"github.com/StepanShel/YandexProject/internal/repo"
+	"github.com/StepanShel/YandexProject/pkg/orchestrator/events"
+	parser "github.com/StepanShel/YandexProject/pkg/orchestrator/parser"
+	uuid "github.com/google/uuid"
+)
+
+// endpoint api/v1/calculate/batch
+//
+// Unlike api/v1/calculate, a batch is accepted only if every expression in it
+// is valid; nothing is stored otherwise.
+func (server *Server) HandleCalculateBatch(w http.ResponseWriter, r *http.Request) {
+	username, ok := r.Context().Value("username").(string)
+	if !ok {
+		respJson(w, errUnauthorized, http.StatusUnauthorized)
+		return
+	}
+
+	items, code, err := server.decodeBatch(w, r)
+	if err != nil {
+		respJson(w, err, code)
+		return
+	}
+
+	if len(items) == 0 {
+		respJson(w, problem.New("batch_empty", "batch is empty"), 422)
+		return
+	}
+	if len(items) > server.Config.MaxBatchSize {
+		respJson(w, problem.Errorf("batch_too_large", "batch has more than %d expressions", server.Config.MaxBatchSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	set, err := server.loadConstants()
+	if err != nil {
+		fmt.Println(err)
+		respJson(w, errors.New("failed to load constants"), http.StatusInternalServerError)
+		return
+	}
+
+	nodes := make([]*parser.Node, len(items))
+	results := make([]parser.Cache, len(items))
+	exprs := make([]*repo.Expression, len(items))
+	var invalid []BatchItemError
+	for i, item := range items {
+		node, constants, err := server.prepareBatchItem(set, item)
+		if err != nil {
+			invalid = append(invalid, BatchItemError{Index: i, Code: problem.Code(err, http.StatusUnprocessableEntity), Error: err.Error()})
+			continue
+		}
+		nodes[i] = node
+		results[i] = server.resultCache()
+		if item.NoCache {
+			results[i] = bypassCache{results[i]}
+		}
+		exprs[i] = &repo.Expression{
+			ID:          uuid.New(),
+			Username:    username,
+			Expression:  item.Expression,
+			Status:      repo.StatusPending,
+			Constants:   constants,
+			CallbackURL: item.CallbackURL,
+		}
+	}
+	if len(invalid) > 0 {
+		respJson(w, &problem.Error{Code: "invalid_batch", Detail: "invalid expressions in batch", Items: invalid}, 422)
+		return
+	}
+
+	batch := &repo.Batch{ID: uuid.New(), Username: username}
+	if err := server.Repo.CreateBatch(batch, exprs); err != nil {
+		fmt.Println(err)
+		respJson(w, errors.New("failed to save batch"), http.StatusInternalServerError)
+		return
+	}
+
+	ids := make([]string, len(exprs))
+	ctxs := make([]context.Context, len(exprs))
+	for i, expr := range exprs {
+		ids[i] = expr.ID.String()
+
+		var cancel context.CancelFunc
+		ctxs[i], cancel = context.WithCancel(context.Background())
+		server.track(expr.ID, cancel)
+
+		server.publishStatus(expr, events.Event{
+			Type:         events.TypeStatus,
+			ExpressionID: expr.ID.String(),
+			Username:     username,
+			Status:       legacyStatus(expr.Status),
+		})
+	}
+
+	go server.runBatch(ctxs, nodes, exprs, results)
+
+	respJson(w, ResponseBatch{BatchID: batch.ID.String(), IDs: ids}, http.StatusCreated)
+}
+
+// decodeBatch accepts either a bare array of items or an object holding
+// them in "expressions".
+func (server *Server) decodeBatch(w http.ResponseWriter, r *http.Request) ([]BatchItem, int, error) {
+	data, code, err := jsonbody.Read(w, r, int64(server.Config.MaxBatchBodyBytes))
+	if err != nil {
+		return nil, code, err
+	}
+
+	var items []BatchItem
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		err = jsonbody.Unmarshal(trimmed, &items)
+	} else {
+		var request BatchRequest
+		err = jsonbody.Unmarshal(data, &request)
+		items = request.Expressions
+	}
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	return items, http.StatusOK, nil
+}
+
+func (server *Server) prepareBatchItem(set *constantSet, item BatchItem) (*parser.Node, []repo.ConstantUsage, error) {
+	if strings.TrimSpace(item.Expression) == "" {
+		return nil, nil, errEmptyExpression
+	}
+	if item.CallbackURL != "" {
+		if err := server.validateCallback(item.CallbackURL); err != nil {
+			return nil, nil, err
+		}
+	}
+	if utf8.RuneCountInString(item.Expression) > server.Config.MaxExpressionLength {
+		return nil, nil, problem.Errorf("expression_too_long", "expression is longer than %d characters", server.Config.MaxExpressionLength)
+	}
+	if err := validateVariables(item.Variables); err != nil {
+		return nil, nil, err
+	}
+
+	node, constants, err := set.parse(item.Expression, item.Variables)
+	if err != nil {
+		return nil, nil, problem.New("invalid_expression", err.Error())
+	}
+	if err := server.checkComplexity(node); err != nil {
+		return nil, nil, err
+	}
+	return node, constants, nil
+}
+
+// runBatch starts the expressions of a batch in order as the owner's batch
+// slots become free, leaving the slots of single expressions alone.
+// Expressions cancelled while waiting are never started.
+func (server *Server) runBatch(ctxs []context.Context, nodes []*parser.Node, exprs []*repo.Expression, results []parser.Cache) {
+	for i, expr := range exprs {
+		held := slot{username: expr.Username, batch: true}
+		if ctxs[i].Err() != nil || !server.acquireWait(ctxs[i], held) {
+			server.untrack(expr.ID)
+			if err := server.setStatus(expr, 0, repo.StatusCancelled, nil); err != nil {
+				fmt.Println(err)
+			}
+			continue
+		}
+		go server.run(ctxs[i], held, nodes[i], expr, results[i])
+	}
+}
+
+// endpoint api/v1/batches/:id
+func (server *Server) HandleBatch(w http.ResponseWriter, r *http.Request) {
+	batch, ok := server.lookupBatch(w, r)
+	if !ok {
+		return
+	}
+
+	counts := make(map[string]int, len(batch.Counts))
+	for status, count := range batch.Counts {
+		counts[legacyStatus(status)] += count
+	}
+
+	respJson(w, Batch{
+		ID:        batch.ID.String(),
+		Status:    legacyStatus(batchStatus(batch)),
+		Total:     batch.Total,
+		Counts:    counts,
+		CreatedAt: batch.CreatedAt,
+	}, 200)
+}
+
+// endpoint api/v2/batches/:id
+func (server *Server) HandleBatchV2(w http.ResponseWriter, r *http.Request) {
+	batch, ok := server.lookupBatch(w, r)
+	if !ok {
+		return
+	}
+
+	respJson(w, Batch{
+		ID:        batch.ID.String(),
+		Status:    batchStatus(batch),
+		Total:     batch.Total,
+		Counts:    batch.Counts,
+		CreatedAt: batch.CreatedAt,
+	}, 200)
+}
+
+// lookupBatch loads the batch named in the request path, writing the error
+// response if it cannot be shown to the user.
+func (server *Server) lookupBatch(w http.ResponseWriter, r *http.Request) (*repo.Batch, bool) {
+	username, ok := r.Context().Value("username").(string)
+	if !ok {
+		respJson(w, errUnauthorized, http.StatusUnauthorized)
+		return nil, false
+	}
+
+	id, err := parseID(r.PathValue("id"))
+	if err != nil {
+		respJson(w, problem.New("invalid_batch_id", "invalid batch id"), http.StatusBadRequest)
+		return nil, false
+	}
+
+	batch, err := server.Repo.GetBatch(id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			respJson(w, problem.New("batch_not_found", "batch not found"), 404)
+			return nil, false
+		}
+		fmt.Println(err)
+		respJson(w, errors.New("failed to get batch"), http.StatusInternalServerError)
+		return nil, false
+	}
+
+	if batch.Username != username {
+		respJson(w, errForbidden, http.StatusForbidden)
+		return nil, false
+	}
+
+	return batch, true
+}
+
+// batchStatus is pending until any expression of the batch starts,
+// processing until all of them finish, then done if all of them were
+// evaluated and error otherwise.
+func batchStatus(batch *repo.Batch) string {
+	switch {
+	case batch.Total > 0 && batch.Counts[repo.StatusPending] == batch.Total:
+		return repo.StatusPending
+	case batch.Counts[repo.StatusPending]+batch.Counts[repo.StatusProcessing] > 0:
+		return repo.StatusProcessing
+	case batch.Total > 0 && batch.Counts[repo.StatusDone] == batch.Total:
+		return repo.StatusDone
+	default:
+		return repo.StatusError
+	}
+}
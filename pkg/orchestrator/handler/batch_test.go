@@ -0,0 +1,243 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/StepanShel/YandexProject/internal/problem"
+	"github.com/StepanShel/YandexProject/internal/repo"
+	"github.com/StepanShel/YandexProject/pkg/orchestrator/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// submitBatch submits the expressions as a batch and returns its response.
+func (api *testAPI) submitBatch(token string, expressions ...string) ResponseBatch {
+	api.t.Helper()
+
+	items := make([]BatchItem, len(expressions))
+	for i, expression := range expressions {
+		items[i] = BatchItem{Expression: expression}
+	}
+	resp, data := api.do("POST", "/api/v1/calculate/batch", token, BatchRequest{Expressions: items})
+	require.Equal(api.t, http.StatusCreated, resp.StatusCode, "%s", data)
+	var created ResponseBatch
+	require.NoError(api.t, json.Unmarshal(data, &created))
+	require.Len(api.t, created.IDs, len(expressions))
+	return created
+}
+
+// batch returns the batch as reported by the given API version.
+func (api *testAPI) batch(token, version, id string) Batch {
+	api.t.Helper()
+
+	resp, data := api.do("GET", "/api/"+version+"/batches/"+id, token, nil)
+	require.Equal(api.t, http.StatusOK, resp.StatusCode, "%s", data)
+	var batch struct{ Batch Batch }
+	require.NoError(api.t, json.Unmarshal(data, &batch))
+	return batch.Batch
+}
+
+// expressionCount returns how many expressions the user has stored.
+func (api *testAPI) expressionCount(token string) int {
+	api.t.Helper()
+
+	resp, data := api.do("GET", "/api/v1/expressions", token, nil)
+	require.Equal(api.t, http.StatusOK, resp.StatusCode, "%s", data)
+	var list struct{ Expressions []json.RawMessage }
+	require.NoError(api.t, json.Unmarshal(data, &list))
+	return len(list.Expressions)
+}
+
+func TestCalculateBatchValidation(t *testing.T) {
+	cfg := config.ConfigFromEnv()
+	cfg.MaxExpressionLength = 50
+	cfg.MaxBatchSize = 3
+	api := serveTestAPI(t, cfg)
+	token := api.login("alice")
+
+	// One invalid expression rejects the whole batch.
+	resp, data := api.do("POST", "/api/v1/calculate/batch", token, []BatchItem{
+		{Expression: "1+1"},
+		{Expression: "2+"},
+		{Expression: "3+3"},
+	})
+	require.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode, "%s", data)
+	var failed struct {
+		problem.Problem
+		Items []BatchItemError `json:"items"`
+	}
+	require.NoError(t, json.Unmarshal(data, &failed))
+	assert.Equal(t, "invalid_batch", failed.Code)
+	require.Len(t, failed.Items, 1)
+	assert.Equal(t, 1, failed.Items[0].Index)
+	assert.Equal(t, "invalid_expression", failed.Items[0].Code)
+
+	resp, data = api.do("POST", "/api/v1/calculate/batch", token, BatchRequest{Expressions: []BatchItem{
+		{Expression: " "},
+		{Expression: strings.Repeat("1+", 30) + "1"},
+		{Expression: "x+1", Variables: map[string]float64{"x": 1}},
+	}})
+	require.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode, "%s", data)
+	failed.Items = nil
+	require.NoError(t, json.Unmarshal(data, &failed))
+	var codes []string
+	for _, item := range failed.Items {
+		codes = append(codes, item.Code)
+	}
+	assert.Equal(t, []string{"empty_expression", "expression_too_long"}, codes)
+
+	tests := []struct {
+		name string
+		body any
+		code int
+	}{
+		{"empty", []BatchItem{}, http.StatusUnprocessableEntity},
+		{"too large", make([]BatchItem, 4), http.StatusRequestEntityTooLarge},
+		{"malformed", `{"expressions": [`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, data := api.do("POST", "/api/v1/calculate/batch", token, tt.body)
+			assert.Equal(t, tt.code, resp.StatusCode, "%s", data)
+		})
+	}
+
+	// Nothing of the rejected batches was stored.
+	assert.Zero(t, api.expressionCount(token))
+}
+
+func TestCalculateBatchTransaction(t *testing.T) {
+	api := newTestAPI(t)
+	token := api.login("alice")
+
+	// Make the database refuse the last expression of the batch.
+	db, err := sql.Open("sqlite3", api.dbPath)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	_, err = db.Exec(`CREATE TRIGGER refuse_expression BEFORE INSERT ON expressions
+		WHEN NEW.expression = '13+13' BEGIN SELECT RAISE(ABORT, 'refused'); END`)
+	require.NoError(t, err)
+
+	resp, data := api.do("POST", "/api/v1/calculate/batch", token, []BatchItem{
+		{Expression: "1+1"},
+		{Expression: "2+2"},
+		{Expression: "13+13"},
+	})
+	require.Equal(t, http.StatusInternalServerError, resp.StatusCode, "%s", data)
+
+	// Neither the batch nor its first expressions were kept.
+	assert.Zero(t, api.expressionCount(token))
+	var batches int
+	require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM batches").Scan(&batches))
+	assert.Zero(t, batches)
+
+	// A batch the database accepts is stored as a whole.
+	created := api.submitBatch(token, "1+1", "2+2", "3+3")
+	resp, data = api.do("GET", "/api/v2/expressions?batch="+created.BatchID, token, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode, "%s", data)
+	var list struct{ Expressions []ExpressionV2 }
+	require.NoError(t, json.Unmarshal(data, &list))
+	var ids []string
+	for _, expr := range list.Expressions {
+		ids = append(ids, expr.ID)
+	}
+	assert.ElementsMatch(t, created.IDs, ids)
+}
+
+func TestBatchStatus(t *testing.T) {
+	api := newTestAPI(t)
+	alice := api.login("alice")
+	bob := api.login("bob")
+
+	// No agent is running yet, so the batch waits for its first task.
+	created := api.submitBatch(alice, "1+1", "2*3", "1/0")
+	batch := api.batch(alice, "v2", created.BatchID)
+	assert.Equal(t, 3, batch.Total)
+	assert.Contains(t, []string{repo.StatusPending, repo.StatusProcessing}, batch.Status)
+	assert.Equal(t, repo.StatusProcessing, api.batch(alice, "v1", created.BatchID).Status)
+
+	api.runAgent()
+	for _, id := range created.IDs {
+		api.await(alice, id)
+	}
+
+	// Division by zero fails one expression and so the batch.
+	batch = api.batch(alice, "v2", created.BatchID)
+	assert.Equal(t, repo.StatusError, batch.Status)
+	assert.Equal(t, map[string]int{repo.StatusDone: 2, repo.StatusError: 1}, batch.Counts)
+
+	batch = api.batch(alice, "v1", created.BatchID)
+	assert.Equal(t, repo.StatusError, batch.Status)
+	assert.Equal(t, map[string]int{"DONE": 2, repo.StatusError: 1}, batch.Counts)
+
+	created = api.submitBatch(alice, "1+1", "2+2")
+	for _, id := range created.IDs {
+		api.await(alice, id)
+	}
+	assert.Equal(t, "DONE", api.batch(alice, "v1", created.BatchID).Status)
+	assert.Equal(t, repo.StatusDone, api.batch(alice, "v2", created.BatchID).Status)
+
+	tests := []struct {
+		name, token, id string
+		code            int
+	}{
+		{"other user", bob, created.BatchID, http.StatusForbidden},
+		{"invalid id", alice, "42", http.StatusBadRequest},
+		{"unknown batch", alice, "00000000-0000-0000-0000-000000000000", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, data := api.do("GET", "/api/v2/batches/"+tt.id, tt.token, nil)
+			assert.Equal(t, tt.code, resp.StatusCode, "%s", data)
+		})
+	}
+}
+
+func TestBatchStatusCounts(t *testing.T) {
+	tests := []struct {
+		name   string
+		total  int
+		counts map[string]int
+		status string
+	}{
+		{"empty", 0, map[string]int{}, repo.StatusError},
+		{"pending", 2, map[string]int{repo.StatusPending: 2}, repo.StatusPending},
+		{"started", 2, map[string]int{repo.StatusPending: 1, repo.StatusDone: 1}, repo.StatusProcessing},
+		{"done", 2, map[string]int{repo.StatusDone: 2}, repo.StatusDone},
+		{"done and cancelled", 2, map[string]int{repo.StatusDone: 1, repo.StatusCancelled: 1}, repo.StatusError},
+		{"done and error", 2, map[string]int{repo.StatusDone: 1, repo.StatusError: 1}, repo.StatusError},
+		{"all terminal states", 3, map[string]int{repo.StatusDone: 1, repo.StatusError: 1, repo.StatusCancelled: 1}, repo.StatusError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.status, batchStatus(&repo.Batch{Total: tt.total, Counts: tt.counts}))
+		})
+	}
+}
+
+func TestBatchConcurrency(t *testing.T) {
+	cfg := config.ConfigFromEnv()
+	cfg.MaxConcurrentExpressions = 1
+	cfg.MaxConcurrentBatchExpressions = 1
+	api := serveTestAPI(t, cfg)
+	token := api.login("alice")
+
+	// Without agents the batch is stuck on its first expression...
+	created := api.submitBatch(token, "1+1", "2+2", "3+3")
+
+	// ...but does not hold the slot of single expressions.
+	id := api.calculate(token, "4+4")
+	resp, data := api.do("POST", "/api/v1/calculate", token, map[string]string{"expression": "5+5"})
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode, "%s", data)
+
+	api.runAgent()
+	assert.Equal(t, 8.0, *api.await(token, id).Result)
+	for _, id := range created.IDs {
+		assert.Equal(t, repo.StatusDone, api.await(token, id).Status)
+	}
+}
@@ -0,0 +1,52 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/StepanShel/YandexProject/pkg/orchestrator/parser"
+)
+
+// resultCache is the part of the cache valid for the current operation
+// settings.
+func (server *Server) resultCache() parser.Cache {
+	cfg := server.timings()
+	return server.Cache.Prefixed(fmt.Sprintf("%d/%d/%d/%d:", cfg.AddTime, cfg.Subtime, cfg.MultiplicTime, cfg.Divtime))
+}
+
+// bypassCache is used by requests that opted out of the cache: nothing is
+// read from it, but the fresh results replace the cached ones.
+type bypassCache struct {
+	parser.Cache
+}
+
+func (bypassCache) Get(string) (float64, bool) {
+	return 0, false
+}
+
+// missedCache skips the lookup of a key that was already missed, so that it
+// is not counted twice.
+type missedCache struct {
+	parser.Cache
+	key string
+}
+
+func (c missedCache) Get(key string) (float64, bool) {
+	if key == c.key {
+		return 0, false
+	}
+	return c.Cache.Get(key)
+}
+
+// noCache reports whether the request opted out of cached results.
+func noCache(r *http.Request) bool {
+	return strings.Contains(strings.ToLower(r.Header.Get("Cache-Control")), "no-cache")
+}
+
+// endpoint api/v1/cache/stats
+//
+// Admins only, see Routes.
+func (server *Server) HandleCacheStats(w http.ResponseWriter, r *http.Request) {
+	respJson(w, server.Cache.Stats(), 200)
+}
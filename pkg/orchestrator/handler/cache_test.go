@@ -0,0 +1,59 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheHeader(t *testing.T) {
+	api := newTestAPI(t)
+	api.runAgent()
+	token := api.login("alice")
+
+	// calculate submits the expression with an idempotency key and returns
+	// the response with the id of the expression.
+	calculate := func(key, expression string) (*http.Response, string) {
+		t.Helper()
+
+		req, err := http.NewRequest("POST", api.URL+"/api/v1/calculate", strings.NewReader(`{"expression": "`+expression+`"}`))
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set(IdempotencyHeader, key)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		var created ResponseID
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&created))
+		return resp, created.Id
+	}
+
+	resp, id := calculate("first", "1+2")
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "MISS", resp.Header.Get("X-Cache"))
+	api.await(token, id)
+
+	resp, cached := calculate("second", "2+1")
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "HIT", resp.Header.Get("X-Cache"))
+	hits := api.server.Cache.Stats().Hits
+
+	// Replays return the stored expressions without looking at the cache,
+	// even though both of them are done.
+	for _, tt := range []struct{ key, expression, id string }{
+		{"first", "1+2", id},
+		{"second", "2+1", cached},
+	} {
+		resp, replayed := calculate(tt.key, tt.expression)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, tt.id, replayed)
+		assert.Equal(t, "true", resp.Header.Get("Idempotent-Replayed"))
+		assert.Empty(t, resp.Header.Get("X-Cache"))
+	}
+	assert.Equal(t, hits, api.server.Cache.Stats().Hits)
+}
@@ -0,0 +1,115 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+
+	uuid "github.com/google/uuid"
+)
+
+func (server *Server) track(id uuid.UUID, cancel context.CancelFunc) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.cancels[id] = cancel
+}
+
+func (server *Server) untrack(id uuid.UUID) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	if cancel, ok := server.cancels[id]; ok {
+		cancel()
+		delete(server.cancels, id)
+	}
+}
+
+// cancelExpression stops the evaluation of one of the user's expressions.
+// The expression gets the "cancelled" status once evaluation has stopped.
+func (server *Server) cancelExpression(id uuid.UUID, username string) error {
+	expr, err := server.Repo.GetExpressionByID(id)
+	if err != nil {
+		return errNotFound
+	}
+	if expr.Username != username {
+		return errForbidden
+	}
+
+	server.mu.Lock()
+	cancel, ok := server.cancels[id]
+	server.mu.Unlock()
+
+	if !ok {
+		return errNotRunning
+	}
+	cancel()
+	return nil
+}
+
+// endpoint api/v1/expressions/:id/cancel
+func (server *Server) HandleCancelExpression(w http.ResponseWriter, r *http.Request) {
+	username, ok := r.Context().Value("username").(string)
+	if !ok {
+		respJson(w, errUnauthorized, http.StatusUnauthorized)
+		return
+	}
+
+	id, err := parseID(r.PathValue("id"))
+	if err != nil {
+		respJson(w, errInvalidID, http.StatusBadRequest)
+		return
+	}
+
+	if err := server.cancelExpression(id, username); err != nil {
+		respJson(w, err, cancelErrorCode(err))
+		return
+	}
+
+	respJson(w, id.String(), http.StatusAccepted)
+}
+
+// endpoint DELETE api/v1/expressions/:id
+//
+// A running expression is cancelled before it is deleted.
+func (server *Server) HandleDeleteExpression(w http.ResponseWriter, r *http.Request) {
+	username, ok := r.Context().Value("username").(string)
+	if !ok {
+		respJson(w, errUnauthorized, http.StatusUnauthorized)
+		return
+	}
+
+	id, err := parseID(r.PathValue("id"))
+	if err != nil {
+		respJson(w, errInvalidID, http.StatusBadRequest)
+		return
+	}
+
+	if err := server.cancelExpression(id, username); err != nil && !errors.Is(err, errNotRunning) {
+		respJson(w, err, cancelErrorCode(err))
+		return
+	}
+
+	if err := server.Repo.DeleteExpression(id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			respJson(w, errNotFound, http.StatusNotFound)
+			return
+		}
+		respJson(w, errors.New("failed to delete expression"), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func cancelErrorCode(err error) int {
+	switch {
+	case errors.Is(err, errNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, errNotRunning):
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
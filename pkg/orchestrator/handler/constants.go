@@ -0,0 +1,168 @@
+package handler
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/StepanShel/YandexProject/internal/jsonbody"
+	"github.com/StepanShel/YandexProject/internal/problem"
+	"github.com/StepanShel/YandexProject/internal/repo"
+	"github.com/StepanShel/YandexProject/pkg/orchestrator/parser"
+)
+
+// endpoint api/v1/constants
+func (server *Server) HandleConstants(w http.ResponseWriter, r *http.Request) {
+	if _, ok := r.Context().Value("username").(string); !ok {
+		respJson(w, errUnauthorized, http.StatusUnauthorized)
+		return
+	}
+
+	stored, err := server.Repo.GetConstants()
+	if err != nil {
+		fmt.Println(err)
+		respJson(w, errors.New("failed to get constants"), http.StatusInternalServerError)
+		return
+	}
+
+	result := make([]Constant, 0, len(parser.Builtins)+len(stored))
+	for name, value := range parser.Builtins {
+		result = append(result, Constant{Name: name, Value: value, Builtin: true})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+
+	for _, c := range stored {
+		result = append(result, Constant{Name: c.Name, Value: c.Value, Version: c.Version})
+	}
+
+	respJson(w, result, 200)
+}
+
+// endpoint api/v1/constants/:name
+//
+// Admins only, see Routes.
+func (server *Server) HandleConstantByName(w http.ResponseWriter, r *http.Request) {
+	username, ok := r.Context().Value("username").(string)
+	if !ok {
+		respJson(w, errUnauthorized, http.StatusUnauthorized)
+		return
+	}
+
+	name := r.PathValue("name")
+	if !parser.IsValidConstantName(name) {
+		respJson(w, problem.New("invalid_constant_name", "invalid constant name"), http.StatusBadRequest)
+		return
+	}
+	if _, builtin := parser.Builtins[name]; builtin {
+		respJson(w, problem.New("builtin_constant", "built-in constants cannot be changed"), http.StatusConflict)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		if err := server.Repo.DeleteConstant(name); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				respJson(w, problem.New("constant_not_found", "constant not found"), 404)
+				return
+			}
+			respJson(w, errors.New("failed to delete constant"), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var request ConstantRequest
+	if code, err := jsonbody.Decode(w, r, &request, int64(server.Config.MaxBodyBytes)); err != nil {
+		respJson(w, err, code)
+		return
+	}
+	if request.Value == nil {
+		respJson(w, problem.New("missing_value", "value is required"), 422)
+		return
+	}
+
+	c, err := server.Repo.SetConstant(name, *request.Value, username)
+	if err != nil {
+		respJson(w, errors.New("failed to save constant"), http.StatusInternalServerError)
+		return
+	}
+
+	respJson(w, Constant{Name: c.Name, Value: c.Value, Version: c.Version}, 200)
+}
+
+// constantSet holds the organisation constants at the time an expression
+// is submitted.
+type constantSet struct {
+	values   map[string]float64
+	versions map[string]int
+}
+
+func (server *Server) loadConstants() (*constantSet, error) {
+	stored, err := server.Repo.GetConstants()
+	if err != nil {
+		return nil, err
+	}
+
+	set := &constantSet{
+		values:   make(map[string]float64, len(stored)),
+		versions: make(map[string]int, len(stored)),
+	}
+	for _, c := range stored {
+		set.values[c.Name] = c.Value
+		set.versions[c.Name] = c.Version
+	}
+	return set, nil
+}
+
+// resolve substitutes built-in and organisation constants into tokens and
+// reports the values used, to be recorded on the expression row. variables
+// are supplied with the expression and shadow organisation constants of the
+// same name.
+func (set *constantSet) resolve(tokens []string, variables map[string]float64) ([]string, []repo.ConstantUsage, error) {
+	values := set.values
+	if len(variables) > 0 {
+		values = make(map[string]float64, len(set.values)+len(variables))
+		for name, value := range set.values {
+			values[name] = value
+		}
+		for name, value := range variables {
+			values[name] = value
+		}
+	}
+
+	tokens, used, err := parser.ResolveConstants(tokens, values)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	usage := make([]repo.ConstantUsage, 0, len(used))
+	for _, name := range used {
+		if value, ok := parser.Builtins[name]; ok {
+			usage = append(usage, repo.ConstantUsage{Name: name, Value: value})
+			continue
+		}
+		if value, ok := variables[name]; ok {
+			usage = append(usage, repo.ConstantUsage{Name: name, Value: value, Variable: true})
+			continue
+		}
+		usage = append(usage, repo.ConstantUsage{Name: name, Value: values[name], Version: set.versions[name]})
+	}
+
+	return tokens, usage, nil
+}
+
+// validateVariables checks the names of the variables supplied with an
+// expression. Built-in constants cannot be shadowed.
+func validateVariables(variables map[string]float64) error {
+	for name := range variables {
+		if !parser.IsValidConstantName(name) {
+			return problem.Errorf("invalid_variable", "invalid variable name: %s", name)
+		}
+		if _, builtin := parser.Builtins[name]; builtin {
+			return problem.Errorf("invalid_variable", "variable %s shadows a built-in constant", name)
+		}
+	}
+	return nil
+}
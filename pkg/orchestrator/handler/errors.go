@@ -0,0 +1,28 @@
+package handler
+
+import (
+	"github.com/StepanShel/YandexProject/internal/problem"
+	uuid "github.com/google/uuid"
+)
+
+// Errors shared by the handlers. Their codes are part of the API and must
+// not change.
+var (
+	errMethodNotAllowed = problem.New("method_not_allowed", "unsupported method")
+	errUnauthorized     = problem.New("unauthorized", "unauthorized")
+	errEmptyExpression  = problem.New("empty_expression", "expression is empty")
+	errInvalidID        = problem.New("invalid_expression_id", "invalid expression id")
+	errNotFound         = problem.New("expression_not_found", "expression not found")
+	errForbidden        = problem.New("access_denied", "access denied")
+	errNotRunning       = problem.New("expression_not_running", "expression is not running")
+	errKeyReused        = problem.New("idempotency_key_reused", "idempotency key was already used for a different request")
+)
+
+// parseID parses an ID taken from a URL. Unlike uuid.Parse it accepts only
+// the canonical form, so each expression has exactly one URL.
+func parseID(value string) (uuid.UUID, error) {
+	if len(value) != 36 {
+		return uuid.Nil, errInvalidID
+	}
+	return uuid.Parse(value)
+}
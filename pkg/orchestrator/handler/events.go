@@ -0,0 +1,178 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/StepanShel/YandexProject/internal/repo"
+	"github.com/StepanShel/YandexProject/pkg/orchestrator/events"
+)
+
+// keepAliveInterval is how often an idle event stream sends a comment so
+// that proxies do not close the connection.
+const keepAliveInterval = 15 * time.Second
+
+// eventStream writes Server-Sent Events.
+type eventStream struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	seq     int
+}
+
+func newEventStream(w http.ResponseWriter) (*eventStream, bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, false
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	return &eventStream{w: w, flusher: flusher}, true
+}
+
+func (s *eventStream) send(e events.Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	s.seq++
+	if _, err := fmt.Fprintf(s.w, "id: %d\nevent: %s\ndata: %s\n\n", s.seq, e.Type, data); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+func (s *eventStream) keepAlive() error {
+	if _, err := fmt.Fprint(s.w, ": keep-alive\n\n"); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+// endpoint api/v1/expressions/:id/events
+//
+// Streams the events of an expression to anyone who may read it.
+func (server *Server) HandleExpressionEvents(w http.ResponseWriter, r *http.Request) {
+	id, err := parseID(r.PathValue("id"))
+	if err != nil {
+		respJson(w, errInvalidID, http.StatusBadRequest)
+		return
+	}
+
+	expr, err := server.Repo.GetExpressionByID(id)
+	if err != nil {
+		respJson(w, errNotFound, 404)
+		return
+	}
+
+	allowed, err := server.canRead(r, expr)
+	if err != nil {
+		fmt.Println(err)
+		respJson(w, errors.New("failed to get expression"), http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		respJson(w, errForbidden, http.StatusForbidden)
+		return
+	}
+
+	// Events are published to the owner. Subscribe before reading the
+	// current state again so that no transition between the two is lost.
+	sub := server.Events.Subscribe(expr.Username, id.String())
+	defer server.Events.Unsubscribe(sub)
+
+	if expr, err = server.Repo.GetExpressionByID(id); err != nil {
+		respJson(w, errNotFound, 404)
+		return
+	}
+
+	stream, ok := newEventStream(w)
+	if !ok {
+		respJson(w, errors.New("streaming unsupported"), http.StatusInternalServerError)
+		return
+	}
+
+	current := statusEvent(expr)
+	if err := stream.send(current); err != nil || current.Terminal() {
+		return
+	}
+
+	server.streamEvents(r.Context(), stream, sub, true)
+}
+
+// statusEvent reports the current status of the expression, with its
+// result once it is done.
+func statusEvent(expr *repo.Expression) events.Event {
+	e := events.Event{
+		Type:         events.TypeStatus,
+		ExpressionID: expr.ID.String(),
+		Username:     expr.Username,
+		Status:       legacyStatus(expr.Status),
+		Error:        expr.Error,
+		Time:         time.Now(),
+	}
+	if expr.Status == repo.StatusDone {
+		result := expr.Result
+		e.Result = &result
+	}
+	return e
+}
+
+// endpoint api/v1/events
+//
+// Streams the events of the caller's own expressions only; expressions
+// shared with them are followed one by one at api/v1/expressions/:id/events.
+func (server *Server) HandleEvents(w http.ResponseWriter, r *http.Request) {
+	username, ok := r.Context().Value("username").(string)
+	if !ok {
+		respJson(w, errUnauthorized, http.StatusUnauthorized)
+		return
+	}
+
+	sub := server.Events.Subscribe(username, "")
+	defer server.Events.Unsubscribe(sub)
+
+	stream, ok := newEventStream(w)
+	if !ok {
+		respJson(w, errors.New("streaming unsupported"), http.StatusInternalServerError)
+		return
+	}
+
+	server.streamEvents(r.Context(), stream, sub, false)
+}
+
+// streamEvents forwards events until the client goes away or, with
+// untilTerminal set, until the expression reaches a terminal status.
+func (server *Server) streamEvents(ctx context.Context, stream *eventStream, sub *events.Subscription, untilTerminal bool) {
+	ticker := time.NewTicker(keepAliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := stream.keepAlive(); err != nil {
+				return
+			}
+		case e := <-sub.C:
+			if err := stream.send(e); err != nil {
+				return
+			}
+			if untilTerminal && e.Terminal() {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package handler
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/StepanShel/YandexProject/pkg/orchestrator/events"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// eventReader reads Server-Sent Events from a stream response.
+type eventReader struct {
+	t       *testing.T
+	scanner *bufio.Scanner
+}
+
+// stream opens the event stream at path.
+func (api *testAPI) stream(token, path string) *eventReader {
+	api.t.Helper()
+
+	req, err := http.NewRequest("GET", api.URL+path, nil)
+	require.NoError(api.t, err)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(api.t, err)
+	api.t.Cleanup(func() { resp.Body.Close() })
+
+	require.Equal(api.t, http.StatusOK, resp.StatusCode)
+	require.Equal(api.t, "text/event-stream", resp.Header.Get("Content-Type"))
+	return &eventReader{t: api.t, scanner: bufio.NewScanner(resp.Body)}
+}
+
+// next returns the next event, or io.EOF once the server ends the stream.
+// Keep-alive comments are skipped.
+func (r *eventReader) next() (events.Event, error) {
+	var e events.Event
+	var name, data string
+	for r.scanner.Scan() {
+		line := r.scanner.Text()
+		switch {
+		case line == "" && data != "":
+			require.NoError(r.t, json.Unmarshal([]byte(data), &e))
+			require.Equal(r.t, e.Type, name)
+			return e, nil
+		case strings.HasPrefix(line, "event: "):
+			name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+	if err := r.scanner.Err(); err != nil {
+		return e, err
+	}
+	return e, io.EOF
+}
+
+func TestExpressionEvents(t *testing.T) {
+	api := newTestAPI(t)
+	token := api.login("alice")
+
+	// No agent is running yet, so the expression waits for its first task.
+	id := api.calculate(token, "1+2*3")
+	stream := api.stream(token, "/api/v1/expressions/"+id+"/events")
+
+	e, err := stream.next()
+	require.NoError(t, err)
+	assert.Equal(t, events.TypeStatus, e.Type)
+	assert.Equal(t, id, e.ExpressionID)
+	assert.False(t, e.Terminal())
+
+	api.runAgent()
+	var tasks []events.Task
+	for !e.Terminal() {
+		e, err = stream.next()
+		require.NoError(t, err)
+		if e.Task != nil {
+			tasks = append(tasks, *e.Task)
+		}
+	}
+	assert.Equal(t, "DONE", e.Status)
+	require.NotNil(t, e.Result)
+	assert.Equal(t, 7.0, *e.Result)
+
+	require.NotEmpty(t, tasks)
+	last := tasks[len(tasks)-1]
+	assert.Equal(t, events.TaskDone, last.State)
+	assert.Equal(t, 2, last.Completed)
+	assert.Equal(t, 2, last.Total)
+
+	// The stream ends after the terminal event.
+	_, err = stream.next()
+	assert.Equal(t, io.EOF, err)
+
+	// A finished expression is reported at once.
+	stream = api.stream(token, "/api/v1/expressions/"+id+"/events")
+	e, err = stream.next()
+	require.NoError(t, err)
+	assert.Equal(t, "DONE", e.Status)
+	assert.Equal(t, 7.0, *e.Result)
+	_, err = stream.next()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestSharedExpressionEvents(t *testing.T) {
+	api := newTestAPI(t)
+	alice := api.login("alice")
+	bob := api.login("bob")
+
+	id := api.calculate(alice, "1+2*3")
+	resp, data := api.do("PUT", "/api/v1/expressions/"+id+"/sharing", alice, ExpressionSharing{Users: []string{"bob"}})
+	require.Equal(t, http.StatusOK, resp.StatusCode, "%s", data)
+
+	// Users the expression is shared with follow it like its owner.
+	stream := api.stream(bob, "/api/v1/expressions/"+id+"/events")
+	e, err := stream.next()
+	require.NoError(t, err)
+	assert.Equal(t, id, e.ExpressionID)
+
+	api.runAgent()
+	for !e.Terminal() {
+		e, err = stream.next()
+		require.NoError(t, err)
+	}
+	assert.Equal(t, "DONE", e.Status)
+	require.NotNil(t, e.Result)
+	assert.Equal(t, 7.0, *e.Result)
+}
+
+func TestExpressionEventsErrors(t *testing.T) {
+	api := newTestAPI(t)
+	alice := api.login("alice")
+	bob := api.login("bob")
+	id := api.calculate(alice, "1+2")
+
+	tests := []struct {
+		name, token, path string
+		code              int
+	}{
+		{"without token", "", "/api/v1/expressions/" + id + "/events", http.StatusUnauthorized},
+		{"invalid id", alice, "/api/v1/expressions/42/events", http.StatusBadRequest},
+		{"unknown expression", alice, "/api/v1/expressions/00000000-0000-0000-0000-000000000000/events", http.StatusNotFound},
+		{"other user", bob, "/api/v1/expressions/" + id + "/events", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, data := api.do("GET", tt.path, tt.token, nil)
+			assert.Equal(t, tt.code, resp.StatusCode, "%s", data)
+		})
+	}
+}
+
+func TestEvents(t *testing.T) {
+	api := newTestAPI(t)
+	api.runAgent()
+	alice := api.login("alice")
+	bob := api.login("bob")
+
+	stream := api.stream(alice, "/api/v1/events")
+
+	// Only the user's own expressions are streamed.
+	api.calculate(bob, "2+2")
+	id := api.calculate(alice, "3+3")
+
+	for {
+		e, err := stream.next()
+		require.NoError(t, err)
+		require.Equal(t, id, e.ExpressionID)
+		if e.Terminal() {
+			assert.Equal(t, 6.0, *e.Result)
+			break
+		}
+	}
+}
@@ -1,35 +1,73 @@
 package handler
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"strings"
 	"sync"
+	"unicode/utf8"
 
+	"github.com/StepanShel/YandexProject/internal/jsonbody"
+	"github.com/StepanShel/YandexProject/internal/problem"
 	"github.com/StepanShel/YandexProject/internal/repo"
+	"github.com/StepanShel/YandexProject/pkg/orchestrator/cache"
+	"github.com/StepanShel/YandexProject/pkg/orchestrator/events"
 	parser "github.com/StepanShel/YandexProject/pkg/orchestrator/parser"
+	"github.com/StepanShel/YandexProject/pkg/orchestrator/webhook"
 	"github.com/StepanShel/YandexProject/proto/calc"
 	uuid "github.com/google/uuid"
 )
 
 func respJson(w http.ResponseWriter, data any, errCode int) error {
+	if err, ok := data.(error); ok {
+		return problem.Write(w, errCode, err)
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 
 	var resp any
 
 	switch data := data.(type) {
-	case error:
-		resp = ResponseError{Error: data.Error()}
 	case string:
 		resp = ResponseID{Id: data}
 	case []Expression:
 		resp = ResponseExprs{Exprs: data}
+	case ResponseID, ResponseExprs, ResponseExpressionsV2, ResponseBatch:
+		resp = data
+	case ExpressionV2:
+		resp = map[string]ExpressionV2{"expression": data}
+	case Batch:
+		resp = map[string]Batch{"batch": data}
+	case cache.Stats:
+		resp = map[string]cache.Stats{"cache": data}
 	case parser.Task:
 		resp = map[string]parser.Task{"task": data}
 	case Expression:
 		resp = map[string]Expression{"Expression": data}
+	case []Constant:
+		resp = ResponseConstants{Constants: data}
+	case Constant:
+		resp = map[string]Constant{"constant": data}
+	case []WebhookAttempt:
+		resp = ResponseWebhookAttempts{Attempts: data}
+	case ResponseUsers:
+		resp = data
+	case UserInfo:
+		resp = map[string]UserInfo{"user": data}
+	case OperationTimings:
+		resp = map[string]OperationTimings{"timings": data}
+	case Team:
+		resp = map[string]Team{"team": data}
+	case TeamInvite:
+		resp = map[string]TeamInvite{"invite": data}
+	case []TeamInvite:
+		resp = ResponseTeamInvites{Invites: data}
+	case ExpressionSharing:
+		resp = map[string]ExpressionSharing{"sharing": data}
 	}
 
 	w.WriteHeader(errCode)
@@ -43,176 +81,507 @@ func respJson(w http.ResponseWriter, data any, errCode int) error {
 
 // endpoint api/v1/calculate
 func (server *Server) HandleCalculate(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		respJson(w, errors.New("unsupported method"), 405)
-		return
-	}
-
 	username, ok := r.Context().Value("username").(string)
 	if !ok {
-		respJson(w, errors.New("unauthorized"), http.StatusUnauthorized)
+		respJson(w, errUnauthorized, http.StatusUnauthorized)
 		return
 	}
 
 	var request Request
-	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
-		respJson(w, errors.New("invalid data"), 422)
+	if code, err := jsonbody.Decode(w, r, &request, int64(server.Config.MaxBodyBytes)); err != nil {
+		respJson(w, err, code)
 		return
 	}
-	defer r.Body.Close()
 
-	id := uuid.New()
+	if noCache(r) {
+		request.NoCache = true
+	}
 
-	expr := &repo.Expression{
-		ID:         id,
-		Username:   username,
-		Expression: request.Expression,
-		Status:     "processing",
+	request.IdempotencyKey = r.Header.Get(IdempotencyHeader)
+	if err := validateIdempotencyKey(request.IdempotencyKey); err != nil {
+		respJson(w, err, http.StatusBadRequest)
+		return
 	}
 
-	if err := server.Repo.CreateExpression(expr); err != nil {
-		respJson(w, errors.New("failed to save expression"), http.StatusInternalServerError)
+	expr, cached, code, err := server.submitExpression(username, request)
+	if err != nil {
+		respJson(w, err, code)
 		return
 	}
 
-	if err := respJson(w, id.String(), 201); err != nil {
+	if code == http.StatusOK {
+		w.Header().Set("Idempotent-Replayed", "true")
+		respJson(w, ResponseID{Id: expr.ID.String(), Status: legacyStatus(expr.Status)}, code)
+		return
+	}
+
+	if cached {
+		w.Header().Set("X-Cache", "HIT")
+	} else {
+		w.Header().Set("X-Cache", "MISS")
+	}
+
+	if err := respJson(w, expr.ID.String(), code); err != nil {
 		fmt.Println(err)
 	}
+}
 
-	go func() {
-		fmt.Println("start parsing")
-		err := server.startParsingExpression(request.Expression, id)
-		if err != nil {
-			if updateErr := server.Repo.UpdateExpressionResult(id, 0, "error"); updateErr != nil {
-				fmt.Println("failed to update expression status:", updateErr)
+// submitExpression validates and stores the requested expression and starts
+// evaluating it. It reports whether the result was taken from the cache, and
+// the HTTP status describing the outcome; it is 200 when the idempotency key
+// of the request returned an existing expression.
+func (server *Server) submitExpression(username string, request Request) (*repo.Expression, bool, int, error) {
+	expression := request.Expression
+	if strings.TrimSpace(expression) == "" {
+		return nil, false, http.StatusUnprocessableEntity, errEmptyExpression
+	}
+
+	if request.IdempotencyKey != "" {
+		unlock := server.lockIdempotencyKey(username, request.IdempotencyKey)
+		defer unlock()
+
+		existing, err := server.Repo.GetExpressionByIdempotencyKey(username, request.IdempotencyKey, server.idempotencyWindowStart())
+		if err == nil {
+			if existing.Expression != expression || existing.CallbackURL != request.CallbackURL {
+				return nil, false, http.StatusUnprocessableEntity, errKeyReused
 			}
-			fmt.Println("parsing failed:", err)
+			return existing, false, http.StatusOK, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			fmt.Println(err)
+			return nil, false, http.StatusInternalServerError, errors.New("failed to check idempotency key")
+		}
+	}
+
+	if request.CallbackURL != "" {
+		if err := server.validateCallback(request.CallbackURL); err != nil {
+			return nil, false, http.StatusUnprocessableEntity, err
+		}
+	}
+
+	if utf8.RuneCountInString(expression) > server.Config.MaxExpressionLength {
+		return nil, false, http.StatusRequestEntityTooLarge, problem.Errorf("expression_too_long", "expression is longer than %d characters", server.Config.MaxExpressionLength)
+	}
+
+	// Syntax errors are reported through the expression status, but trees
+	// that are too large are rejected before anything is stored.
+	node, constants, parseErr := server.parseExpression(expression)
+	if parseErr == nil {
+		if err := server.checkComplexity(node); err != nil {
+			return nil, false, http.StatusUnprocessableEntity, err
+		}
+	}
+
+	// A cached result answers the request without evaluating anything.
+	results := server.resultCache()
+	if parseErr == nil {
+		key := parser.Fingerprint(node)
+		if request.NoCache {
+			results = bypassCache{results}
+		} else if value, ok := results.Get(key); ok {
+			expr, code, err := server.storeCached(username, request, constants, value)
+			return expr, err == nil, code, err
 		} else {
-			fmt.Println("parsing completed successfully")
+			results = missedCache{results, key}
 		}
-	}()
+	}
+
+	if !server.acquire(slot{username: username}) {
+		return nil, false, http.StatusTooManyRequests, problem.Errorf("too_many_expressions", "no more than %d expressions may be processed at once", server.Config.MaxConcurrentExpressions)
+	}
+
+	expr := &repo.Expression{
+		ID:             uuid.New(),
+		Username:       username,
+		Expression:     expression,
+		Status:         repo.StatusPending,
+		CallbackURL:    request.CallbackURL,
+		IdempotencyKey: request.IdempotencyKey,
+	}
+
+	if err := server.Repo.CreateExpression(expr); err != nil {
+		server.release(slot{username: username})
+		return nil, false, http.StatusInternalServerError, errors.New("failed to save expression")
+	}
+
+	if len(constants) > 0 {
+		if err := server.Repo.SetExpressionConstants(expr.ID, constants); err != nil {
+			fmt.Println("failed to record constants:", err)
+		}
+	}
+
+	if parseErr != nil {
+		server.release(slot{username: username})
+		fmt.Println("parsing failed:", parseErr)
+		if err := server.setStatus(expr, 0, repo.StatusError, parseErr); err != nil {
+			fmt.Println(err)
+		}
+		expr.Status, expr.Error = repo.StatusError, parseErr.Error()
+		return expr, false, http.StatusCreated, nil
+	}
+
+	server.publishStatus(expr, events.Event{
+		Type:         events.TypeStatus,
+		ExpressionID: expr.ID.String(),
+		Username:     username,
+		Status:       legacyStatus(expr.Status),
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	server.track(expr.ID, cancel)
+	go server.run(ctx, slot{username: username}, node, expr, results)
+
+	return expr, false, http.StatusCreated, nil
+}
+
+// storeCached stores an expression answered from the cache as done.
+func (server *Server) storeCached(username string, request Request, constants []repo.ConstantUsage, value float64) (*repo.Expression, int, error) {
+	expr := &repo.Expression{
+		ID:             uuid.New(),
+		Username:       username,
+		Expression:     request.Expression,
+		Status:         repo.StatusPending,
+		CallbackURL:    request.CallbackURL,
+		IdempotencyKey: request.IdempotencyKey,
+	}
+	if err := server.Repo.CreateExpression(expr); err != nil {
+		return nil, http.StatusInternalServerError, errors.New("failed to save expression")
+	}
+
+	if len(constants) > 0 {
+		if err := server.Repo.SetExpressionConstants(expr.ID, constants); err != nil {
+			fmt.Println("failed to record constants:", err)
+		}
+	}
+
+	if err := server.setStatus(expr, value, repo.StatusDone, nil); err != nil {
+		return nil, http.StatusInternalServerError, errors.New("failed to save expression")
+	}
+	expr.Status, expr.Result = repo.StatusDone, value
+
+	return expr, http.StatusCreated, nil
+}
+
+// run evaluates a stored expression holding one of its owner's slots, and
+// frees the slot when done.
+func (server *Server) run(ctx context.Context, held slot, node *parser.Node, expr *repo.Expression, results parser.Cache) {
+	defer server.release(held)
+	defer server.untrack(expr.ID)
+
+	if err := server.Repo.StartExpression(expr.ID); err != nil {
+		fmt.Println(err)
+	}
+
+	fmt.Println("start parsing")
+	err := server.startParsingExpression(ctx, node, expr, results)
+	if err != nil {
+		fmt.Println("parsing failed:", err)
+	} else {
+		fmt.Println("parsing completed successfully")
+	}
 }
 
 // endpoint api/v1/expressions
 func (server *Server) HandleExpressions(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		respJson(w, errors.New("unsupported method"), 405)
+	username, ok := r.Context().Value("username").(string)
+	if !ok {
+		respJson(w, errUnauthorized, http.StatusUnauthorized)
 		return
 	}
 
-	username, ok := r.Context().Value("username").(string)
-	if !ok {
-		respJson(w, errors.New("unauthorized"), http.StatusUnauthorized)
+	filter, err := parseListQuery(r.URL.Query(), username, 0)
+	if err != nil {
+		respJson(w, err, http.StatusBadRequest)
 		return
 	}
+	filter.TeamID = callerTeamID(r)
+	filter.Statuses = fromLegacyStatuses(filter.Statuses)
 
-	expressions, err := server.Repo.GetExpressions(username)
+	expressions, next, err := server.Repo.ListExpressions(filter)
 	if err != nil {
 		fmt.Println(err)
 		respJson(w, errors.New("failed to get expressions"), http.StatusInternalServerError)
 		return
 	}
 
-	var result []Expression
+	result := make([]Expression, 0, len(expressions))
 	for _, expr := range expressions {
 		result = append(result, Expression{
 			ID:     expr.ID.String(),
-			Result: float64(expr.Result),
-			Status: expr.Status,
+			Result: expr.Result,
+			Status: legacyStatus(expr.Status),
 		})
 	}
 
-	respJson(w, result, 200)
+	respJson(w, ResponseExprs{Exprs: result, NextCursor: encodeCursor(next)}, 200)
 }
 
-// endpoint api/v1/expressions/:id
+// endpoint api/v1/expressions/{id}
 func (server *Server) HandleExpressionsById(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		respJson(w, errors.New("unsupported method"), 405)
+	if _, ok := r.Context().Value("username").(string); !ok {
+		respJson(w, errUnauthorized, http.StatusUnauthorized)
 		return
 	}
 
-	username, ok := r.Context().Value("username").(string)
-	if !ok {
-		respJson(w, errors.New("unauthorized"), http.StatusUnauthorized)
+	id, err := parseID(r.PathValue("id"))
+	if err != nil {
+		respJson(w, errInvalidID, http.StatusBadRequest)
 		return
 	}
 
-	path := strings.Split(r.URL.Path, "/")
-	id, _ := uuid.Parse(path[4])
-
 	expr, err := server.Repo.GetExpressionByID(id)
 	if err != nil {
-		respJson(w, errors.New("expression not found"), 404)
+		respJson(w, errNotFound, 404)
 		return
 	}
 
-	if expr.Username != username {
-		respJson(w, errors.New("access denied"), http.StatusForbidden)
+	// Expressions shared with the user or their team may be read too.
+	allowed, err := server.canRead(r, expr)
+	if err != nil {
+		fmt.Println(err)
+		respJson(w, errors.New("failed to get expression"), http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		respJson(w, errForbidden, http.StatusForbidden)
 		return
 	}
 
 	respJson(w, Expression{
 		ID:     expr.ID.String(),
-		Result: float64(expr.Result),
-		Status: expr.Status,
+		Result: expr.Result,
+		Status: legacyStatus(expr.Status),
 	}, 200)
 }
 
-func (server *Server) startParsingExpression(expression string, id uuid.UUID) error {
-	tasksch := make(chan *calc.Task, 100)
-	resultch := make(chan *calc.Result, 100)
-	defer close(tasksch)
-	defer close(resultch)
+// parseExpression builds the tree for expression with all constants resolved.
+func (server *Server) parseExpression(expression string) (*parser.Node, []repo.ConstantUsage, error) {
+	set, err := server.loadConstants()
+	if err != nil {
+		return nil, nil, err
+	}
+	return set.parse(expression, nil)
+}
 
+func (set *constantSet) parse(expression string, variables map[string]float64) (*parser.Node, []repo.ConstantUsage, error) {
 	tokens, err := parser.Tokenize(expression)
 	if err != nil {
-		return err
+		return nil, nil, err
+	}
+	tokens, constants, err := set.resolve(tokens, variables)
+	if err != nil {
+		return nil, nil, err
 	}
 	node, err := parser.Ast(tokens)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
+	return node, constants, nil
+}
 
-	var wg sync.WaitGroup
-	var result float64
-	var parseErr error
+func (server *Server) checkComplexity(node *parser.Node) error {
+	depth, tasks := parser.Measure(node)
+	if depth > server.Config.MaxDepth {
+		return problem.Errorf("expression_too_complex", "expression is nested deeper than %d levels", server.Config.MaxDepth)
+	}
+	if tasks > server.Config.MaxTasks {
+		return problem.Errorf("expression_too_complex", "expression needs more than %d operations", server.Config.MaxTasks)
+	}
+	return nil
+}
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		result, parseErr = parser.ParsingAST(node, server.Config, tasksch, resultch)
-	}()
+// slot names a budget of concurrent expressions. Every user has one for
+// single expressions and another one for batches.
+type slot struct {
+	username string
+	batch    bool
+}
+
+func (server *Server) slotLimit(s slot) int {
+	if s.batch {
+		return server.Config.MaxConcurrentBatchExpressions
+	}
+	return server.Config.MaxConcurrentExpressions
+}
+
+// acquire reserves one of the slots of s.
+func (server *Server) acquire(s slot) bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
 
-	wg.Add(1)
+	if server.running[s] >= server.slotLimit(s) {
+		return false
+	}
+	server.running[s]++
+	return true
+}
+
+// acquireWait is like acquire but waits for a slot to free up. It gives up
+// when ctx is done.
+func (server *Server) acquireWait(ctx context.Context, s slot) bool {
+	for {
+		server.mu.Lock()
+		if server.running[s] < server.slotLimit(s) {
+			server.running[s]++
+			server.mu.Unlock()
+			return true
+		}
+		freed := server.freed
+		server.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-freed:
+		}
+	}
+}
+
+func (server *Server) release(s slot) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	if server.running[s]--; server.running[s] <= 0 {
+		delete(server.running, s)
+	}
+
+	// Wake everybody waiting in acquireWait.
+	close(server.freed)
+	server.freed = make(chan struct{})
+}
+
+func (server *Server) startParsingExpression(ctx context.Context, node *parser.Node, expr *repo.Expression, results parser.Cache) error {
+	tasksch := make(chan *calc.Task)
+	resultch := make(chan *calc.Result)
+	// agentch is never closed: an agent may be sending the result of the
+	// task in flight while the expression is being cancelled.
+	agentch := make(chan *calc.Result, 1)
+	done := make(chan struct{})
+
+	// progress describes the task in flight; ParsingAST waits for each
+	// result before dispatching the next task.
+	_, total := parser.Measure(node)
+	progress := events.Task{Total: total}
+	var progressMu sync.Mutex
+
+	dispatcherDone := make(chan struct{})
 	go func() {
-		defer wg.Done()
+		defer close(dispatcherDone)
 		for task := range tasksch {
-			server.grpcServer.Tasks <- task
+			progressMu.Lock()
+			progress.ID = task.Id
+			progress.State = events.TaskDispatched
+			progress.Operation = task.Operation
+			progress.Arg1, progress.Arg2 = task.Arg1, task.Arg2
+			progress.Result, progress.Error = nil, ""
+			server.publishTask(expr, progress)
+			progressMu.Unlock()
+
+			server.grpcServer.Submit(expr.ID.String(), task, agentch)
 		}
 	}()
 
-	wg.Add(1)
 	go func() {
-		defer wg.Done()
 		for {
+			var result *calc.Result
+			select {
+			case <-done:
+				return
+			case result = <-agentch:
+			}
+
+			progressMu.Lock()
+			progress.Completed++
+			progress.State = events.TaskDone
+			if result.Error != "" {
+				progress.Error = result.Error
+			} else {
+				value := result.Result
+				progress.Result = &value
+			}
+			server.publishTask(expr, progress)
+			progressMu.Unlock()
+
 			select {
-			case resultch <- <-server.grpcServer.AgentCh:
+			case <-done:
+				return
+			case resultch <- result:
 			}
 		}
 	}()
 
-	wg.Wait()
+	result, parseErr := parser.ParsingASTCached(ctx, node, server.timings(), results, tasksch, resultch)
+	close(tasksch)
+	close(done)
 
 	if parseErr != nil {
-		if err := server.Repo.UpdateExpressionResult(id, 0, "error"); err != nil {
+		// Wait for the task in flight to be queued so that it is dropped
+		// too, e.g. when its agent timed out.
+		<-dispatcherDone
+		server.grpcServer.Drop(expr.ID.String())
+	}
+	if errors.Is(parseErr, context.Canceled) {
+		return server.setStatus(expr, 0, repo.StatusCancelled, nil)
+	}
+	if parseErr != nil {
+		if err := server.setStatus(expr, 0, repo.StatusError, parseErr); err != nil {
 			return fmt.Errorf("update status error: %v, original error: %v", err, parseErr)
 		}
 		return parseErr
 	}
-	if err := server.Repo.UpdateExpressionResult(id, int(result), "DONE"); err != nil {
+	if err := server.setStatus(expr, result, repo.StatusDone, nil); err != nil {
 		return err
 	}
 
 	return nil
 }
+
+// setStatus stores the final status of the expression and notifies
+// subscribers.
+func (server *Server) setStatus(expr *repo.Expression, result float64, status string, cause error) error {
+	var errMsg string
+	if cause != nil {
+		errMsg = cause.Error()
+	}
+	err := server.Repo.FinishExpression(expr.ID, result, status, errMsg)
+
+	event := events.Event{
+		Type:         events.TypeStatus,
+		ExpressionID: expr.ID.String(),
+		Username:     expr.Username,
+		Status:       legacyStatus(status),
+		Error:        errMsg,
+	}
+	if status == repo.StatusDone {
+		event.Result = &result
+	}
+	server.publishStatus(expr, event)
+
+	return err
+}
+
+// publishStatus notifies subscribers of a status change and, once the
+// expression is finished, its callback URL.
+func (server *Server) publishStatus(expr *repo.Expression, event events.Event) {
+	server.Events.Publish(event)
+
+	if event.Terminal() && expr.CallbackURL != "" {
+		server.Webhooks.Deliver(expr.ID, expr.CallbackURL, webhook.Payload{
+			ID:         expr.ID.String(),
+			Expression: expr.Expression,
+			Status:     event.Status,
+			Result:     event.Result,
+			Error:      event.Error,
+		})
+	}
+}
+
+func (server *Server) publishTask(expr *repo.Expression, task events.Task) {
+	server.Events.Publish(events.Event{
+		Type:         events.TypeTask,
+		ExpressionID: expr.ID.String(),
+		Username:     expr.Username,
+		Status:       repo.StatusProcessing,
+		Task:         &task,
+	})
+}
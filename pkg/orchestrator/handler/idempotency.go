@@ -0,0 +1,55 @@
+package handler
+
+import (
+	"time"
+
+	"github.com/StepanShel/YandexProject/internal/problem"
+)
+
+// IdempotencyHeader carries a client chosen key making api/v1/calculate safe
+// to retry: repeating the key returns the expression created the first time.
+const IdempotencyHeader = "Idempotency-Key"
+
+const maxIdempotencyKeyLength = 255
+
+func validateIdempotencyKey(key string) error {
+	if len(key) > maxIdempotencyKeyLength {
+		return problem.New("invalid_idempotency_key", "idempotency key is too long")
+	}
+	for _, c := range key {
+		if c < 0x21 || c > 0x7e {
+			return problem.New("invalid_idempotency_key", "idempotency key must be printable ASCII")
+		}
+	}
+	return nil
+}
+
+// lockIdempotencyKey serialises submissions of the user with the same key,
+// so that concurrent retries cannot both create an expression. The returned
+// function releases the lock.
+func (server *Server) lockIdempotencyKey(username, key string) func() {
+	id := username + "\x00" + key
+	for {
+		server.mu.Lock()
+		inflight, busy := server.keys[id]
+		if !busy {
+			inflight = make(chan struct{})
+			server.keys[id] = inflight
+			server.mu.Unlock()
+			break
+		}
+		server.mu.Unlock()
+		<-inflight
+	}
+
+	return func() {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		close(server.keys[id])
+		delete(server.keys, id)
+	}
+}
+
+func (server *Server) idempotencyWindowStart() time.Time {
+	return time.Now().Add(-time.Duration(server.Config.IdempotencyWindowHours) * time.Hour)
+}
@@ -0,0 +1,146 @@
+package handler
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/StepanShel/YandexProject/internal/problem"
+	"github.com/StepanShel/YandexProject/internal/repo"
+	uuid "github.com/google/uuid"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+// parseListQuery builds the filter for api/v1/expressions from its query
+// parameters:
+//
+//	limit   page size, 1..500; without it pageSize, or 50 with a cursor
+//	cursor  next_cursor of the previous page
+//	status  comma-separated statuses
+//	from    created at or after, RFC 3339 or YYYY-MM-DD
+//	to      created before, RFC 3339 or YYYY-MM-DD
+//	q       substring of the expression text
+//	batch   batch id
+//	sort    created_at or -created_at (default, newest first)
+//	scope   own (default), team for those shared with the user's team, or
+//	        shared for those of others shared with the user or their team
+//
+// A pageSize of zero lists everything unless limit or cursor is given, as
+// API v1 did before it had pages.
+func parseListQuery(query url.Values, username string, pageSize int) (repo.ExpressionFilter, error) {
+	filter := repo.ExpressionFilter{
+		Username: username,
+		Limit:    pageSize,
+		Search:   query.Get("q"),
+	}
+	if query.Has("cursor") && pageSize == 0 {
+		filter.Limit = defaultPageSize
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxPageSize {
+			return filter, problem.Errorf("invalid_parameter", "limit must be between 1 and %d", maxPageSize)
+		}
+		filter.Limit = n
+	}
+
+	if cursor := query.Get("cursor"); cursor != "" {
+		after, err := decodeCursor(cursor)
+		if err != nil {
+			return filter, problem.New("invalid_parameter", "invalid cursor")
+		}
+		filter.After = after
+	}
+
+	if batch := query.Get("batch"); batch != "" {
+		id, err := parseID(batch)
+		if err != nil {
+			return filter, problem.New("invalid_batch_id", "invalid batch id")
+		}
+		filter.BatchID = id
+	}
+
+	if status := query.Get("status"); status != "" {
+		for _, s := range strings.Split(status, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				filter.Statuses = append(filter.Statuses, s)
+			}
+		}
+	}
+
+	var err error
+	if filter.From, err = parseTime(query.Get("from")); err != nil {
+		return filter, problem.New("invalid_parameter", "from must be an RFC 3339 time or a date")
+	}
+	if filter.To, err = parseTime(query.Get("to")); err != nil {
+		return filter, problem.New("invalid_parameter", "to must be an RFC 3339 time or a date")
+	}
+
+	switch query.Get("sort") {
+	case "", "-created_at":
+	case "created_at":
+		filter.Ascending = true
+	default:
+		return filter, problem.New("invalid_parameter", "sort must be created_at or -created_at")
+	}
+
+	switch scope := query.Get("scope"); scope {
+	case "":
+		filter.Scope = repo.ScopeOwn
+	case repo.ScopeOwn, repo.ScopeTeam, repo.ScopeShared:
+		filter.Scope = scope
+	default:
+		return filter, problem.New("invalid_parameter", "scope must be own, team or shared")
+	}
+
+	return filter, nil
+}
+
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, value)
+}
+
+// Cursors are opaque to clients; they encode the position of the last
+// expression of a page.
+func encodeCursor(cursor *repo.Cursor) string {
+	if cursor == nil {
+		return ""
+	}
+	raw := cursor.CreatedAt.UTC().Format(time.RFC3339) + "|" + cursor.ID.String()
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeCursor(value string) (*repo.Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+
+	createdAt, id, ok := strings.Cut(string(raw), "|")
+	if !ok {
+		return nil, errors.New("malformed cursor")
+	}
+
+	var cursor repo.Cursor
+	if cursor.CreatedAt, err = time.Parse(time.RFC3339, createdAt); err != nil {
+		return nil, err
+	}
+	if cursor.ID, err = uuid.Parse(id); err != nil {
+		return nil, err
+	}
+	return &cursor, nil
+}
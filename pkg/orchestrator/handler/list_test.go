@@ -0,0 +1,173 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/StepanShel/YandexProject/internal/problem"
+	"github.com/StepanShel/YandexProject/internal/repo"
+	uuid "github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseListQuery(t *testing.T) {
+	cursor := &repo.Cursor{CreatedAt: time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC), ID: uuid.New()}
+	batch := uuid.New()
+
+	tests := []struct {
+		name     string
+		query    string
+		pageSize int
+		want     repo.ExpressionFilter
+	}{
+		{"v1 lists everything", "", 0, repo.ExpressionFilter{Username: "alice", Scope: repo.ScopeOwn}},
+		{"v1 cursor pages", "cursor=" + encodeCursor(cursor), 0, repo.ExpressionFilter{Username: "alice", Scope: repo.ScopeOwn, Limit: defaultPageSize, After: cursor}},
+		{"v2 pages", "", defaultPageSize, repo.ExpressionFilter{Username: "alice", Scope: repo.ScopeOwn, Limit: defaultPageSize}},
+		{"limit", "limit=500", 0, repo.ExpressionFilter{Username: "alice", Scope: repo.ScopeOwn, Limit: 500}},
+		{
+			"filters",
+			"status=DONE,+error,&q=sqrt&batch=" + batch.String() + "&from=2025-01-01&to=2025-02-01T10:00:00Z&sort=created_at&scope=team",
+			defaultPageSize,
+			repo.ExpressionFilter{
+				Username:  "alice",
+				Statuses:  []string{"DONE", "error"},
+				Search:    "sqrt",
+				BatchID:   batch,
+				From:      time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+				To:        time.Date(2025, 2, 1, 10, 0, 0, 0, time.UTC),
+				Ascending: true,
+				Scope:     repo.ScopeTeam,
+				Limit:     defaultPageSize,
+			},
+		},
+		{"newest first", "sort=-created_at&scope=shared", 0, repo.ExpressionFilter{Username: "alice", Scope: repo.ScopeShared}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, err := url.ParseQuery(tt.query)
+			require.NoError(t, err)
+			filter, err := parseListQuery(query, "alice", tt.pageSize)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, filter)
+		})
+	}
+}
+
+func TestParseListQueryErrors(t *testing.T) {
+	tests := []struct {
+		query, code string
+	}{
+		{"limit=0", "invalid_parameter"},
+		{"limit=501", "invalid_parameter"},
+		{"limit=ten", "invalid_parameter"},
+		{"cursor=bogus", "invalid_parameter"},
+		{"cursor=" + encodeCursor(&repo.Cursor{}) + "x", "invalid_parameter"},
+		{"from=yesterday", "invalid_parameter"},
+		{"to=2025-13-01", "invalid_parameter"},
+		{"sort=name", "invalid_parameter"},
+		{"scope=all", "invalid_parameter"},
+		{"batch=42", "invalid_batch_id"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			query, err := url.ParseQuery(tt.query)
+			require.NoError(t, err)
+			_, err = parseListQuery(query, "alice", 0)
+			assert.Equal(t, tt.code, problem.Code(err, http.StatusBadRequest))
+		})
+	}
+}
+
+func TestListExpressions(t *testing.T) {
+	api := newTestAPI(t)
+	token := api.login("alice")
+
+	const total = 60
+	for i := range total {
+		status := repo.StatusDone
+		if i%3 == 0 {
+			status = repo.StatusError
+		}
+		require.NoError(t, api.repo.CreateExpression(&repo.Expression{
+			Username:   "alice",
+			Expression: fmt.Sprintf("%d+1", i),
+			Status:     status,
+		}))
+	}
+
+	type page struct {
+		Expressions []json.RawMessage `json:"expressions"`
+		NextCursor  string            `json:"next_cursor"`
+	}
+	list := func(path string) page {
+		t.Helper()
+		resp, data := api.do("GET", path, token, nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode, "%s", data)
+		var p page
+		require.NoError(t, json.Unmarshal(data, &p))
+		return p
+	}
+
+	// Existing v1 clients get the whole list.
+	p := list("/api/v1/expressions")
+	assert.Len(t, p.Expressions, total)
+	assert.Empty(t, p.NextCursor)
+
+	// Pages cover the list once.
+	p = list("/api/v1/expressions?limit=25")
+	assert.Len(t, p.Expressions, 25)
+	require.NotEmpty(t, p.NextCursor)
+	p = list("/api/v1/expressions?cursor=" + p.NextCursor)
+	assert.Len(t, p.Expressions, total-25)
+	assert.Empty(t, p.NextCursor)
+
+	// API v2 pages by default.
+	p = list("/api/v2/expressions")
+	assert.Len(t, p.Expressions, defaultPageSize)
+	assert.NotEmpty(t, p.NextCursor)
+
+	ids := func(p page) []string {
+		t.Helper()
+		var ids []string
+		for _, raw := range p.Expressions {
+			var expr ExpressionV2
+			require.NoError(t, json.Unmarshal(raw, &expr))
+			ids = append(ids, expr.ID)
+		}
+		return ids
+	}
+	newest := ids(list("/api/v2/expressions?limit=500"))
+	oldest := ids(list("/api/v2/expressions?limit=500&sort=created_at"))
+	require.Len(t, oldest, total)
+	slices.Reverse(oldest)
+	assert.Equal(t, newest, oldest)
+
+	p = list("/api/v2/expressions?status=error&q=2")
+	require.NotEmpty(t, p.Expressions)
+	for _, raw := range p.Expressions {
+		var expr ExpressionV2
+		require.NoError(t, json.Unmarshal(raw, &expr))
+		assert.Equal(t, repo.StatusError, expr.Status)
+		assert.Contains(t, expr.Expression, "2")
+	}
+
+	for _, path := range []string{
+		"/api/v1/expressions?limit=0",
+		"/api/v1/expressions?cursor=bogus",
+		"/api/v1/expressions?from=yesterday",
+		"/api/v2/expressions?sort=name",
+		"/api/v2/expressions?status=bogus",
+		"/api/v2/expressions?batch=42",
+	} {
+		resp, data := api.do("GET", path, token, nil)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "%s: %s", path, data)
+	}
+}
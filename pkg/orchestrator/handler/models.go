@@ -1,25 +1,70 @@
 package handler
 
 import (
+	"context"
 	"fmt"
+	"net/http"
 	"sync"
+	"time"
 
+	"github.com/StepanShel/YandexProject/internal/ratelimit"
 	"github.com/StepanShel/YandexProject/internal/repo"
+	"github.com/StepanShel/YandexProject/pkg/orchestrator/cache"
 	"github.com/StepanShel/YandexProject/pkg/orchestrator/config"
+	"github.com/StepanShel/YandexProject/pkg/orchestrator/events"
 	grpc "github.com/StepanShel/YandexProject/pkg/orchestrator/gRPC"
-	"github.com/StepanShel/YandexProject/pkg/orchestrator/parser"
+	"github.com/StepanShel/YandexProject/pkg/orchestrator/webhook"
+	uuid "github.com/google/uuid"
 )
 
 type Request struct {
 	Expression string `json:"expression"`
+	// CallbackURL receives the result once the expression is finished.
+	CallbackURL string `json:"callback_url,omitempty"`
+	// NoCache evaluates the expression even if its result is cached. It is
+	// also set by a "Cache-Control: no-cache" header.
+	NoCache bool `json:"no_cache,omitempty"`
+	// IdempotencyKey comes from the Idempotency-Key header.
+	IdempotencyKey string `json:"-"`
 }
 
-type ResponseError struct {
+// BatchItem is one expression of a batch. Variables are substituted like
+// constants, for this expression only.
+type BatchItem struct {
+	Expression  string             `json:"expression"`
+	Variables   map[string]float64 `json:"variables,omitempty"`
+	CallbackURL string             `json:"callback_url,omitempty"`
+	NoCache     bool               `json:"no_cache,omitempty"`
+}
+
+type BatchRequest struct {
+	Expressions []BatchItem `json:"expressions"`
+}
+
+type ResponseBatch struct {
+	BatchID string   `json:"batch_id"`
+	IDs     []string `json:"ids"`
+}
+
+type BatchItemError struct {
+	Index int    `json:"index"`
+	Code  string `json:"code"`
 	Error string `json:"error"`
 }
 
+type Batch struct {
+	ID        string         `json:"id"`
+	Status    string         `json:"status"`
+	Total     int            `json:"total"`
+	Counts    map[string]int `json:"counts"`
+	CreatedAt string         `json:"created_at"`
+}
+
 type ResponseID struct {
 	Id string `json:"id"`
+	// Status is set when a repeated idempotency key returns an existing
+	// expression.
+	Status string `json:"status,omitempty"`
 }
 
 type ResultFromAgent struct {
@@ -29,6 +74,8 @@ type ResultFromAgent struct {
 
 type ResponseExprs struct {
 	Exprs []Expression `json:"expressions"`
+	// NextCursor fetches the next page; it is empty on the last one.
+	NextCursor string `json:"next_cursor,omitempty"`
 }
 
 type Expression struct {
@@ -37,13 +84,143 @@ type Expression struct {
 	Result float64 `json:"result"`
 }
 
+// ExpressionV2 is the API v2 representation of an expression. Result is
+// set once the expression is done, Error once it failed.
+type ExpressionV2 struct {
+	ID         string               `json:"id"`
+	Expression string               `json:"expression"`
+	Owner      string               `json:"owner"`
+	Status     string               `json:"status"`
+	Result     *float64             `json:"result,omitempty"`
+	Error      string               `json:"error,omitempty"`
+	Constants  []repo.ConstantUsage `json:"constants,omitempty"`
+	BatchID    string               `json:"batch_id,omitempty"`
+	CreatedAt  string               `json:"created_at"`
+	StartedAt  string               `json:"started_at,omitempty"`
+	FinishedAt string               `json:"finished_at,omitempty"`
+}
+
+type ResponseExpressionsV2 struct {
+	Expressions []ExpressionV2 `json:"expressions"`
+	NextCursor  string         `json:"next_cursor,omitempty"`
+}
+
+type Constant struct {
+	Name    string  `json:"name"`
+	Value   float64 `json:"value"`
+	Version int     `json:"version"`
+	Builtin bool    `json:"builtin,omitempty"`
+}
+
+type ConstantRequest struct {
+	Value *float64 `json:"value"`
+}
+
+type ResponseConstants struct {
+	Constants []Constant `json:"constants"`
+}
+
+type WebhookAttempt struct {
+	URL        string `json:"url"`
+	Attempt    int    `json:"attempt"`
+	StatusCode int    `json:"status_code"`
+	Error      string `json:"error,omitempty"`
+	Delivered  bool   `json:"delivered"`
+	CreatedAt  string `json:"created_at"`
+}
+
+// AccountDeletionRequest confirms the deletion of the account.
+type AccountDeletionRequest struct {
+	Password string `json:"password"`
+}
+
+// UserInfo is how admins see a user account.
+type UserInfo struct {
+	Username string `json:"username"`
+	Role     string `json:"role"`
+	Disabled bool   `json:"disabled"`
+}
+
+type ResponseUsers struct {
+	Users []UserInfo `json:"users"`
+}
+
+// UserUpdate changes the role of a user or disables the account. Omitted
+// fields are left as they are.
+type UserUpdate struct {
+	Role     *string `json:"role,omitempty"`
+	Disabled *bool   `json:"disabled,omitempty"`
+}
+
+// OperationTimings are the simulated durations of the operations, in
+// milliseconds.
+type OperationTimings struct {
+	Addition       int `json:"addition_ms"`
+	Subtraction    int `json:"subtraction_ms"`
+	Multiplication int `json:"multiplication_ms"`
+	Division       int `json:"division_ms"`
+}
+
+type TeamRequest struct {
+	Name string `json:"name"`
+}
+
+type TeamMemberRequest struct {
+	Username string `json:"username"`
+}
+
+// Team is a group of users sharing expressions.
+type Team struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Owner     string    `json:"owner"`
+	Members   []string  `json:"members"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TeamInvite is an invite for Username to join a team.
+type TeamInvite struct {
+	TeamID    string    `json:"team_id"`
+	Team      string    `json:"team"`
+	Owner     string    `json:"owner"`
+	Username  string    `json:"username"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type ResponseTeamInvites struct {
+	Invites []TeamInvite `json:"invites"`
+}
+
+// ExpressionSharing tells who may read an expression besides its owner:
+// the owner's team and particular users.
+type ExpressionSharing struct {
+	Team  bool     `json:"team"`
+	Users []string `json:"users"`
+}
+
+type ResponseWebhookAttempts struct {
+	Attempts []WebhookAttempt `json:"attempts"`
+}
+
 type Server struct {
 	grpcServer *grpc.Server
 	Repo       *repo.Repo
 	mu         sync.Mutex
-	tasks      []parser.Task
-	Agentch    chan parser.Result
+	running    map[slot]int
+	freed      chan struct{}
+	keys       map[string]chan struct{}
+	cancels    map[uuid.UUID]context.CancelFunc
 	Config     *config.Config
+	// settingsMu guards the operation timings of Config, which admins may
+	// change at runtime.
+	settingsMu sync.RWMutex
+	Events     *events.Hub
+	Webhooks   *webhook.Dispatcher
+	Cache      *cache.Cache
+	limiter    *ratelimit.Limiter
+	// confirmPassword checks the password of the caller under the login
+	// lockout, writing the error if it is wrong; Routes sets it.
+	confirmPassword func(w http.ResponseWriter, r *http.Request, username, password string) bool
 }
 
 func NewServer(grpcServer *grpc.Server) *Server {
@@ -53,10 +230,22 @@ func NewServer(grpcServer *grpc.Server) *Server {
 		return nil
 	}
 
+	return New(grpcServer, Repo, config.ConfigFromEnv())
+}
+
+// New returns a server storing expressions in the given repository.
+func New(grpcServer *grpc.Server, Repo *repo.Repo, cfg *config.Config) *Server {
 	return &Server{
 		grpcServer: grpcServer,
 		Repo:       Repo,
-		tasks:      make([]parser.Task, 0),
-		Config:     config.ConfigFromEnv(),
+		running:    make(map[slot]int),
+		freed:      make(chan struct{}),
+		keys:       make(map[string]chan struct{}),
+		cancels:    make(map[uuid.UUID]context.CancelFunc),
+		Config:     cfg,
+		Events:     events.NewHub(),
+		Webhooks:   webhook.NewDispatcher(cfg.WebhookSecret, cfg.WebhookMaxAttempts, Repo),
+		Cache:      cache.New(time.Duration(cfg.CacheTTLSeconds)*time.Second, cfg.CacheMaxEntries),
+		limiter:    ratelimit.New(),
 	}
 }
@@ -0,0 +1,655 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/StepanShel/YandexProject/internal/auth"
+	"github.com/StepanShel/YandexProject/internal/problem"
+	"github.com/StepanShel/YandexProject/internal/repo"
+	uuid "github.com/google/uuid"
+)
+
+// The OpenAPI document is generated from the request and response types, so
+// that it cannot drift from what the handlers encode.
+
+var openAPIDocument = sync.OnceValue(func() []byte {
+	data, err := json.Marshal(OpenAPI())
+	if err != nil {
+		panic(err)
+	}
+	return data
+})
+
+// endpoint api/v1/openapi.json
+func (server *Server) HandleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPIDocument())
+}
+
+// OpenAPI returns the OpenAPI 3 description of the API.
+func OpenAPI() map[string]any {
+	s := &schemas{components: make(map[string]any)}
+
+	errorResponse := func(description string) map[string]any {
+		return problemResponse(description, s.of(problem.Problem{}))
+	}
+	unauthorized := errorResponse("Missing, invalid or expired token")
+	adminOnly := errorResponse("Not an admin or account disabled")
+	bearer := []map[string]any{{"bearerAuth": []string{}}, {"apiKeyAuth": []string{}}}
+	tokenOnly := []map[string]any{{"bearerAuth": []string{}}}
+
+	paths := map[string]any{
+		"/api/v1/register": map[string]any{
+			"post": map[string]any{
+				"operationId": "register",
+				"summary":     "Register a user",
+				"requestBody": requestBody(s.of(repo.User{})),
+				"responses": map[string]any{
+					"200": map[string]any{"description": "Registered"},
+					"400": errorResponse("Malformed body or unknown field"),
+					"409": errorResponse("User already exists"),
+					"422": errorResponse("Invalid username or weak password"),
+				},
+			},
+		},
+		"/api/v1/login": map[string]any{
+			"post": map[string]any{
+				"operationId": "login",
+				"summary":     "Get an access token",
+				"description": "After repeated failed logins to a username or from an address, logins are locked out for a period doubling with each further failure.",
+				"requestBody": requestBody(s.of(repo.User{})),
+				"responses": map[string]any{
+					"200": response("Access token and the refresh token renewing it", s.of(auth.TokenResponse{})),
+					"400": errorResponse("Malformed body or unknown field"),
+					"401": errorResponse("Invalid credentials"),
+					"403": errorResponse("Account disabled"),
+					"429": errorResponse("Locked out after failed logins; see Retry-After"),
+				},
+			},
+		},
+		"/.well-known/jwks.json": map[string]any{
+			"get": map[string]any{
+				"operationId": "jwks",
+				"summary":     "Public keys access tokens are signed with",
+				"description": "Tokens name their key in the kid header. HS256 secrets are not published.",
+				"responses": map[string]any{
+					"200": response("JSON Web Key Set", s.of(auth.JWKS{})),
+				},
+			},
+		},
+		"/api/v1/token/refresh": map[string]any{
+			"post": map[string]any{
+				"operationId": "refreshToken",
+				"summary":     "Exchange a refresh token for new tokens",
+				"description": "The refresh token is single-use. Presenting a used one again revokes all refresh tokens of its user.",
+				"requestBody": requestBody(s.of(auth.RefreshRequest{})),
+				"responses": map[string]any{
+					"200": response("New access token and refresh token", s.of(auth.TokenResponse{})),
+					"400": errorResponse("Malformed body or unknown field"),
+					"401": errorResponse("Invalid, expired, revoked or reused refresh token"),
+				},
+			},
+		},
+		"/api/v1/logout": map[string]any{
+			"post": map[string]any{
+				"operationId": "logout",
+				"summary":     "Revoke the access token and optionally a refresh token",
+				"security":    bearer,
+				"requestBody": map[string]any{
+					"required": false,
+					"content":  map[string]any{"application/json": map[string]any{"schema": s.of(auth.LogoutRequest{})}},
+				},
+				"responses": map[string]any{
+					"204": map[string]any{"description": "Logged out"},
+					"400": errorResponse("Malformed body or unknown field"),
+					"401": unauthorized,
+				},
+			},
+		},
+		"/api/v1/account/password": map[string]any{
+			"post": map[string]any{
+				"operationId": "changePassword",
+				"summary":     "Change the password",
+				"description": "All access and refresh tokens and API keys of the user stop working; the response carries new tokens.",
+				"security":    tokenOnly,
+				"requestBody": requestBody(s.of(auth.PasswordChangeRequest{})),
+				"responses": map[string]any{
+					"200": response("New access token and refresh token", s.of(auth.TokenResponse{})),
+					"400": errorResponse("Malformed body or unknown field"),
+					"401": unauthorized,
+					"403": errorResponse("Wrong current password or authenticated with an API key"),
+					"422": errorResponse("Weak new password"),
+					"429": errorResponse("Locked out after wrong passwords; see Retry-After"),
+				},
+			},
+		},
+		"/api/v1/account": map[string]any{
+			"delete": map[string]any{
+				"operationId": "deleteAccount",
+				"summary":     "Delete the account with all its expressions",
+				"description": "Wrong passwords count as failed logins.",
+				"security":    tokenOnly,
+				"requestBody": requestBody(s.of(AccountDeletionRequest{})),
+				"responses": map[string]any{
+					"204": map[string]any{"description": "Deleted"},
+					"400": errorResponse("Malformed body or unknown field"),
+					"401": unauthorized,
+					"403": errorResponse("Wrong password or authenticated with an API key"),
+					"429": errorResponse("Locked out after wrong passwords; see Retry-After"),
+				},
+			},
+		},
+		"/api/v1/apikeys": map[string]any{
+			"get": map[string]any{
+				"operationId": "listAPIKeys",
+				"summary":     "List the user's API keys that were not revoked",
+				"security":    tokenOnly,
+				"responses": map[string]any{
+					"200": response("API keys, newest first", s.of(auth.APIKeysResponse{})),
+					"401": unauthorized,
+					"403": errorResponse("Authenticated with an API key"),
+				},
+			},
+			"post": map[string]any{
+				"operationId": "createAPIKey",
+				"summary":     "Create an API key",
+				"description": "The key is returned only in this response. Scopes default to read and write.",
+				"security":    tokenOnly,
+				"requestBody": requestBody(s.of(auth.APIKeyRequest{})),
+				"responses": map[string]any{
+					"201": response("The key and its description", s.of(auth.CreatedAPIKey{})),
+					"400": errorResponse("Malformed body or unknown field"),
+					"401": unauthorized,
+					"403": errorResponse("Authenticated with an API key"),
+					"409": errorResponse("Too many API keys"),
+					"422": errorResponse("Invalid name, scope or expiry"),
+				},
+			},
+		},
+		"/api/v1/apikeys/{id}": map[string]any{
+			"parameters": []any{
+				required(parameter("id", "path", "API key id", map[string]any{"type": "string", "format": "uuid"})),
+			},
+			"delete": map[string]any{
+				"operationId": "revokeAPIKey",
+				"summary":     "Revoke an API key",
+				"security":    tokenOnly,
+				"responses": map[string]any{
+					"204": map[string]any{"description": "Revoked"},
+					"400": errorResponse("Invalid API key id"),
+					"401": unauthorized,
+					"403": errorResponse("Authenticated with an API key"),
+					"404": errorResponse("API key not found"),
+				},
+			},
+		},
+		"/api/v1/calculate": map[string]any{
+			"post": map[string]any{
+				"operationId": "calculate",
+				"summary":     "Submit an expression",
+				"security":    bearer,
+				"parameters": []any{
+					parameter("Idempotency-Key", "header", "Repeating the key returns the expression created the first time", stringSchema()),
+					parameter("Cache-Control", "header", "no-cache evaluates the expression even if its result is cached", stringSchema()),
+				},
+				"requestBody": requestBody(s.of(Request{})),
+				"responses": map[string]any{
+					"201": response("Expression accepted; syntax errors are reported through its status", s.of(ResponseID{})),
+					"200": response("Expression previously submitted with the same Idempotency-Key", s.of(ResponseID{})),
+					"400": errorResponse("Malformed body, unknown field or invalid Idempotency-Key"),
+					"401": unauthorized,
+					"403": errorResponse("Readonly user"),
+					"413": errorResponse("Expression or body too long"),
+					"422": errorResponse("Empty expression, invalid callback URL or callbacks disabled, expression too complex or reused Idempotency-Key"),
+					"429": errorResponse("Too many expressions in progress"),
+				},
+			},
+		},
+		"/api/v1/expressions": map[string]any{
+			"get": map[string]any{
+				"operationId": "listExpressions",
+				"summary":     "List the user's expressions, newest first",
+				"security":    bearer,
+				"parameters": []any{
+					parameter("limit", "query", "Page size; without limit and cursor all expressions are listed", map[string]any{"type": "integer", "minimum": 1, "maximum": maxPageSize}),
+					parameter("cursor", "query", "next_cursor of the previous page", stringSchema()),
+					parameter("status", "query", "Comma-separated statuses", stringSchema()),
+					parameter("from", "query", "Created at or after, RFC 3339 time or date", stringSchema()),
+					parameter("to", "query", "Created before, RFC 3339 time or date", stringSchema()),
+					parameter("q", "query", "Substring of the expression text", stringSchema()),
+					parameter("batch", "query", "Batch id", map[string]any{"type": "string", "format": "uuid"}),
+					parameter("sort", "query", "Sort order", map[string]any{"type": "string", "enum": []string{"created_at", "-created_at"}}),
+					parameter("scope", "query", "own: the user's expressions; team: those shared with the user's team; shared: those of others shared with the user or their team",
+						map[string]any{"type": "string", "enum": []string{repo.ScopeOwn, repo.ScopeTeam, repo.ScopeShared}, "default": repo.ScopeOwn}),
+				},
+				"responses": map[string]any{
+					"200": response("A page of expressions", s.of(ResponseExprs{})),
+					"400": errorResponse("Invalid query parameter"),
+					"401": unauthorized,
+				},
+			},
+		},
+		"/api/v1/expressions/{id}": map[string]any{
+			"parameters": []any{
+				required(parameter("id", "path", "Expression id", map[string]any{"type": "string", "format": "uuid"})),
+			},
+			"get": map[string]any{
+				"operationId": "getExpression",
+				"summary":     "Get an expression",
+				"description": "Expressions of other users may be read if they are shared with the user or their team.",
+				"security":    bearer,
+				"responses": map[string]any{
+					"200": response("The expression", object(map[string]any{"Expression": s.of(Expression{})})),
+					"400": errorResponse("Invalid expression id"),
+					"401": unauthorized,
+					"403": errorResponse("Expression of another user not shared with the user"),
+					"404": errorResponse("Expression not found"),
+				},
+			},
+			"delete": map[string]any{
+				"operationId": "deleteExpression",
+				"summary":     "Delete an expression, cancelling it if it is running",
+				"security":    bearer,
+				"responses": map[string]any{
+					"204": map[string]any{"description": "Deleted"},
+					"400": errorResponse("Invalid expression id"),
+					"401": unauthorized,
+					"403": errorResponse("Expression of another user"),
+					"404": errorResponse("Expression not found"),
+				},
+			},
+		},
+		"/api/v1/expressions/{id}/sharing": map[string]any{
+			"parameters": []any{
+				required(parameter("id", "path", "Expression id", map[string]any{"type": "string", "format": "uuid"})),
+			},
+			"get": map[string]any{
+				"operationId": "getExpressionSharing",
+				"summary":     "Tell whom an expression is shared with",
+				"security":    bearer,
+				"responses": map[string]any{
+					"200": response("The sharing", object(map[string]any{"sharing": s.of(ExpressionSharing{})})),
+					"400": errorResponse("Invalid expression id"),
+					"401": unauthorized,
+					"403": errorResponse("Expression of another user"),
+					"404": errorResponse("Expression not found"),
+				},
+			},
+			"put": map[string]any{
+				"operationId": "shareExpression",
+				"summary":     "Share an expression read-only with the user's team or particular users",
+				"description": "Replaces the previous sharing. Only the owner may change or delete the expression.",
+				"security":    bearer,
+				"requestBody": requestBody(s.of(ExpressionSharing{})),
+				"responses": map[string]any{
+					"200": response("The new sharing", object(map[string]any{"sharing": s.of(ExpressionSharing{})})),
+					"400": errorResponse("Invalid expression id, malformed body or unknown field"),
+					"401": unauthorized,
+					"403": errorResponse("Expression of another user or readonly user"),
+					"404": errorResponse("Expression not found"),
+					"422": errorResponse("No team to share with, a user it cannot be shared with or too many users"),
+				},
+			},
+		},
+		"/api/v1/team": map[string]any{
+			"post": map[string]any{
+				"operationId": "createTeam",
+				"summary":     "Create a team owned by the user",
+				"security":    bearer,
+				"requestBody": requestBody(s.of(TeamRequest{})),
+				"responses": map[string]any{
+					"201": response("The team", object(map[string]any{"team": s.of(Team{})})),
+					"400": errorResponse("Malformed body or unknown field"),
+					"401": unauthorized,
+					"409": errorResponse("Team name taken or the user already belongs to a team"),
+					"422": errorResponse("Invalid name"),
+				},
+			},
+			"get": map[string]any{
+				"operationId": "getTeam",
+				"summary":     "Get the team of the user",
+				"security":    bearer,
+				"responses": map[string]any{
+					"200": response("The team", object(map[string]any{"team": s.of(Team{})})),
+					"401": unauthorized,
+					"404": errorResponse("The user does not belong to a team"),
+				},
+			},
+			"delete": map[string]any{
+				"operationId": "deleteTeam",
+				"summary":     "Delete the team of the user",
+				"description": "Members are left without a team; their expressions are no longer shared with it.",
+				"security":    bearer,
+				"responses": map[string]any{
+					"204": map[string]any{"description": "Deleted"},
+					"401": unauthorized,
+					"403": errorResponse("Not the owner of the team"),
+					"404": errorResponse("The user does not belong to a team"),
+				},
+			},
+		},
+		"/api/v1/team/members": map[string]any{
+			"post": map[string]any{
+				"operationId": "addTeamMember",
+				"summary":     "Invite a user to the team",
+				"description": "The user joins the team by accepting the invite. Inviting the user again keeps the first invite.",
+				"security":    bearer,
+				"requestBody": requestBody(s.of(TeamMemberRequest{})),
+				"responses": map[string]any{
+					"202": response("The invite", object(map[string]any{"invite": s.of(TeamInvite{})})),
+					"400": errorResponse("Malformed body or unknown field"),
+					"401": unauthorized,
+					"403": errorResponse("Not the owner of the team"),
+					"404": errorResponse("The user does not belong to a team"),
+					"422": errorResponse("The user cannot be invited: unknown or already in a team"),
+				},
+			},
+		},
+		"/api/v1/team/invites": map[string]any{
+			"get": map[string]any{
+				"operationId": "listTeamInvites",
+				"summary":     "List the invites of the user to join teams",
+				"security":    bearer,
+				"responses": map[string]any{
+					"200": response("Invites, oldest first", s.of(ResponseTeamInvites{})),
+					"401": unauthorized,
+				},
+			},
+		},
+		"/api/v1/team/invites/{team}": map[string]any{
+			"parameters": []any{
+				required(parameter("team", "path", "Id of the inviting team", map[string]any{"type": "string", "format": "uuid"})),
+			},
+			"delete": map[string]any{
+				"operationId": "declineTeamInvite",
+				"summary":     "Decline an invite",
+				"security":    bearer,
+				"responses": map[string]any{
+					"204": map[string]any{"description": "Declined"},
+					"400": errorResponse("Invalid team id"),
+					"401": unauthorized,
+					"404": errorResponse("Invite not found"),
+				},
+			},
+		},
+		"/api/v1/team/invites/{team}/accept": map[string]any{
+			"parameters": []any{
+				required(parameter("team", "path", "Id of the inviting team", map[string]any{"type": "string", "format": "uuid"})),
+			},
+			"post": map[string]any{
+				"operationId": "acceptTeamInvite",
+				"summary":     "Accept an invite and join the team",
+				"description": "The other invites of the user are dropped.",
+				"security":    bearer,
+				"responses": map[string]any{
+					"200": response("The team", object(map[string]any{"team": s.of(Team{})})),
+					"400": errorResponse("Invalid team id"),
+					"401": unauthorized,
+					"404": errorResponse("Invite not found"),
+					"409": errorResponse("The user already belongs to a team"),
+				},
+			},
+		},
+		"/api/v1/team/members/{username}": map[string]any{
+			"parameters": []any{
+				required(parameter("username", "path", "Username", stringSchema())),
+			},
+			"delete": map[string]any{
+				"operationId": "removeTeamMember",
+				"summary":     "Remove a member from the team, or leave it",
+				"description": "The owner removes members; members remove themselves. Their expressions are no longer shared with the team.",
+				"security":    bearer,
+				"responses": map[string]any{
+					"204": map[string]any{"description": "Removed"},
+					"401": unauthorized,
+					"403": errorResponse("Not the owner of the team"),
+					"404": errorResponse("No team or not a member"),
+					"409": errorResponse("The owner cannot leave the team"),
+				},
+			},
+		},
+		"/api/v1/admin/users": map[string]any{
+			"get": map[string]any{
+				"operationId": "adminListUsers",
+				"summary":     "List all users",
+				"security":    bearer,
+				"responses": map[string]any{
+					"200": response("Users ordered by name", s.of(ResponseUsers{})),
+					"401": unauthorized,
+					"403": adminOnly,
+				},
+			},
+		},
+		"/api/v1/admin/users/{username}": map[string]any{
+			"parameters": []any{
+				required(parameter("username", "path", "Username", stringSchema())),
+			},
+			"patch": map[string]any{
+				"operationId": "adminUpdateUser",
+				"summary":     "Change the role of a user or disable the account",
+				"description": "Tokens issued before stop being accepted. Disabling the account also revokes its refresh tokens.",
+				"security":    bearer,
+				"requestBody": requestBody(s.of(UserUpdate{})),
+				"responses": map[string]any{
+					"200": response("The updated user", object(map[string]any{"user": s.of(UserInfo{})})),
+					"400": errorResponse("Malformed body or unknown field"),
+					"401": unauthorized,
+					"403": adminOnly,
+					"404": errorResponse("User not found"),
+					"409": errorResponse("Admins cannot change their own account"),
+					"422": errorResponse("Unknown role"),
+				},
+			},
+		},
+		"/api/v1/admin/expressions": map[string]any{
+			"get": map[string]any{
+				"operationId": "adminListExpressions",
+				"summary":     "List the expressions of any user, newest first",
+				"security":    bearer,
+				"parameters": []any{
+					required(parameter("owner", "query", "Username", stringSchema())),
+					parameter("limit", "query", "Page size", map[string]any{"type": "integer", "minimum": 1, "maximum": maxPageSize, "default": defaultPageSize}),
+					parameter("cursor", "query", "next_cursor of the previous page", stringSchema()),
+					parameter("status", "query", "Comma-separated statuses", stringSchema()),
+				},
+				"responses": map[string]any{
+					"200": response("A page of expressions", s.of(ResponseExpressionsV2{})),
+					"400": errorResponse("Missing owner or invalid query parameter"),
+					"401": unauthorized,
+					"403": adminOnly,
+				},
+			},
+		},
+		"/api/v1/admin/expressions/{id}": map[string]any{
+			"parameters": []any{
+				required(parameter("id", "path", "Expression id", map[string]any{"type": "string", "format": "uuid"})),
+			},
+			"get": map[string]any{
+				"operationId": "adminGetExpression",
+				"summary":     "Get an expression of any user",
+				"security":    bearer,
+				"responses": map[string]any{
+					"200": response("The expression", object(map[string]any{"expression": s.of(ExpressionV2{})})),
+					"400": errorResponse("Invalid expression id"),
+					"401": unauthorized,
+					"403": adminOnly,
+					"404": errorResponse("Expression not found"),
+				},
+			},
+		},
+		"/api/v1/admin/settings/timings": map[string]any{
+			"get": map[string]any{
+				"operationId": "adminGetTimings",
+				"summary":     "Get the operation timings",
+				"security":    bearer,
+				"responses": map[string]any{
+					"200": response("Operation timings in milliseconds", object(map[string]any{"timings": s.of(OperationTimings{})})),
+					"401": unauthorized,
+					"403": adminOnly,
+				},
+			},
+			"put": map[string]any{
+				"operationId": "adminSetTimings",
+				"summary":     "Change the operation timings until the restart",
+				"security":    bearer,
+				"requestBody": requestBody(s.of(OperationTimings{})),
+				"responses": map[string]any{
+					"200": response("The new operation timings", object(map[string]any{"timings": s.of(OperationTimings{})})),
+					"400": errorResponse("Malformed body or unknown field"),
+					"401": unauthorized,
+					"403": adminOnly,
+					"422": errorResponse("Timing not positive"),
+				},
+			},
+		},
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":       "Distributed calculator",
+			"version":     "1.0.0",
+			"description": "Requests are rate limited per user, or per client address without credentials. Any operation may answer 429 with the rate_limited code and a Retry-After header.",
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": s.components,
+			"securitySchemes": map[string]any{
+				"bearerAuth": map[string]any{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+				"apiKeyAuth": map[string]any{"type": "apiKey", "in": "header", "name": auth.APIKeyHeader},
+			},
+		},
+	}
+}
+
+// schemas builds JSON schemas from Go types, collecting named structs as
+// components.
+type schemas struct {
+	components map[string]any
+}
+
+var (
+	uuidType = reflect.TypeOf(uuid.UUID{})
+	timeType = reflect.TypeOf(time.Time{})
+)
+
+func (s *schemas) of(value any) map[string]any {
+	return s.schema(reflect.TypeOf(value))
+}
+
+func (s *schemas) schema(t reflect.Type) map[string]any {
+	switch {
+	case t == uuidType:
+		return map[string]any{"type": "string", "format": "uuid"}
+	case t == timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Pointer:
+		schema := s.schema(t.Elem())
+		if ref, ok := schema["$ref"]; ok {
+			return map[string]any{"allOf": []any{map[string]any{"$ref": ref}}, "nullable": true}
+		}
+		schema["nullable"] = true
+		return schema
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return stringSchema()
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number", "format": "double"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": s.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": s.schema(t.Elem())}
+	case reflect.Struct:
+		if _, ok := s.components[t.Name()]; !ok {
+			s.components[t.Name()] = nil // guards against recursive types
+			s.components[t.Name()] = s.structSchema(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return map[string]any{}
+}
+
+func (s *schemas) structSchema(t reflect.Type) map[string]any {
+	properties := make(map[string]any)
+	var requiredFields []string
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		properties[name] = s.schema(field.Type)
+		if !strings.Contains(options, "omitempty") && field.Type.Kind() != reflect.Pointer {
+			requiredFields = append(requiredFields, name)
+		}
+	}
+
+	schema := map[string]any{"type": "object", "properties": properties}
+	if len(requiredFields) > 0 {
+		schema["required"] = requiredFields
+	}
+	return schema
+}
+
+func stringSchema() map[string]any {
+	return map[string]any{"type": "string"}
+}
+
+func object(properties map[string]any) map[string]any {
+	names := make([]string, 0, len(properties))
+	for name := range properties {
+		names = append(names, name)
+	}
+	return map[string]any{"type": "object", "properties": properties, "required": names}
+}
+
+func requestBody(schema map[string]any) map[string]any {
+	return map[string]any{
+		"required": true,
+		"content":  map[string]any{"application/json": map[string]any{"schema": schema}},
+	}
+}
+
+func response(description string, schema map[string]any) map[string]any {
+	return map[string]any{
+		"description": description,
+		"content":     map[string]any{"application/json": map[string]any{"schema": schema}},
+	}
+}
+
+// problemResponse describes an RFC 7807 error response.
+func problemResponse(description string, schema map[string]any) map[string]any {
+	return map[string]any{
+		"description": description,
+		"content":     map[string]any{problem.ContentType: map[string]any{"schema": schema}},
+	}
+}
+
+func parameter(name, in, description string, schema map[string]any) map[string]any {
+	return map[string]any{"name": name, "in": in, "description": description, "schema": schema}
+}
+
+func required(parameter map[string]any) map[string]any {
+	parameter["required"] = true
+	return parameter
+}
@@ -0,0 +1,608 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/StepanShel/YandexProject/internal/auth"
+	"github.com/StepanShel/YandexProject/internal/problem"
+	"github.com/StepanShel/YandexProject/internal/repo"
+	uuid "github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestOpenAPIContract calls every documented operation and checks that the
+// status code is documented and the body matches its schema. The subtests
+// run in order and build on the users, tokens and expressions created by the
+// ones before them.
+func TestOpenAPIContract(t *testing.T) {
+	ts := newTestAPI(t)
+
+	resp, err := http.Get(ts.URL + "/api/v1/openapi.json")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var spec map[string]any
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&spec))
+	assert.Equal(t, "3.0.3", spec["openapi"])
+
+	covered := make(map[string]bool)
+
+	const (
+		refresh    = "/api/v1/token/refresh"
+		byID       = "/api/v1/expressions/{id}"
+		apikeys    = "/api/v1/apikeys"
+		keyByID    = "/api/v1/apikeys/{id}"
+		users      = "/api/v1/admin/users"
+		user       = "/api/v1/admin/users/{username}"
+		team       = "/api/v1/team"
+		members    = "/api/v1/team/members"
+		invites    = "/api/v1/team/invites"
+		invite     = "/api/v1/team/invites/{team}"
+		accept     = "/api/v1/team/invites/{team}/accept"
+		sharing    = "/api/v1/expressions/{id}/sharing"
+		password   = "/api/v1/account/password"
+		account    = "/api/v1/account"
+		adminExprs = "/api/v1/admin/expressions"
+		timings    = "/api/v1/admin/settings/timings"
+	)
+	alice := map[string]string{"username": "alice", "password": "secret42"}
+	bob := map[string]string{"username": "bob", "password": "secret42"}
+	key := map[string]string{"Idempotency-Key": "contract"}
+
+	// State shared by the subtests.
+	var (
+		token, admin       string
+		bobLogin           auth.TokenResponse
+		created            ResponseID
+		readKey            auth.CreatedAPIKey
+		withKey            map[string]string
+		erin, frank, grace string
+		ops                struct{ Team Team }
+		shared             ResponseID
+		sharedPath         string
+	)
+
+	// member registers the user and returns an access token for them.
+	member := func(c *contract, name string) string {
+		creds := map[string]string{"username": name, "password": "secret42"}
+		c.call("POST", "/api/v1/register", "/api/v1/register", "", nil, creds, 200)
+		var tokens auth.TokenResponse
+		c.decode(c.call("POST", "/api/v1/login", "/api/v1/login", "", nil, creds, 200), &tokens)
+		return tokens.Token
+	}
+
+	steps := []struct {
+		name string
+		run  func(t *testing.T, c *contract)
+	}{
+		{"jwks", func(t *testing.T, c *contract) {
+			c.call("GET", "/.well-known/jwks.json", "/.well-known/jwks.json", "", nil, nil, 200)
+		}},
+		{"register", func(t *testing.T, c *contract) {
+			c.call("POST", "/api/v1/register", "/api/v1/register", "", nil, alice, 200)
+			c.call("POST", "/api/v1/register", "/api/v1/register", "", nil, alice, 409)
+			c.call("POST", "/api/v1/register", "/api/v1/register", "", nil, "{", 400)
+			c.call("POST", "/api/v1/register", "/api/v1/register", "", nil, map[string]string{"username": "carol", "password": "secret42", "nickname": "c"}, 400)
+			c.call("POST", "/api/v1/register", "/api/v1/register", "", nil, bob, 200)
+			c.call("POST", "/api/v1/register", "/api/v1/register", "", nil, map[string]string{"username": "", "password": "secret42"}, 422)
+			c.call("POST", "/api/v1/register", "/api/v1/register", "", nil, map[string]string{"username": "dave", "password": "secret"}, 422)
+		}},
+		{"login", func(t *testing.T, c *contract) {
+			var login auth.TokenResponse
+			c.decode(c.call("POST", "/api/v1/login", "/api/v1/login", "", nil, alice, 200), &login)
+			token = login.Token
+			c.decode(c.call("POST", "/api/v1/login", "/api/v1/login", "", nil, bob, 200), &bobLogin)
+			c.call("POST", "/api/v1/login", "/api/v1/login", "", nil, map[string]string{"username": "alice", "password": "wrong"}, 401)
+			c.call("POST", "/api/v1/login", "/api/v1/login", "", nil, "{", 400)
+
+			// Guessing is locked out after three failures, unknown users included.
+			mallory := map[string]string{"username": "mallory", "password": "guess123"}
+			for range 3 {
+				c.call("POST", "/api/v1/login", "/api/v1/login", "", nil, mallory, 401)
+			}
+			c.call("POST", "/api/v1/login", "/api/v1/login", "", nil, mallory, 429)
+		}},
+		{"refresh", func(t *testing.T, c *contract) {
+			var refreshed auth.TokenResponse
+			c.decode(c.call("POST", refresh, refresh, "", nil, auth.RefreshRequest{RefreshToken: bobLogin.RefreshToken}, 200), &refreshed)
+			c.call("POST", refresh, refresh, "", nil, auth.RefreshRequest{RefreshToken: "unknown"}, 401)
+			c.call("POST", refresh, refresh, "", nil, "{", 400)
+			// Reusing a refresh token ends all sessions of its user.
+			c.call("POST", refresh, refresh, "", nil, auth.RefreshRequest{RefreshToken: bobLogin.RefreshToken}, 401)
+			c.call("POST", refresh, refresh, "", nil, auth.RefreshRequest{RefreshToken: refreshed.RefreshToken}, 401)
+		}},
+		{"logout", func(t *testing.T, c *contract) {
+			var carolLogin auth.TokenResponse
+			c.call("POST", "/api/v1/register", "/api/v1/register", "", nil, map[string]string{"username": "carol", "password": "secret42"}, 200)
+			c.decode(c.call("POST", "/api/v1/login", "/api/v1/login", "", nil, map[string]string{"username": "carol", "password": "secret42"}, 200), &carolLogin)
+			c.call("POST", "/api/v1/logout", "/api/v1/logout", carolLogin.Token, nil, "{", 400)
+			c.call("POST", "/api/v1/logout", "/api/v1/logout", carolLogin.Token, nil, auth.LogoutRequest{RefreshToken: carolLogin.RefreshToken}, 204)
+			c.call("POST", "/api/v1/logout", "/api/v1/logout", carolLogin.Token, nil, nil, 401)
+			c.call("POST", refresh, refresh, "", nil, auth.RefreshRequest{RefreshToken: carolLogin.RefreshToken}, 401)
+		}},
+		{"calculate", func(t *testing.T, c *contract) {
+			c.call("POST", "/api/v1/calculate", "/api/v1/calculate", "", nil, map[string]string{"expression": "2+2"}, 401)
+			c.decode(c.call("POST", "/api/v1/calculate", "/api/v1/calculate", token, nil, map[string]string{"expression": "2+2"}, 201), &created)
+			c.call("POST", "/api/v1/calculate", "/api/v1/calculate", token, key, map[string]string{"expression": "3+3"}, 201)
+			c.call("POST", "/api/v1/calculate", "/api/v1/calculate", token, key, map[string]string{"expression": "3+3"}, 200)
+			c.call("POST", "/api/v1/calculate", "/api/v1/calculate", token, map[string]string{"Idempotency-Key": "not valid"}, map[string]string{"expression": "3+3"}, 400)
+			c.call("POST", "/api/v1/calculate", "/api/v1/calculate", token, nil, "{", 400)
+			c.call("POST", "/api/v1/calculate", "/api/v1/calculate", token, nil, map[string]string{"expression": "1+1", "expresion": "2"}, 400)
+			c.call("POST", "/api/v1/calculate", "/api/v1/calculate", token, nil, map[string]string{"expression": "  "}, 422)
+			c.call("POST", "/api/v1/calculate", "/api/v1/calculate", token, nil, map[string]string{"expression": strings.Repeat("1+", 30) + "1"}, 413)
+			// Without agents both expressions above are still running.
+			c.call("POST", "/api/v1/calculate", "/api/v1/calculate", token, nil, map[string]string{"expression": "4+4"}, 429)
+		}},
+		{"list expressions", func(t *testing.T, c *contract) {
+			c.call("GET", "/api/v1/expressions", "/api/v1/expressions", token, nil, nil, 200)
+			c.call("GET", "/api/v1/expressions", "/api/v1/expressions?limit=1&sort=created_at", token, nil, nil, 200)
+			c.call("GET", "/api/v1/expressions", "/api/v1/expressions", bobLogin.Token, nil, nil, 200)
+			c.call("GET", "/api/v1/expressions", "/api/v1/expressions?limit=0", token, nil, nil, 400)
+			c.call("GET", "/api/v1/expressions", "/api/v1/expressions", "", nil, nil, 401)
+		}},
+		{"get expression", func(t *testing.T, c *contract) {
+			c.call("GET", byID, "/api/v1/expressions/"+created.Id, token, nil, nil, 200)
+			c.call("GET", byID, "/api/v1/expressions/not-a-uuid", token, nil, nil, 400)
+			c.call("GET", byID, "/api/v1/expressions/"+strings.ReplaceAll(created.Id, "-", ""), token, nil, nil, 400)
+			c.call("GET", byID, "/api/v1/expressions/"+created.Id, bobLogin.Token, nil, nil, 403)
+			c.call("GET", byID, "/api/v1/expressions/"+uuid.NewString(), token, nil, nil, 404)
+			c.call("GET", byID, "/api/v1/expressions/"+created.Id, "", nil, nil, 401)
+		}},
+		{"delete expression", func(t *testing.T, c *contract) {
+			c.call("DELETE", byID, "/api/v1/expressions/not-a-uuid", token, nil, nil, 400)
+			c.call("DELETE", byID, "/api/v1/expressions/"+created.Id, bobLogin.Token, nil, nil, 403)
+			c.call("DELETE", byID, "/api/v1/expressions/"+created.Id, token, nil, nil, 204)
+			c.call("DELETE", byID, "/api/v1/expressions/"+created.Id, token, nil, nil, 404)
+			c.call("DELETE", byID, "/api/v1/expressions/"+created.Id, "", nil, nil, 401)
+		}},
+		{"create api key", func(t *testing.T, c *contract) {
+			c.decode(c.call("POST", apikeys, apikeys, token, nil, auth.APIKeyRequest{Name: "reports", Scopes: []string{auth.ScopeRead}}, 201), &readKey)
+			assert.True(t, strings.HasPrefix(readKey.Key, readKey.APIKey.Prefix))
+			c.call("POST", apikeys, apikeys, token, nil, auth.APIKeyRequest{Name: " "}, 422)
+			c.call("POST", apikeys, apikeys, token, nil, auth.APIKeyRequest{Name: "ops", Scopes: []string{auth.ScopeAdmin}}, 422)
+			past := time.Now().Add(-time.Hour)
+			c.call("POST", apikeys, apikeys, token, nil, auth.APIKeyRequest{Name: "old", ExpiresAt: &past}, 422)
+			c.call("POST", apikeys, apikeys, token, nil, "{", 400)
+			c.call("POST", apikeys, apikeys, "", nil, auth.APIKeyRequest{Name: "anonymous"}, 401)
+
+			// Keys authenticate like tokens, within their scopes, but cannot
+			// manage keys.
+			withKey = map[string]string{auth.APIKeyHeader: readKey.Key}
+			c.call("GET", "/api/v1/expressions", "/api/v1/expressions", "", withKey, nil, 200)
+			c.call("GET", "/api/v1/expressions", "/api/v1/expressions", readKey.Key, nil, nil, 200)
+			c.call("POST", "/api/v1/calculate", "/api/v1/calculate", "", withKey, map[string]string{"expression": "2+2"}, 403)
+			c.call("GET", apikeys, apikeys, "", withKey, nil, 403)
+			c.call("POST", apikeys, apikeys, "", withKey, auth.APIKeyRequest{Name: "more"}, 403)
+			c.call("DELETE", keyByID, "/api/v1/apikeys/"+readKey.APIKey.ID, "", withKey, nil, 403)
+		}},
+		{"list api keys", func(t *testing.T, c *contract) {
+			var keys auth.APIKeysResponse
+			c.decode(c.call("GET", apikeys, apikeys, token, nil, nil, 200), &keys)
+			require.Len(t, keys.APIKeys, 1)
+			assert.NotNil(t, keys.APIKeys[0].LastUsedAt)
+			c.call("GET", apikeys, apikeys, "", nil, nil, 401)
+
+			for i := len(keys.APIKeys); i < 50; i++ {
+				c.call("POST", apikeys, apikeys, token, nil, auth.APIKeyRequest{Name: fmt.Sprint("job ", i)}, 201)
+			}
+			c.call("POST", apikeys, apikeys, token, nil, auth.APIKeyRequest{Name: "one too many"}, 409)
+		}},
+		{"revoke api key", func(t *testing.T, c *contract) {
+			c.call("DELETE", keyByID, "/api/v1/apikeys/"+readKey.APIKey.ID, bobLogin.Token, nil, nil, 404)
+			c.call("DELETE", keyByID, "/api/v1/apikeys/"+readKey.APIKey.ID, token, nil, nil, 204)
+			c.call("DELETE", keyByID, "/api/v1/apikeys/"+readKey.APIKey.ID, token, nil, nil, 404)
+			c.call("DELETE", keyByID, "/api/v1/apikeys/not-a-uuid", token, nil, nil, 400)
+			c.call("DELETE", keyByID, "/api/v1/apikeys/"+readKey.APIKey.ID, "", nil, nil, 401)
+			c.call("GET", "/api/v1/expressions", "/api/v1/expressions", "", withKey, nil, 401)
+		}},
+		{"account", func(t *testing.T, c *contract) {
+			// Changing the password ends the other sessions of the user and
+			// revokes their API keys.
+			dave := map[string]string{"username": "dave", "password": "secret42"}
+			c.call("POST", "/api/v1/register", "/api/v1/register", "", nil, dave, 200)
+			var daveLogin, daveChanged auth.TokenResponse
+			c.decode(c.call("POST", "/api/v1/login", "/api/v1/login", "", nil, dave, 200), &daveLogin)
+			var daveKey auth.CreatedAPIKey
+			c.decode(c.call("POST", apikeys, apikeys, daveLogin.Token, nil, auth.APIKeyRequest{Name: "backup"}, 201), &daveKey)
+			c.call("POST", password, password, daveLogin.Token, nil, auth.PasswordChangeRequest{CurrentPassword: "wrong", NewPassword: "better-99"}, 403)
+			c.call("POST", password, password, daveLogin.Token, nil, auth.PasswordChangeRequest{CurrentPassword: "secret42", NewPassword: "short1"}, 422)
+			c.call("POST", password, password, daveLogin.Token, nil, "{", 400)
+			c.call("POST", password, password, "", nil, auth.PasswordChangeRequest{CurrentPassword: "secret42", NewPassword: "better-99"}, 401)
+			c.decode(c.call("POST", password, password, daveLogin.Token, nil, auth.PasswordChangeRequest{CurrentPassword: "secret42", NewPassword: "better-99"}, 200), &daveChanged)
+			c.call("GET", "/api/v1/expressions", "/api/v1/expressions", daveLogin.Token, nil, nil, 401)
+			c.call("GET", "/api/v1/expressions", "/api/v1/expressions", "", map[string]string{auth.APIKeyHeader: daveKey.Key}, nil, 401)
+			c.call("POST", refresh, refresh, "", nil, auth.RefreshRequest{RefreshToken: daveLogin.RefreshToken}, 401)
+			c.call("POST", "/api/v1/login", "/api/v1/login", "", nil, dave, 401)
+			// Wrong passwords confirming a change or a deletion count as
+			// failed logins: these are the second and the third.
+			c.call("DELETE", account, account, daveChanged.Token, nil, AccountDeletionRequest{Password: "secret42"}, 403)
+			c.call("POST", password, password, daveChanged.Token, nil, auth.PasswordChangeRequest{CurrentPassword: "secret42", NewPassword: "better-100"}, 403)
+			c.call("POST", password, password, daveChanged.Token, nil, auth.PasswordChangeRequest{CurrentPassword: "better-99", NewPassword: "better-100"}, 429)
+			c.call("DELETE", account, account, daveChanged.Token, nil, AccountDeletionRequest{Password: "better-99"}, 429)
+
+			// A deleted account cannot be used, even if its name is taken again.
+			eve := map[string]string{"username": "eve", "password": "secret42"}
+			eveToken := member(c, "eve")
+			c.call("DELETE", account, account, eveToken, nil, "{", 400)
+			c.call("DELETE", account, account, "", nil, AccountDeletionRequest{Password: "secret42"}, 401)
+			c.call("DELETE", account, account, eveToken, nil, AccountDeletionRequest{Password: "secret42"}, 204)
+			c.call("GET", "/api/v1/expressions", "/api/v1/expressions", eveToken, nil, nil, 401)
+			c.call("POST", "/api/v1/register", "/api/v1/register", "", nil, eve, 200)
+			c.call("GET", "/api/v1/expressions", "/api/v1/expressions", eveToken, nil, nil, 401)
+		}},
+		{"admin users", func(t *testing.T, c *contract) {
+			// Admins are promoted at startup, once they have registered.
+			adminCreds := map[string]string{"username": "admin", "password": "secret42"}
+			c.call("POST", "/api/v1/register", "/api/v1/register", "", nil, adminCreds, 200)
+			require.NoError(t, ts.repo.SetUserRole("admin", repo.RoleAdmin))
+			var adminLogin auth.TokenResponse
+			c.decode(c.call("POST", "/api/v1/login", "/api/v1/login", "", nil, adminCreds, 200), &adminLogin)
+			admin = adminLogin.Token
+
+			var list ResponseUsers
+			c.decode(c.call("GET", users, users, admin, nil, nil, 200), &list)
+			assert.Contains(t, list.Users, UserInfo{Username: "admin", Role: repo.RoleAdmin})
+			c.call("GET", users, users, token, nil, nil, 403)
+			c.call("GET", users, users, "", nil, nil, 401)
+		}},
+		{"admin user update", func(t *testing.T, c *contract) {
+			readonly, disabled := repo.RoleReadonly, true
+			c.call("PATCH", user, "/api/v1/admin/users/bob", admin, nil, UserUpdate{Role: &readonly}, 200)
+			c.call("PATCH", user, "/api/v1/admin/users/bob", admin, nil, map[string]string{"role": "root"}, 422)
+			c.call("PATCH", user, "/api/v1/admin/users/bob", admin, nil, "{", 400)
+			c.call("PATCH", user, "/api/v1/admin/users/nobody", admin, nil, UserUpdate{Role: &readonly}, 404)
+			c.call("PATCH", user, "/api/v1/admin/users/admin", admin, nil, UserUpdate{Role: &readonly}, 409)
+			c.call("PATCH", user, "/api/v1/admin/users/alice", token, nil, UserUpdate{Role: &readonly}, 403)
+			c.call("PATCH", user, "/api/v1/admin/users/alice", "", nil, UserUpdate{Role: &readonly}, 401)
+
+			// The role change invalidated bob's token; the new one is readonly.
+			c.call("GET", "/api/v1/expressions", "/api/v1/expressions", bobLogin.Token, nil, nil, 401)
+			c.decode(c.call("POST", "/api/v1/login", "/api/v1/login", "", nil, bob, 200), &bobLogin)
+			c.call("GET", "/api/v1/expressions", "/api/v1/expressions", bobLogin.Token, nil, nil, 200)
+			c.call("POST", "/api/v1/calculate", "/api/v1/calculate", bobLogin.Token, nil, map[string]string{"expression": "2+2"}, 403)
+
+			c.call("PATCH", user, "/api/v1/admin/users/bob", admin, nil, UserUpdate{Disabled: &disabled}, 200)
+			c.call("POST", "/api/v1/login", "/api/v1/login", "", nil, bob, 403)
+		}},
+		{"admin expressions", func(t *testing.T, c *contract) {
+			var kept ResponseID
+			c.decode(c.call("POST", "/api/v1/calculate", "/api/v1/calculate", token, key, map[string]string{"expression": "3+3"}, 200), &kept)
+			var owned ResponseExpressionsV2
+			c.decode(c.call("GET", adminExprs, adminExprs+"?owner=alice", admin, nil, nil, 200), &owned)
+			assert.NotEmpty(t, owned.Expressions)
+			c.call("GET", adminExprs, adminExprs, admin, nil, nil, 400)
+			c.call("GET", adminExprs, adminExprs+"?owner=alice", token, nil, nil, 403)
+			c.call("GET", adminExprs, adminExprs+"?owner=alice", "", nil, nil, 401)
+
+			anyExpr := "/api/v1/admin/expressions/{id}"
+			c.call("GET", anyExpr, "/api/v1/admin/expressions/"+kept.Id, admin, nil, nil, 200)
+			c.call("GET", anyExpr, "/api/v1/admin/expressions/not-a-uuid", admin, nil, nil, 400)
+			c.call("GET", anyExpr, "/api/v1/admin/expressions/"+uuid.NewString(), admin, nil, nil, 404)
+			c.call("GET", anyExpr, "/api/v1/admin/expressions/"+kept.Id, token, nil, nil, 403)
+			c.call("GET", anyExpr, "/api/v1/admin/expressions/"+kept.Id, "", nil, nil, 401)
+		}},
+		{"admin timings", func(t *testing.T, c *contract) {
+			c.call("GET", timings, timings, admin, nil, nil, 200)
+			c.call("GET", timings, timings, token, nil, nil, 403)
+			c.call("GET", timings, timings, "", nil, nil, 401)
+			changed := OperationTimings{Addition: 1, Subtraction: 2, Multiplication: 3, Division: 4}
+			var set struct{ Timings OperationTimings }
+			c.decode(c.call("PUT", timings, timings, admin, nil, changed, 200), &set)
+			assert.Equal(t, changed, set.Timings)
+			c.call("PUT", timings, timings, admin, nil, OperationTimings{Addition: 1}, 422)
+			c.call("PUT", timings, timings, admin, nil, "{", 400)
+			c.call("PUT", timings, timings, token, nil, changed, 403)
+			c.call("PUT", timings, timings, "", nil, changed, 401)
+		}},
+		{"create team", func(t *testing.T, c *contract) {
+			// Teams: erin owns one, frank joins it and grace stays outside.
+			erin, frank, grace = member(c, "erin"), member(c, "frank"), member(c, "grace")
+
+			c.call("GET", team, team, erin, nil, nil, 404)
+			c.call("POST", team, team, erin, nil, TeamRequest{Name: " "}, 422)
+			c.call("POST", team, team, erin, nil, "{", 400)
+			c.call("POST", team, team, "", nil, TeamRequest{Name: "ops"}, 401)
+			c.decode(c.call("POST", team, team, erin, nil, TeamRequest{Name: "ops"}, 201), &ops)
+			assert.Equal(t, "erin", ops.Team.Owner)
+			assert.Equal(t, []string{"erin"}, ops.Team.Members)
+			c.call("POST", team, team, erin, nil, TeamRequest{Name: "dev"}, 409)
+			c.call("POST", team, team, grace, nil, TeamRequest{Name: "ops"}, 409)
+			c.call("GET", team, team, "", nil, nil, 401)
+		}},
+		{"add team member", func(t *testing.T, c *contract) {
+			// Members join by accepting an invite of the owner.
+			var invited struct{ Invite TeamInvite }
+			c.decode(c.call("POST", members, members, erin, nil, TeamMemberRequest{Username: "frank"}, 202), &invited)
+			assert.Equal(t, TeamInvite{TeamID: ops.Team.ID, Team: "ops", Owner: "erin", Username: "frank", CreatedAt: invited.Invite.CreatedAt}, invited.Invite)
+			c.call("POST", members, members, erin, nil, TeamMemberRequest{Username: "frank"}, 202)
+			// Unknown users and users in a team get the same error.
+			c.call("POST", members, members, erin, nil, TeamMemberRequest{Username: "nobody"}, 422)
+			c.call("POST", members, members, erin, nil, TeamMemberRequest{Username: "erin"}, 422)
+			c.call("POST", members, members, erin, nil, "{", 400)
+			c.call("POST", members, members, frank, nil, TeamMemberRequest{Username: "grace"}, 404)
+			c.call("POST", members, members, "", nil, TeamMemberRequest{Username: "grace"}, 401)
+			c.decode(c.call("GET", team, team, erin, nil, nil, 200), &ops)
+			assert.Equal(t, []string{"erin"}, ops.Team.Members)
+
+			var pending ResponseTeamInvites
+			c.decode(c.call("GET", invites, invites, frank, nil, nil, 200), &pending)
+			assert.Equal(t, []TeamInvite{invited.Invite}, pending.Invites)
+			c.call("GET", invites, invites, "", nil, nil, 401)
+			acceptPath := invites + "/" + ops.Team.ID + "/accept"
+			c.call("POST", accept, acceptPath, grace, nil, nil, 404)
+			c.call("POST", accept, invites+"/not-a-uuid/accept", frank, nil, nil, 400)
+			c.call("POST", accept, acceptPath, "", nil, nil, 401)
+			c.decode(c.call("POST", accept, acceptPath, frank, nil, nil, 200), &ops)
+			assert.Equal(t, []string{"erin", "frank"}, ops.Team.Members)
+			c.call("POST", accept, acceptPath, frank, nil, nil, 404)
+			c.decode(c.call("GET", invites, invites, frank, nil, nil, 200), &pending)
+			assert.Empty(t, pending.Invites)
+			c.call("POST", members, members, erin, nil, TeamMemberRequest{Username: "frank"}, 422)
+			c.call("POST", members, members, frank, nil, TeamMemberRequest{Username: "grace"}, 403)
+
+			// Invites may be declined instead, and cannot be accepted after
+			// joining another team.
+			c.call("POST", members, members, erin, nil, TeamMemberRequest{Username: "grace"}, 202)
+			c.call("POST", team, team, grace, nil, TeamRequest{Name: "qa"}, 201)
+			c.call("POST", accept, acceptPath, grace, nil, nil, 409)
+			c.call("DELETE", team, team, grace, nil, nil, 204)
+			invitePath := invites + "/" + ops.Team.ID
+			c.call("DELETE", invite, invitePath, "", nil, nil, 401)
+			c.call("DELETE", invite, invites+"/not-a-uuid", grace, nil, nil, 400)
+			c.call("DELETE", invite, invitePath, grace, nil, nil, 204)
+			c.call("DELETE", invite, invitePath, grace, nil, nil, 404)
+			c.call("POST", accept, acceptPath, grace, nil, nil, 404)
+
+			// Tokens do not carry the team: the current membership applies.
+			var frankLogin auth.TokenResponse
+			c.decode(c.call("POST", "/api/v1/login", "/api/v1/login", "", nil, map[string]string{"username": "frank", "password": "secret42"}, 200), &frankLogin)
+			payload, err := base64.RawURLEncoding.DecodeString(strings.Split(frankLogin.Token, ".")[1])
+			require.NoError(t, err)
+			assert.NotContains(t, string(payload), `"team"`)
+		}},
+		{"sharing", func(t *testing.T, c *contract) {
+			// Shared expressions are read-only for everyone but their owner.
+			c.decode(c.call("POST", "/api/v1/calculate", "/api/v1/calculate", erin, nil, map[string]string{"expression": "5+5"}, 201), &shared)
+			sharedPath = "/api/v1/expressions/" + shared.Id
+			c.call("GET", byID, sharedPath, frank, nil, nil, 403)
+			c.call("GET", sharing, sharedPath+"/sharing", erin, nil, nil, 200)
+			c.call("PUT", sharing, sharedPath+"/sharing", erin, nil, ExpressionSharing{Team: true}, 200)
+			c.call("GET", byID, sharedPath, frank, nil, nil, 200)
+			c.call("GET", byID, sharedPath, grace, nil, nil, 403)
+			var shares struct{ Sharing ExpressionSharing }
+			c.decode(c.call("PUT", sharing, sharedPath+"/sharing", erin, nil, ExpressionSharing{Team: true, Users: []string{"grace"}}, 200), &shares)
+			assert.Equal(t, ExpressionSharing{Team: true, Users: []string{"grace"}}, shares.Sharing)
+			c.call("GET", byID, sharedPath, grace, nil, nil, 200)
+			c.call("DELETE", byID, sharedPath, frank, nil, nil, 403)
+			c.call("GET", sharing, sharedPath+"/sharing", frank, nil, nil, 403)
+			c.call("PUT", sharing, sharedPath+"/sharing", grace, nil, ExpressionSharing{}, 403)
+			c.call("PUT", sharing, sharedPath+"/sharing", erin, nil, ExpressionSharing{Users: []string{"nobody"}}, 422)
+			c.call("PUT", sharing, sharedPath+"/sharing", erin, nil, ExpressionSharing{Users: []string{"erin"}}, 422)
+			c.call("PUT", sharing, sharedPath+"/sharing", erin, nil, "{", 400)
+			c.call("GET", sharing, "/api/v1/expressions/not-a-uuid/sharing", erin, nil, nil, 400)
+			c.call("PUT", sharing, "/api/v1/expressions/not-a-uuid/sharing", erin, nil, ExpressionSharing{}, 400)
+			c.call("GET", sharing, "/api/v1/expressions/"+uuid.NewString()+"/sharing", erin, nil, nil, 404)
+			c.call("PUT", sharing, "/api/v1/expressions/"+uuid.NewString()+"/sharing", erin, nil, ExpressionSharing{}, 404)
+			c.call("GET", sharing, sharedPath+"/sharing", "", nil, nil, 401)
+			c.call("PUT", sharing, sharedPath+"/sharing", "", nil, ExpressionSharing{}, 401)
+
+			var page ResponseExprs
+			c.decode(c.call("GET", "/api/v1/expressions", "/api/v1/expressions?scope=team", frank, nil, nil, 200), &page)
+			require.Len(t, page.Exprs, 1)
+			assert.Equal(t, shared.Id, page.Exprs[0].ID)
+			c.decode(c.call("GET", "/api/v1/expressions", "/api/v1/expressions?scope=shared", grace, nil, nil, 200), &page)
+			require.Len(t, page.Exprs, 1)
+			assert.Equal(t, shared.Id, page.Exprs[0].ID)
+			c.decode(c.call("GET", "/api/v1/expressions", "/api/v1/expressions", frank, nil, nil, 200), &page)
+			assert.Empty(t, page.Exprs)
+			c.call("GET", "/api/v1/expressions", "/api/v1/expressions?scope=everyone", frank, nil, nil, 400)
+		}},
+		{"remove team member", func(t *testing.T, c *contract) {
+			removeMember := "/api/v1/team/members/{username}"
+			c.call("POST", members, members, erin, nil, TeamMemberRequest{Username: "grace"}, 202)
+			c.call("POST", accept, invites+"/"+ops.Team.ID+"/accept", grace, nil, nil, 200)
+			c.call("DELETE", removeMember, members+"/grace", frank, nil, nil, 403)
+			c.call("DELETE", removeMember, members+"/erin", frank, nil, nil, 409)
+			c.call("DELETE", removeMember, members+"/nobody", erin, nil, nil, 404)
+			c.call("DELETE", removeMember, members+"/grace", "", nil, nil, 401)
+			c.call("DELETE", removeMember, members+"/grace", grace, nil, nil, 204)
+			c.call("DELETE", team, team, frank, nil, nil, 403)
+			c.call("DELETE", removeMember, members+"/frank", erin, nil, nil, 204)
+			c.call("GET", byID, sharedPath, frank, nil, nil, 403)
+			c.call("DELETE", removeMember, members+"/frank", frank, nil, nil, 404)
+		}},
+		{"delete team", func(t *testing.T, c *contract) {
+			c.call("DELETE", team, team, "", nil, nil, 401)
+			c.call("DELETE", team, team, erin, nil, nil, 204)
+			c.call("DELETE", team, team, erin, nil, nil, 404)
+			// Users shared with keep their access.
+			c.call("GET", byID, sharedPath, grace, nil, nil, 200)
+		}},
+	}
+
+	for _, step := range steps {
+		// Later steps depend on the earlier ones, so stop at the first
+		// failure.
+		require.True(t, t.Run(step.name, func(t *testing.T) {
+			step.run(t, &contract{t: t, spec: spec, url: ts.URL, covered: covered})
+		}), "%s failed", step.name)
+	}
+
+	// Every documented response has been exercised.
+	for path, item := range spec["paths"].(map[string]any) {
+		for method, op := range item.(map[string]any) {
+			if method == "parameters" {
+				continue
+			}
+			for code := range op.(map[string]any)["responses"].(map[string]any) {
+				name := strings.ToUpper(method) + " " + path + " " + code
+				assert.True(t, covered[name], "%s is not covered by the contract test", name)
+			}
+		}
+	}
+}
+
+type contract struct {
+	t       *testing.T
+	spec    map[string]any
+	url     string
+	covered map[string]bool
+}
+
+// call performs the request and validates the response against the
+// operation of the spec at path. body is sent as is if it is a string.
+func (c *contract) call(method, path, target, token string, headers map[string]string, body any, want int) []byte {
+	c.t.Helper()
+
+	var payload io.Reader
+	switch body := body.(type) {
+	case nil:
+	case string:
+		payload = strings.NewReader(body)
+	default:
+		data, err := json.Marshal(body)
+		require.NoError(c.t, err)
+		payload = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, c.url+target, payload)
+	require.NoError(c.t, err)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(c.t, err)
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	require.NoError(c.t, err)
+
+	name := fmt.Sprintf("%s %s %d", method, path, resp.StatusCode)
+	require.Equal(c.t, want, resp.StatusCode, "%s %s: %s", method, target, data)
+	c.covered[name] = true
+
+	item, ok := c.spec["paths"].(map[string]any)[path].(map[string]any)
+	require.True(c.t, ok, "%s is not documented", path)
+	op, ok := item[strings.ToLower(method)].(map[string]any)
+	require.True(c.t, ok, "%s %s is not documented", method, path)
+	documented, ok := op["responses"].(map[string]any)[fmt.Sprint(resp.StatusCode)].(map[string]any)
+	require.True(c.t, ok, "%s is not documented", name)
+
+	content, ok := documented["content"].(map[string]any)
+	if !ok {
+		assert.Empty(c.t, bytes.TrimSpace(data), "%s: undocumented body", name)
+		return data
+	}
+
+	mediaType, _, _ := strings.Cut(resp.Header.Get("Content-Type"), ";")
+	media, ok := content[mediaType].(map[string]any)
+	require.True(c.t, ok, "%s: undocumented content type %q", name, mediaType)
+
+	if mediaType == "application/json" || mediaType == problem.ContentType {
+		var value any
+		require.NoError(c.t, json.Unmarshal(data, &value), "%s: %s", name, data)
+		for _, issue := range c.validate(media["schema"].(map[string]any), value, "body") {
+			c.t.Errorf("%s: %s", name, issue)
+		}
+	}
+	if mediaType == problem.ContentType {
+		var p problem.Problem
+		c.decode(data, &p)
+		assert.Equal(c.t, resp.StatusCode, p.Status, "%s: status", name)
+		assert.NotEmpty(c.t, p.Code, "%s: code", name)
+		assert.NotEmpty(c.t, p.RequestID, "%s: request id", name)
+		assert.Equal(c.t, resp.Header.Get(problem.RequestIDHeader), p.RequestID, "%s: request id", name)
+	}
+	return data
+}
+
+func (c *contract) decode(data []byte, v any) {
+	c.t.Helper()
+	require.NoError(c.t, json.Unmarshal(data, v))
+}
+
+// validate checks value against the subset of JSON Schema the generator
+// produces. Properties missing from the schema are reported too.
+func (c *contract) validate(schema map[string]any, value any, at string) []string {
+	if ref, ok := schema["$ref"].(string); ok {
+		name := strings.TrimPrefix(ref, "#/components/schemas/")
+		schema = c.spec["components"].(map[string]any)["schemas"].(map[string]any)[name].(map[string]any)
+	}
+	if value == nil {
+		if schema["nullable"] == true {
+			return nil
+		}
+		return []string{at + " is null"}
+	}
+	if allOf, ok := schema["allOf"].([]any); ok {
+		var problems []string
+		for _, s := range allOf {
+			problems = append(problems, c.validate(s.(map[string]any), value, at)...)
+		}
+		return problems
+	}
+
+	var problems []string
+	switch schema["type"] {
+	case "object":
+		object, ok := value.(map[string]any)
+		if !ok {
+			return []string{at + " is not an object"}
+		}
+		properties, _ := schema["properties"].(map[string]any)
+		required, _ := schema["required"].([]any)
+		for _, name := range required {
+			if _, ok := object[name.(string)]; !ok {
+				problems = append(problems, fmt.Sprintf("%s.%s is missing", at, name))
+			}
+		}
+		for name, v := range object {
+			if s, ok := properties[name].(map[string]any); ok {
+				problems = append(problems, c.validate(s, v, at+"."+name)...)
+			} else if s, ok := schema["additionalProperties"].(map[string]any); ok {
+				problems = append(problems, c.validate(s, v, at+"."+name)...)
+			} else {
+				problems = append(problems, fmt.Sprintf("%s.%s is not documented", at, name))
+			}
+		}
+	case "array":
+		array, ok := value.([]any)
+		if !ok {
+			return []string{at + " is not an array"}
+		}
+		for i, v := range array {
+			problems = append(problems, c.validate(schema["items"].(map[string]any), v, fmt.Sprintf("%s[%d]", at, i))...)
+		}
+	case "string":
+		if _, ok := value.(string); !ok {
+			problems = append(problems, at+" is not a string")
+		}
+	case "number":
+		if _, ok := value.(float64); !ok {
+			problems = append(problems, at+" is not a number")
+		}
+	case "integer":
+		if n, ok := value.(float64); !ok || n != math.Trunc(n) {
+			problems = append(problems, at+" is not an integer")
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			problems = append(problems, at+" is not a boolean")
+		}
+	}
+	return problems
+}
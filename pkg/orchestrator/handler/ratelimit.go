@@ -0,0 +1,59 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/StepanShel/YandexProject/internal/problem"
+	"github.com/StepanShel/YandexProject/internal/ratelimit"
+)
+
+var errRateLimited = problem.New("rate_limited", "too many requests; try again later")
+
+// rateLimit limits the requests of each user, or of each client address
+// for requests without credentials. Routed after authentication, it sees
+// the username.
+func (server *Server) rateLimit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		quota := ratelimit.Quota{PerMinute: server.Config.RateLimitPerMinute, Burst: server.Config.RateLimitBurst}
+
+		var key string
+		if username, ok := r.Context().Value("username").(string); ok {
+			key = "user:" + username
+			if perMinute, ok := server.Config.RateLimitUsers[username]; ok {
+				quota.PerMinute = perMinute
+			}
+		} else {
+			key = "ip:" + ratelimit.ClientIP(r, server.Config.TrustProxy)
+		}
+
+		if server.allow(w, key, quota) {
+			next(w, r)
+		}
+	}
+}
+
+// limitAddress limits the requests of each client address before their
+// credentials are checked, so that floods of invalid tokens and API keys
+// are turned away early.
+func (server *Server) limitAddress(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		quota := ratelimit.Quota{PerMinute: server.Config.RateLimitIPPerMinute, Burst: server.Config.RateLimitIPBurst}
+		if server.allow(w, "addr:"+ratelimit.ClientIP(r, server.Config.TrustProxy), quota) {
+			next(w, r)
+		}
+	}
+}
+
+// allow takes a request of key from the limiter, writing the error
+// response if there is none left. A negative quota allows everything.
+func (server *Server) allow(w http.ResponseWriter, key string, quota ratelimit.Quota) bool {
+	if quota.PerMinute < 0 {
+		return true
+	}
+	if ok, wait := server.limiter.Allow(key, quota); !ok {
+		w.Header().Set("Retry-After", ratelimit.RetryAfter(wait))
+		respJson(w, errRateLimited, http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,126 @@
+package handler
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/StepanShel/YandexProject/internal/auth"
+	"github.com/StepanShel/YandexProject/internal/problem"
+	"github.com/StepanShel/YandexProject/internal/repo"
+)
+
+type route struct {
+	method  string
+	path    string
+	handler http.HandlerFunc
+}
+
+// Routes registers the HTTP API on mux. A known path requested with a
+// method it does not serve gets a 405 problem listing the allowed methods;
+// unknown paths get a 404 problem.
+func (server *Server) Routes(mux *http.ServeMux, authHandler *auth.AuthHandler, jwtService *auth.TokenService) {
+	// Requests are rate limited per user once authenticated, and per client
+	// address otherwise. Requests with credentials are limited per address
+	// before those are checked too.
+	public := server.rateLimit
+	authed := func(h http.HandlerFunc) http.HandlerFunc {
+		return server.limitAddress(jwtService.AuthMiddleware(server.rateLimit(h)))
+	}
+	// Readonly users may only read; admin routes are for admins.
+	writer := func(h http.HandlerFunc) http.HandlerFunc {
+		return authed(auth.RequireRole(repo.RoleUser, repo.RoleAdmin)(h))
+	}
+	admin := func(h http.HandlerFunc) http.HandlerFunc {
+		return authed(auth.RequireRole(repo.RoleAdmin)(h))
+	}
+	// The account and its API keys are managed with access tokens only.
+	account := func(h http.HandlerFunc) http.HandlerFunc {
+		return authed(auth.RequireToken(h))
+	}
+
+	server.confirmPassword = authHandler.ConfirmPassword
+
+	routes := []route{
+		{"GET", "/api/v1/openapi.json", public(server.HandleOpenAPI)},
+		{"GET", "/.well-known/jwks.json", public(jwtService.HandleJWKS)},
+		{"POST", "/api/v1/register", public(authHandler.Register)},
+		{"POST", "/api/v1/login", public(authHandler.Login)},
+		{"POST", "/api/v1/token/refresh", public(authHandler.Refresh)},
+		{"POST", "/api/v1/logout", authed(authHandler.Logout)},
+		{"POST", "/api/v1/account/password", account(authHandler.ChangePassword)},
+		{"DELETE", "/api/v1/account", account(server.HandleDeleteAccount)},
+		{"GET", "/api/v1/apikeys", account(authHandler.ListAPIKeys)},
+		{"POST", "/api/v1/apikeys", account(authHandler.CreateAPIKey)},
+		{"DELETE", "/api/v1/apikeys/{id}", account(authHandler.RevokeAPIKey)},
+
+		{"POST", "/api/v1/calculate", writer(server.HandleCalculate)},
+		{"POST", "/api/v1/calculate/batch", writer(server.HandleCalculateBatch)},
+		{"GET", "/api/v1/batches/{id}", authed(server.HandleBatch)},
+		{"GET", "/api/v1/expressions", authed(server.HandleExpressions)},
+		{"GET", "/api/v1/expressions/{id}", authed(server.HandleExpressionsById)},
+		{"DELETE", "/api/v1/expressions/{id}", writer(server.HandleDeleteExpression)},
+		{"POST", "/api/v1/expressions/{id}/cancel", writer(server.HandleCancelExpression)},
+		{"GET", "/api/v1/expressions/{id}/events", authed(server.HandleExpressionEvents)},
+		{"GET", "/api/v1/expressions/{id}/webhooks", authed(server.HandleWebhookAttempts)},
+		{"GET", "/api/v1/expressions/{id}/sharing", authed(server.HandleExpressionSharing)},
+		{"PUT", "/api/v1/expressions/{id}/sharing", writer(server.HandleExpressionSharing)},
+		{"GET", "/api/v1/events", authed(server.HandleEvents)},
+		{"GET", "/api/v1/ws", writer(server.HandleWebSocket)},
+		{"GET", "/api/v1/cache/stats", admin(server.HandleCacheStats)},
+		{"GET", "/api/v1/constants", authed(server.HandleConstants)},
+		{"PUT", "/api/v1/constants/{name}", admin(server.HandleConstantByName)},
+		{"DELETE", "/api/v1/constants/{name}", admin(server.HandleConstantByName)},
+
+		{"POST", "/api/v1/team", writer(server.HandleCreateTeam)},
+		{"GET", "/api/v1/team", authed(server.HandleTeam)},
+		{"DELETE", "/api/v1/team", writer(server.HandleTeam)},
+		{"POST", "/api/v1/team/members", writer(server.HandleAddTeamMember)},
+		{"GET", "/api/v1/team/invites", authed(server.HandleTeamInvites)},
+		{"POST", "/api/v1/team/invites/{team}/accept", writer(server.HandleAcceptTeamInvite)},
+		{"DELETE", "/api/v1/team/invites/{team}", writer(server.HandleDeclineTeamInvite)},
+		{"DELETE", "/api/v1/team/members/{username}", writer(server.HandleRemoveTeamMember)},
+
+		{"GET", "/api/v1/admin/users", admin(server.HandleAdminUsers)},
+		{"PATCH", "/api/v1/admin/users/{username}", admin(server.HandleAdminUpdateUser)},
+		{"GET", "/api/v1/admin/expressions", admin(server.HandleAdminExpressions)},
+		{"GET", "/api/v1/admin/expressions/{id}", admin(server.HandleAdminExpressionById)},
+		{"GET", "/api/v1/admin/settings/timings", admin(server.HandleAdminTimings)},
+		{"PUT", "/api/v1/admin/settings/timings", admin(server.HandleAdminTimings)},
+
+		{"GET", "/api/v2/expressions", authed(server.HandleExpressionsV2)},
+		{"GET", "/api/v2/expressions/{id}", authed(server.HandleExpressionByIdV2)},
+		{"GET", "/api/v2/batches/{id}", authed(server.HandleBatchV2)},
+	}
+
+	var paths []string
+	allowed := make(map[string][]string)
+	for _, rt := range routes {
+		mux.HandleFunc(rt.method+" "+rt.path, rt.handler)
+		if _, ok := allowed[rt.path]; !ok {
+			paths = append(paths, rt.path)
+		}
+		allowed[rt.path] = append(allowed[rt.path], rt.method)
+	}
+
+	// Patterns without a method are less specific than the ones above, so
+	// they only see the methods no route serves.
+	for _, path := range paths {
+		mux.HandleFunc(path, methodNotAllowed(allowed[path]))
+	}
+	mux.HandleFunc("/", problem.NotFound)
+}
+
+func methodNotAllowed(methods []string) http.HandlerFunc {
+	for _, method := range methods {
+		if method == http.MethodGet {
+			methods = append(methods, http.MethodHead)
+			break
+		}
+	}
+	allow := strings.Join(methods, ", ")
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Allow", allow)
+		respJson(w, errMethodNotAllowed, http.StatusMethodNotAllowed)
+	}
+}
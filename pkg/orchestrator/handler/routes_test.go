@@ -0,0 +1,192 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/StepanShel/YandexProject/internal/auth"
+	"github.com/StepanShel/YandexProject/internal/problem"
+	"github.com/StepanShel/YandexProject/pkg/orchestrator/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoutes(t *testing.T) {
+	ts := newTestAPI(t)
+
+	tests := []struct {
+		method, path string
+		code         int
+		allow        string
+		problemCode  string
+	}{
+		{"GET", "/api/v1/calculate", http.StatusMethodNotAllowed, "POST", "method_not_allowed"},
+		{"PUT", "/api/v1/expressions/00000000-0000-0000-0000-000000000000", http.StatusMethodNotAllowed, "GET, DELETE, HEAD", "method_not_allowed"},
+		{"POST", "/api/v1/login/", http.StatusNotFound, "", "route_not_found"},
+		{"GET", "/api/v3/expressions", http.StatusNotFound, "", "route_not_found"},
+		// Routed requests still need a token.
+		{"GET", "/api/v1/expressions/00000000-0000-0000-0000-000000000000", http.StatusUnauthorized, "", "missing_token"},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, ts.URL+tt.path, nil)
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+
+		var p problem.Problem
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&p))
+		resp.Body.Close()
+
+		assert.Equal(t, tt.code, resp.StatusCode, "%s %s", tt.method, tt.path)
+		assert.Equal(t, tt.allow, resp.Header.Get("Allow"), "%s %s", tt.method, tt.path)
+		assert.Equal(t, tt.problemCode, p.Code, "%s %s", tt.method, tt.path)
+	}
+}
+
+// doFrom sends the request as if it came through a proxy from the client
+// at ip. The body is read by the caller.
+func (api *testAPI) doFrom(method, path, ip, token string, body any) *http.Response {
+	api.t.Helper()
+
+	var payload io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		require.NoError(api.t, err)
+		payload = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, api.URL+path, payload)
+	require.NoError(api.t, err)
+	req.Header.Set("X-Forwarded-For", "203.0.113.1, "+ip)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(api.t, err)
+	api.t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestRateLimit(t *testing.T) {
+	cfg := config.ConfigFromEnv()
+	cfg.RateLimitPerMinute = 1
+	cfg.RateLimitBurst = 2
+	cfg.RateLimitUsers = map[string]int{"vip": 1000}
+	cfg.TrustProxy = true
+	ts := serveTestAPI(t, cfg)
+	do := ts.doFrom
+
+	login := func(username, ip string) string {
+		t.Helper()
+		user := map[string]string{"username": username, "password": "secret42"}
+		require.Equal(t, http.StatusOK, do("POST", "/api/v1/register", ip, "", user).StatusCode)
+		resp := do("POST", "/api/v1/login", ip, "", user)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var tokens auth.TokenResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&tokens))
+		return tokens.Token
+	}
+
+	// Requests without credentials are limited per client address.
+	for range 2 {
+		assert.Equal(t, http.StatusOK, do("GET", "/api/v1/openapi.json", "10.0.0.1", "", nil).StatusCode)
+	}
+	resp := do("GET", "/api/v1/openapi.json", "10.0.0.1", "", nil)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "60", resp.Header.Get("Retry-After"))
+	var p problem.Problem
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&p))
+	assert.Equal(t, "rate_limited", p.Code)
+	assert.Equal(t, http.StatusOK, do("GET", "/api/v1/openapi.json", "10.0.0.2", "", nil).StatusCode)
+
+	// Authenticated requests are limited per user, wherever they come from.
+	token := login("alice", "10.0.0.3")
+	assert.Equal(t, http.StatusOK, do("GET", "/api/v1/expressions", "10.0.0.4", token, nil).StatusCode)
+	assert.Equal(t, http.StatusOK, do("GET", "/api/v1/expressions", "10.0.0.5", token, nil).StatusCode)
+	assert.Equal(t, http.StatusTooManyRequests, do("GET", "/api/v1/expressions", "10.0.0.6", token, nil).StatusCode)
+
+	// Users with their own quota refill faster.
+	token = login("vip", "10.0.0.7")
+	for range 5 {
+		assert.Equal(t, http.StatusOK, do("GET", "/api/v1/expressions", "10.0.0.8", token, nil).StatusCode)
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestRateLimitBeforeAuthentication(t *testing.T) {
+	cfg := config.ConfigFromEnv()
+	cfg.RateLimitIPPerMinute = 1
+	cfg.RateLimitIPBurst = 2
+	cfg.TrustProxy = true
+	ts := serveTestAPI(t, cfg)
+
+	// Invalid tokens are turned away per address before they are checked.
+	for range 2 {
+		assert.Equal(t, http.StatusUnauthorized, ts.doFrom("GET", "/api/v1/expressions", "10.0.0.1", "bogus", nil).StatusCode)
+	}
+	resp := ts.doFrom("GET", "/api/v1/expressions", "10.0.0.1", "bogus", nil)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.NotEmpty(t, resp.Header.Get("Retry-After"))
+	assert.Equal(t, http.StatusUnauthorized, ts.doFrom("GET", "/api/v1/expressions", "10.0.0.2", "bogus", nil).StatusCode)
+}
+
+func TestLoginLockout(t *testing.T) {
+	cfg := config.ConfigFromEnv()
+	cfg.LoginMaxAttempts = 3
+	cfg.LoginMaxAttemptsPerIP = 5
+	cfg.TrustProxy = true
+	ts := serveTestAPI(t, cfg)
+
+	alice := map[string]string{"username": "alice", "password": "secret42"}
+	guess := map[string]string{"username": "alice", "password": "guess123"}
+	require.Equal(t, http.StatusOK, ts.doFrom("POST", "/api/v1/register", "10.0.0.1", "", alice).StatusCode)
+
+	// Guessing alice's password locks out the guessing address...
+	for range 3 {
+		assert.Equal(t, http.StatusUnauthorized, ts.doFrom("POST", "/api/v1/login", "10.0.0.66", "", guess).StatusCode)
+	}
+	resp := ts.doFrom("POST", "/api/v1/login", "10.0.0.66", "", alice)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.NotEmpty(t, resp.Header.Get("Retry-After"))
+
+	// ...but not logins to alice from other addresses.
+	assert.Equal(t, http.StatusOK, ts.doFrom("POST", "/api/v1/login", "10.0.0.1", "", alice).StatusCode)
+
+	// An address guessing many usernames is locked out for all of them.
+	for _, name := range []string{"bob", "carol"} {
+		user := map[string]string{"username": name, "password": "guess123"}
+		assert.Equal(t, http.StatusUnauthorized, ts.doFrom("POST", "/api/v1/login", "10.0.0.66", "", user).StatusCode)
+	}
+	assert.Equal(t, http.StatusTooManyRequests, ts.doFrom("POST", "/api/v1/login", "10.0.0.66", "", map[string]string{"username": "dave", "password": "guess123"}).StatusCode)
+	assert.Equal(t, http.StatusOK, ts.doFrom("POST", "/api/v1/login", "10.0.0.2", "", alice).StatusCode)
+}
+
+func TestLoginLockoutPerUser(t *testing.T) {
+	cfg := config.ConfigFromEnv()
+	cfg.LoginMaxAttempts = 3
+	cfg.LoginMaxAttemptsPerUser = 6
+	cfg.TrustProxy = true
+	ts := serveTestAPI(t, cfg)
+
+	alice := map[string]string{"username": "alice", "password": "secret42"}
+	guess := map[string]string{"username": "alice", "password": "guess123"}
+	require.Equal(t, http.StatusOK, ts.doFrom("POST", "/api/v1/register", "10.0.0.1", "", alice).StatusCode)
+	require.Equal(t, http.StatusOK, ts.doFrom("POST", "/api/v1/register", "10.0.0.1", "", map[string]string{"username": "bob", "password": "secret42"}).StatusCode)
+
+	// Guessing from a new address each time still locks alice out...
+	for i := range 6 {
+		ip := fmt.Sprintf("10.0.1.%d", i)
+		assert.Equal(t, http.StatusUnauthorized, ts.doFrom("POST", "/api/v1/login", ip, "", guess).StatusCode)
+	}
+	resp := ts.doFrom("POST", "/api/v1/login", "10.0.0.1", "", alice)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.NotEmpty(t, resp.Header.Get("Retry-After"))
+
+	// ...but no other user.
+	assert.Equal(t, http.StatusOK, ts.doFrom("POST", "/api/v1/login", "10.0.1.0", "", map[string]string{"username": "bob", "password": "secret42"}).StatusCode)
+}
@@ -0,0 +1,217 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/StepanShel/YandexProject/internal/agent"
+	"github.com/StepanShel/YandexProject/internal/auth"
+	"github.com/StepanShel/YandexProject/internal/problem"
+	"github.com/StepanShel/YandexProject/internal/ratelimit"
+	"github.com/StepanShel/YandexProject/internal/repo"
+	"github.com/StepanShel/YandexProject/pkg/orchestrator/config"
+	grpc "github.com/StepanShel/YandexProject/pkg/orchestrator/gRPC"
+	"github.com/StepanShel/YandexProject/proto/calc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testAPI is a test server with the parts of it tests need to reach.
+type testAPI struct {
+	*httptest.Server
+	t      *testing.T
+	server *Server
+	repo   *repo.Repo
+	agents *grpc.Server
+	// dbPath is the file of the database behind repo.
+	dbPath string
+}
+
+// newTestAPI serves the documented endpoints the way cmd/orchestrator does,
+// backed by a temporary database.
+func newTestAPI(t *testing.T) *testAPI {
+	t.Helper()
+
+	cfg := config.ConfigFromEnv()
+	cfg.MaxExpressionLength = 50
+	cfg.MaxConcurrentExpressions = 2
+	cfg.LoginMaxAttempts = 3
+	return serveTestAPI(t, cfg)
+}
+
+func serveTestAPI(t *testing.T, cfg *config.Config) *testAPI {
+	t.Helper()
+
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	repository, err := repo.Open(dbPath)
+	require.NoError(t, err)
+	agents := grpc.NewServer()
+	server := New(agents, repository, cfg)
+
+	keys, err := auth.NewKeySet(auth.KeyConfig{Secret: strings.Repeat("k", 32)})
+	require.NoError(t, err)
+	jwtService := auth.NewJWTService(keys, repository)
+	authHandler := auth.NewAuthHandler(repository, jwtService)
+	authHandler.Guard = &auth.LoginGuard{
+		Users:      ratelimit.NewLockout(cfg.LoginMaxAttempts, time.Minute, time.Hour),
+		IPs:        ratelimit.NewLockout(cfg.LoginMaxAttemptsPerIP, time.Minute, time.Hour),
+		Accounts:   ratelimit.NewLockout(cfg.LoginMaxAttemptsPerUser, time.Minute, 5*time.Minute),
+		TrustProxy: cfg.TrustProxy,
+	}
+
+	mux := http.NewServeMux()
+	server.Routes(mux, authHandler, jwtService)
+
+	ts := httptest.NewServer(problem.WithRequestID(mux))
+	t.Cleanup(ts.Close)
+	return &testAPI{Server: ts, t: t, server: server, repo: repository, agents: agents, dbPath: dbPath}
+}
+
+// runAgent answers the tasks of the server the way cmd/agent does, without
+// the delays, until the test ends.
+func (api *testAPI) runAgent() {
+	ctx, cancel := context.WithCancel(context.Background())
+	api.t.Cleanup(cancel)
+
+	go func() {
+		for {
+			task, err := api.agents.GetTask(ctx, &calc.Empty{})
+			if err != nil {
+				return
+			}
+			value, err := agent.Calculate(task.Operation, 0, task.Arg1, task.Arg2)
+			result := &calc.Result{TaskId: task.Id, Result: value}
+			if err != nil {
+				result.Error = err.Error()
+			}
+			api.agents.SendResult(ctx, result)
+		}
+	}()
+}
+
+// do sends body as JSON, or as is if it is a string, and returns the
+// response with its body read.
+func (api *testAPI) do(method, path, token string, body any) (*http.Response, []byte) {
+	api.t.Helper()
+
+	var payload io.Reader
+	switch body := body.(type) {
+	case nil:
+	case string:
+		payload = strings.NewReader(body)
+	default:
+		data, err := json.Marshal(body)
+		require.NoError(api.t, err)
+		payload = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, api.URL+path, payload)
+	require.NoError(api.t, err)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(api.t, err)
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	require.NoError(api.t, err)
+	return resp, data
+}
+
+// login registers the user and returns an access token for them.
+func (api *testAPI) login(username string) string {
+	api.t.Helper()
+
+	creds := map[string]string{"username": username, "password": "secret42"}
+	resp, data := api.do("POST", "/api/v1/register", "", creds)
+	require.Equal(api.t, http.StatusOK, resp.StatusCode, "%s", data)
+	resp, data = api.do("POST", "/api/v1/login", "", creds)
+	require.Equal(api.t, http.StatusOK, resp.StatusCode, "%s", data)
+
+	var tokens auth.TokenResponse
+	require.NoError(api.t, json.Unmarshal(data, &tokens))
+	return tokens.Token
+}
+
+// calculate submits the expression and returns its id.
+func (api *testAPI) calculate(token, expression string) string {
+	api.t.Helper()
+
+	resp, data := api.do("POST", "/api/v1/calculate", token, map[string]string{"expression": expression})
+	require.Equal(api.t, http.StatusCreated, resp.StatusCode, "%s", data)
+	var created ResponseID
+	require.NoError(api.t, json.Unmarshal(data, &created))
+	return created.Id
+}
+
+// await polls the expression until it reaches a terminal status.
+func (api *testAPI) await(token, id string) ExpressionV2 {
+	api.t.Helper()
+
+	var expr struct{ Expression ExpressionV2 }
+	require.Eventually(api.t, func() bool {
+		resp, data := api.do("GET", "/api/v2/expressions/"+id, token, nil)
+		require.Equal(api.t, http.StatusOK, resp.StatusCode, "%s", data)
+		require.NoError(api.t, json.Unmarshal(data, &expr))
+		return expr.Expression.FinishedAt != ""
+	}, 5*time.Second, 10*time.Millisecond)
+	return expr.Expression
+}
+
+func TestFractionalResult(t *testing.T) {
+	api := newTestAPI(t)
+	api.runAgent()
+	token := api.login("alice")
+
+	id := api.calculate(token, "1e-3*2")
+	expr := api.await(token, id)
+	require.Equal(t, repo.StatusDone, expr.Status)
+	require.NotNil(t, expr.Result)
+	assert.Equal(t, 0.002, *expr.Result)
+
+	// API v1 reports the same value.
+	resp, data := api.do("GET", "/api/v1/expressions/"+id, token, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var v1 struct{ Expression Expression }
+	require.NoError(t, json.Unmarshal(data, &v1))
+	assert.Equal(t, 0.002, v1.Expression.Result)
+}
+
+func TestTaskTimeout(t *testing.T) {
+	cfg := config.ConfigFromEnv()
+	cfg.MaxConcurrentExpressions = 1
+	cfg.TaskTimeoutSlackMs = 50
+	api := serveTestAPI(t, cfg)
+	token := api.login("alice")
+
+	// No agent takes the task, so the expression fails...
+	expr := api.await(token, api.calculate(token, "1+2"))
+	assert.Equal(t, repo.StatusError, expr.Status)
+	assert.Equal(t, "task timed out", expr.Error)
+
+	// ...and frees its slot for the next one.
+	api.runAgent()
+	expr = api.await(token, api.calculate(token, "2+2"))
+	require.Equal(t, repo.StatusDone, expr.Status)
+	assert.Equal(t, 4.0, *expr.Result)
+}
+
+func TestExpressionLength(t *testing.T) {
+	api := newTestAPI(t)
+	token := api.login("alice")
+
+	// The limit of 50 counts characters, not bytes.
+	resp, data := api.do("POST", "/api/v1/calculate", token, map[string]string{"expression": strings.Repeat("ё", 50)})
+	assert.Equal(t, http.StatusCreated, resp.StatusCode, "%s", data)
+
+	resp, data = api.do("POST", "/api/v1/calculate", token, map[string]string{"expression": strings.Repeat("ё", 51)})
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode, "%s", data)
+}
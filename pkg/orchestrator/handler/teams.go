@@ -0,0 +1,427 @@
+package handler
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/StepanShel/YandexProject/internal/auth"
+	"github.com/StepanShel/YandexProject/internal/jsonbody"
+	"github.com/StepanShel/YandexProject/internal/problem"
+	"github.com/StepanShel/YandexProject/internal/repo"
+	uuid "github.com/google/uuid"
+)
+
+const (
+	maxTeamName = 100
+	// maxShares is how many users one expression may be shared with.
+	maxShares = 100
+)
+
+var (
+	errNoTeam        = problem.New("team_not_found", "you do not belong to a team")
+	errNotTeamOwner  = problem.New("not_team_owner", "only the owner of the team may do this")
+	errNotMember     = problem.New("not_team_member", "the user is not a member of the team")
+	errNoInvite      = problem.New("invite_not_found", "invite not found")
+	errInvalidTeamID = problem.New("invalid_team_id", "invalid team id")
+	// errCannotInvite is the same for unknown users and for users already
+	// in a team, so that invites do not tell which users exist.
+	errCannotInvite = problem.New("invalid_invite", "the user cannot be invited")
+)
+
+func newTeam(team *repo.Team) Team {
+	return Team{
+		ID:        team.ID.String(),
+		Name:      team.Name,
+		Owner:     team.Owner,
+		Members:   team.Members,
+		CreatedAt: team.CreatedAt.UTC(),
+	}
+}
+
+func newTeamInvite(invite *repo.TeamInvite) TeamInvite {
+	return TeamInvite{
+		TeamID:    invite.TeamID.String(),
+		Team:      invite.Team,
+		Owner:     invite.Owner,
+		Username:  invite.Username,
+		CreatedAt: invite.CreatedAt.UTC(),
+	}
+}
+
+// canRead reports whether the caller may read the expression: it is theirs,
+// or it is shared with them or their team.
+func (server *Server) canRead(r *http.Request, expr *repo.Expression) (bool, error) {
+	claims, ok := auth.ClaimsFrom(r.Context())
+	if !ok {
+		return false, nil
+	}
+	if expr.Username == claims.Subject || (expr.TeamID != "" && expr.TeamID == claims.Team) {
+		return true, nil
+	}
+	return server.Repo.IsSharedWith(expr.ID, claims.Subject)
+}
+
+// callerTeamID returns the id of the team of the caller, if any.
+func callerTeamID(r *http.Request) string {
+	if claims, ok := auth.ClaimsFrom(r.Context()); ok {
+		return claims.Team
+	}
+	return ""
+}
+
+// callerTeam returns the team of the caller, or errNoTeam.
+func (server *Server) callerTeam(claims *auth.Claims) (*repo.Team, error) {
+	if claims.Team == "" {
+		return nil, errNoTeam
+	}
+	id, err := uuid.Parse(claims.Team)
+	if err != nil {
+		return nil, err
+	}
+	team, err := server.Repo.GetTeam(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errNoTeam
+	}
+	return team, err
+}
+
+// writeTeamError writes the error of callerTeam or of a team operation.
+func writeTeamError(w http.ResponseWriter, err error, action string) {
+	switch {
+	case errors.Is(err, errNoTeam):
+		respJson(w, errNoTeam, http.StatusNotFound)
+	case errors.Is(err, repo.ErrInTeam):
+		respJson(w, problem.New("already_in_team", "the user already belongs to a team"), http.StatusConflict)
+	case errors.Is(err, sql.ErrNoRows):
+		respJson(w, errNotMember, http.StatusNotFound)
+	default:
+		fmt.Println(err)
+		respJson(w, fmt.Errorf("failed to %s", action), http.StatusInternalServerError)
+	}
+}
+
+// endpoint api/v1/team
+//
+// Creates a team owned by the caller, who must not belong to one yet.
+func (server *Server) HandleCreateTeam(w http.ResponseWriter, r *http.Request) {
+	claims, ok := auth.ClaimsFrom(r.Context())
+	if !ok {
+		respJson(w, errUnauthorized, http.StatusUnauthorized)
+		return
+	}
+
+	var request TeamRequest
+	if code, err := jsonbody.Decode(w, r, &request, int64(server.Config.MaxBodyBytes)); err != nil {
+		respJson(w, err, code)
+		return
+	}
+	request.Name = strings.TrimSpace(request.Name)
+	if request.Name == "" || utf8.RuneCountInString(request.Name) > maxTeamName {
+		respJson(w, problem.Errorf("invalid_name", "name must be 1 to %d characters long", maxTeamName), 422)
+		return
+	}
+
+	team := &repo.Team{Name: request.Name, Owner: claims.Subject}
+	if err := server.Repo.CreateTeam(team); err != nil {
+		if errors.Is(err, repo.ErrTeamExists) {
+			respJson(w, problem.New("team_name_taken", "team already exists"), http.StatusConflict)
+			return
+		}
+		writeTeamError(w, err, "create team")
+		return
+	}
+
+	respJson(w, newTeam(team), http.StatusCreated)
+}
+
+// endpoint api/v1/team
+//
+// GET returns the team of the caller, DELETE lets its owner delete it.
+func (server *Server) HandleTeam(w http.ResponseWriter, r *http.Request) {
+	claims, ok := auth.ClaimsFrom(r.Context())
+	if !ok {
+		respJson(w, errUnauthorized, http.StatusUnauthorized)
+		return
+	}
+
+	team, err := server.callerTeam(claims)
+	if err != nil {
+		writeTeamError(w, err, "get team")
+		return
+	}
+	if r.Method != http.MethodDelete {
+		respJson(w, newTeam(team), 200)
+		return
+	}
+
+	if team.Owner != claims.Subject {
+		respJson(w, errNotTeamOwner, http.StatusForbidden)
+		return
+	}
+	if err := server.Repo.DeleteTeam(team.ID); err != nil {
+		writeTeamError(w, err, "delete team")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// endpoint api/v1/team/members
+//
+// Invites a user without a team to the team of the caller, who must own it.
+// The user joins by accepting the invite at api/v1/team/invites/:team/accept.
+func (server *Server) HandleAddTeamMember(w http.ResponseWriter, r *http.Request) {
+	claims, ok := auth.ClaimsFrom(r.Context())
+	if !ok {
+		respJson(w, errUnauthorized, http.StatusUnauthorized)
+		return
+	}
+
+	var request TeamMemberRequest
+	if code, err := jsonbody.Decode(w, r, &request, int64(server.Config.MaxBodyBytes)); err != nil {
+		respJson(w, err, code)
+		return
+	}
+
+	team, err := server.callerTeam(claims)
+	if err != nil {
+		writeTeamError(w, err, "invite team member")
+		return
+	}
+	if team.Owner != claims.Subject {
+		respJson(w, errNotTeamOwner, http.StatusForbidden)
+		return
+	}
+
+	invite, err := server.Repo.InviteTeamMember(team.ID, request.Username)
+	if errors.Is(err, sql.ErrNoRows) || errors.Is(err, repo.ErrInTeam) {
+		respJson(w, errCannotInvite, 422)
+		return
+	}
+	if err != nil {
+		writeTeamError(w, err, "invite team member")
+		return
+	}
+	respJson(w, newTeamInvite(invite), http.StatusAccepted)
+}
+
+// endpoint api/v1/team/invites
+//
+// Returns the invites of the caller to join teams.
+func (server *Server) HandleTeamInvites(w http.ResponseWriter, r *http.Request) {
+	claims, ok := auth.ClaimsFrom(r.Context())
+	if !ok {
+		respJson(w, errUnauthorized, http.StatusUnauthorized)
+		return
+	}
+
+	invites, err := server.Repo.ListTeamInvites(claims.Subject)
+	if err != nil {
+		writeTeamError(w, err, "list team invites")
+		return
+	}
+	result := make([]TeamInvite, 0, len(invites))
+	for i := range invites {
+		result = append(result, newTeamInvite(&invites[i]))
+	}
+	respJson(w, result, 200)
+}
+
+// endpoint api/v1/team/invites/:team/accept
+//
+// Makes the caller a member of the team that invited them. Their other
+// invites are dropped.
+func (server *Server) HandleAcceptTeamInvite(w http.ResponseWriter, r *http.Request) {
+	claims, ok := auth.ClaimsFrom(r.Context())
+	if !ok {
+		respJson(w, errUnauthorized, http.StatusUnauthorized)
+		return
+	}
+
+	id, err := parseID(r.PathValue("team"))
+	if err != nil {
+		respJson(w, errInvalidTeamID, http.StatusBadRequest)
+		return
+	}
+
+	err = server.Repo.AcceptTeamInvite(id, claims.Subject)
+	if errors.Is(err, sql.ErrNoRows) {
+		respJson(w, errNoInvite, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeTeamError(w, err, "accept team invite")
+		return
+	}
+
+	team, err := server.Repo.GetTeam(id)
+	if err != nil {
+		writeTeamError(w, err, "accept team invite")
+		return
+	}
+	respJson(w, newTeam(team), 200)
+}
+
+// endpoint api/v1/team/invites/:team
+//
+// Declines the invite of the caller to join the team.
+func (server *Server) HandleDeclineTeamInvite(w http.ResponseWriter, r *http.Request) {
+	claims, ok := auth.ClaimsFrom(r.Context())
+	if !ok {
+		respJson(w, errUnauthorized, http.StatusUnauthorized)
+		return
+	}
+
+	id, err := parseID(r.PathValue("team"))
+	if err != nil {
+		respJson(w, errInvalidTeamID, http.StatusBadRequest)
+		return
+	}
+
+	err = server.Repo.DeclineTeamInvite(id, claims.Subject)
+	if errors.Is(err, sql.ErrNoRows) {
+		respJson(w, errNoInvite, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeTeamError(w, err, "decline team invite")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// endpoint api/v1/team/members/:username
+//
+// Owners remove members; members leave by removing themselves. Expressions
+// of a removed member are no longer shared with the team.
+func (server *Server) HandleRemoveTeamMember(w http.ResponseWriter, r *http.Request) {
+	claims, ok := auth.ClaimsFrom(r.Context())
+	if !ok {
+		respJson(w, errUnauthorized, http.StatusUnauthorized)
+		return
+	}
+
+	team, err := server.callerTeam(claims)
+	if err != nil {
+		writeTeamError(w, err, "remove team member")
+		return
+	}
+
+	member := r.PathValue("username")
+	switch {
+	case member == team.Owner:
+		respJson(w, problem.New("owner_cannot_leave", "the owner cannot leave the team; delete it instead"), http.StatusConflict)
+		return
+	case member != claims.Subject && team.Owner != claims.Subject:
+		respJson(w, errNotTeamOwner, http.StatusForbidden)
+		return
+	}
+
+	if err := server.Repo.RemoveTeamMember(team.ID, member); err != nil {
+		writeTeamError(w, err, "remove team member")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// endpoint api/v1/expressions/:id/sharing
+//
+// GET tells whom the expression is shared with, PUT replaces it. Shared
+// expressions are read-only for everyone but the owner, who alone may see
+// and change the sharing.
+func (server *Server) HandleExpressionSharing(w http.ResponseWriter, r *http.Request) {
+	claims, ok := auth.ClaimsFrom(r.Context())
+	if !ok {
+		respJson(w, errUnauthorized, http.StatusUnauthorized)
+		return
+	}
+
+	id, err := parseID(r.PathValue("id"))
+	if err != nil {
+		respJson(w, errInvalidID, http.StatusBadRequest)
+		return
+	}
+
+	var request ExpressionSharing
+	if r.Method == http.MethodPut {
+		if code, err := jsonbody.Decode(w, r, &request, int64(server.Config.MaxBodyBytes)); err != nil {
+			respJson(w, err, code)
+			return
+		}
+	}
+
+	expr, err := server.Repo.GetExpressionByID(id)
+	if err != nil {
+		respJson(w, errNotFound, 404)
+		return
+	}
+	if expr.Username != claims.Subject {
+		respJson(w, errForbidden, http.StatusForbidden)
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		if code, err := server.validateSharing(claims, &request); err != nil {
+			if code == http.StatusInternalServerError {
+				fmt.Println(err)
+				err = errors.New("failed to share expression")
+			}
+			respJson(w, err, code)
+			return
+		}
+		teamID := ""
+		if request.Team {
+			teamID = claims.Team
+		}
+		if err := server.Repo.ShareExpression(id, teamID, request.Users); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				respJson(w, errNotFound, 404)
+				return
+			}
+			fmt.Println(err)
+			respJson(w, errors.New("failed to share expression"), http.StatusInternalServerError)
+			return
+		}
+		expr.TeamID = teamID
+	}
+
+	users, err := server.Repo.GetExpressionShares(id)
+	if err != nil {
+		fmt.Println(err)
+		respJson(w, errors.New("failed to get sharing"), http.StatusInternalServerError)
+		return
+	}
+	respJson(w, ExpressionSharing{Team: expr.TeamID != "", Users: users}, 200)
+}
+
+// validateSharing checks that the caller has a team to share with and that
+// the users may be shared with. Unknown, disabled and the caller themselves
+// get the same error, so that sharing does not tell which users exist.
+func (server *Server) validateSharing(claims *auth.Claims, request *ExpressionSharing) (int, error) {
+	if request.Team && claims.Team == "" {
+		return 422, problem.New("invalid_share", "you do not belong to a team")
+	}
+	if len(request.Users) > maxShares {
+		return 422, problem.Errorf("invalid_share", "an expression may be shared with at most %d users", maxShares)
+	}
+	for _, username := range request.Users {
+		errCannotShare := problem.Errorf("invalid_share", "cannot share the expression with %s", username)
+		if username == claims.Subject {
+			return 422, errCannotShare
+		}
+		user, err := server.Repo.GetUserByName(username)
+		if errors.Is(err, sql.ErrNoRows) {
+			return 422, errCannotShare
+		}
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		if user.Disabled {
+			return 422, errCannotShare
+		}
+	}
+	return 0, nil
+}
@@ -0,0 +1,142 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/StepanShel/YandexProject/internal/problem"
+	"github.com/StepanShel/YandexProject/internal/repo"
+	uuid "github.com/google/uuid"
+)
+
+// API v2 describes expressions completely and reports their status with the
+// values of the repo status enum. API v1 keeps its original representation:
+// done expressions are "DONE" and pending ones are "processing".
+
+var statuses = map[string]bool{
+	repo.StatusPending:    true,
+	repo.StatusProcessing: true,
+	repo.StatusDone:       true,
+	repo.StatusError:      true,
+	repo.StatusCancelled:  true,
+}
+
+// legacyStatus is the API v1 spelling of status.
+func legacyStatus(status string) string {
+	switch status {
+	case repo.StatusDone:
+		return "DONE"
+	case repo.StatusPending:
+		return repo.StatusProcessing
+	}
+	return status
+}
+
+// fromLegacyStatuses translates the statuses of an API v1 filter.
+func fromLegacyStatuses(legacy []string) []string {
+	var result []string
+	for _, status := range legacy {
+		switch status {
+		case "DONE":
+			result = append(result, repo.StatusDone)
+		case repo.StatusProcessing:
+			result = append(result, repo.StatusPending, repo.StatusProcessing)
+		default:
+			result = append(result, status)
+		}
+	}
+	return result
+}
+
+func newExpressionV2(expr *repo.Expression) ExpressionV2 {
+	result := ExpressionV2{
+		ID:         expr.ID.String(),
+		Expression: expr.Expression,
+		Owner:      expr.Username,
+		Status:     expr.Status,
+		Error:      expr.Error,
+		Constants:  expr.Constants,
+		CreatedAt:  expr.CreatedAt,
+		StartedAt:  expr.StartedAt,
+		FinishedAt: expr.FinishedAt,
+	}
+	if expr.Status == repo.StatusDone {
+		value := expr.Result
+		result.Result = &value
+	}
+	if expr.BatchID != uuid.Nil {
+		result.BatchID = expr.BatchID.String()
+	}
+	return result
+}
+
+// endpoint api/v2/expressions
+func (server *Server) HandleExpressionsV2(w http.ResponseWriter, r *http.Request) {
+	username, ok := r.Context().Value("username").(string)
+	if !ok {
+		respJson(w, errUnauthorized, http.StatusUnauthorized)
+		return
+	}
+
+	filter, err := parseListQuery(r.URL.Query(), username, defaultPageSize)
+	if err != nil {
+		respJson(w, err, http.StatusBadRequest)
+		return
+	}
+	filter.TeamID = callerTeamID(r)
+	for _, status := range filter.Statuses {
+		if !statuses[status] {
+			respJson(w, problem.Errorf("invalid_parameter", "unknown status: %s", status), http.StatusBadRequest)
+			return
+		}
+	}
+
+	expressions, next, err := server.Repo.ListExpressions(filter)
+	if err != nil {
+		fmt.Println(err)
+		respJson(w, errors.New("failed to get expressions"), http.StatusInternalServerError)
+		return
+	}
+
+	result := make([]ExpressionV2, 0, len(expressions))
+	for i := range expressions {
+		result = append(result, newExpressionV2(&expressions[i]))
+	}
+
+	respJson(w, ResponseExpressionsV2{Expressions: result, NextCursor: encodeCursor(next)}, 200)
+}
+
+// endpoint api/v2/expressions/:id
+func (server *Server) HandleExpressionByIdV2(w http.ResponseWriter, r *http.Request) {
+	if _, ok := r.Context().Value("username").(string); !ok {
+		respJson(w, errUnauthorized, http.StatusUnauthorized)
+		return
+	}
+
+	id, err := parseID(r.PathValue("id"))
+	if err != nil {
+		respJson(w, errInvalidID, http.StatusBadRequest)
+		return
+	}
+
+	expr, err := server.Repo.GetExpressionByID(id)
+	if err != nil {
+		respJson(w, errNotFound, 404)
+		return
+	}
+
+	// Expressions shared with the user or their team may be read too.
+	allowed, err := server.canRead(r, expr)
+	if err != nil {
+		fmt.Println(err)
+		respJson(w, errors.New("failed to get expression"), http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		respJson(w, errForbidden, http.StatusForbidden)
+		return
+	}
+
+	respJson(w, newExpressionV2(expr), 200)
+}
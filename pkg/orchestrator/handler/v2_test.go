@@ -0,0 +1,120 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/StepanShel/YandexProject/internal/repo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLegacyStatus(t *testing.T) {
+	tests := []struct {
+		status, legacy string
+	}{
+		{repo.StatusPending, "processing"},
+		{repo.StatusProcessing, "processing"},
+		{repo.StatusDone, "DONE"},
+		{repo.StatusError, "error"},
+		{repo.StatusCancelled, "cancelled"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.status, func(t *testing.T) {
+			assert.Equal(t, tt.legacy, legacyStatus(tt.status))
+		})
+	}
+}
+
+func TestFromLegacyStatuses(t *testing.T) {
+	assert.Equal(t,
+		[]string{repo.StatusDone, repo.StatusPending, repo.StatusProcessing, repo.StatusError},
+		fromLegacyStatuses([]string{"DONE", "processing", "error"}))
+	assert.Empty(t, fromLegacyStatuses(nil))
+}
+
+func TestExpressionV2(t *testing.T) {
+	api := newTestAPI(t)
+	alice := api.login("alice")
+	bob := api.login("bob")
+
+	get := func(version, id string) []byte {
+		t.Helper()
+		resp, data := api.do("GET", "/api/"+version+"/expressions/"+id, alice, nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode, "%s", data)
+		return data
+	}
+
+	// No agent is running yet, so the expression waits for its first task.
+	pending := api.calculate(alice, "1+2*3")
+	var v1 struct{ Expression Expression }
+	require.NoError(t, json.Unmarshal(get("v1", pending), &v1))
+	assert.Equal(t, "processing", v1.Expression.Status)
+	var v2 struct{ Expression ExpressionV2 }
+	require.NoError(t, json.Unmarshal(get("v2", pending), &v2))
+	assert.Contains(t, []string{repo.StatusPending, repo.StatusProcessing}, v2.Expression.Status)
+	assert.Nil(t, v2.Expression.Result)
+	assert.Empty(t, v2.Expression.FinishedAt)
+
+	api.runAgent()
+	done := api.await(alice, pending)
+	assert.Equal(t, pending, done.ID)
+	assert.Equal(t, "1+2*3", done.Expression)
+	assert.Equal(t, "alice", done.Owner)
+	assert.Equal(t, repo.StatusDone, done.Status)
+	require.NotNil(t, done.Result)
+	assert.Equal(t, 7.0, *done.Result)
+	assert.Empty(t, done.Error)
+	assert.NotEmpty(t, done.CreatedAt)
+	assert.NotEmpty(t, done.StartedAt)
+	assert.NotEmpty(t, done.FinishedAt)
+	assert.Empty(t, done.BatchID)
+
+	require.NoError(t, json.Unmarshal(get("v1", pending), &v1))
+	assert.Equal(t, Expression{ID: pending, Status: "DONE", Result: 7}, v1.Expression)
+
+	// Failed expressions carry the error instead of a result.
+	failed := api.await(alice, api.calculate(alice, "1/0"))
+	assert.Equal(t, repo.StatusError, failed.Status)
+	assert.Nil(t, failed.Result)
+	assert.NotEmpty(t, failed.Error)
+
+	// API v2 filters by its own statuses, API v1 by the legacy ones.
+	list := func(path string) []string {
+		t.Helper()
+		resp, data := api.do("GET", path, alice, nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode, "%s", data)
+		var page struct {
+			Expressions []struct{ ID string }
+		}
+		require.NoError(t, json.Unmarshal(data, &page))
+		var ids []string
+		for _, expr := range page.Expressions {
+			ids = append(ids, expr.ID)
+		}
+		return ids
+	}
+	assert.Equal(t, []string{pending}, list("/api/v2/expressions?status=done"))
+	assert.Equal(t, []string{pending}, list("/api/v1/expressions?status=DONE"))
+	assert.Equal(t, []string{failed.ID}, list("/api/v2/expressions?status=error"))
+	assert.Empty(t, list("/api/v2/expressions?status=pending,processing"))
+
+	tests := []struct {
+		name, token, path string
+		code              int
+	}{
+		{"unknown status", alice, "/api/v2/expressions?status=DONE", http.StatusBadRequest},
+		{"without token", "", "/api/v2/expressions/" + pending, http.StatusUnauthorized},
+		{"invalid id", alice, "/api/v2/expressions/42", http.StatusBadRequest},
+		{"unknown expression", alice, "/api/v2/expressions/00000000-0000-0000-0000-000000000000", http.StatusNotFound},
+		{"other user", bob, "/api/v2/expressions/" + pending, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, data := api.do("GET", tt.path, tt.token, nil)
+			assert.Equal(t, tt.code, resp.StatusCode, "%s", data)
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/StepanShel/YandexProject/internal/problem"
+	"github.com/StepanShel/YandexProject/pkg/orchestrator/webhook"
+)
+
+// validateCallback checks a callback URL sent with an expression.
+func (server *Server) validateCallback(rawURL string) error {
+	err := server.Webhooks.Validate(rawURL)
+	if errors.Is(err, webhook.ErrDisabled) {
+		return problem.New("callbacks_disabled", err.Error())
+	}
+	if err != nil {
+		return problem.New("invalid_callback_url", err.Error())
+	}
+	return nil
+}
+
+// endpoint api/v1/expressions/:id/webhooks
+//
+// Only the owner sees the attempts, even of a shared expression: the
+// callback URL is theirs.
+func (server *Server) HandleWebhookAttempts(w http.ResponseWriter, r *http.Request) {
+	username, ok := r.Context().Value("username").(string)
+	if !ok {
+		respJson(w, errUnauthorized, http.StatusUnauthorized)
+		return
+	}
+
+	id, err := parseID(r.PathValue("id"))
+	if err != nil {
+		respJson(w, errInvalidID, http.StatusBadRequest)
+		return
+	}
+
+	expr, err := server.Repo.GetExpressionByID(id)
+	if err != nil {
+		respJson(w, errNotFound, 404)
+		return
+	}
+
+	if expr.Username != username {
+		respJson(w, errForbidden, http.StatusForbidden)
+		return
+	}
+
+	attempts, err := server.Repo.GetWebhookAttempts(id)
+	if err != nil {
+		fmt.Println(err)
+		respJson(w, errors.New("failed to get webhook attempts"), http.StatusInternalServerError)
+		return
+	}
+
+	result := make([]WebhookAttempt, 0, len(attempts))
+	for _, a := range attempts {
+		result = append(result, WebhookAttempt{
+			URL:        a.URL,
+			Attempt:    a.Attempt,
+			StatusCode: a.StatusCode,
+			Error:      a.Error,
+			Delivered:  a.Delivered,
+			CreatedAt:  a.CreatedAt,
+		})
+	}
+
+	respJson(w, result, 200)
+}
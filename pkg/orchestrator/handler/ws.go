@@ -0,0 +1,203 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+
+	"github.com/StepanShel/YandexProject/internal/auth"
+	"github.com/StepanShel/YandexProject/pkg/orchestrator/events"
+	uuid "github.com/google/uuid"
+	"golang.org/x/net/websocket"
+)
+
+// WebSocket message types sent by the client.
+const (
+	wsCalculate = "calculate"
+	wsCancel    = "cancel"
+)
+
+// WebSocket message types sent by the server, in addition to the event
+// types of package events.
+const (
+	wsAccepted = "accepted"
+	wsError    = "error"
+)
+
+// WSRequest is a message from the client. Ref is an opaque client value
+// echoed in the reply so that replies can be matched to requests.
+type WSRequest struct {
+	Type        string `json:"type"`
+	Ref         string `json:"ref,omitempty"`
+	Expression  string `json:"expression,omitempty"`
+	CallbackURL string `json:"callback_url,omitempty"`
+	ID          string `json:"id,omitempty"`
+}
+
+// WSReply answers a WSRequest.
+type WSReply struct {
+	Type  string `json:"type"`
+	Ref   string `json:"ref,omitempty"`
+	ID    string `json:"id,omitempty"`
+	Error string `json:"error,omitempty"`
+	Code  int    `json:"code,omitempty"`
+}
+
+// endpoint api/v1/ws
+//
+// Clients submit expressions and cancel them over one connection and receive
+// the status and task events of every expression submitted on it. Like
+// cancelling elsewhere, this works only for the caller's own expressions.
+func (server *Server) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
+	username, ok := r.Context().Value("username").(string)
+	if !ok {
+		respJson(w, errUnauthorized, http.StatusUnauthorized)
+		return
+	}
+
+	ws := websocket.Server{
+		Handshake: func(config *websocket.Config, r *http.Request) error {
+			if !server.allowedOrigin(r) {
+				return errors.New("origin not allowed")
+			}
+			// Accept the subprotocol that carried the token, if any,
+			// without echoing the token.
+			if slices.Contains(config.Protocol, auth.WebSocketProtocol) {
+				config.Protocol = []string{auth.WebSocketProtocol}
+			} else {
+				config.Protocol = nil
+			}
+			return nil
+		},
+		Handler: func(conn *websocket.Conn) {
+			server.serveWebSocket(conn, username)
+		},
+	}
+	ws.ServeHTTP(w, r)
+}
+
+// allowedOrigin reports whether a page from the origin of r may open a
+// WebSocket connection. Otherwise any site could open one with a token the
+// browser holds for the user. Clients other than browsers send no Origin.
+func (server *Server) allowedOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && u.Host == r.Host {
+		return true
+	}
+	return slices.Contains(server.Config.WSAllowedOrigins, origin)
+}
+
+func (server *Server) serveWebSocket(conn *websocket.Conn, username string) {
+	defer conn.Close()
+
+	sub := server.Events.Subscribe(username, "")
+	defer server.Events.Unsubscribe(sub)
+
+	// done stops the reader when the connection is given up on while it
+	// is passing on a request.
+	done := make(chan struct{})
+	defer close(done)
+
+	requests := make(chan WSRequest)
+	go func() {
+		defer close(requests)
+		for {
+			var request WSRequest
+			if err := websocket.JSON.Receive(conn, &request); err != nil {
+				return
+			}
+			select {
+			case requests <- request:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	// inFlight holds the expressions submitted on this connection that have
+	// not reached a terminal status yet. Requests and events are handled in
+	// one goroutine, so an expression is registered before its first event
+	// is read from the subscription.
+	inFlight := make(map[string]bool)
+
+	for {
+		var reply any
+
+		select {
+		case request, ok := <-requests:
+			if !ok {
+				return
+			}
+			var final *events.Event
+			reply, final = server.handleWSRequest(request, username, inFlight)
+			if final != nil {
+				// The expression finished before it was accepted, e.g. it
+				// came from the cache or did not parse, so its terminal
+				// event was published before it could be registered.
+				if err := websocket.JSON.Send(conn, reply); err != nil {
+					return
+				}
+				reply = *final
+			}
+		case e := <-sub.C:
+			if !inFlight[e.ExpressionID] {
+				continue
+			}
+			if e.Terminal() {
+				delete(inFlight, e.ExpressionID)
+			}
+			reply = e
+		}
+
+		if err := websocket.JSON.Send(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+// handleWSRequest answers the request. For an expression that is finished
+// as soon as it is submitted, it also returns the terminal event to send
+// after the reply.
+func (server *Server) handleWSRequest(request WSRequest, username string, inFlight map[string]bool) (WSReply, *events.Event) {
+	reply := WSReply{Type: wsError, Ref: request.Ref, ID: request.ID}
+
+	switch request.Type {
+	case wsCalculate:
+		expr, _, code, err := server.submitExpression(username, Request{
+			Expression:  request.Expression,
+			CallbackURL: request.CallbackURL,
+		})
+		if err != nil {
+			reply.Error, reply.Code = err.Error(), code
+			return reply, nil
+		}
+
+		accepted := WSReply{Type: wsAccepted, Ref: request.Ref, ID: expr.ID.String()}
+		if expr.Finished() {
+			final := statusEvent(expr)
+			return accepted, &final
+		}
+		inFlight[accepted.ID] = true
+		return accepted, nil
+
+	case wsCancel:
+		id, err := uuid.Parse(request.ID)
+		if err != nil {
+			reply.Error, reply.Code = "invalid expression id", http.StatusBadRequest
+			return reply, nil
+		}
+
+		if err := server.cancelExpression(id, username); err != nil {
+			reply.Error, reply.Code = err.Error(), cancelErrorCode(err)
+			return reply, nil
+		}
+		return WSReply{Type: wsAccepted, Ref: request.Ref, ID: request.ID}, nil
+	}
+
+	reply.Error, reply.Code = "unknown message type", http.StatusBadRequest
+	return reply, nil
+}
@@ -0,0 +1,163 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/StepanShel/YandexProject/internal/auth"
+	"github.com/StepanShel/YandexProject/pkg/orchestrator/config"
+	"github.com/StepanShel/YandexProject/pkg/orchestrator/events"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/websocket"
+)
+
+// dialWS opens a WebSocket connection from a page at origin. A token is
+// sent in the Authorization header unless protocols are given.
+func (api *testAPI) dialWS(origin, token string, protocols ...string) (*websocket.Conn, error) {
+	api.t.Helper()
+
+	cfg, err := websocket.NewConfig(strings.Replace(api.URL, "http", "ws", 1)+"/api/v1/ws", origin)
+	require.NoError(api.t, err)
+	cfg.Protocol = protocols
+	if token != "" {
+		cfg.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	conn, err := websocket.DialConfig(cfg)
+	if err == nil {
+		api.t.Cleanup(func() { conn.Close() })
+	}
+	return conn, err
+}
+
+// receiveWS reads the next message from conn into a generic map.
+func receiveWS(t *testing.T, conn *websocket.Conn) map[string]any {
+	t.Helper()
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	var msg map[string]any
+	require.NoError(t, websocket.JSON.Receive(conn, &msg))
+	return msg
+}
+
+func TestWebSocket(t *testing.T) {
+	api := newTestAPI(t)
+	api.runAgent()
+	token := api.login("alice")
+
+	conn, err := api.dialWS(api.URL, token)
+	require.NoError(t, err)
+
+	require.NoError(t, websocket.JSON.Send(conn, WSRequest{Type: wsCalculate, Ref: "1", Expression: "2+2*2"}))
+	msg := receiveWS(t, conn)
+	assert.Equal(t, wsAccepted, msg["type"])
+	assert.Equal(t, "1", msg["ref"])
+	id := msg["id"].(string)
+
+	// Events of the expression follow until it is finished.
+	for {
+		data, err := json.Marshal(receiveWS(t, conn))
+		require.NoError(t, err)
+		var e events.Event
+		require.NoError(t, json.Unmarshal(data, &e))
+		require.Equal(t, id, e.ExpressionID)
+		if e.Terminal() {
+			assert.Equal(t, "DONE", e.Status)
+			assert.Equal(t, 6.0, *e.Result)
+			break
+		}
+	}
+
+	tests := []struct {
+		name    string
+		request WSRequest
+		code    float64
+	}{
+		{"invalid expression", WSRequest{Type: wsCalculate, Ref: "2", Expression: strings.Repeat("1+", 50) + "1"}, http.StatusRequestEntityTooLarge},
+		{"invalid id", WSRequest{Type: wsCancel, Ref: "3", ID: "42"}, http.StatusBadRequest},
+		{"unknown expression", WSRequest{Type: wsCancel, Ref: "4", ID: "00000000-0000-0000-0000-000000000000"}, http.StatusNotFound},
+		{"unknown type", WSRequest{Type: "bogus", Ref: "5"}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.NoError(t, websocket.JSON.Send(conn, tt.request))
+			msg := receiveWS(t, conn)
+			assert.Equal(t, wsError, msg["type"])
+			assert.Equal(t, tt.request.Ref, msg["ref"])
+			assert.Equal(t, tt.code, msg["code"])
+			assert.NotEmpty(t, msg["error"])
+		})
+	}
+}
+
+func TestWebSocketFinishedOnSubmit(t *testing.T) {
+	api := newTestAPI(t)
+	api.runAgent()
+	token := api.login("alice")
+	api.await(token, api.calculate(token, "3+4"))
+
+	conn, err := api.dialWS(api.URL, token)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name, expression, status string
+	}{
+		{"cached", "3+4", "DONE"},
+		{"invalid", "2+", "error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.NoError(t, websocket.JSON.Send(conn, WSRequest{Type: wsCalculate, Ref: tt.name, Expression: tt.expression}))
+			msg := receiveWS(t, conn)
+			require.Equal(t, wsAccepted, msg["type"], "%v", msg)
+			assert.Equal(t, tt.name, msg["ref"])
+
+			// The terminal event follows at once, although it was
+			// published before the expression was accepted.
+			data, err := json.Marshal(receiveWS(t, conn))
+			require.NoError(t, err)
+			var e events.Event
+			require.NoError(t, json.Unmarshal(data, &e))
+			assert.Equal(t, msg["id"], e.ExpressionID)
+			assert.True(t, e.Terminal())
+			assert.Equal(t, tt.status, e.Status)
+			if tt.status == "DONE" {
+				require.NotNil(t, e.Result)
+				assert.Equal(t, 7.0, *e.Result)
+			} else {
+				assert.NotEmpty(t, e.Error)
+			}
+		})
+	}
+}
+
+func TestWebSocketHandshake(t *testing.T) {
+	cfg := config.ConfigFromEnv()
+	cfg.WSAllowedOrigins = []string{"https://app.example.com"}
+	api := serveTestAPI(t, cfg)
+	token := api.login("alice")
+
+	// Pages from other sites may not connect with the user's token.
+	_, err := api.dialWS("https://evil.example.com", token)
+	assert.Error(t, err)
+
+	conn, err := api.dialWS("https://app.example.com", token)
+	require.NoError(t, err)
+	conn.Close()
+
+	// Browsers offer the token as a subprotocol, which is not echoed.
+	conn, err = api.dialWS(api.URL, "", auth.WebSocketProtocol, token)
+	require.NoError(t, err)
+	assert.Equal(t, []string{auth.WebSocketProtocol}, conn.Config().Protocol)
+	conn.Close()
+
+	// Tokens in the query string are not accepted.
+	wsCfg, err := websocket.NewConfig(strings.Replace(api.URL, "http", "ws", 1)+"/api/v1/ws?access_token="+token, api.URL)
+	require.NoError(t, err)
+	_, err = websocket.DialConfig(wsCfg)
+	assert.Error(t, err)
+}
@@ -0,0 +1,64 @@
+package parser
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+)
+
+// Cache stores results of evaluated subtrees by their fingerprint.
+type Cache interface {
+	Get(key string) (float64, bool)
+	Put(key string, value float64)
+}
+
+// commutative operations give the same result whatever the order of their
+// operands, so their operands are sorted when fingerprinting.
+var commutative = map[string]bool{"+": true, "*": true}
+
+// Fingerprint identifies the value of the tree: trees that differ only in
+// the spelling of numbers or in the order of operands of + and * have the
+// same fingerprint.
+func Fingerprint(node *Node) string {
+	return fingerprints(node)[node]
+}
+
+// fingerprints returns the fingerprint of every node of the tree.
+func fingerprints(node *Node) map[*Node]string {
+	keys := make(map[*Node]string)
+	stack := []*Node{node}
+
+	for len(stack) > 0 {
+		current := stack[len(stack)-1]
+
+		if current.left == nil || current.right == nil {
+			value := current.value
+			if number, err := parseNumber(value); err == nil {
+				value = strconv.FormatFloat(number, 'g', -1, 64)
+			}
+			keys[current] = "n:" + value
+			stack = stack[:len(stack)-1]
+			continue
+		}
+
+		left, ok := keys[current.left]
+		if !ok {
+			stack = append(stack, current.left)
+			continue
+		}
+		right, ok := keys[current.right]
+		if !ok {
+			stack = append(stack, current.right)
+			continue
+		}
+
+		if commutative[current.value] && right < left {
+			left, right = right, left
+		}
+		sum := sha256.Sum256([]byte(current.value + "(" + left + "," + right + ")"))
+		keys[current] = hex.EncodeToString(sum[:])
+		stack = stack[:len(stack)-1]
+	}
+
+	return keys
+}
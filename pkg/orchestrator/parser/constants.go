@@ -0,0 +1,62 @@
+package parser
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Builtins are the mathematical constants available in every expression.
+var Builtins = map[string]float64{
+	"pi":  math.Pi,
+	"e":   math.E,
+	"tau": 2 * math.Pi,
+	"phi": math.Phi,
+}
+
+// IsValidConstantName reports whether name can be used as a constant in
+// expressions.
+func IsValidConstantName(name string) bool {
+	return !strings.HasPrefix(name, "-") && isIdentifier(name)
+}
+
+// ResolveConstants replaces identifier tokens with the literal value of the
+// constant they name. Built-in constants take precedence over the ones in
+// constants. It returns the resolved tokens and the sorted names of the
+// constants that were used.
+func ResolveConstants(tokens []string, constants map[string]float64) ([]string, []string, error) {
+	resolved := make([]string, 0, len(tokens))
+	seen := make(map[string]bool)
+	var used []string
+
+	for _, token := range tokens {
+		if !isIdentifier(token) {
+			resolved = append(resolved, token)
+			continue
+		}
+
+		name := strings.TrimPrefix(token, "-")
+		value, ok := Builtins[name]
+		if !ok {
+			value, ok = constants[name]
+		}
+		if !ok {
+			return nil, nil, fmt.Errorf("unknown constant: %s", name)
+		}
+
+		if name != token {
+			value = -value
+		}
+		resolved = append(resolved, strconv.FormatFloat(value, 'g', -1, 64))
+
+		if !seen[name] {
+			seen[name] = true
+			used = append(used, name)
+		}
+	}
+
+	sort.Strings(used)
+	return resolved, used, nil
+}
@@ -3,24 +3,48 @@ package parser
 import (
 	"fmt"
 	"strconv"
+	"strings"
 	"unicode"
 )
 
 func Tokenize(expression string) ([]string, error) {
 	var tokens []string
 	var buffer []rune
+	runes := []rune(expression)
+
+	for i := 0; i < len(runes); i++ {
+		char := runes[i]
 
-	for i, char := range expression {
 		if unicode.IsSpace(char) {
 			continue
 		}
 
 		if unicode.IsDigit(char) || char == '.' {
-			buffer = append(buffer, char)
+			end := scanNumber(runes, i)
+			literal := string(runes[i:end])
+			if _, err := parseNumber(literal); err != nil {
+				return nil, fmt.Errorf("invalid number %q at position %d", literal, i+1)
+			}
+			buffer = append(buffer, runes[i:end]...)
+			tokens = append(tokens, string(buffer))
+			buffer = []rune{}
+			i = end - 1
+			continue
+		}
+
+		if unicode.IsLetter(char) || char == '_' {
+			end := i
+			for end < len(runes) && isIdentifierRune(runes[end]) {
+				end++
+			}
+			buffer = append(buffer, runes[i:end]...)
+			tokens = append(tokens, string(buffer))
+			buffer = []rune{}
+			i = end - 1
 			continue
 		}
 
-		if char == '-' && (i == 0 || isOperator(string(expression[i-1]))) {
+		if char == '-' && isUnaryPosition(tokens) {
 			buffer = append(buffer, char)
 			continue
 		}
@@ -44,11 +68,106 @@ func Tokenize(expression string) ([]string, error) {
 	return tokens, nil
 }
 
+// scanNumber returns the end of the numeric literal starting at runes[start].
+// Letters, digits, underscores and dots are consumed greedily so that
+// malformed literals such as "1.2.3" or "12abc" are reported as a whole.
+// A sign is only part of the literal right after an exponent marker:
+// e/E for decimal literals and p/P for hexadecimal ones.
+func scanNumber(runes []rune, start int) int {
+	hex := start+1 < len(runes) && runes[start] == '0' && (runes[start+1] == 'x' || runes[start+1] == 'X')
+
+	i := start
+	for i < len(runes) {
+		char := runes[i]
+		if unicode.IsLetter(char) || unicode.IsDigit(char) || char == '_' || char == '.' {
+			i++
+			continue
+		}
+		if (char == '+' || char == '-') && i > start && isExponent(runes[i-1], hex) {
+			i++
+			continue
+		}
+		break
+	}
+	return i
+}
+
+func isExponent(char rune, hex bool) bool {
+	if hex {
+		return char == 'p' || char == 'P'
+	}
+	return char == 'e' || char == 'E'
+}
+
+// parseNumber parses decimal, scientific, hexadecimal (0x), binary (0b)
+// and octal (0o) literals with optional underscore digit separators.
+func parseNumber(s string) (float64, error) {
+	digits := strings.TrimPrefix(s, "-")
+	if digits == "" || !(unicode.IsDigit(rune(digits[0])) || digits[0] == '.') {
+		return 0, strconv.ErrSyntax
+	}
+
+	if len(digits) > 2 && digits[0] == '0' {
+		switch digits[1] {
+		case 'x', 'X':
+			if strings.ContainsAny(digits, ".pP") {
+				return strconv.ParseFloat(s, 64)
+			}
+			return parseInteger(s)
+		case 'b', 'B', 'o', 'O':
+			return parseInteger(s)
+		}
+	}
+
+	return strconv.ParseFloat(s, 64)
+}
+
+func parseInteger(s string) (float64, error) {
+	negative := strings.HasPrefix(s, "-")
+	value, err := strconv.ParseUint(strings.TrimPrefix(s, "-"), 0, 64)
+	if err != nil {
+		return 0, err
+	}
+	if negative {
+		return -float64(value), nil
+	}
+	return float64(value), nil
+}
+
+// isUnaryPosition reports whether a minus read after tokens negates the
+// next operand: at the start of the expression, after an operator or after
+// an opening parenthesis. Whitespace is not significant.
+func isUnaryPosition(tokens []string) bool {
+	if len(tokens) == 0 {
+		return true
+	}
+	last := tokens[len(tokens)-1]
+	return isOperator(last) || last == "("
+}
+
+func isIdentifierRune(char rune) bool {
+	return unicode.IsLetter(char) || unicode.IsDigit(char) || char == '_'
+}
+
+// isIdentifier reports whether s (optionally negated) names a constant.
+func isIdentifier(s string) bool {
+	name := strings.TrimPrefix(s, "-")
+	if name == "" || unicode.IsDigit(rune(name[0])) {
+		return false
+	}
+	for _, char := range name {
+		if !isIdentifierRune(char) {
+			return false
+		}
+	}
+	return true
+}
+
 func isOperator(s string) bool {
 	return s == "+" || s == "-" || s == "*" || s == "/"
 }
 
 func isNumber(s string) bool {
-	_, err := strconv.ParseFloat(s, 64)
+	_, err := parseNumber(s)
 	return err == nil
 }
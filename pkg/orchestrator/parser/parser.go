@@ -1,9 +1,10 @@
 package parser
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"strconv"
+	"time"
 
 	"github.com/StepanShel/YandexProject/pkg/orchestrator/config"
 	"github.com/StepanShel/YandexProject/proto/calc"
@@ -90,7 +91,54 @@ func Ast(tokens []string) (*Node, error) {
 	return stack[0], nil
 }
 
-func ParsingAST(node *Node, cfg *config.Config, tasksch chan *calc.Task, resultchan chan *calc.Result) (float64, error) {
+// Measure returns the depth of the tree rooted at node and the number of
+// operations, i.e. tasks, needed to evaluate it.
+func Measure(node *Node) (depth int, operations int) {
+	type frame struct {
+		node  *Node
+		depth int
+	}
+
+	stack := []frame{{node, 1}}
+	for len(stack) > 0 {
+		current := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if current.node == nil {
+			continue
+		}
+
+		depth = max(depth, current.depth)
+		if current.node.left != nil || current.node.right != nil {
+			operations++
+		}
+		stack = append(stack, frame{current.node.left, current.depth + 1}, frame{current.node.right, current.depth + 1})
+	}
+
+	return depth, operations
+}
+
+// ErrTaskTimeout is returned when an agent does not return the result of a
+// task in time, e.g. because it died while computing it.
+var ErrTaskTimeout = errors.New("task timed out")
+
+// ParsingAST evaluates the tree in post-order without recursion, so deep
+// trees cannot exhaust the goroutine stack. Each operation is sent to tasksch
+// and its result is awaited on resultchan for the operation time plus
+// cfg.TaskTimeoutSlackMs, after which evaluation fails with ErrTaskTimeout.
+// Evaluation stops with ctx.Err() when ctx is cancelled.
+func ParsingAST(ctx context.Context, node *Node, cfg *config.Config, tasksch chan *calc.Task, resultchan chan *calc.Result) (float64, error) {
+	return ParsingASTCached(ctx, node, cfg, nil, tasksch, resultchan)
+}
+
+// ParsingASTCached is like ParsingAST but takes the results of subtrees
+// found in cache instead of dispatching their tasks, and stores the results
+// it computes. A nil cache disables caching.
+func ParsingASTCached(ctx context.Context, node *Node, cfg *config.Config, cache Cache, tasksch chan *calc.Task, resultchan chan *calc.Result) (float64, error) {
+	var keys map[*Node]string
+	if cache != nil {
+		keys = fingerprints(node)
+	}
+
 	operationTime := map[string]int{
 		"+": cfg.AddTime,
 		"-": cfg.Subtime,
@@ -98,43 +146,156 @@ func ParsingAST(node *Node, cfg *config.Config, tasksch chan *calc.Task, resultc
 		"*": cfg.MultiplicTime,
 	}
 
-	if isNumber(node.value) {
-		res, err := strconv.ParseFloat(node.value, 64)
+	values := make(map[*Node]float64)
+	stack := []*Node{node}
+
+	for len(stack) > 0 {
+		current := stack[len(stack)-1]
+
+		if isNumber(current.value) {
+			res, err := parseNumber(current.value)
+			if err != nil {
+				return 0, err
+			}
+			values[current] = res
+			stack = stack[:len(stack)-1]
+			continue
+		}
+
+		if current.left == nil || current.right == nil {
+			return 0, errors.New("invalid AST")
+		}
+
+		leftresult, ok := values[current.left]
+		// Look the subtree up once, on the first visit of the node.
+		if _, rightDone := values[current.right]; cache != nil && !ok && !rightDone {
+			if cached, hit := cache.Get(keys[current]); hit {
+				values[current] = cached
+				stack = stack[:len(stack)-1]
+				continue
+			}
+		}
+		if !ok {
+			stack = append(stack, current.left)
+			continue
+		}
+		rightresult, ok := values[current.right]
+		if !ok {
+			stack = append(stack, current.right)
+			continue
+		}
+
+		task := &calc.Task{
+			Id:            uuid.New().String(),
+			Arg1:          leftresult,
+			Arg2:          rightresult,
+			Operation:     current.value,
+			OperationTime: int32(operationTime[current.value]),
+		}
+
+		var timeout time.Duration
+		if cfg.TaskTimeoutSlackMs > 0 {
+			timeout = time.Duration(operationTime[current.value]+cfg.TaskTimeoutSlackMs) * time.Millisecond
+		}
+		result, err := dispatch(ctx, timeout, task, tasksch, resultchan)
 		if err != nil {
 			return 0, err
 		}
-		return res, nil
+		if cache != nil {
+			cache.Put(keys[current], result)
+		}
+		values[current] = result
+		stack = stack[:len(stack)-1]
 	}
 
-	if node.left == nil || node.right == nil {
-		return 0, errors.New("invalid AST")
+	return values[node], nil
+}
+
+// dispatch sends task to tasksch and waits for its result for at most
+// timeout, or without a deadline if timeout is zero.
+func dispatch(ctx context.Context, timeout time.Duration, task *calc.Task, tasksch chan *calc.Task, resultchan chan *calc.Result) (float64, error) {
+	taskCtx, cancel := ctx, context.CancelFunc(func() {})
+	if timeout > 0 {
+		taskCtx, cancel = context.WithTimeout(ctx, timeout)
 	}
+	defer cancel()
 
-	leftresult, err := ParsingAST(node.left, cfg, tasksch, resultchan)
-	if err != nil {
-		return 0, err
+	var err error
+	select {
+	case tasksch <- task:
+		var result float64
+		if result, err = awaitResult(taskCtx, task.Id, resultchan); err == nil {
+			return result, nil
+		}
+	case <-taskCtx.Done():
+		err = taskCtx.Err()
 	}
-	rightresult, err := ParsingAST(node.right, cfg, tasksch, resultchan)
-	if err != nil {
-		return 0, err
+
+	if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+		return 0, ErrTaskTimeout
 	}
-	task := &calc.Task{
-		Id:            uuid.New().String(),
-		Arg1:          float32(leftresult),
-		Arg2:          float32(rightresult),
-		Operation:     node.value,
-		OperationTime: int32(operationTime[node.value]),
+	return 0, err
+}
+
+func awaitResult(ctx context.Context, taskID string, resultchan chan *calc.Result) (float64, error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case result, ok := <-resultchan:
+			if !ok {
+				return 0, errors.New("result channel closed")
+			}
+			if result.TaskId != taskID {
+				continue
+			}
+			if result.Error != "" {
+				return 0, errors.New(result.Error)
+			}
+			return result.Result, nil
+		}
 	}
+}
+
+// Step is one operation of an evaluation plan. Operands are either literals
+// or references to the results of earlier steps written as "#n".
+type Step struct {
+	Left      string
+	Operation string
+	Right     string
+}
+
+// Plan lists the operations needed to evaluate the tree, in the order
+// ParsingAST dispatches them.
+func Plan(node *Node) []Step {
+	var steps []Step
+	refs := make(map[*Node]string)
+	stack := []*Node{node}
 
-	tasksch <- task
+	for len(stack) > 0 {
+		current := stack[len(stack)-1]
+
+		if current.left == nil || current.right == nil {
+			refs[current] = current.value
+			stack = stack[:len(stack)-1]
+			continue
+		}
 
-	var result = &calc.Result{}
-	for result = range resultchan {
-		if result.TaskId == task.Id {
-			node.value = fmt.Sprintf("%v", result.Result)
-			return float64(result.Result), nil
+		left, ok := refs[current.left]
+		if !ok {
+			stack = append(stack, current.left)
+			continue
 		}
+		right, ok := refs[current.right]
+		if !ok {
+			stack = append(stack, current.right)
+			continue
+		}
+
+		steps = append(steps, Step{Left: left, Operation: current.value, Right: right})
+		refs[current] = fmt.Sprintf("#%d", len(steps))
+		stack = stack[:len(stack)-1]
 	}
-	return 0, errors.New("how")
 
+	return steps
 }
@@ -1,8 +1,12 @@
 package parser
 
 import (
+	"context"
 	"fmt"
 	"testing"
+
+	"github.com/StepanShel/YandexProject/pkg/orchestrator/config"
+	"github.com/StepanShel/YandexProject/proto/calc"
 )
 
 func TestTokenize(t *testing.T) {
@@ -12,12 +16,17 @@ func TestTokenize(t *testing.T) {
 		err      error
 	}{
 		{"2 + 2", []string{"2", "+", "2"}, nil},
-		{"3.14 * -5", []string{"3.14", "*", "-", "5"}, nil},
+		{"3.14 * -5", []string{"3.14", "*", "-5"}, nil},
 		{"2 + (3 * 4)", []string{"2", "+", "(", "3", "*", "4", ")"}, nil},
 		{"-10 + 20", []string{"-10", "+", "20"}, nil},
 		{"10.5 / 2.5", []string{"10.5", "/", "2.5"}, nil},
 
-		{"2 + a", nil, fmt.Errorf("invalid character: a")},
+		{"2 + a", []string{"2", "+", "a"}, nil},
+		{"2 * -pi", []string{"2", "*", "-pi"}, nil},
+		{"(-2) * 3", []string{"(", "-2", ")", "*", "3"}, nil},
+		{"2 -3", []string{"2", "-", "3"}, nil},
+		{"-tau/VAT_2", []string{"-tau", "/", "VAT_2"}, nil},
+		{"2 + $", nil, fmt.Errorf("invalid character: $")},
 		{"2 # 3", nil, fmt.Errorf("invalid character: #")},
 
 		{"", []string{}, nil},
@@ -43,6 +52,116 @@ func TestTokenize(t *testing.T) {
 	}
 }
 
+func TestTokenizeNumericLiterals(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []string
+		err      error
+	}{
+		{"1e-3 + 2", []string{"1e-3", "+", "2"}, nil},
+		{"2.5E+10*3", []string{"2.5E+10", "*", "3"}, nil},
+		{"-1e3 - 1", []string{"-1e3", "-", "1"}, nil},
+		{"0xFF + 0b1010", []string{"0xFF", "+", "0b1010"}, nil},
+		{"0o17 / 0x1p-2", []string{"0o17", "/", "0x1p-2"}, nil},
+		{"1_000_000 * 0x_FF", []string{"1_000_000", "*", "0x_FF"}, nil},
+		{".5 + 5.", []string{".5", "+", "5."}, nil},
+
+		{"1.2.3", nil, fmt.Errorf("invalid number \"1.2.3\" at position 1")},
+		{"2 + 1e", nil, fmt.Errorf("invalid number \"1e\" at position 5")},
+		{"0b102", nil, fmt.Errorf("invalid number \"0b102\" at position 1")},
+		{"0xFG", nil, fmt.Errorf("invalid number \"0xFG\" at position 1")},
+		{"1__000", nil, fmt.Errorf("invalid number \"1__000\" at position 1")},
+		{"100_", nil, fmt.Errorf("invalid number \"100_\" at position 1")},
+		{"12abc", nil, fmt.Errorf("invalid number \"12abc\" at position 1")},
+		{"1e400", nil, fmt.Errorf("invalid number \"1e400\" at position 1")},
+	}
+
+	for _, test := range tests {
+		tokens, err := Tokenize(test.input)
+		if err != nil && test.err == nil {
+			t.Errorf("Tokenize(%q) returned unexpected error: %v", test.input, err)
+		}
+		if err == nil && test.err != nil {
+			t.Errorf("Tokenize(%q) expected error: %v", test.input, test.err)
+		}
+		if err != nil && test.err != nil && err.Error() != test.err.Error() {
+			t.Errorf("Tokenize(%q) returned wrong error: got %v want %v", test.input, err, test.err)
+		}
+		if !compareSlices(tokens, test.expected) {
+			t.Errorf("Tokenize(%q) = %v, expected %v", test.input, tokens, test.expected)
+		}
+	}
+}
+
+func TestParseNumber(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected float64
+	}{
+		{"42", 42},
+		{"-42", -42},
+		{"1e-3", 0.001},
+		{"2.5E+2", 250},
+		{"0xFF", 255},
+		{"-0xff", -255},
+		{"0b1010", 10},
+		{"0o17", 15},
+		{"0x1p-2", 0.25},
+		{"1_000_000", 1000000},
+		{"017", 17},
+	}
+
+	for _, test := range tests {
+		value, err := parseNumber(test.input)
+		if err != nil {
+			t.Errorf("parseNumber(%q) returned unexpected error: %v", test.input, err)
+			continue
+		}
+		if value != test.expected {
+			t.Errorf("parseNumber(%q) = %v, expected %v", test.input, value, test.expected)
+		}
+	}
+}
+
+func TestResolveConstants(t *testing.T) {
+	constants := map[string]float64{"VAT": 0.2, "pi": 3}
+
+	tests := []struct {
+		input    []string
+		expected []string
+		used     []string
+		err      error
+	}{
+		{[]string{"2", "*", "pi"}, []string{"2", "*", "3.141592653589793"}, []string{"pi"}, nil},
+		{[]string{"-e", "+", "tau"}, []string{"-2.718281828459045", "+", "6.283185307179586"}, []string{"e", "tau"}, nil},
+		{[]string{"100", "*", "VAT", "+", "VAT"}, []string{"100", "*", "0.2", "+", "0.2"}, []string{"VAT"}, nil},
+		{[]string{"phi", "-", "-VAT"}, []string{"1.618033988749895", "-", "-0.2"}, []string{"VAT", "phi"}, nil},
+		{[]string{"2", "+", "2"}, []string{"2", "+", "2"}, nil, nil},
+
+		{[]string{"2", "+", "a"}, nil, nil, fmt.Errorf("unknown constant: a")},
+		{[]string{"-vat"}, nil, nil, fmt.Errorf("unknown constant: vat")},
+	}
+
+	for _, test := range tests {
+		tokens, used, err := ResolveConstants(test.input, constants)
+		if err != nil && test.err == nil {
+			t.Errorf("ResolveConstants(%v) returned unexpected error: %v", test.input, err)
+		}
+		if err == nil && test.err != nil {
+			t.Errorf("ResolveConstants(%v) expected error: %v", test.input, test.err)
+		}
+		if err != nil && test.err != nil && err.Error() != test.err.Error() {
+			t.Errorf("ResolveConstants(%v) returned wrong error: got %v want %v", test.input, err, test.err)
+		}
+		if !compareSlices(tokens, test.expected) {
+			t.Errorf("ResolveConstants(%v) = %v, expected %v", test.input, tokens, test.expected)
+		}
+		if !compareSlices(used, test.used) {
+			t.Errorf("ResolveConstants(%v) used %v, expected %v", test.input, used, test.used)
+		}
+	}
+}
+
 func TestToPostfix(t *testing.T) {
 	tests := []struct {
 		input    []string
@@ -90,3 +209,218 @@ func compareSlices(a, b []string) bool {
 	}
 	return true
 }
+
+func TestMeasure(t *testing.T) {
+	tests := []struct {
+		input      string
+		depth      int
+		operations int
+	}{
+		{"2", 1, 0},
+		{"2 + 2", 2, 1},
+		{"2 + 2 * 2", 3, 2},
+		{"(1 + 2) * (3 + 4)", 3, 3},
+		{"1 + 1 + 1 + 1", 4, 3},
+	}
+
+	for _, test := range tests {
+		tokens, err := Tokenize(test.input)
+		if err != nil {
+			t.Fatalf("Tokenize(%q) returned unexpected error: %v", test.input, err)
+		}
+		node, err := Ast(tokens)
+		if err != nil {
+			t.Fatalf("Ast(%q) returned unexpected error: %v", test.input, err)
+		}
+		depth, operations := Measure(node)
+		if depth != test.depth || operations != test.operations {
+			t.Errorf("Measure(%q) = %d, %d, expected %d, %d", test.input, depth, operations, test.depth, test.operations)
+		}
+	}
+}
+
+func TestParsingASTDeepTree(t *testing.T) {
+	const n = 100000
+
+	tokens := []string{"1"}
+	for i := 1; i < n; i++ {
+		tokens = append(tokens, "+", "1")
+	}
+	node, err := Ast(tokens)
+	if err != nil {
+		t.Fatalf("Ast returned unexpected error: %v", err)
+	}
+
+	tasksch := make(chan *calc.Task)
+	resultch := make(chan *calc.Result)
+	go func() {
+		for task := range tasksch {
+			resultch <- &calc.Result{TaskId: task.Id, Result: task.Arg1 + task.Arg2}
+		}
+	}()
+	defer close(tasksch)
+
+	result, err := ParsingAST(context.Background(), node, &config.Config{}, tasksch, resultch)
+	if err != nil {
+		t.Fatalf("ParsingAST returned unexpected error: %v", err)
+	}
+	if result != n {
+		t.Errorf("ParsingAST = %v, expected %v", result, n)
+	}
+}
+
+func TestParsingASTAgentError(t *testing.T) {
+	tokens, _ := Tokenize("1 / 0 + 2")
+	node, err := Ast(tokens)
+	if err != nil {
+		t.Fatalf("Ast returned unexpected error: %v", err)
+	}
+
+	tasksch := make(chan *calc.Task)
+	resultch := make(chan *calc.Result)
+	go func() {
+		for task := range tasksch {
+			resultch <- &calc.Result{TaskId: task.Id, Error: "division by zero"}
+		}
+	}()
+	defer close(tasksch)
+
+	if _, err := ParsingAST(context.Background(), node, &config.Config{}, tasksch, resultch); err == nil || err.Error() != "division by zero" {
+		t.Errorf("ParsingAST returned %v, expected agent error", err)
+	}
+}
+
+func TestParsingASTCancel(t *testing.T) {
+	tokens, _ := Tokenize("1 + 2")
+	node, err := Ast(tokens)
+	if err != nil {
+		t.Fatalf("Ast returned unexpected error: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tasksch := make(chan *calc.Task)
+	resultch := make(chan *calc.Result)
+	go func() {
+		<-tasksch
+		cancel()
+	}()
+
+	if _, err := ParsingAST(ctx, node, &config.Config{}, tasksch, resultch); err != context.Canceled {
+		t.Errorf("ParsingAST returned %v, expected %v", err, context.Canceled)
+	}
+}
+
+func TestParsingASTTimeout(t *testing.T) {
+	tokens, _ := Tokenize("1 + 2")
+	node, err := Ast(tokens)
+	if err != nil {
+		t.Fatalf("Ast returned unexpected error: %v", err)
+	}
+
+	// The agent takes the task and never answers.
+	tasksch := make(chan *calc.Task)
+	resultch := make(chan *calc.Result)
+	go func() {
+		for range tasksch {
+		}
+	}()
+	defer close(tasksch)
+
+	cfg := &config.Config{AddTime: 10, TaskTimeoutSlackMs: 20}
+	if _, err := ParsingAST(context.Background(), node, cfg, tasksch, resultch); err != ErrTaskTimeout {
+		t.Errorf("ParsingAST returned %v, expected %v", err, ErrTaskTimeout)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	tests := []struct {
+		a, b string
+		same bool
+	}{
+		{"1 + 2", "2 + 1", true},
+		{"2 * (3 + 4)", "(4 + 3) * 2", true},
+		{"0x10 - 1", "16 - 1", true},
+		{"1.50 / 3", "1.5 / 3", true},
+		{"1 - 2", "2 - 1", false},
+		{"4 / 2", "2 / 4", false},
+		{"1 + 2 + 3", "1 + (2 + 3)", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.a+" ~ "+tt.b, func(t *testing.T) {
+			a, _ := Tokenize(tt.a)
+			b, _ := Tokenize(tt.b)
+			nodeA, err := Ast(a)
+			if err != nil {
+				t.Fatalf("Ast(%q) returned unexpected error: %v", tt.a, err)
+			}
+			nodeB, err := Ast(b)
+			if err != nil {
+				t.Fatalf("Ast(%q) returned unexpected error: %v", tt.b, err)
+			}
+
+			if same := Fingerprint(nodeA) == Fingerprint(nodeB); same != tt.same {
+				t.Errorf("same fingerprint = %v, expected %v", same, tt.same)
+			}
+		})
+	}
+}
+
+type mapCache map[string]float64
+
+func (c mapCache) Get(key string) (float64, bool) {
+	value, ok := c[key]
+	return value, ok
+}
+
+func (c mapCache) Put(key string, value float64) {
+	c[key] = value
+}
+
+func TestParsingASTCached(t *testing.T) {
+	tasksch := make(chan *calc.Task)
+	resultch := make(chan *calc.Result)
+	dispatched := 0
+	go func() {
+		for task := range tasksch {
+			dispatched++
+			var result float64
+			switch task.Operation {
+			case "+":
+				result = task.Arg1 + task.Arg2
+			case "*":
+				result = task.Arg1 * task.Arg2
+			}
+			resultch <- &calc.Result{TaskId: task.Id, Result: result}
+		}
+	}()
+	defer close(tasksch)
+
+	cache := mapCache{}
+	eval := func(expression string) float64 {
+		tokens, _ := Tokenize(expression)
+		node, err := Ast(tokens)
+		if err != nil {
+			t.Fatalf("Ast returned unexpected error: %v", err)
+		}
+		result, err := ParsingASTCached(context.Background(), node, &config.Config{}, cache, tasksch, resultch)
+		if err != nil {
+			t.Fatalf("ParsingASTCached returned unexpected error: %v", err)
+		}
+		return result
+	}
+
+	if result := eval("(1 + 2) * 3"); result != 9 || dispatched != 2 {
+		t.Fatalf("got %v after %d tasks, expected 9 after 2", result, dispatched)
+	}
+
+	// The shared subtree 2 + 1 is not dispatched again.
+	if result := eval("(2 + 1) * 4"); result != 12 || dispatched != 3 {
+		t.Errorf("got %v after %d tasks, expected 12 after 3", result, dispatched)
+	}
+
+	// Neither is the whole expression.
+	if result := eval("3 * (1 + 2)"); result != 9 || dispatched != 3 {
+		t.Errorf("got %v after %d tasks, expected 9 after 3", result, dispatched)
+	}
+}
@@ -0,0 +1,310 @@
+// Package webhook delivers expression results to user supplied callback URLs.
+//
+// Each delivery is a JSON POST signed with HMAC-SHA256 using the
+// orchestrator's webhook secret. The signed message is the Unix time of the
+// attempt, sent in the TimestampHeader, a dot and the request body; the
+// signature is sent in the SignatureHeader as "sha256=<hex>". Receivers
+// should reject deliveries whose timestamp is more than Tolerance away from
+// their clock, so that captured deliveries cannot be replayed; Verify does
+// both checks. Failed deliveries are retried with exponential backoff and
+// every attempt is recorded.
+//
+// Callbacks may only reach public addresses: the address is checked when
+// connecting, after DNS resolution, and redirects are not followed, so that
+// users cannot make the orchestrator call internal services.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/StepanShel/YandexProject/internal/repo"
+	uuid "github.com/google/uuid"
+)
+
+const (
+	SignatureHeader = "X-Calc-Signature"
+	TimestampHeader = "X-Calc-Timestamp"
+	AttemptHeader   = "X-Calc-Attempt"
+)
+
+// Tolerance is how far the timestamp of a delivery may be from the clock of
+// the receiver for Verify to accept it.
+const Tolerance = 5 * time.Minute
+
+// ErrInvalidSignature is returned by Verify for deliveries that were not
+// signed with the secret or whose timestamp is out of tolerance.
+var ErrInvalidSignature = errors.New("invalid webhook signature")
+
+// Payload is the body posted to the callback URL.
+type Payload struct {
+	ID         string   `json:"id"`
+	Expression string   `json:"expression"`
+	Status     string   `json:"status"`
+	Result     *float64 `json:"result,omitempty"`
+	Error      string   `json:"error,omitempty"`
+}
+
+// Recorder stores delivery attempts.
+type Recorder interface {
+	InsertWebhookAttempt(attempt repo.WebhookAttempt) error
+}
+
+// ErrDisabled is returned by Validate when no webhook secret is configured:
+// callbacks signed with an empty key could be forged by anyone.
+var ErrDisabled = errors.New("callbacks are disabled: the server has no webhook secret")
+
+// errNotPublic fails deliveries to internal addresses for good.
+var errNotPublic = errors.New("callback address is not public")
+
+type Dispatcher struct {
+	Client      *http.Client
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+
+	secret   []byte
+	recorder Recorder
+
+	// pending tracks deliveries in progress so that Shutdown can wait for
+	// them; no new ones are started once closed is set.
+	mu      sync.Mutex
+	pending sync.WaitGroup
+	closed  bool
+}
+
+func NewDispatcher(secret string, maxAttempts int, recorder Recorder) *Dispatcher {
+	dialer := &net.Dialer{Timeout: 10 * time.Second, Control: checkAddress}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	// Through a proxy only the proxy's address would be checked.
+	transport.Proxy = nil
+
+	return &Dispatcher{
+		Client: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: transport,
+			// A redirect could point anywhere, including internal
+			// addresses; the 3xx response fails the delivery instead.
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+		MaxAttempts: maxAttempts,
+		BaseDelay:   time.Second,
+		MaxDelay:    time.Minute,
+		secret:      []byte(secret),
+		recorder:    recorder,
+	}
+}
+
+// Validate checks that rawURL can be used as a callback URL and that
+// callbacks are enabled.
+func (d *Dispatcher) Validate(rawURL string) error {
+	if len(d.secret) == 0 {
+		return ErrDisabled
+	}
+	return ValidateURL(rawURL)
+}
+
+// ValidateURL checks that rawURL can be used as a callback URL. Hosts given
+// as internal IP addresses or localhost are rejected right away; names that
+// resolve to internal addresses are rejected when delivering.
+func ValidateURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("callback_url must be an absolute http or https URL")
+	}
+
+	host := u.Hostname()
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return errors.New("callback_url must not point to an internal address")
+	}
+	if ip, err := netip.ParseAddr(host); err == nil && !public(ip) {
+		return errors.New("callback_url must not point to an internal address")
+	}
+	return nil
+}
+
+// checkAddress is the dialer's Control function: it refuses connections to
+// internal addresses, whatever name resolved to them.
+func checkAddress(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if !public(addrPort.Addr()) {
+		return fmt.Errorf("%w: %s", errNotPublic, addrPort.Addr())
+	}
+	return nil
+}
+
+// public reports whether ip is neither loopback, private, link-local (which
+// includes cloud metadata services) nor unspecified.
+func public(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return ip.IsValid() && !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsUnspecified() &&
+		!ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() && !ip.IsInterfaceLocalMulticast()
+}
+
+// Sign returns the signature of body sent at timestamp, a Unix time as in
+// the TimestampHeader, as sent in the SignatureHeader.
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature and the timestamp of a delivery received at
+// now. Deliveries older or newer than Tolerance are rejected.
+func Verify(secret []byte, timestamp, signature string, body []byte, now time.Time) error {
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	if skew := now.Sub(time.Unix(sec, 0)); skew > Tolerance || skew < -Tolerance {
+		return ErrInvalidSignature
+	}
+	if !hmac.Equal([]byte(signature), []byte(Sign(secret, timestamp, body))) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// Deliver posts payload to callbackURL in the background. Deliveries are
+// not started once Shutdown has been called.
+func (d *Dispatcher) Deliver(expressionID uuid.UUID, callbackURL string, payload Payload) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		fmt.Printf("webhook delivery for expression %s skipped: shutting down\n", expressionID)
+		return
+	}
+
+	d.pending.Add(1)
+	go func() {
+		defer d.pending.Done()
+		if err := d.deliver(expressionID, callbackURL, payload); err != nil {
+			fmt.Println("webhook delivery failed:", err)
+		}
+	}()
+}
+
+// Shutdown stops starting deliveries and waits for the ones in progress,
+// retries included, to finish and record their attempts, or for ctx to
+// expire.
+func (d *Dispatcher) Shutdown(ctx context.Context) error {
+	d.mu.Lock()
+	d.closed = true
+	d.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.pending.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// deliver posts payload until it is accepted, a permanent error occurs or
+// MaxAttempts is reached.
+func (d *Dispatcher) deliver(expressionID uuid.UUID, callbackURL string, payload Payload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	var lastErr error
+	for attempt := 1; attempt <= d.MaxAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(d.backoff(attempt))
+		}
+
+		code, err := d.post(callbackURL, body, attempt)
+		record := repo.WebhookAttempt{
+			ExpressionID: expressionID,
+			URL:          callbackURL,
+			Attempt:      attempt,
+			StatusCode:   code,
+			Delivered:    err == nil,
+		}
+		if err != nil {
+			record.Error = err.Error()
+		}
+		if recErr := d.recorder.InsertWebhookAttempt(record); recErr != nil {
+			fmt.Println("failed to record webhook attempt:", recErr)
+		}
+
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+		if !retryable(code) || errors.Is(err, errNotPublic) {
+			break
+		}
+	}
+
+	return fmt.Errorf("expression %s: %v", expressionID, lastErr)
+}
+
+func (d *Dispatcher) post(callbackURL string, body []byte, attempt int) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	// Every attempt is signed anew, so that retries stay within Tolerance.
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(SignatureHeader, Sign(d.secret, timestamp, body))
+	req.Header.Set(AttemptHeader, strconv.Itoa(attempt))
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("callback responded with %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// backoff returns the delay before the given attempt: BaseDelay doubled for
+// every failed attempt, capped at MaxDelay.
+func (d *Dispatcher) backoff(attempt int) time.Duration {
+	delay := d.BaseDelay << (attempt - 2)
+	if delay <= 0 || delay > d.MaxDelay {
+		return d.MaxDelay
+	}
+	return delay
+}
+
+// retryable reports whether a delivery that got status code may succeed
+// later. Code 0 means no response was received.
+func retryable(code int) bool {
+	return code == 0 || code == http.StatusRequestTimeout || code == http.StatusTooManyRequests || code >= 500
+}
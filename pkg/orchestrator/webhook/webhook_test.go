@@ -0,0 +1,229 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/StepanShel/YandexProject/internal/repo"
+	uuid "github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeRecorder struct {
+	mu       sync.Mutex
+	attempts []repo.WebhookAttempt
+}
+
+func (f *fakeRecorder) InsertWebhookAttempt(attempt repo.WebhookAttempt) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.attempts = append(f.attempts, attempt)
+	return nil
+}
+
+// newTestDispatcher returns a dispatcher for receiver. Its client is the
+// receiver's, as the dispatcher's own refuses the loopback address.
+func newTestDispatcher(recorder Recorder, receiver *httptest.Server) *Dispatcher {
+	d := NewDispatcher("secret", 4, recorder)
+	d.BaseDelay = time.Millisecond
+	client := receiver.Client()
+	client.CheckRedirect = d.Client.CheckRedirect
+	d.Client = client
+	return d
+}
+
+func TestDeliverRetries(t *testing.T) {
+	var mu sync.Mutex
+	var bodies [][]byte
+	var signatures, timestamps []string
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		mu.Lock()
+		defer mu.Unlock()
+		bodies = append(bodies, body)
+		signatures = append(signatures, r.Header.Get(SignatureHeader))
+		timestamps = append(timestamps, r.Header.Get(TimestampHeader))
+		if len(bodies) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer receiver.Close()
+
+	recorder := &fakeRecorder{}
+	id := uuid.New()
+	result := 6.0
+
+	err := newTestDispatcher(recorder, receiver).deliver(id, receiver.URL, Payload{ID: id.String(), Status: "DONE", Result: &result})
+	require.NoError(t, err)
+
+	require.Len(t, bodies, 3)
+	for i, body := range bodies {
+		assert.Equal(t, Sign([]byte("secret"), timestamps[i], body), signatures[i])
+		assert.NoError(t, Verify([]byte("secret"), timestamps[i], signatures[i], body, time.Now()))
+	}
+	var received Payload
+	require.NoError(t, json.Unmarshal(bodies[2], &received))
+	assert.Equal(t, id.String(), received.ID)
+	assert.Equal(t, 6.0, *received.Result)
+
+	require.Len(t, recorder.attempts, 3)
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.attempts[0].StatusCode)
+	assert.False(t, recorder.attempts[0].Delivered)
+	assert.Equal(t, 3, recorder.attempts[2].Attempt)
+	assert.True(t, recorder.attempts[2].Delivered)
+}
+
+func TestVerify(t *testing.T) {
+	secret := []byte("secret")
+	body := []byte(`{"id":"1"}`)
+	now := time.Unix(1700000000, 0)
+	timestamp := "1700000000"
+	signature := Sign(secret, timestamp, body)
+
+	assert.NoError(t, Verify(secret, timestamp, signature, body, now))
+	assert.NoError(t, Verify(secret, timestamp, signature, body, now.Add(Tolerance)))
+
+	tests := []struct {
+		name, timestamp, signature string
+		body                       []byte
+		now                        time.Time
+	}{
+		{"replayed later", timestamp, signature, body, now.Add(Tolerance + time.Second)},
+		{"from the future", timestamp, signature, body, now.Add(-Tolerance - time.Second)},
+		{"changed timestamp", "1700000001", signature, body, now},
+		{"changed body", timestamp, signature, []byte(`{"id":"2"}`), now},
+		{"other secret", timestamp, Sign([]byte("other"), timestamp, body), body, now},
+		{"invalid timestamp", "soon", signature, body, now},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.ErrorIs(t, Verify(secret, tt.timestamp, tt.signature, tt.body, tt.now), ErrInvalidSignature)
+		})
+	}
+}
+
+func TestDeliverGivesUp(t *testing.T) {
+	t.Run("MaxAttempts", func(t *testing.T) {
+		receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+		defer receiver.Close()
+
+		recorder := &fakeRecorder{}
+		err := newTestDispatcher(recorder, receiver).deliver(uuid.New(), receiver.URL, Payload{Status: "error"})
+		assert.Error(t, err)
+		assert.Len(t, recorder.attempts, 4)
+	})
+
+	t.Run("PermanentError", func(t *testing.T) {
+		receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusGone)
+		}))
+		defer receiver.Close()
+
+		recorder := &fakeRecorder{}
+		err := newTestDispatcher(recorder, receiver).deliver(uuid.New(), receiver.URL, Payload{Status: "error"})
+		assert.Error(t, err)
+		assert.Len(t, recorder.attempts, 1)
+	})
+
+	t.Run("Redirect", func(t *testing.T) {
+		receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, "http://169.254.169.254/latest/meta-data", http.StatusTemporaryRedirect)
+		}))
+		defer receiver.Close()
+
+		recorder := &fakeRecorder{}
+		err := newTestDispatcher(recorder, receiver).deliver(uuid.New(), receiver.URL, Payload{Status: "error"})
+		assert.Error(t, err)
+		require.Len(t, recorder.attempts, 1)
+		assert.Equal(t, http.StatusTemporaryRedirect, recorder.attempts[0].StatusCode)
+	})
+}
+
+func TestDeliverRefusesInternalAddresses(t *testing.T) {
+	var calls atomic.Int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+	}))
+	defer receiver.Close()
+
+	// The dispatcher's own client checks the address it connects to,
+	// whatever the URL says.
+	recorder := &fakeRecorder{}
+	d := NewDispatcher("secret", 4, recorder)
+	d.BaseDelay = time.Millisecond
+	err := d.deliver(uuid.New(), receiver.URL, Payload{Status: "DONE"})
+	assert.ErrorContains(t, err, "callback address is not public: 127.0.0.1")
+	assert.Zero(t, calls.Load())
+	assert.Len(t, recorder.attempts, 1)
+}
+
+func TestShutdown(t *testing.T) {
+	release := make(chan struct{})
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer receiver.Close()
+
+	recorder := &fakeRecorder{}
+	d := newTestDispatcher(recorder, receiver)
+	d.Deliver(uuid.New(), receiver.URL, Payload{Status: "DONE"})
+
+	// Shutdown waits for the delivery in progress...
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, d.Shutdown(ctx), context.DeadlineExceeded)
+
+	close(release)
+	require.NoError(t, d.Shutdown(context.Background()))
+	assert.Len(t, recorder.attempts, 1)
+
+	// ...and no new ones are started.
+	d.Deliver(uuid.New(), receiver.URL, Payload{Status: "DONE"})
+	require.NoError(t, d.Shutdown(context.Background()))
+	assert.Len(t, recorder.attempts, 1)
+}
+
+func TestValidate(t *testing.T) {
+	assert.NoError(t, NewDispatcher("secret", 1, &fakeRecorder{}).Validate("https://example.com/hook"))
+	assert.ErrorIs(t, NewDispatcher("", 1, &fakeRecorder{}).Validate("https://example.com/hook"), ErrDisabled)
+}
+
+func TestBackoff(t *testing.T) {
+	d := NewDispatcher("secret", 10, &fakeRecorder{})
+
+	assert.Equal(t, time.Second, d.backoff(2))
+	assert.Equal(t, 2*time.Second, d.backoff(3))
+	assert.Equal(t, 8*time.Second, d.backoff(5))
+	assert.Equal(t, time.Minute, d.backoff(10))
+	assert.Equal(t, time.Minute, d.backoff(100))
+}
+
+func TestValidateURL(t *testing.T) {
+	assert.NoError(t, ValidateURL("https://example.com/hook"))
+	assert.NoError(t, ValidateURL("https://93.184.215.14:8443/hook"))
+	assert.Error(t, ValidateURL("http://localhost:9000"))
+	assert.Error(t, ValidateURL("http://api.localhost/hook"))
+	assert.Error(t, ValidateURL("http://127.0.0.1/hook"))
+	assert.Error(t, ValidateURL("http://10.0.0.5/hook"))
+	assert.Error(t, ValidateURL("http://192.168.1.1/hook"))
+	assert.Error(t, ValidateURL("http://169.254.169.254/latest/meta-data"))
+	assert.Error(t, ValidateURL("http://0.0.0.0/hook"))
+	assert.Error(t, ValidateURL("http://[::1]/hook"))
+	assert.Error(t, ValidateURL("http://[::ffff:127.0.0.1]/hook"))
+	assert.Error(t, ValidateURL("http://[fe80::1]/hook"))
+	assert.Error(t, ValidateURL("ftp://example.com"))
+	assert.Error(t, ValidateURL("/relative"))
+	assert.Error(t, ValidateURL("::"))
+}
@@ -64,8 +64,8 @@ type Task struct {
 	unknownFields protoimpl.UnknownFields
 
 	Id            string  `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
-	Arg1          float32 `protobuf:"fixed32,2,opt,name=arg1,proto3" json:"arg1,omitempty"`
-	Arg2          float32 `protobuf:"fixed32,3,opt,name=arg2,proto3" json:"arg2,omitempty"`
+	Arg1          float64 `protobuf:"fixed64,2,opt,name=arg1,proto3" json:"arg1,omitempty"`
+	Arg2          float64 `protobuf:"fixed64,3,opt,name=arg2,proto3" json:"arg2,omitempty"`
 	Operation     string  `protobuf:"bytes,4,opt,name=operation,proto3" json:"operation,omitempty"`
 	OperationTime int32   `protobuf:"varint,5,opt,name=operation_time,json=operationTime,proto3" json:"operation_time,omitempty"`
 }
@@ -109,14 +109,14 @@ func (x *Task) GetId() string {
 	return ""
 }
 
-func (x *Task) GetArg1() float32 {
+func (x *Task) GetArg1() float64 {
 	if x != nil {
 		return x.Arg1
 	}
 	return 0
 }
 
-func (x *Task) GetArg2() float32 {
+func (x *Task) GetArg2() float64 {
 	if x != nil {
 		return x.Arg2
 	}
@@ -143,7 +143,7 @@ type Result struct {
 	unknownFields protoimpl.UnknownFields
 
 	TaskId string  `protobuf:"bytes,1,opt,name=task_id,json=taskId,proto3" json:"task_id,omitempty"`
-	Result float32 `protobuf:"fixed32,2,opt,name=result,proto3" json:"result,omitempty"`
+	Result float64 `protobuf:"fixed64,2,opt,name=result,proto3" json:"result,omitempty"`
 	Error  string  `protobuf:"bytes,3,opt,name=error,proto3" json:"error,omitempty"`
 }
 
@@ -186,7 +186,7 @@ func (x *Result) GetTaskId() string {
 	return ""
 }
 
-func (x *Result) GetResult() float32 {
+func (x *Result) GetResult() float64 {
 	if x != nil {
 		return x.Result
 	}
@@ -208,8 +208,8 @@ var file_proto_calculator_proto_rawDesc = []byte{
 	0x61, 0x74, 0x6f, 0x72, 0x22, 0x07, 0x0a, 0x05, 0x45, 0x6d, 0x70, 0x74, 0x79, 0x22, 0x83, 0x01,
 	0x0a, 0x04, 0x54, 0x61, 0x73, 0x6b, 0x12, 0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01,
 	0x28, 0x09, 0x52, 0x02, 0x69, 0x64, 0x12, 0x12, 0x0a, 0x04, 0x61, 0x72, 0x67, 0x31, 0x18, 0x02,
-	0x20, 0x01, 0x28, 0x02, 0x52, 0x04, 0x61, 0x72, 0x67, 0x31, 0x12, 0x12, 0x0a, 0x04, 0x61, 0x72,
-	0x67, 0x32, 0x18, 0x03, 0x20, 0x01, 0x28, 0x02, 0x52, 0x04, 0x61, 0x72, 0x67, 0x32, 0x12, 0x1c,
+	0x20, 0x01, 0x28, 0x01, 0x52, 0x04, 0x61, 0x72, 0x67, 0x31, 0x12, 0x12, 0x0a, 0x04, 0x61, 0x72,
+	0x67, 0x32, 0x18, 0x03, 0x20, 0x01, 0x28, 0x01, 0x52, 0x04, 0x61, 0x72, 0x67, 0x32, 0x12, 0x1c,
 	0x0a, 0x09, 0x6f, 0x70, 0x65, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x18, 0x04, 0x20, 0x01, 0x28,
 	0x09, 0x52, 0x09, 0x6f, 0x70, 0x65, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x12, 0x25, 0x0a, 0x0e,
 	0x6f, 0x70, 0x65, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x5f, 0x74, 0x69, 0x6d, 0x65, 0x18, 0x05,
@@ -217,7 +217,7 @@ var file_proto_calculator_proto_rawDesc = []byte{
 	0x69, 0x6d, 0x65, 0x22, 0x4f, 0x0a, 0x06, 0x52, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x12, 0x17, 0x0a,
 	0x07, 0x74, 0x61, 0x73, 0x6b, 0x5f, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06,
 	0x74, 0x61, 0x73, 0x6b, 0x49, 0x64, 0x12, 0x16, 0x0a, 0x06, 0x72, 0x65, 0x73, 0x75, 0x6c, 0x74,
-	0x18, 0x02, 0x20, 0x01, 0x28, 0x02, 0x52, 0x06, 0x72, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x12, 0x14,
+	0x18, 0x02, 0x20, 0x01, 0x28, 0x01, 0x52, 0x06, 0x72, 0x65, 0x73, 0x75, 0x6c, 0x74, 0x12, 0x14,
 	0x0a, 0x05, 0x65, 0x72, 0x72, 0x6f, 0x72, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x65,
 	0x72, 0x72, 0x6f, 0x72, 0x32, 0x75, 0x0a, 0x0a, 0x43, 0x61, 0x6c, 0x63, 0x75, 0x6c, 0x61, 0x74,
 	0x6f, 0x72, 0x12, 0x30, 0x0a, 0x07, 0x47, 0x65, 0x74, 0x54, 0x61, 0x73, 0x6b, 0x12, 0x11, 0x2e,